@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stephank/lazyssh/manager"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// clientMain implements the 'status', 'stop', 'drain' and 'undrain'
+// subcommands, which connect to a running LazySSH server to issue control
+// commands.
+func clientMain(command string, args []string) {
+	home, _ := os.UserHomeDir()
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	server := flags.String("server", "jump@localhost:7922", "server to connect to, in the format: user@host:port")
+	identity := flags.String("i", "", "private key file to authenticate with (required)")
+	knownHosts := flags.String("known-hosts", filepath.Join(home, ".ssh", "known_hosts"), "known hosts file to verify the server host key")
+	insecure := flags.Bool("insecure", false, "do not verify the server host key")
+	jsonOutput := flags.Bool("json", false, "output JSON")
+	var connections *bool
+	if command == "drain" {
+		connections = flags.Bool("connections", false, "also reject new connections to running machines")
+	}
+	flags.Usage = func() {
+		if command == "stop" {
+			fmt.Fprintf(flags.Output(), "Usage: lazyssh stop [flags] <target>\n")
+		} else {
+			fmt.Fprintf(flags.Output(), "Usage: lazyssh %s [flags]\n", command)
+		}
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	remoteCommand := command
+	switch {
+	case command == "stop" && flags.NArg() == 1:
+		remoteCommand = "stop " + flags.Arg(0)
+	case command == "drain" && flags.NArg() == 0:
+		if *connections {
+			remoteCommand = "drain connections"
+		}
+	case (command == "status" || command == "undrain") && flags.NArg() == 0:
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *identity == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	output, err := runRemoteCommand(*server, *identity, *knownHosts, *insecure, remoteCommand)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	switch {
+	case command == "stop":
+		if !*jsonOutput {
+			fmt.Printf("Stopping machines for target '%s'\n", flags.Arg(0))
+		}
+	case command == "drain":
+		if !*jsonOutput {
+			fmt.Printf("Draining server\n")
+		}
+	case command == "undrain":
+		if !*jsonOutput {
+			fmt.Printf("No longer draining server\n")
+		}
+	case *jsonOutput:
+		os.Stdout.Write(output)
+	default:
+		status := &manager.Status{}
+		if err := json.Unmarshal(output, status); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid response from server: %s\n", err.Error())
+			os.Exit(1)
+		}
+		printStatus(status)
+	}
+}
+
+// Connect to the server and run a control command, returning its output.
+func runRemoteCommand(server string, identity string, knownHostsFile string, insecure bool, command string) ([]byte, error) {
+	user := "jump"
+	hostPort := server
+	if idx := strings.LastIndexByte(server, '@'); idx != -1 {
+		user = server[:idx]
+		hostPort = server[idx+1:]
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, "7922")
+	}
+
+	keyPem, err := ioutil.ReadFile(identity)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read identity file: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse identity file: %w", err)
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !insecure {
+		hostKeyCallback, err = knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read known hosts file: %w", err)
+		}
+	}
+
+	client, err := ssh.Dial("tcp", hostPort, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to server: %w", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("Could not open session: %w", err)
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	output, err := session.Output(command)
+	if err != nil {
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) && stderr.Len() != 0 {
+			return nil, errors.New(strings.TrimSpace(stderr.String()))
+		}
+		return nil, fmt.Errorf("Command failed: %w", err)
+	}
+	return output, nil
+}
+
+// Print a Status as a table.
+func printStatus(status *manager.Status) {
+	if status.Drain != "" && status.Drain != "off" {
+		fmt.Printf("Draining: %s\n\n", status.Drain)
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "TARGET\tTYPE\tSTATE\tCONNECTIONS\tUPTIME\tINSTANCE\tINFO\n")
+	for _, target := range status.Targets {
+		if len(target.Machines) == 0 {
+			fmt.Fprintf(w, "%s\t%s\tstopped\t-\t-\t-\t-\n", target.Addr, target.Type)
+		}
+		for _, mach := range target.Machines {
+			uptime := now.Sub(mach.Started).Truncate(time.Second)
+			instance := mach.InstanceID
+			if instance == "" {
+				instance = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", target.Addr, target.Type, mach.State, mach.Connections, uptime, instance, formatInfo(mach.Info))
+		}
+	}
+	w.Flush()
+}
+
+// Format machine info as sorted key=value pairs.
+func formatInfo(info map[string]string) string {
+	if len(info) == 0 {
+		return "-"
+	}
+	var pairs []string
+	for key, value := range info {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
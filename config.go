@@ -3,17 +3,44 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/manager"
 	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 	"golang.org/x/crypto/ssh"
 )
 
 // hclFiles is a File index expected by the DiagnosticWriter.
 type hclFiles map[string]*hcl.File
 
+// rootSchema describes the HCL top-level blocks that are processed before the
+// rest of the configuration, because they provide the evaluation context.
+var rootSchema = &hcl.BodySchema{
+	Blocks: []hcl.BlockHeaderSchema{
+		{Type: "variable", LabelNames: []string{"name"}},
+		{Type: "locals"},
+	},
+}
+
+// hclVariableConfig is used to unmarshal HCL `variable` blocks.
+type hclVariableConfig struct {
+	Default     *hcl.Attribute `hcl:"default,optional"`
+	Description string         `hcl:"description,optional"`
+}
+
 // hclConfig is used to unmarshal the HCL top-level.
 type hclConfig struct {
 	Server  hclServerConfig   `hcl:"server,block"`
@@ -22,87 +49,442 @@ type hclConfig struct {
 
 // hclServerConfig is used to unmarshal the HCL `server` block.
 type hclServerConfig struct {
-	Listen        string `hcl:"listen,optional"`
-	HostKey       string `hcl:"host_key,attr"`
+	Listen        string             `hcl:"listen,optional"`
+	ListenNetwork string             `hcl:"listen_network,optional"`
+	HostKey       string             `hcl:"host_key,optional"`
+	HostKeyFile   string             `hcl:"host_key_file,optional"`
+	AuthorizedKey *string            `hcl:"authorized_key,optional"`
+	Clients       []*hclClientConfig `hcl:"client,block"`
+	HealthListen  string             `hcl:"health_listen,optional"`
+	BufferSize    int                `hcl:"buffer_size,optional"`
+	TCPKeepAlive  string             `hcl:"tcp_keepalive,optional"`
+	StateFile     string             `hcl:"state_file,optional"`
+	Heartbeat     string             `hcl:"heartbeat_interval,optional"`
+	Handshake     string             `hcl:"handshake_timeout,optional"`
+	KeepAlive     string             `hcl:"keepalive_interval,optional"`
+	KeepAliveMax  *int               `hcl:"keepalive_count_max,optional"`
+	Shutdown      string             `hcl:"shutdown_timeout,optional"`
+	MaxConnsPerIP int                `hcl:"max_connections_per_ip,optional"`
+	AllowedCIDRs  []string           `hcl:"allowed_cidrs,optional"`
+	StrictAddrs   bool               `hcl:"strict_target_addresses,optional"`
+	LogFile       string             `hcl:"log_file,optional"`
+	LogSyslog     bool               `hcl:"log_syslog,optional"`
+	Tracing       *hclTracingConfig  `hcl:"tracing,block"`
+}
+
+// hclClientConfig is used to unmarshal HCL `client` blocks.
+type hclClientConfig struct {
+	Name          string `hcl:"name,optional"`
 	AuthorizedKey string `hcl:"authorized_key,attr"`
+	Admin         bool   `hcl:"admin,optional"`
+}
+
+// hclTracingConfig is used to unmarshal the HCL `tracing` block.
+type hclTracingConfig struct {
+	Endpoint    string            `hcl:"endpoint,attr"`
+	Headers     map[string]string `hcl:"headers,optional"`
+	ServiceName string            `hcl:"service_name,optional"`
 }
 
 // hclTargetConfig is used to unmarshal HCL `target` blocks.
+//
+// Only settings common to all targets are unmarshalled here. The remaining
+// Body is passed to the Factory for the target type.
 type hclTargetConfig struct {
-	Addr     string `hcl:"addr,label"`
-	Type     string `hcl:"type,label"`
-	hcl.Body `hcl:"body,remain"`
+	Addr                     string `hcl:"addr,label"`
+	Type                     string `hcl:"type,label"`
+	MaxConnectionsPerMachine int    `hcl:"max_connections_per_machine,optional"`
+	MaxStarting              int    `hcl:"max_starting,optional"`
+	IdleTimeout              string `hcl:"idle_timeout,optional"`
+	DialProxy                string `hcl:"dial_proxy,optional"`
+	hcl.Body                 `hcl:"body,remain"`
 }
 
 // config is the result of parsing and validation the HCL configuration.
 type config struct {
-	Listen        string
-	HostKey       ssh.Signer
-	AuthorizedKey [32]byte
-	providers.Providers
+	// Listen is the normalized listen address, and ListenNetwork the network
+	// to listen on. The same goes for the health endpoints.
+	Listen              string
+	ListenNetwork       string
+	HealthListen        string
+	HealthListenNetwork string
+	// HandshakeTimeout limits the SSH handshake of incoming connections. Zero
+	// means no limit.
+	HandshakeTimeout time.Duration
+	// KeepAliveInterval is the interval at which SSH keep-alive requests are
+	// sent to clients. Zero disables keep-alive.
+	KeepAliveInterval time.Duration
+	// KeepAliveCountMax is the number of unanswered keep-alive requests after
+	// which a client is disconnected.
+	KeepAliveCountMax int
+	// AllowedNets are the networks clients may connect from. Empty means
+	// clients may connect from anywhere.
+	AllowedNets    []*net.IPNet
+	HostKey        ssh.Signer
+	AuthorizedKeys []authorizedKey
+	Targets        manager.Targets
+	Manager        manager.Options
+	// Tracing is nil if tracing is not configured.
+	Tracing *tracing.Options
+	// LogFile is the path of a file to write logs to. Empty means stderr,
+	// unless LogSyslog is set.
+	LogFile   string
+	LogSyslog bool
+}
+
+// authorizedKey is a client public key that may connect, with the identity
+// name logged when it does.
+type authorizedKey struct {
+	Name string
+	// Hash is the SHA-256 hash of the marshalled public key.
+	Hash [32]byte
+	// Admin is set if the client may run control commands.
+	Admin bool
 }
 
-// Parse a file containing HCL configuration.
+// Parse HCL configuration.
+//
+// The cfgPath may be a single file, a directory, or a glob pattern. For a
+// directory, all '*.hcl' files in it are loaded. When multiple files are
+// loaded, their contents are merged.
+//
+// The vars argument contains variable values from the command-line, which
+// override defaults set in `variable` blocks. If checkOnly is set, the
+// configuration is only validated, and the resulting Targets are not used.
 //
 // This method returns a hclFiles used in printing diagnostics, the *config
 // which is non-nil on success, and Diagnostics which may be non-nil on even
 // when successful.
-func parseConfigFile(cfgFile string, factories providers.Factories) (hclFiles, *config, hcl.Diagnostics) {
+func parseConfigFile(cfgPath string, vars map[string]string, checkOnly bool, factories providers.Factories) (hclFiles, *config, hcl.Diagnostics) {
 	// Step one: basic HCL parsing, without schema.
 	parser := hclparse.NewParser()
-	file, diags := parser.ParseHCLFile(cfgFile)
+	cfgFiles, diags := resolveConfigFiles(cfgPath)
+	if diags.HasErrors() {
+		return parser.Files(), nil, diags
+	}
+	var parsedFiles []*hcl.File
+	for _, cfgFile := range cfgFiles {
+		file, fileDiags := parser.ParseHCLFile(cfgFile)
+		diags = append(diags, fileDiags...)
+		parsedFiles = append(parsedFiles, file)
+	}
 	files := parser.Files()
 	if diags.HasErrors() {
 		// Can't provide more info if this doesn't succeed.
 		return files, nil, diags
 	}
+	body := hcl.MergeFiles(parsedFiles)
 
-	// Step two: Partial unmarshal using hclConfig and implied schema.
+	// Step two: Build the evaluation context from 'variable' and 'locals'
+	// blocks, which is then used to evaluate all other expressions.
+	content, body, moreDiags := body.PartialContent(rootSchema)
+	diags = append(diags, moreDiags...)
+	if diags.HasErrors() {
+		return files, nil, diags
+	}
+	evalCtx, moreDiags := buildEvalContext(content.Blocks, vars)
+	diags = append(diags, moreDiags...)
+	if diags.HasErrors() {
+		// Can't provide more info if this doesn't succeed.
+		return files, nil, diags
+	}
+
+	// Step three: Partial unmarshal using hclConfig and implied schema.
 	// Specifically, this does not unmarshal 'target' blocks.
 	hclConfig := hclConfig{}
-	if diags = gohcl.DecodeBody(file.Body, nil, &hclConfig); diags.HasErrors() {
+	if diags = append(diags, gohcl.DecodeBody(body, evalCtx, &hclConfig)...); diags.HasErrors() {
 		// Can't provide more info if this doesn't succeed.
 		return files, nil, diags
 	}
 
-	// Step three: Defaults and further field parsing.
+	// Step four: Defaults and further field parsing.
 	//
 	// If these fail, we add diagnostics but continue to provide more feedback.
 	if hclConfig.Server.Listen == "" {
 		hclConfig.Server.Listen = "localhost:7922"
 	}
-
-	hostKey, err := ssh.ParsePrivateKey([]byte(hclConfig.Server.HostKey))
+	listenNetwork, listen, err := parseListenAddr(hclConfig.Server.Listen)
 	if err != nil {
 		diags = append(diags, &hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Could not parse server host_key",
-			Detail:   err.Error(),
+			Summary:  "Invalid server listen address",
+			Detail:   fmt.Sprintf("The listen value '%s' is not a valid address: %s", hclConfig.Server.Listen, err.Error()),
 		})
+	} else if hclConfig.Server.ListenNetwork != "" {
+		if err := checkListenNetwork(hclConfig.Server.ListenNetwork, listenNetwork); err == nil {
+			listenNetwork = hclConfig.Server.ListenNetwork
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid server listen_network",
+				Detail:   fmt.Sprintf("The listen_network %s", err.Error()),
+			})
+		}
 	}
 
-	authorizedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hclConfig.Server.AuthorizedKey))
-	if err != nil {
+	var healthListenNetwork, healthListen string
+	if hclConfig.Server.HealthListen != "" {
+		healthListenNetwork, healthListen, err = parseListenAddr(hclConfig.Server.HealthListen)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid server health_listen address",
+				Detail:   fmt.Sprintf("The health_listen value '%s' is not a valid address: %s", hclConfig.Server.HealthListen, err.Error()),
+			})
+		}
+	}
+
+	if hclConfig.Server.BufferSize < 0 {
 		diags = append(diags, &hcl.Diagnostic{
 			Severity: hcl.DiagError,
-			Summary:  "Could not parse server authorized_key",
-			Detail:   err.Error(),
+			Summary:  "Invalid server buffer_size",
+			Detail:   fmt.Sprintf("The buffer_size must be a positive number of bytes, but got %d", hclConfig.Server.BufferSize),
 		})
 	}
 
-	// Step four: For each 'target', ask the Factory for the associated type to
+	var keepAlive time.Duration
+	if hclConfig.Server.TCPKeepAlive != "" {
+		keepAlive, err = time.ParseDuration(hclConfig.Server.TCPKeepAlive)
+		if err != nil || keepAlive < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for server tcp_keepalive",
+				Detail:   fmt.Sprintf("The tcp_keepalive value '%s' is not a valid duration", hclConfig.Server.TCPKeepAlive),
+			})
+		} else if keepAlive == 0 {
+			// Zero in config disables, but means the default in net.Dialer.
+			keepAlive = -1
+		}
+	}
+
+	var tracingOpts *tracing.Options
+	if hclTracing := hclConfig.Server.Tracing; hclTracing != nil {
+		endpoint, err := url.Parse(hclTracing.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tracing endpoint",
+				Detail:   fmt.Sprintf("The tracing endpoint must be an http or https URL, but got '%s'", hclTracing.Endpoint),
+			})
+		}
+		tracingOpts = &tracing.Options{
+			Endpoint:    hclTracing.Endpoint,
+			Headers:     hclTracing.Headers,
+			ServiceName: hclTracing.ServiceName,
+		}
+	}
+
+	var heartbeat time.Duration
+	if hclConfig.Server.Heartbeat != "" {
+		heartbeat, err = time.ParseDuration(hclConfig.Server.Heartbeat)
+		if err != nil || heartbeat < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for server heartbeat_interval",
+				Detail:   fmt.Sprintf("The heartbeat_interval value '%s' is not a valid duration", hclConfig.Server.Heartbeat),
+			})
+		}
+	}
+
+	handshakeTimeout := 30 * time.Second
+	if hclConfig.Server.Handshake != "" {
+		handshakeTimeout, err = time.ParseDuration(hclConfig.Server.Handshake)
+		if err != nil || handshakeTimeout < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for server handshake_timeout",
+				Detail:   fmt.Sprintf("The handshake_timeout value '%s' is not a valid duration", hclConfig.Server.Handshake),
+			})
+		}
+	}
+
+	var keepAliveInterval time.Duration
+	if hclConfig.Server.KeepAlive != "" {
+		keepAliveInterval, err = time.ParseDuration(hclConfig.Server.KeepAlive)
+		if err != nil || keepAliveInterval < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for server keepalive_interval",
+				Detail:   fmt.Sprintf("The keepalive_interval value '%s' is not a valid duration", hclConfig.Server.KeepAlive),
+			})
+		}
+	}
+
+	keepAliveCountMax := 3
+	if hclConfig.Server.KeepAliveMax != nil {
+		keepAliveCountMax = *hclConfig.Server.KeepAliveMax
+		if keepAliveCountMax < 1 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for server keepalive_count_max",
+				Detail:   fmt.Sprintf("The keepalive_count_max value must be at least 1, but got %d", keepAliveCountMax),
+			})
+		}
+	}
+
+	var shutdownTimeout time.Duration
+	if hclConfig.Server.Shutdown != "" {
+		shutdownTimeout, err = time.ParseDuration(hclConfig.Server.Shutdown)
+		if err != nil || shutdownTimeout < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for server shutdown_timeout",
+				Detail:   fmt.Sprintf("The shutdown_timeout value '%s' is not a valid duration", hclConfig.Server.Shutdown),
+			})
+		}
+	}
+
+	if hclConfig.Server.MaxConnsPerIP < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for server max_connections_per_ip",
+			Detail:   fmt.Sprintf("The max_connections_per_ip value must not be negative, but got %d", hclConfig.Server.MaxConnsPerIP),
+		})
+	}
+
+	var allowedNets []*net.IPNet
+	for _, cidr := range hclConfig.Server.AllowedCIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid server allowed_cidrs entry",
+				Detail:   fmt.Sprintf("The allowed_cidrs entry '%s' is not a valid CIDR, like '192.168.0.0/16' or '2001:db8::/32'", cidr),
+			})
+			continue
+		}
+		allowedNets = append(allowedNets, ipNet)
+	}
+
+	var hostKey ssh.Signer
+	hostKeyPem := []byte(hclConfig.Server.HostKey)
+	switch {
+	case hclConfig.Server.HostKey != "" && hclConfig.Server.HostKeyFile != "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting server host key",
+			Detail:   "Only one of host_key and host_key_file may be set in the server block",
+		})
+	case hclConfig.Server.HostKey == "" && hclConfig.Server.HostKeyFile == "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing server host key",
+			Detail:   "One of host_key or host_key_file must be set in the server block",
+		})
+	case hclConfig.Server.HostKeyFile != "":
+		hostKeyPem, err = ioutil.ReadFile(hclConfig.Server.HostKeyFile)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Could not read server host_key_file",
+				Detail:   err.Error(),
+			})
+		}
+	}
+	if !diags.HasErrors() {
+		hostKey, err = ssh.ParsePrivateKey(hostKeyPem)
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Could not parse server host key",
+				Detail:   err.Error(),
+			})
+		}
+	}
+
+	if hclConfig.Server.LogFile != "" && hclConfig.Server.LogSyslog {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting server log_file and log_syslog",
+			Detail:   "Only one of log_file and log_syslog may be set",
+		})
+	}
+
+	authorizedKeys, authDiags := parseAuthorizedKeys(&hclConfig.Server)
+	diags = append(diags, authDiags...)
+
+	// Step five: For each 'target', ask the Factory for the associated type to
 	// parse config and instantiate a Provider.
 	//
 	// If these fail, we add diagnostics but continue to provide more feedback.
-	providers := make(providers.Providers)
+	cfgCtx := &providers.ConfigContext{
+		EvalContext: evalCtx,
+		CheckOnly:   checkOnly,
+	}
+	targets := make(manager.Targets)
+	targetRanges := make(map[string]hcl.Range)
 	for _, hclTarget := range hclConfig.Targets {
-		_, exists := providers[hclTarget.Addr]
-		if exists {
+		targetRange := hclTarget.Body.MissingItemRange()
+		if prev, exists := targetRanges[hclTarget.Addr]; exists {
 			diags = append(diags, &hcl.Diagnostic{
 				Severity: hcl.DiagError,
 				Summary:  "Duplicate target address",
-				Detail:   fmt.Sprintf("Each target must have a unique address, but '%s' was used in multiple target definitions", hclTarget.Addr),
+				Detail:   fmt.Sprintf("Each target must have a unique address, but '%s' was used in multiple target definitions, in %s:%d and %s:%d", hclTarget.Addr, prev.Filename, prev.Start.Line, targetRange.Filename, targetRange.Start.Line),
+				Subject:  &targetRange,
 			})
+		} else {
+			targetRanges[hclTarget.Addr] = targetRange
+		}
+
+		// Targets take precedence over real hosts, so a target with a public
+		// address silently shadows that host for all clients.
+		if hclTarget.Addr != manager.CatchAllTarget && !isInternalAddr(hclTarget.Addr) {
+			severity := hcl.DiagWarning
+			if hclConfig.Server.StrictAddrs {
+				severity = hcl.DiagError
+			}
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: severity,
+				Summary:  "Target address may shadow a real host",
+				Detail:   fmt.Sprintf("Target '%s' looks like a public hostname or IP address. Connections to it through LazySSH will go to the target instead of the real host. Consider an internal name, like one ending in '.internal', or a name without dots", hclTarget.Addr),
+				Subject:  &targetRange,
+			})
+		}
+
+		if hclTarget.MaxConnectionsPerMachine < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'max_connections_per_machine' field",
+				Detail:   fmt.Sprintf("Target '%s' has a negative 'max_connections_per_machine' value", hclTarget.Addr),
+				Subject:  &targetRange,
+			})
+		}
+
+		if hclTarget.MaxStarting < 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'max_starting' field",
+				Detail:   fmt.Sprintf("Target '%s' has a negative 'max_starting' value", hclTarget.Addr),
+				Subject:  &targetRange,
+			})
+		}
+
+		var idleTimeout time.Duration
+		if hclTarget.IdleTimeout != "" {
+			idleTimeout, err = time.ParseDuration(hclTarget.IdleTimeout)
+			if err != nil || idleTimeout < 0 {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'idle_timeout' field",
+					Detail:   fmt.Sprintf("Target '%s' has an invalid 'idle_timeout' value '%s'", hclTarget.Addr, hclTarget.IdleTimeout),
+					Subject:  &targetRange,
+				})
+			}
+		}
+
+		var dialer providers.Dialer
+		if hclTarget.DialProxy != "" {
+			proxyDialer, err := providers.NewProxyDialer(hclTarget.DialProxy, &net.Dialer{KeepAlive: keepAlive})
+			if err == nil {
+				dialer = proxyDialer
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid value for 'dial_proxy' field",
+					Detail:   fmt.Sprintf("Target '%s' has an invalid 'dial_proxy' value: %s", hclTarget.Addr, err.Error()),
+					Subject:  &targetRange,
+				})
+			}
 		}
 
 		factory, ok := factories[hclTarget.Type]
@@ -115,7 +497,9 @@ func parseConfigFile(cfgFile string, factories providers.Factories) (hclFiles, *
 			continue
 		}
 
-		prov, err := factory.NewProvider(hclTarget.Addr, hclTarget.Body)
+		targetCtx := *cfgCtx
+		targetCtx.Dialer = dialer
+		prov, err := factory.NewProvider(hclTarget.Addr, hclTarget.Body, &targetCtx)
 		provDiags, ok := err.(hcl.Diagnostics)
 		if !ok && err != nil {
 			provDiags = hcl.Diagnostics{
@@ -129,7 +513,14 @@ func parseConfigFile(cfgFile string, factories providers.Factories) (hclFiles, *
 
 		diags = append(diags, provDiags...)
 		if !provDiags.HasErrors() {
-			providers[hclTarget.Addr] = prov
+			targets[hclTarget.Addr] = &manager.Target{
+				Provider:                 prov,
+				Type:                     hclTarget.Type,
+				MaxConnectionsPerMachine: hclTarget.MaxConnectionsPerMachine,
+				MaxStarting:              hclTarget.MaxStarting,
+				IdleTimeout:              idleTimeout,
+				Dialer:                   dialer,
+			}
 		}
 	}
 
@@ -139,10 +530,320 @@ func parseConfigFile(cfgFile string, factories providers.Factories) (hclFiles, *
 	}
 
 	cfg := &config{
-		Listen:        hclConfig.Server.Listen,
-		HostKey:       hostKey,
-		AuthorizedKey: sha256.Sum256(authorizedKey.Marshal()),
-		Providers:     providers,
+		Listen:              listen,
+		ListenNetwork:       listenNetwork,
+		HealthListen:        healthListen,
+		HealthListenNetwork: healthListenNetwork,
+		HandshakeTimeout:    handshakeTimeout,
+		KeepAliveInterval:   keepAliveInterval,
+		KeepAliveCountMax:   keepAliveCountMax,
+		AllowedNets:         allowedNets,
+		HostKey:             hostKey,
+		AuthorizedKeys:      authorizedKeys,
+		Targets:             targets,
+		Manager: manager.Options{
+			BufferSize:          hclConfig.Server.BufferSize,
+			KeepAlive:           keepAlive,
+			StateFile:           hclConfig.Server.StateFile,
+			HeartbeatInterval:   heartbeat,
+			ShutdownTimeout:     shutdownTimeout,
+			MaxConnectionsPerIP: hclConfig.Server.MaxConnsPerIP,
+		},
+		Tracing:   tracingOpts,
+		LogFile:   hclConfig.Server.LogFile,
+		LogSyslog: hclConfig.Server.LogSyslog,
 	}
 	return files, cfg, diags
 }
+
+// Parse the 'authorized_key' attribute and 'client' blocks of the server
+// block into a list of authorized keys.
+//
+// Clients without a name are identified by the comment of their key, if any.
+func parseAuthorizedKeys(server *hclServerConfig) ([]authorizedKey, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	clients := server.Clients
+	if server.AuthorizedKey != nil {
+		clients = append([]*hclClientConfig{{AuthorizedKey: *server.AuthorizedKey}}, clients...)
+	}
+	if len(clients) == 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing server authorized_key",
+			Detail:   "Set 'authorized_key' or add at least one 'client' block to the server block",
+		})
+		return nil, diags
+	}
+
+	var keys []authorizedKey
+	seen := make(map[[32]byte]bool)
+	for _, client := range clients {
+		pubKey, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(client.AuthorizedKey))
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Could not parse server authorized_key",
+				Detail:   err.Error(),
+			})
+			continue
+		}
+
+		key := authorizedKey{
+			Name:  client.Name,
+			Hash:  sha256.Sum256(pubKey.Marshal()),
+			Admin: client.Admin,
+		}
+		if key.Name == "" {
+			key.Name = comment
+		}
+		if seen[key.Hash] {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate server authorized_key",
+				Detail:   fmt.Sprintf("The key for client '%s' is authorized more than once", key.Name),
+			})
+			continue
+		}
+		seen[key.Hash] = true
+		keys = append(keys, key)
+	}
+	return keys, diags
+}
+
+// Build the hcl.EvalContext from 'variable' and 'locals' blocks.
+//
+// Variables are available in expressions as `var.<name>`, and locals as
+// `local.<name>`. Locals may refer to variables and other locals.
+func buildEvalContext(blocks hcl.Blocks, vars map[string]string) (*hcl.EvalContext, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	evalCtx := &hcl.EvalContext{
+		Variables: map[string]cty.Value{
+			"var":   cty.EmptyObjectVal,
+			"local": cty.EmptyObjectVal,
+		},
+	}
+
+	// Collect variables, applying command-line overrides.
+	varVals := make(map[string]cty.Value)
+	varRanges := make(map[string]hcl.Range)
+	var localAttrs []*hcl.Attribute
+	for _, block := range blocks {
+		if block.Type == "locals" {
+			attrs, attrDiags := block.Body.JustAttributes()
+			diags = append(diags, attrDiags...)
+			for _, attr := range attrs {
+				localAttrs = append(localAttrs, attr)
+			}
+			continue
+		}
+
+		name := block.Labels[0]
+		if prev, exists := varRanges[name]; exists {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate variable",
+				Detail:   fmt.Sprintf("Variable '%s' was already defined at %s", name, prev.String()),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+		varRanges[name] = block.DefRange
+
+		hclVariable := hclVariableConfig{}
+		if varDiags := gohcl.DecodeBody(block.Body, nil, &hclVariable); varDiags.HasErrors() {
+			diags = append(diags, varDiags...)
+			continue
+		}
+
+		var val cty.Value
+		if hclVariable.Default != nil {
+			var valDiags hcl.Diagnostics
+			val, valDiags = hclVariable.Default.Expr.Value(nil)
+			diags = append(diags, valDiags...)
+		}
+
+		if override, ok := vars[name]; ok {
+			if val == cty.NilVal || val.Type() == cty.DynamicPseudoType {
+				val = cty.StringVal(override)
+			} else {
+				converted, err := convert.Convert(cty.StringVal(override), val.Type())
+				if err != nil {
+					diags = append(diags, &hcl.Diagnostic{
+						Severity: hcl.DiagError,
+						Summary:  "Invalid value for variable",
+						Detail:   fmt.Sprintf("The value given for variable '%s' on the command-line is not compatible with its default: %s", name, err.Error()),
+						Subject:  block.DefRange.Ptr(),
+					})
+					continue
+				}
+				val = converted
+			}
+		} else if val == cty.NilVal {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing value for variable",
+				Detail:   fmt.Sprintf("Variable '%s' has no default, so a value must be given on the command-line using: -var %s=...", name, name),
+				Subject:  block.DefRange.Ptr(),
+			})
+			continue
+		}
+
+		varVals[name] = val
+	}
+
+	for name := range vars {
+		if _, exists := varRanges[name]; !exists {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Undeclared variable",
+				Detail:   fmt.Sprintf("A value was given on the command-line for variable '%s', but it is not declared in a 'variable' block", name),
+			})
+		}
+	}
+
+	if len(varVals) != 0 {
+		evalCtx.Variables["var"] = cty.ObjectVal(varVals)
+	}
+
+	// Evaluate locals. These may depend on each other, so repeatedly evaluate
+	// those with all dependencies met, until we no longer make progress.
+	pending := make(map[string]*hcl.Attribute)
+	for _, attr := range localAttrs {
+		if prev, exists := pending[attr.Name]; exists {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Duplicate local value",
+				Detail:   fmt.Sprintf("Local value '%s' was already defined at %s", attr.Name, prev.NameRange.String()),
+				Subject:  attr.NameRange.Ptr(),
+			})
+			continue
+		}
+		pending[attr.Name] = attr
+	}
+
+	localVals := make(map[string]cty.Value)
+	for len(pending) > 0 {
+		progress := false
+		for name, attr := range pending {
+			if !localDepsMet(attr, pending) {
+				continue
+			}
+
+			val, valDiags := attr.Expr.Value(evalCtx)
+			diags = append(diags, valDiags...)
+			localVals[name] = val
+			evalCtx.Variables["local"] = cty.ObjectVal(localVals)
+			delete(pending, name)
+			progress = true
+		}
+
+		if !progress {
+			for name, attr := range pending {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Cyclic local value",
+					Detail:   fmt.Sprintf("Local value '%s' depends on itself, possibly via other local values", name),
+					Subject:  attr.Expr.Range().Ptr(),
+				})
+			}
+			break
+		}
+	}
+
+	return evalCtx, diags
+}
+
+// Check if a local value refers to other local values still pending
+// evaluation.
+func localDepsMet(attr *hcl.Attribute, pending map[string]*hcl.Attribute) bool {
+	for _, traversal := range attr.Expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		step, ok := traversal[1].(hcl.TraverseAttr)
+		if !ok {
+			continue
+		}
+		if _, isPending := pending[step.Name]; isPending {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve the config path to a list of files to load.
+func resolveConfigFiles(cfgPath string) ([]string, hcl.Diagnostics) {
+	pattern := cfgPath
+	if info, err := os.Stat(cfgPath); err == nil && info.IsDir() {
+		pattern = filepath.Join(cfgPath, "*.hcl")
+	} else if !strings.ContainsAny(cfgPath, "*?[") {
+		// A plain file, which may not exist. Leave reporting that to the parser.
+		return []string{cfgPath}, nil
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, hcl.Diagnostics{
+			&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid config path",
+				Detail:   fmt.Sprintf("The config path '%s' is not a valid pattern: %s", cfgPath, err.Error()),
+			},
+		}
+	}
+	if len(matches) == 0 {
+		return nil, hcl.Diagnostics{
+			&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "No config files found",
+				Detail:   fmt.Sprintf("The config path '%s' did not match any files", cfgPath),
+			},
+		}
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// internalTLDs are top-level domains that are reserved or commonly used for
+// private networks, and are never resolved publicly.
+var internalTLDs = map[string]bool{
+	"arpa":      true, // Includes 'home.arpa'.
+	"corp":      true,
+	"example":   true,
+	"home":      true,
+	"internal":  true,
+	"intranet":  true,
+	"invalid":   true,
+	"lan":       true,
+	"local":     true,
+	"localhost": true,
+	"private":   true,
+	"test":      true,
+}
+
+// privateNets are IP ranges that are not publicly routable.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		nets = append(nets, ipNet)
+	}
+	return nets
+}()
+
+// Check whether a target address looks internal: a private, loopback or
+// link-local IP address, a name without dots, or a name in an internal TLD.
+func isInternalAddr(addr string) bool {
+	if ip := net.ParseIP(addr); ip != nil {
+		for _, ipNet := range privateNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+	}
+	name := strings.ToLower(strings.TrimSuffix(addr, "."))
+	dot := strings.LastIndexByte(name, '.')
+	return dot == -1 || internalTLDs[name[dot+1:]]
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/stephank/lazyssh/providers"
+)
+
+// writeConfigFiles creates a temporary directory containing the given files.
+// A host key is generated in the directory as 'host_key', and the server
+// block can refer to it with the '%HOST_KEY_FILE%' placeholder. The same
+// goes for '%AUTHORIZED_KEY%'.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lazyssh-config-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	hostKeyFile := filepath.Join(dir, "host_key")
+	if _, _, err := generateKeyFiles(hostKeyFile, "test"); err != nil {
+		t.Fatalf("could not generate host key: %s", err)
+	}
+	_, authorizedKey, err := generateKey("client")
+	if err != nil {
+		t.Fatalf("could not generate client key: %s", err)
+	}
+
+	replacer := strings.NewReplacer(
+		"%HOST_KEY_FILE%", filepath.ToSlash(hostKeyFile),
+		"%AUTHORIZED_KEY%", strings.TrimSpace(string(authorizedKey)),
+	)
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(replacer.Replace(contents)), 0644); err != nil {
+			t.Fatalf("could not write %s: %s", name, err)
+		}
+	}
+	return dir
+}
+
+const serverConfig = `
+server {
+  host_key_file = "%HOST_KEY_FILE%"
+  authorized_key = "%AUTHORIZED_KEY%"
+}
+`
+
+func forwardTarget(addr string) string {
+	return fmt.Sprintf(`
+target %q "forward" {
+  to = "10.0.0.1"
+}
+`, addr)
+}
+
+// targetAddrs returns the sorted addresses of configured targets.
+func targetAddrs(cfg *config) []string {
+	var addrs []string
+	for addr := range cfg.Targets {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func parseTestConfig(t *testing.T, cfgPath string) (*config, hcl.Diagnostics) {
+	t.Helper()
+	_, cfg, diags := parseConfigFile(cfgPath, nil, true, providers.FactoryMap)
+	return cfg, diags
+}
+
+func TestLoadDirectory(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"00-server.hcl": serverConfig,
+		"10-a.hcl":      forwardTarget("a.internal"),
+		"20-b.hcl":      forwardTarget("b.internal"),
+		"notes.txt":     "not a config file",
+		"extra.conf":    forwardTarget("ignored.internal"),
+	})
+
+	cfg, diags := parseTestConfig(t, dir)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if addrs := targetAddrs(cfg); strings.Join(addrs, ",") != "a.internal,b.internal" {
+		t.Fatalf("unexpected targets: %v", addrs)
+	}
+}
+
+func TestLoadGlob(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"lazyssh.hcl":     serverConfig,
+		"lazyssh-a.hcl":   forwardTarget("a.internal"),
+		"lazyssh-b.hcl":   forwardTarget("b.internal"),
+		"other-c.hcl":     forwardTarget("c.internal"),
+		"lazyssh-old.bak": forwardTarget("old.internal"),
+	})
+
+	cfg, diags := parseTestConfig(t, filepath.Join(dir, "lazyssh*.hcl"))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if addrs := targetAddrs(cfg); strings.Join(addrs, ",") != "a.internal,b.internal" {
+		t.Fatalf("unexpected targets: %v", addrs)
+	}
+}
+
+func TestLoadSingleFile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.hcl": serverConfig + forwardTarget("a.internal"),
+		"other.hcl":  forwardTarget("b.internal"),
+	})
+
+	cfg, diags := parseTestConfig(t, filepath.Join(dir, "config.hcl"))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if addrs := targetAddrs(cfg); strings.Join(addrs, ",") != "a.internal" {
+		t.Fatalf("unexpected targets: %v", addrs)
+	}
+}
+
+func TestResolveConfigFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"b.hcl":   "",
+		"a.hcl":   "",
+		"c.conf":  "",
+		"sub.hcl": "",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "nested"), 0755); err != nil {
+		t.Fatalf("could not create dir: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    []string
+		wantErr string
+	}{
+		{"directory", dir, []string{"a.hcl", "b.hcl", "sub.hcl"}, ""},
+		{"glob", filepath.Join(dir, "*.conf"), []string{"c.conf"}, ""},
+		{"plain file", filepath.Join(dir, "b.hcl"), []string{"b.hcl"}, ""},
+		{"missing plain file", filepath.Join(dir, "missing.hcl"), []string{"missing.hcl"}, ""},
+		{"empty directory", filepath.Join(dir, "nested"), nil, "No config files found"},
+		{"glob without matches", filepath.Join(dir, "*.json"), nil, "No config files found"},
+		{"invalid glob", filepath.Join(dir, "[.hcl"), nil, "Invalid config path"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files, diags := resolveConfigFiles(test.path)
+			if test.wantErr != "" {
+				if !diags.HasErrors() || diags[0].Summary != test.wantErr {
+					t.Fatalf("expected error '%s', got: %v", test.wantErr, diags)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected errors: %s", diags.Error())
+			}
+			var names []string
+			for _, file := range files {
+				names = append(names, filepath.Base(file))
+			}
+			if strings.Join(names, ",") != strings.Join(test.want, ",") {
+				t.Fatalf("expected files %v, got %v", test.want, names)
+			}
+		})
+	}
+}
+
+func TestDuplicateTargetAcrossFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"00-server.hcl": serverConfig,
+		"10-a.hcl":      forwardTarget("a.internal"),
+		"20-b.hcl":      "\n\n" + forwardTarget("b.internal") + forwardTarget("a.internal"),
+	})
+
+	cfg, diags := parseTestConfig(t, dir)
+	if cfg != nil {
+		t.Fatalf("expected no config on error")
+	}
+	var dupDiag *hcl.Diagnostic
+	for _, diag := range diags {
+		if diag.Summary == "Duplicate target address" {
+			dupDiag = diag
+		}
+	}
+	if dupDiag == nil {
+		t.Fatalf("expected a duplicate target error, got: %v", diags)
+	}
+
+	first := filepath.Join(dir, "10-a.hcl") + ":2"
+	second := filepath.Join(dir, "20-b.hcl") + ":8"
+	expected := fmt.Sprintf("in %s and %s", first, second)
+	if !strings.HasSuffix(dupDiag.Detail, expected) {
+		t.Fatalf("expected detail to end with '%s', got: %s", expected, dupDiag.Detail)
+	}
+	if dupDiag.Subject == nil || dupDiag.Subject.Filename != filepath.Join(dir, "20-b.hcl") {
+		t.Fatalf("expected subject in the second file, got: %v", dupDiag.Subject)
+	}
+}
+
+func TestDuplicateServerAcrossFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.hcl": serverConfig,
+		"b.hcl": serverConfig,
+	})
+
+	_, diags := parseTestConfig(t, dir)
+	if !diags.HasErrors() {
+		t.Fatalf("expected an error for multiple server blocks")
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.hcl": `
+server {
+  host_key_file = "%HOST_KEY_FILE%"
+  authorized_key = "%AUTHORIZED_KEY%"
+
+  client {
+    name = "ops"
+    authorized_key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+    admin = true
+  }
+}
+` + forwardTarget("a"),
+	})
+
+	cfg, diags := parseTestConfig(t, filepath.Join(dir, "config.hcl"))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if len(cfg.AuthorizedKeys) != 2 {
+		t.Fatalf("expected 2 authorized keys, got %d", len(cfg.AuthorizedKeys))
+	}
+	if cfg.AuthorizedKeys[0].Admin || !cfg.AuthorizedKeys[1].Admin {
+		t.Fatalf("expected only client 'ops' to be an admin, got: %+v", cfg.AuthorizedKeys)
+	}
+}
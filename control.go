@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/stephank/lazyssh/manager"
+	"golang.org/x/crypto/ssh"
+)
+
+// handleSession serves control commands on an SSH 'session' channel.
+//
+// Clients send a single command using an 'exec' request, like the 'lazyssh
+// status' and 'lazyssh stop' subcommands do. Only clients with 'admin = true'
+// may run commands, others get an error. Runs on a dedicated goroutine per
+// channel, so is free to block.
+func handleSession(newChan ssh.NewChannel, remoteAddr string, perms *ssh.Permissions, mgr *manager.Manager) {
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		payload := struct{ Command string }{}
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+
+		req.Reply(true, nil)
+		identity := perms.Extensions[identityExtension]
+		var exitStatus uint32
+		if perms.Extensions[adminExtension] != "true" {
+			log.Printf("%s control command rejected for '%s', not an admin: %s\n", remoteAddr, identity, payload.Command)
+			fmt.Fprintf(ch.Stderr(), "client '%s' is not allowed to run control commands\n", identity)
+			exitStatus = 1
+		} else {
+			log.Printf("%s control command by '%s': %s\n", remoteAddr, identity, payload.Command)
+			exitStatus = runControlCommand(ch, ch.Stderr(), mgr, payload.Command)
+		}
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{exitStatus}))
+		return
+	}
+}
+
+// runControlCommand executes a control command, and returns the exit status.
+func runControlCommand(stdout io.Writer, stderr io.Writer, mgr *manager.Manager, command string) uint32 {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, "missing command\n")
+		return 1
+	}
+
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		if err := json.NewEncoder(stdout).Encode(mgr.Status()); err != nil {
+			fmt.Fprintf(stderr, "%s\n", err.Error())
+			return 1
+		}
+		return 0
+	case args[0] == "drain" && len(args) == 1:
+		mgr.Drain(manager.DrainMachines)
+		return 0
+	case args[0] == "drain" && len(args) == 2 && args[1] == "connections":
+		mgr.Drain(manager.DrainConnections)
+		return 0
+	case args[0] == "undrain" && len(args) == 1:
+		mgr.Drain(manager.DrainOff)
+		return 0
+	case args[0] == "stop" && len(args) == 2:
+		if err := mgr.StopTarget(args[1]); err != nil {
+			fmt.Fprintf(stderr, "%s\n", err.Error())
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintf(stderr, "invalid command: %s\n", command)
+		return 1
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "github.com/stephank/lazyssh/manager"
+
+// There is no SIGUSR1 on this platform. Draining is still available through
+// control commands.
+func setupDrainSignal(mgr *manager.Manager) {}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/stephank/lazyssh/manager"
+)
+
+// SIGUSR1 toggles draining of new machines.
+func setupDrainSignal(mgr *manager.Manager) {
+	drainCh := make(chan os.Signal, 1)
+	signal.Notify(drainCh, syscall.SIGUSR1)
+	go func() {
+		for range drainCh {
+			mgr.ToggleDrain()
+		}
+	}()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/stephank/lazyssh/metrics"
+)
+
+// healthServer serves HTTP liveness and readiness endpoints, and metrics.
+type healthServer struct {
+	http.Server
+	// bound is non-zero while the SSH listener is bound.
+	bound int32
+	// ready is non-zero while the SSH listener is accepting connections.
+	ready int32
+}
+
+// Start a healthServer on the given address.
+func startHealthServer(network string, addr string) (*healthServer, error) {
+	listener, err := listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &healthServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", srv.handler(&srv.bound))
+	mux.HandleFunc("/readyz", srv.handler(&srv.ready))
+	mux.Handle("/metrics", metrics.Handler())
+	srv.Handler = mux
+
+	go srv.Serve(listener)
+	return srv, nil
+}
+
+// Create a handler that responds based on the given flag.
+func (srv *healthServer) handler(flag *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(flag) != 0 {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok\n"))
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("unavailable\n"))
+		}
+	}
+}
+
+// Set whether the SSH listener is bound.
+//
+// Safe to call on a nil healthServer, which does nothing.
+func (srv *healthServer) setBound(value bool) {
+	if srv != nil {
+		atomic.StoreInt32(&srv.bound, boolToInt32(value))
+	}
+}
+
+// Set whether the SSH listener is accepting connections.
+//
+// Safe to call on a nil healthServer, which does nothing.
+func (srv *healthServer) setReady(value bool) {
+	if srv != nil {
+		atomic.StoreInt32(&srv.ready, boolToInt32(value))
+	}
+}
+
+// Stop the healthServer.
+//
+// Safe to call on a nil healthServer, which does nothing.
+func (srv *healthServer) stop() {
+	if srv != nil {
+		srv.Close()
+	}
+}
+
+func boolToInt32(value bool) int32 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keygenMain implements the 'keygen' subcommand, which generates a host key
+// and client key pair, and prints matching configuration snippets. With
+// '-host-only', only the host key is generated, which is what the 'genkey'
+// alias does.
+func keygenMain(args []string) {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory to write keys to")
+	inline := flags.Bool("inline", false, "print the host key inline in the server block")
+	hostOnly := flags.Bool("host-only", false, "only generate a host key")
+	host := flags.String("host", "[localhost]:7922", "host pattern for the printed known_hosts line")
+	flags.Parse(args)
+
+	absDir, err := filepath.Abs(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid directory: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	hostKeyFile := filepath.Join(absDir, "lazyssh_host_key")
+	hostKeyPem, hostPub, err := generateKeyFiles(hostKeyFile, "lazyssh-host")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not generate host key: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	var clientKeyFile string
+	var clientPub []byte
+	if *hostOnly {
+		fmt.Printf("# Wrote %s\n", hostKeyFile)
+	} else {
+		clientKeyFile = filepath.Join(absDir, "lazyssh_client_key")
+		_, clientPub, err = generateKeyFiles(clientKeyFile, "lazyssh-client")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not generate client key: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("# Wrote %s and %s\n", hostKeyFile, clientKeyFile)
+	}
+
+	fmt.Printf("\n# Server configuration for config.hcl:\n\n")
+	fmt.Printf("server {\n")
+	if *inline {
+		fmt.Printf("  host_key = <<-EOF\n")
+		for _, line := range strings.Split(strings.TrimSpace(string(hostKeyPem)), "\n") {
+			fmt.Printf("    %s\n", line)
+		}
+		fmt.Printf("  EOF\n")
+	} else {
+		fmt.Printf("  host_key_file = %q\n", hostKeyFile)
+	}
+	if clientPub != nil {
+		fmt.Printf("  authorized_key = %q\n", strings.TrimSpace(string(clientPub)))
+	}
+	fmt.Printf("}\n")
+
+	fmt.Printf("\n# Line for ~/.ssh/known_hosts:\n\n")
+	fmt.Printf("%s %s\n", *host, strings.TrimSpace(string(hostPub)))
+
+	if *hostOnly {
+		return
+	}
+	fmt.Printf("\n# Client configuration for ~/.ssh/config:\n\n")
+	fmt.Printf("Host lazyssh\n")
+	fmt.Printf("  Hostname localhost\n")
+	fmt.Printf("  Port 7922\n")
+	fmt.Printf("  User jump\n")
+	fmt.Printf("  PreferredAuthentications publickey\n")
+	fmt.Printf("  IdentityFile %s\n", clientKeyFile)
+	fmt.Printf("  IdentitiesOnly yes\n")
+	fmt.Printf("\n")
+	fmt.Printf("# Repeat for every target address in config.hcl.\n")
+	fmt.Printf("Host mytarget\n")
+	fmt.Printf("  ProxyJump lazyssh\n")
+}
+
+// Generate an Ed25519 key pair.
+//
+// Returns the PEM of the private key, and the public key in authorized_keys
+// format, with the comment.
+func generateKey(comment string) ([]byte, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privPem := marshalEd25519PrivateKey(priv, comment)
+	authorizedKey := ssh.MarshalAuthorizedKey(sshPub)
+	authorizedKey = append(authorizedKey[:len(authorizedKey)-1], []byte(" "+comment+"\n")...)
+	return privPem, authorizedKey, nil
+}
+
+// Generate an Ed25519 key pair, and write the private key to the given file,
+// and the public key to the same file with a '.pub' extension.
+//
+// Returns the PEM of the private key, and the public key in authorized_keys
+// format. Existing files are never overwritten.
+func generateKeyFiles(file string, comment string) ([]byte, []byte, error) {
+	privPem, authorizedKey, err := generateKey(comment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeNewFile(file, privPem, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writeNewFile(file+".pub", authorizedKey, 0644); err != nil {
+		return nil, nil, err
+	}
+
+	return privPem, authorizedKey, nil
+}
+
+// Write a file, failing if it already exists.
+func writeNewFile(file string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Marshal an unencrypted Ed25519 private key in the OpenSSH format, which is
+// understood by both LazySSH and the OpenSSH client.
+//
+// See: https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.key
+func marshalEd25519PrivateKey(priv ed25519.PrivateKey, comment string) []byte {
+	pub := priv.Public().(ed25519.PublicKey)
+	pubKey := ssh.Marshal(struct {
+		KeyType string
+		Pub     []byte
+	}{ssh.KeyAlgoED25519, pub})
+
+	check := make([]byte, 4)
+	rand.Read(check)
+	checkInt := binary.BigEndian.Uint32(check)
+
+	privKey := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+	}{checkInt, checkInt, ssh.KeyAlgoED25519, pub, priv, comment})
+	for i := 1; len(privKey)%8 != 0; i++ {
+		privKey = append(privKey, byte(i))
+	}
+
+	data := append([]byte("openssh-key-v1\x00"), ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{"none", "none", "", 1, pubKey, privKey})...)
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: data,
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseListenAddr normalizes a listen address, and returns the network to
+// listen on. In addition to the usual forms, an unbracketed IPv6 literal is
+// accepted, like ':::7922'.
+//
+// The network follows from the host: an IPv4 literal listens on IPv4 only, an
+// IPv6 literal on IPv6 only, and a hostname or empty host on both, where
+// supported.
+func parseListenAddr(addr string) (string, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Split an unbracketed IPv6 literal at the last colon.
+		idx := strings.LastIndexByte(addr, ':')
+		if idx < 0 || strings.ContainsAny(addr, "[]") || parseIP(addr[:idx]) == nil {
+			return "", "", err
+		}
+		host, port = addr[:idx], addr[idx+1:]
+	}
+	if port == "" {
+		return "", "", errors.New("missing port in address")
+	}
+
+	network := "tcp"
+	if ip := parseIP(host); ip != nil {
+		if ip.To4() != nil {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// parseIP parses an IP address, which may have an IPv6 zone.
+func parseIP(host string) net.IP {
+	if idx := strings.IndexByte(host, '%'); idx >= 0 {
+		host = host[:idx]
+	}
+	return net.ParseIP(host)
+}
+
+// checkListenNetwork verifies a 'listen_network' value is compatible with the
+// network derived from the listen address.
+func checkListenNetwork(network string, derived string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("value '%s' is invalid, must be one of: tcp, tcp4, tcp6", network)
+	}
+	if derived != "tcp" && network != derived {
+		return fmt.Errorf("value '%s' conflicts with the IP address in listen, which requires '%s'", network, derived)
+	}
+	return nil
+}
+
+// listen binds a TCP listener. If a hostname resolves to both IPv4 and IPv6
+// addresses, Go only tries the first IPv4 address. If that fails, for example
+// with 'localhost' on a host without IPv4, the IPv6 addresses are tried.
+func listen(network string, addr string) (net.Listener, error) {
+	listener, err := net.Listen(network, addr)
+	if err == nil || network != "tcp" {
+		return listener, err
+	}
+
+	host, port, splitErr := net.SplitHostPort(addr)
+	if splitErr != nil || host == "" || parseIP(host) != nil {
+		return nil, err
+	}
+	ips, lookupErr := net.LookupIP(host)
+	if lookupErr != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			continue
+		}
+		if listener, err6 := net.Listen("tcp6", net.JoinHostPort(ip.String(), port)); err6 == nil {
+			return listener, nil
+		}
+	}
+	return nil, err
+}
+
+// allowedRemote checks whether a client address is in one of the allowed
+// networks. An empty list allows all addresses.
+func allowedRemote(nets []*net.IPNet, addr net.Addr) bool {
+	if len(nets) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// logFile is a log destination that can be reopened, so it cooperates with
+// tools like logrotate.
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open a logFile for appending.
+func openLogFile(path string) (*logFile, error) {
+	f := &logFile{path: path}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+// Close the current file, and open the path again. On error, the current file
+// remains in use.
+func (f *logFile) reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	old := f.file
+	f.file = file
+	f.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Direct the global logger to the destination in the config. Log files are
+// reopened on SIGHUP.
+func setupLogging(config *config) error {
+	switch {
+	case config.LogFile != "":
+		f, err := openLogFile(config.LogFile)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				if err := f.reopen(); err != nil {
+					log.Printf("Could not reopen log file: %s\n", err.Error())
+				}
+			}
+		}()
+	case config.LogSyslog:
+		return setupSyslog()
+	}
+	return nil
+}
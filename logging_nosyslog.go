@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+// Syslog is not available on this platform.
+func setupSyslog() error {
+	return errors.New("syslog is not supported on this platform")
+}
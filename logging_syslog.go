@@ -0,0 +1,21 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log"
+	"log/syslog"
+)
+
+// Direct the global logger to the system logger.
+func setupSyslog() error {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "lazyssh")
+	if err != nil {
+		return err
+	}
+	// Syslog adds its own timestamps.
+	log.SetFlags(0)
+	log.SetOutput(writer)
+	return nil
+}
@@ -6,27 +6,79 @@ import (
 	"errors"
 	"flag"
 	"log"
-	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/stephank/lazyssh/manager"
 	"github.com/stephank/lazyssh/providers"
 	_ "github.com/stephank/lazyssh/providers/aws_ec2"
+	_ "github.com/stephank/lazyssh/providers/azure_vm"
+	_ "github.com/stephank/lazyssh/providers/digitalocean"
+	_ "github.com/stephank/lazyssh/providers/docker"
+	_ "github.com/stephank/lazyssh/providers/fallback"
 	_ "github.com/stephank/lazyssh/providers/forward"
+	_ "github.com/stephank/lazyssh/providers/gce"
 	_ "github.com/stephank/lazyssh/providers/hcloud"
+	_ "github.com/stephank/lazyssh/providers/libvirt"
+	_ "github.com/stephank/lazyssh/providers/proxmox"
+	_ "github.com/stephank/lazyssh/providers/scaleway"
 	_ "github.com/stephank/lazyssh/providers/virtualbox"
+	_ "github.com/stephank/lazyssh/providers/vultr"
+	"github.com/stephank/lazyssh/tracing"
 	"golang.org/x/crypto/ssh"
 )
 
+// identityExtension is the ssh.Permissions extension holding the name of the
+// client identity that authenticated.
+const identityExtension = "lazyssh-identity"
+
+// adminExtension is the ssh.Permissions extension set for clients that may
+// run control commands.
+const adminExtension = "lazyssh-admin"
+
+// varFlags collects repeated -var flags.
+type varFlags map[string]string
+
+func (vars varFlags) String() string {
+	return ""
+}
+
+func (vars varFlags) Set(value string) error {
+	idx := strings.IndexByte(value, '=')
+	if idx < 1 {
+		return errors.New("expected a value in the format: name=value")
+	}
+	vars[value[:idx]] = value[idx+1:]
+	return nil
+}
+
 func main() {
-	configFile := flag.String("config", "config.hcl", "config file")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			keygenMain(os.Args[2:])
+			return
+		case "genkey":
+			keygenMain(append([]string{"-host-only"}, os.Args[2:]...))
+			return
+		case "status", "stop", "drain", "undrain":
+			clientMain(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	vars := make(varFlags)
+	configFile := flag.String("config", "config.hcl", "config file, directory or glob pattern")
+	flag.Var(vars, "var", "set a config variable, in the format: name=value")
+	checkOnly := flag.Bool("check", false, "only validate the config, then exit")
 	flag.Parse()
 
 	// Parse config and always print diagnostics, but only fail on errors.
-	files, config, diags := parseConfigFile(*configFile, providers.FactoryMap)
+	files, config, diags := parseConfigFile(*configFile, vars, *checkOnly, providers.FactoryMap)
 	stdoutInfo, _ := os.Stdout.Stat()
 	isTty := (stdoutInfo.Mode() & os.ModeCharDevice) != 0
 	writer := hcl.NewDiagnosticTextWriter(os.Stdout, files, 80, isTty)
@@ -34,8 +86,21 @@ func main() {
 	if diags.HasErrors() {
 		os.Exit(1)
 	}
+	if *checkOnly {
+		os.Exit(0)
+	}
+
+	if err := setupLogging(config); err != nil {
+		log.Printf("Could not set up logging: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if config.Tracing != nil {
+		tracing.Start(*config.Tracing)
+		log.Printf("Exporting traces to %s\n", config.Tracing.Endpoint)
+	}
 
-	manager := manager.NewManager(config.Providers)
+	manager := manager.NewManager(config.Targets, config.Manager)
 
 	sshConfig := &ssh.ServerConfig{}
 	sshConfig.AddHostKey(config.HostKey)
@@ -45,36 +110,60 @@ func main() {
 			return nil, errors.New("Unauthorized")
 		}
 
+		// Compare against every key, so timing doesn't reveal which matched.
 		input := sha256.Sum256(key.Marshal())
-		if subtle.ConstantTimeCompare(input[:], config.AuthorizedKey[:]) == 0 {
+		var match *authorizedKey
+		for i := range config.AuthorizedKeys {
+			if subtle.ConstantTimeCompare(input[:], config.AuthorizedKeys[i].Hash[:]) == 1 {
+				match = &config.AuthorizedKeys[i]
+			}
+		}
+		if match == nil {
 			return nil, errors.New("Unauthorized")
 		}
 
-		return nil, nil
+		extensions := map[string]string{identityExtension: match.Name}
+		if match.Admin {
+			extensions[adminExtension] = "true"
+		}
+		return &ssh.Permissions{Extensions: extensions}, nil
 	}
 
+	// Successful auth is logged once the handshake completes, with the identity.
 	sshConfig.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error) {
-		if err == nil {
-			log.Printf("%v %s auth success\n", conn.RemoteAddr(), method)
-		} else {
+		if err != nil {
 			log.Printf("%v %s auth attempt: %v\n", conn.RemoteAddr(), method, err)
 		}
 	}
 
-	listener, err := net.Listen("tcp", config.Listen)
+	listener, err := listen(config.ListenNetwork, config.Listen)
 	if err != nil {
 		log.Printf("Could not bind to port: %s\n", err)
 		os.Exit(1)
 	}
 
-	log.Printf("Listening on %s\n", config.Listen)
+	log.Printf("Listening on %s\n", listener.Addr())
+
+	var health *healthServer
+	if config.HealthListen != "" {
+		health, err = startHealthServer(config.HealthListenNetwork, config.HealthListen)
+		if err != nil {
+			log.Printf("Could not bind health port: %s\n", err)
+			os.Exit(1)
+		}
+		log.Printf("Health endpoints listening on %s\n", config.HealthListen)
+	}
+	health.setBound(true)
 
 	exitStatus := 0
 	stopping := false
-	termCh := make(chan os.Signal)
+	termCh := make(chan os.Signal, 1)
 	signal.Notify(termCh, syscall.SIGINT, syscall.SIGTERM)
 
+	setupDrainSignal(manager)
+
 	go func() {
+		health.setReady(true)
 		for {
 			rawConn, err := listener.Accept()
 			if err != nil {
@@ -87,18 +176,47 @@ func main() {
 				return
 			}
 
+			// Drop clients outside allowed_cidrs before spending any effort on
+			// the handshake.
+			if !allowedRemote(config.AllowedNets, rawConn.RemoteAddr()) {
+				log.Printf("%v rejected connection, because the address is not in allowed_cidrs\n", rawConn.RemoteAddr())
+				rawConn.Close()
+				continue
+			}
+
 			go func() {
+				// Limit how long a client may take to complete the handshake, so
+				// stalled clients don't hold on to the connection forever.
+				if config.HandshakeTimeout > 0 {
+					rawConn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+				}
 				conn, newChannels, reqs, err := ssh.NewServerConn(rawConn, sshConfig)
 				if err != nil {
 					log.Printf("%v handshake failed: %s\n", rawConn.RemoteAddr(), err.Error())
 					return
 				}
+				rawConn.SetDeadline(time.Time{})
+				if identity := conn.Permissions.Extensions[identityExtension]; identity != "" {
+					log.Printf("%v auth success as '%s'\n", conn.RemoteAddr(), identity)
+				} else {
+					log.Printf("%v auth success\n", conn.RemoteAddr())
+				}
 
 				defer conn.Close()
 				go ssh.DiscardRequests(reqs)
 
+				if config.KeepAliveInterval > 0 {
+					done := make(chan struct{})
+					defer close(done)
+					go keepAlive(conn, config.KeepAliveInterval, config.KeepAliveCountMax, done)
+				}
+
 				for ch := range newChannels {
-					manager.NewChannel(ch)
+					if ch.ChannelType() == "session" {
+						go handleSession(ch, conn.RemoteAddr().String(), conn.Permissions, manager)
+					} else {
+						manager.NewChannel(ch, conn.RemoteAddr())
+					}
 				}
 			}()
 		}
@@ -109,9 +227,54 @@ func main() {
 	signal.Reset()
 
 	stopping = true
+	health.setReady(false)
 	listener.Close()
+	health.setBound(false)
 	log.Printf("Stopping all machines\n")
 	manager.Stop()
+	health.stop()
+	tracing.Shutdown()
 	log.Printf("Shutdown complete\n")
 	os.Exit(exitStatus)
 }
+
+// Send keep-alive requests to an SSH client at the given interval, and close
+// the connection if countMax requests in a row go unanswered. Stops when done
+// is closed.
+func keepAlive(conn *ssh.ServerConn, interval time.Duration, countMax int, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Only one request is in flight at a time. Any reply counts, because
+	// clients typically reply with failure to unknown requests.
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if !pending {
+				pending = true
+				go func() {
+					_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+					replies <- err
+				}()
+				continue
+			}
+			missed++
+			if missed >= countMax {
+				log.Printf("%v did not answer %d keep-alive request(s), disconnecting\n", conn.RemoteAddr(), missed)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// activity tracks data transfer on a forwarded connection, for the purpose of
+// idle timeouts. All fields are accessed atomically.
+type activity struct {
+	// last is the time of the last transfer in either direction, as returned
+	// by time.Time.UnixNano.
+	last int64
+	// bytesIn is the number of bytes sent by the SSH client.
+	bytesIn int64
+	// bytesOut is the number of bytes sent to the SSH client.
+	bytesOut int64
+}
+
+// activityReader wraps a Reader to record activity.
+type activityReader struct {
+	io.Reader
+	act   *activity
+	bytes *int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		atomic.AddInt64(r.bytes, int64(n))
+		atomic.StoreInt64(&r.act.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watchIdle calls closeFn once there has been no activity for the given
+// timeout. It returns when done is closed.
+//
+// Runs on a dedicated goroutine per connection.
+func watchIdle(target string, act *activity, timeout time.Duration, done <-chan struct{}, closeFn func()) {
+	start := time.Now()
+	interval := timeout / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&act.last))
+			if now.Sub(last) < timeout {
+				continue
+			}
+			log.Printf(
+				"Closing idle connection to target '%s' after %s (idle for %s, %d bytes in, %d bytes out)\n",
+				target, now.Sub(start).Truncate(time.Second), now.Sub(last).Truncate(time.Second),
+				atomic.LoadInt64(&act.bytesIn), atomic.LoadInt64(&act.bytesOut),
+			)
+			closeFn()
+			return
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/forward"
+)
+
+// newLoopbackForward creates a 'forward' target to loopback, the same way the
+// config file would.
+func newLoopbackForward(tb testing.TB) *Target {
+	tb.Helper()
+	return newForward(tb, `to = "127.0.0.1"`)
+}
+
+// newForward creates a 'forward' target from the body of a target block.
+func newForward(tb testing.TB, body string) *Target {
+	tb.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		tb.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&forward.Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{})
+	if err != nil {
+		tb.Fatalf("could not create provider: %s", err)
+	}
+	return &Target{Provider: prov, Type: "forward"}
+}
+
+// startServer starts a TCP server on loopback that runs handle for every
+// connection. Returns the port.
+func startServer(tb testing.TB, handle func(conn *net.TCPConn)) uint32 {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("could not listen: %s", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn.(*net.TCPConn))
+			}()
+		}
+	}()
+	return uint32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// readAllTimeout reads from the client side of a channel until EOF.
+func readAllTimeout(t *testing.T, ch *testChannel) []byte {
+	t.Helper()
+	type result struct {
+		data []byte
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		data, err := ioutil.ReadAll(readerFunc(ch.clientRead))
+		resCh <- result{data, err}
+	}()
+	select {
+	case res := <-resCh:
+		if res.err != nil {
+			t.Fatalf("read failed: %s", res.err)
+		}
+		return res.data
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for EOF")
+	}
+	return nil
+}
+
+// The client closes its write side first. The upstream must see EOF, and its
+// response must still reach the client afterwards.
+func TestHalfCloseFromClient(t *testing.T) {
+	received := make(chan string, 1)
+	port := startServer(t, func(conn *net.TCPConn) {
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+		conn.Write([]byte("response after EOF"))
+		conn.CloseWrite()
+	})
+	mgr := NewManager(Targets{"test": newLoopbackForward(t)}, Options{})
+	defer stopManager(t, mgr)
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	if _, err := ch.clientWrite([]byte("request")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	ch.inW.Close()
+
+	select {
+	case data := <-received:
+		if data != "request" {
+			t.Fatalf("upstream received '%s'", data)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for upstream to see EOF")
+	}
+	if data := readAllTimeout(t, ch); string(data) != "response after EOF" {
+		t.Fatalf("client received '%s'", data)
+	}
+}
+
+// The upstream closes its write side first. The client must see EOF, and the
+// upstream must still receive data the client sends afterwards.
+func TestHalfCloseFromUpstream(t *testing.T) {
+	received := make(chan string, 1)
+	port := startServer(t, func(conn *net.TCPConn) {
+		conn.Write([]byte("greeting"))
+		conn.CloseWrite()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+	})
+	mgr := NewManager(Targets{"test": newLoopbackForward(t)}, Options{})
+	defer stopManager(t, mgr)
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	if data := readAllTimeout(t, ch); string(data) != "greeting" {
+		t.Fatalf("client received '%s'", data)
+	}
+
+	if _, err := ch.clientWrite([]byte("data after EOF")); err != nil {
+		t.Fatalf("write after EOF failed: %s", err)
+	}
+	ch.inW.Close()
+	select {
+	case data := <-received:
+		if data != "data after EOF" {
+			t.Fatalf("upstream received '%s'", data)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for upstream to receive data")
+	}
+}
+
+// A 'forward' target with 'socket' dials the unix socket, and half-close
+// works the same as for TCP.
+func TestUnixSocketUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazyssh-manager-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "upstream.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		received <- string(data)
+		conn.Write([]byte("response over unix socket"))
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+
+	target := newForward(t, fmt.Sprintf("socket = %q", socket))
+	mgr := NewManager(Targets{"test": target}, Options{})
+	defer stopManager(t, mgr)
+
+	// The port is ignored for unix sockets.
+	ch := openChannel(mgr, "test", 22).wait(t)
+	if _, err := ch.clientWrite([]byte("request")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	ch.inW.Close()
+
+	select {
+	case data := <-received:
+		if data != "request" {
+			t.Fatalf("upstream received '%s'", data)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for upstream to see EOF")
+	}
+	if data := readAllTimeout(t, ch); string(data) != "response over unix socket" {
+		t.Fatalf("client received '%s'", data)
+	}
+}
+
+// A 'forward' target with a socket that does not exist rejects the channel.
+func TestUnixSocketUpstreamMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazyssh-manager-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "missing.sock")
+
+	target := newForward(t, fmt.Sprintf("socket = %q", socket))
+	mgr := NewManager(Targets{"test": target}, Options{})
+	defer stopManager(t, mgr)
+
+	reason := openChannel(mgr, "test", 22).waitRejected(t)
+	if !strings.Contains(reason, "dial unix "+socket) {
+		t.Fatalf("unexpected rejection reason: %s", reason)
+	}
+}
+
+// Push data from the client through a loopback 'forward' target, with
+// different buffer sizes.
+func BenchmarkForward(b *testing.B) {
+	const chunkSize = 1024 * 1024
+	// Keep connection logging out of the benchmark output.
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, bufferSize := range []int{32 * 1024, 64 * 1024, 256 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%dk", bufferSize/1024), func(b *testing.B) {
+			received := make(chan int64, 1)
+			port := startServer(b, func(conn *net.TCPConn) {
+				n, _ := io.Copy(ioutil.Discard, conn)
+				received <- n
+			})
+			mgr := NewManager(Targets{"test": newLoopbackForward(b)}, Options{BufferSize: bufferSize})
+			defer mgr.Stop()
+
+			nc := openChannel(mgr, "test", port)
+			var ch *testChannel
+			select {
+			case ch = <-nc.accepted:
+			case reason := <-nc.rejected:
+				b.Fatalf("channel rejected: %s", reason)
+			}
+
+			chunk := make([]byte, chunkSize)
+			b.SetBytes(chunkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := ch.clientWrite(chunk); err != nil {
+					b.Fatalf("write failed: %s", err)
+				}
+			}
+			ch.inW.Close()
+			if n := <-received; n != int64(b.N)*chunkSize {
+				b.Fatalf("upstream received %d bytes, expected %d", n, int64(b.N)*chunkSize)
+			}
+			b.StopTimer()
+			ioutil.ReadAll(readerFunc(ch.clientRead))
+		})
+	}
+}
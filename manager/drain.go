@@ -0,0 +1,72 @@
+package manager
+
+import (
+	"log"
+)
+
+// DrainMode controls which new SSH channels the Manager accepts, so a server
+// can be put into maintenance without shutting down running machines.
+type DrainMode int
+
+const (
+	// DrainOff accepts all channels. This is the default.
+	DrainOff DrainMode = iota
+	// DrainMachines rejects channels that would start a new machine, but
+	// still accepts channels to running shared machines.
+	DrainMachines
+	// DrainConnections rejects all new channels.
+	DrainConnections
+
+	// drainToggle is sent by ToggleDrain.
+	drainToggle DrainMode = -1
+)
+
+func (mode DrainMode) String() string {
+	switch mode {
+	case DrainMachines:
+		return "machines"
+	case DrainConnections:
+		return "connections"
+	default:
+		return "off"
+	}
+}
+
+// Drain sets the drain mode of the Manager.
+//
+// Unlike Stop, running machines and connections are not affected, and
+// draining can be undone by setting DrainOff.
+func (mgr *Manager) Drain(mode DrainMode) {
+	mgr.drain <- mode
+}
+
+// ToggleDrain switches between DrainOff and DrainMachines. If the Manager is
+// draining in any mode, draining is turned off.
+func (mgr *Manager) ToggleDrain() {
+	mgr.drain <- drainToggle
+}
+
+// handleDrain sets the drain mode.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) handleDrain(mode DrainMode) {
+	if mode == drainToggle {
+		if mgr.drainMode == DrainOff {
+			mode = DrainMachines
+		} else {
+			mode = DrainOff
+		}
+	}
+	if mode == mgr.drainMode {
+		return
+	}
+	switch mode {
+	case DrainMachines:
+		log.Printf("Draining, no longer starting new machines\n")
+	case DrainConnections:
+		log.Printf("Draining, no longer accepting new connections\n")
+	default:
+		log.Printf("No longer draining\n")
+	}
+	mgr.drainMode = mode
+}
@@ -1,13 +1,20 @@
 package manager
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/stephank/lazyssh/metrics"
 	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -29,13 +36,92 @@ type machine struct {
 	// shared indicates whether IsShared was true at the time the machine was
 	// created. If true, the machine will be in sharedMachines.
 	shared bool
+	// err is the error returned from RunMachine, if any. Only accessed by the
+	// Manager goroutine once the machine has stopped.
+	err error
+	// conns is the number of SSH channels assigned to this machine. Only
+	// accessed by the Manager goroutine.
+	conns int
+	// started is the time the machine was created.
+	started time.Time
+	// ready is set to non-zero once the first connection was translated.
+	// Accessed atomically.
+	ready int32
+	// stopping indicates a Stop message was sent. Only accessed by the Manager
+	// goroutine.
+	stopping bool
+	// starting indicates the machine counts towards MaxStarting of its target,
+	// until it becomes ready or stops. Only accessed by the Manager goroutine.
+	starting bool
 }
 
 // machines is an index of running machines.
 type machines map[*machine]struct{}
 
 // sharedMachines is an index of shared running machines by target address.
-type sharedMachines map[string]*machine
+// A target may have multiple shared machines if it limits the number of
+// connections per machine.
+type sharedMachines map[string][]*machine
+
+// halfCloseConn is a connection that can be closed in one direction, like
+// *net.TCPConn and *net.UnixConn.
+type halfCloseConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// Target holds the configuration for a target address.
+type Target struct {
+	// Provider manages machines for this target.
+	providers.Provider
+	// Type is the provider type name, used for informational purposes.
+	Type string
+	// MaxConnectionsPerMachine is the number of connections a shared machine
+	// accepts before an additional machine is started. Zero means unlimited.
+	MaxConnectionsPerMachine int
+	// MaxStarting is the number of machines that may be starting at the same
+	// time. Channels that need another machine are queued until a start
+	// completes. Zero means unlimited.
+	MaxStarting int
+	// IdleTimeout is the duration after which a forwarded connection without
+	// any data transfer is closed. Zero means no timeout.
+	IdleTimeout time.Duration
+	// Dialer is used to connect to machines of this target, if set. It is nil
+	// for direct connections.
+	Dialer providers.Dialer
+}
+
+// Targets is an index of configured targets by address.
+type Targets map[string]*Target
+
+// CatchAllTarget is the address of a target that handles connections to any
+// address without a target of its own.
+const CatchAllTarget = "*"
+
+// Options holds Manager settings from the server configuration.
+type Options struct {
+	// BufferSize is the size of buffers used to copy data between SSH channels
+	// and TCP connections. Zero means the default of 64 KiB.
+	BufferSize int
+	// KeepAlive is the TCP keep-alive period for forwarded connections. Zero
+	// means the system default, and a negative value disables keep-alive.
+	KeepAlive time.Duration
+	// StateFile is the path to a file where running machines are recorded, so
+	// they can be recovered after a restart. Empty disables this feature.
+	StateFile string
+	// HeartbeatInterval is the interval at which running machines are logged.
+	// Zero disables heartbeat logging.
+	HeartbeatInterval time.Duration
+	// ShutdownTimeout limits how long Stop waits for machines to stop. Machines
+	// with active connections are given half this time for the connections to
+	// close, before they are stopped. Zero means no limit, in which case all
+	// machines are stopped immediately, regardless of active connections.
+	ShutdownTimeout time.Duration
+	// MaxConnectionsPerIP limits the number of forwarded connections from a
+	// single client IP address. Zero means no limit.
+	MaxConnectionsPerIP int
+}
 
 // Manager is the central piece responsible for starting/stopping machines
 // using a Provider, and connecting SSH channels to the actual TCP port onn the
@@ -45,49 +131,154 @@ type sharedMachines map[string]*machine
 // Public methods on the Manager provide an interface to communicate with the
 // goroutine. (This is essentially the agent pattern.)
 type Manager struct {
-	newChannel  chan ssh.NewChannel
+	newChannel  chan *newChannelMsg
 	stop        chan chan struct{}
 	machStopped chan *machine
-	providers   providers.Providers
+	machReady   chan *machine
+	connClosed  chan *connClosedMsg
+	status      chan chan *Status
+	stopTarget  chan *stopTargetMsg
+	drain       chan DrainMode
+	drainMode   DrainMode
+	targets     Targets
+	bufPool     *sync.Pool
+	dialer      *net.Dialer
+	state       *stateFile
+	// stopErrors describes machines that reported errors while stopping, for
+	// the summary logged on shutdown.
+	stopErrors []string
+	// connsPerIP counts forwarded connections by client IP address, to
+	// enforce maxConnsPerIP.
+	connsPerIP    map[string]int
+	maxConnsPerIP int
+	// starting counts machines in the process of starting by target address,
+	// and queued holds channels waiting for a start to complete, to enforce
+	// Target.MaxStarting.
+	starting map[string]int
+	queued   map[string][]*newChannelMsg
 	machines
 	sharedMachines
 }
 
-// NewManager creates a new Manager from the given Providers, and starts the
+// NewManager creates a new Manager from the given Targets, and starts the
 // main goroutine running the Manager message loop.
 //
-// Ownership of the Providers passed in is transferred to the Manager.
+// Ownership of the Targets passed in is transferred to the Manager.
 // Specifically, Provider methods are called from the Manager goroutine.
-func NewManager(provs providers.Providers) *Manager {
+func NewManager(targets Targets, opts Options) *Manager {
+	bufferSize := opts.BufferSize
+	if bufferSize == 0 {
+		bufferSize = 64 * 1024
+	}
+
 	mgr := &Manager{
-		newChannel:     make(chan ssh.NewChannel),
+		dialer: &net.Dialer{
+			KeepAlive: opts.KeepAlive,
+		},
+		bufPool: &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, bufferSize)
+				return &buf
+			},
+		},
+		newChannel:     make(chan *newChannelMsg),
 		stop:           make(chan chan struct{}),
 		machStopped:    make(chan *machine),
-		providers:      provs,
+		machReady:      make(chan *machine),
+		connClosed:     make(chan *connClosedMsg),
+		status:         make(chan chan *Status),
+		stopTarget:     make(chan *stopTargetMsg),
+		drain:          make(chan DrainMode),
+		targets:        targets,
+		connsPerIP:     make(map[string]int),
+		maxConnsPerIP:  opts.MaxConnectionsPerIP,
+		starting:       make(map[string]int),
+		queued:         make(map[string][]*newChannelMsg),
 		machines:       make(machines),
 		sharedMachines: make(sharedMachines),
 	}
+	if opts.StateFile != "" {
+		mgr.state = &stateFile{
+			path:    opts.StateFile,
+			entries: make(map[*machine]stateEntry),
+		}
+	}
+	tracked := mgr.recoverMachines()
+	for addr, target := range targets {
+		if sweeper, ok := target.Provider.(providers.Sweeper); ok {
+			go sweeper.Sweep(tracked[addr])
+		}
+	}
 	go func() {
+		// A nil channel blocks forever, which disables the select case.
+		var heartbeat <-chan time.Time
+		if opts.HeartbeatInterval > 0 {
+			ticker := time.NewTicker(opts.HeartbeatInterval)
+			defer ticker.Stop()
+			heartbeat = ticker.C
+		}
+
+		// Machines stop concurrently, each on their own goroutine. With a
+		// shutdown timeout, machines with active connections are only stopped
+		// once those close, or connTimeout passes. The timeouts are started on
+		// the first Stop call.
 		var stoppingCh []chan struct{}
+		var connTimeout <-chan time.Time
+		var shutdownTimeout <-chan time.Time
 		for stoppingCh == nil || len(mgr.machines) > 0 {
 			select {
-			case newChan := <-mgr.newChannel:
+			case msg := <-mgr.newChannel:
 				if stoppingCh == nil {
-					mgr.handleNewChannel(newChan)
+					mgr.handleNewChannel(msg.newChan, msg.remoteAddr)
 				} else {
-					newChan.Reject(ssh.Prohibited, "this server is shutting down")
+					msg.newChan.Reject(ssh.Prohibited, "this server is shutting down")
 				}
 			case mach := <-mgr.machStopped:
 				mgr.handleMachineStopped(mach)
+			case mach := <-mgr.machReady:
+				mgr.handleMachineReady(mach)
+			case msg := <-mgr.connClosed:
+				msg.mach.conns--
+				mgr.releaseClientConn(msg.clientIP)
+				if stoppingCh != nil && msg.mach.conns == 0 {
+					mgr.stopMachine(msg.mach)
+				}
+			case replyCh := <-mgr.status:
+				replyCh <- mgr.handleStatus()
+			case msg := <-mgr.stopTarget:
+				msg.reply <- mgr.handleStopTarget(msg.target)
+			case mode := <-mgr.drain:
+				mgr.handleDrain(mode)
+			case <-heartbeat:
+				mgr.logHeartbeat()
 			case replyCh := <-mgr.stop:
 				if stoppingCh == nil {
-					for mach := range mgr.machines {
-						mach.Stop <- struct{}{}
+					mgr.rejectQueued("this server is shutting down")
+					if opts.ShutdownTimeout > 0 {
+						mgr.stopIdleMachines()
+						connTimeout = time.After(opts.ShutdownTimeout / 2)
+						shutdownTimeout = time.After(opts.ShutdownTimeout)
+					} else {
+						// Without a limit, waiting for connections could take
+						// forever, so stop everything right away.
+						for mach := range mgr.machines {
+							mgr.stopMachine(mach)
+						}
 					}
 				}
 				stoppingCh = append(stoppingCh, replyCh)
+			case <-connTimeout:
+				for mach := range mgr.machines {
+					if !mach.stopping {
+						log.Printf("Closing %d active connection(s) to target '%s' for shutdown\n", mach.conns, mach.target)
+						mgr.stopMachine(mach)
+					}
+				}
+			case <-shutdownTimeout:
+				mgr.abandonMachines()
 			}
 		}
+		mgr.logStopSummary()
 		for _, ch := range stoppingCh {
 			ch <- struct{}{}
 		}
@@ -95,13 +286,27 @@ func NewManager(provs providers.Providers) *Manager {
 	return mgr
 }
 
+// newChannelMsg is the message sent to the Manager goroutine by NewChannel.
+type newChannelMsg struct {
+	newChan    ssh.NewChannel
+	remoteAddr net.Addr
+}
+
+// connClosedMsg is the message sent to the Manager goroutine when a
+// connection ends.
+type connClosedMsg struct {
+	mach     *machine
+	clientIP string
+}
+
 // NewChannel transfers an SSH channel to the Manager for processing.
 //
 // The Manager will verify the channel is 'direct-tcpip' channel and parse
 // parameters, start the target machine if necessary, then connect the channel
-// to the requested TCP port on the target machine.
-func (mgr *Manager) NewChannel(newChan ssh.NewChannel) {
-	mgr.newChannel <- newChan
+// to the requested TCP port on the target machine. The remote address of the
+// SSH client is used for logging.
+func (mgr *Manager) NewChannel(newChan ssh.NewChannel, remoteAddr net.Addr) {
+	mgr.newChannel <- &newChannelMsg{newChan, remoteAddr}
 }
 
 // Stop instructs the Manager to shutdown.
@@ -119,7 +324,7 @@ func (mgr *Manager) Stop() {
 //
 // Runs on the Manager message loop goroutine. A separate goroutine is launched
 // for the Provider to do processing on.
-func (mgr *Manager) handleNewChannel(newChan ssh.NewChannel) {
+func (mgr *Manager) handleNewChannel(newChan ssh.NewChannel, remoteAddr net.Addr) {
 	if newChan.ChannelType() != "direct-tcpip" {
 		newChan.Reject(ssh.UnknownChannelType, "unsuported channel type")
 		return
@@ -131,49 +336,252 @@ func (mgr *Manager) handleNewChannel(newChan ssh.NewChannel) {
 		return
 	}
 
-	prov, ok := mgr.providers[input.RemoteAddr]
+	// Fall back to the catch-all target for unknown addresses, if configured.
+	// The Provider still receives the requested address in TranslateMsg.
+	addr := input.RemoteAddr
+	target, ok := mgr.targets[addr]
+	if !ok {
+		addr = CatchAllTarget
+		target, ok = mgr.targets[addr]
+	}
 	if !ok {
 		newChan.Reject(ssh.ConnectionFailed, "unknown remote address")
 		return
 	}
 
-	// Try for a shared machine, otherwise start a new one.
+	if mgr.drainMode == DrainConnections {
+		newChan.Reject(ssh.Prohibited, "this server is draining")
+		return
+	}
+
+	clientIP := clientIP(remoteAddr)
+	if mgr.maxConnsPerIP > 0 && mgr.connsPerIP[clientIP] >= mgr.maxConnsPerIP {
+		log.Printf("%v rejected connection to target '%s', because the client is at max_connections_per_ip\n", remoteAddr, addr)
+		newChan.Reject(ssh.ResourceShortage, "too many connections from this address")
+		return
+	}
+
+	span := tracing.NewSpan(nil, "channel")
+	span.SetAttribute("lazyssh.target", addr)
+	span.SetAttribute("lazyssh.provider", target.Type)
+	prov := target.Provider
+
+	// Try for a shared machine with room for another connection, otherwise
+	// start a new one.
 	var mach *machine
 	if prov.IsShared() {
-		mach = mgr.sharedMachines[input.RemoteAddr]
+		for _, shared := range mgr.sharedMachines[addr] {
+			if target.MaxConnectionsPerMachine == 0 || shared.conns < target.MaxConnectionsPerMachine {
+				mach = shared
+				break
+			}
+		}
+	}
+
+	if mach == nil && mgr.drainMode != DrainOff {
+		span.SetError(errors.New("this server is draining"))
+		span.End()
+		newChan.Reject(ssh.Prohibited, "this server is draining")
+		return
+	}
+
+	// Wait for a start to complete if the target is at max_starting. The
+	// channel goes through this function again once dequeued.
+	if mach == nil && target.MaxStarting > 0 && mgr.starting[addr] >= target.MaxStarting {
+		span.End()
+		log.Printf("%v queued connection to target '%s', because it is at max_starting\n", remoteAddr, addr)
+		mgr.queued[addr] = append(mgr.queued[addr], &newChannelMsg{newChan, remoteAddr})
+		return
 	}
 
 	if mach == nil {
-		mach = &machine{
-			target: input.RemoteAddr,
-			Machine: providers.Machine{
-				ModActive: make(chan int8),
-				Translate: make(chan *providers.TranslateMsg),
-				Stop:      make(chan struct{}, 1),
-			},
+		log.Printf("Starting machine for target '%s'\n", addr)
+		mach = mgr.newMachine(addr, target, span, prov.RunMachine)
+		mach.starting = true
+		mgr.starting[addr]++
+	}
+
+	// Further connection setup is async, don't block the Manager message loop.
+	mach.conns++
+	mgr.connsPerIP[clientIP]++
+	go func() {
+		mgr.connectChannel(newChan, remoteAddr, mach, target, input, span)
+		mgr.connClosed <- &connClosedMsg{mach, clientIP}
+	}()
+}
+
+// releaseStart stops counting a machine towards MaxStarting of its target, and
+// processes the channels queued for the target again.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) releaseStart(mach *machine) {
+	if !mach.starting {
+		return
+	}
+	mach.starting = false
+	if mgr.starting[mach.target] <= 1 {
+		delete(mgr.starting, mach.target)
+	} else {
+		mgr.starting[mach.target]--
+	}
+
+	// Channels that still can't be handled are queued again, in order.
+	queue := mgr.queued[mach.target]
+	delete(mgr.queued, mach.target)
+	for _, msg := range queue {
+		mgr.handleNewChannel(msg.newChan, msg.remoteAddr)
+	}
+}
+
+// handleMachineReady records the start duration of a machine, once the first
+// connection was translated, which providers only do once connectivity is
+// verified. Recovered machines are not counted, because they were not started.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) handleMachineReady(mach *machine) {
+	if mach.starting {
+		metrics.ObserveStart(mach.target, mgr.targets[mach.target].Type, time.Since(mach.started))
+	}
+	mgr.releaseStart(mach)
+}
+
+// rejectQueued rejects all channels waiting for a machine start.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) rejectQueued(reason string) {
+	for addr, queue := range mgr.queued {
+		for _, msg := range queue {
+			msg.newChan.Reject(ssh.Prohibited, reason)
 		}
+		delete(mgr.queued, addr)
+	}
+}
+
+// releaseClientConn decrements the connection count of a client IP address.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) releaseClientConn(clientIP string) {
+	if mgr.connsPerIP[clientIP] <= 1 {
+		delete(mgr.connsPerIP, clientIP)
+	} else {
+		mgr.connsPerIP[clientIP]--
+	}
+}
+
+// clientIP returns the IP address part of a client address, to group
+// connections from the same client regardless of source port.
+func clientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// newMachine creates a machine for a target, and starts a goroutine that
+// calls run to manage the machine lifecycle.
+//
+// Runs on the Manager message loop goroutine, or from NewManager before the
+// message loop starts.
+func (mgr *Manager) newMachine(addr string, target *Target, parentSpan *tracing.Span, run func(*providers.Machine) error) *machine {
+	mach := &machine{
+		target:  addr,
+		started: time.Now(),
+		Machine: providers.Machine{
+			ModActive: make(chan int8),
+			Translate: make(chan *providers.TranslateMsg),
+			Stop:      make(chan struct{}, 1),
+			Span:      tracing.NewSpan(parentSpan, "machine"),
+		},
+	}
+	mach.Span.SetAttribute("lazyssh.target", mach.target)
+	mach.Span.SetAttribute("lazyssh.provider", target.Type)
+	if mgr.state != nil {
+		mach.Recorder = &machineRecorder{file: mgr.state, mach: mach, typ: target.Type}
+	}
 
-		log.Printf("Starting machine for target '%s'\n", mach.target)
-		go func() {
-			prov.RunMachine(&mach.Machine)
+	go func() {
+		// Recover from provider panics, so one bad provider doesn't take down
+		// every other active session.
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Provider panic for target '%s': %v\n%s", mach.target, r, debug.Stack())
+				mach.err = fmt.Errorf("internal error in provider: %v", r)
+			}
+			mach.Span.SetError(mach.err)
+			mach.Span.End()
 			mgr.machStopped <- mach
 		}()
+		mach.err = run(&mach.Machine)
+	}()
+
+	mgr.machines[mach] = struct{}{}
+	if target.IsShared() {
+		mach.shared = true
+		mgr.sharedMachines[mach.target] = append(mgr.sharedMachines[mach.target], mach)
+	}
+	return mach
+}
+
+// recoverMachines reads the state file, and hands machines recorded by a
+// previous process to their Provider for recovery.
+//
+// Returns the instance IDs being recovered, by target address. Runs from
+// NewManager before the message loop starts.
+func (mgr *Manager) recoverMachines() map[string][]string {
+	tracked := make(map[string][]string)
+	if mgr.state == nil {
+		return tracked
+	}
+
+	entries, err := loadStateFile(mgr.state.path)
+	if err != nil {
+		log.Printf("Could not read state file: %s\n", err.Error())
+		return tracked
+	}
 
-		mgr.machines[mach] = struct{}{}
-		if prov.IsShared() {
-			mach.shared = true
-			mgr.sharedMachines[mach.target] = mach
+	for _, entry := range entries {
+		target, ok := mgr.targets[entry.Target]
+		var recoverer providers.Recoverer
+		if ok && target.Type == entry.Type {
+			recoverer, ok = target.Provider.(providers.Recoverer)
+		} else {
+			ok = false
+		}
+		if !ok {
+			log.Printf("Cannot recover machine '%s' for target '%s', it may need to be cleaned up manually\n", entry.ID, entry.Target)
+			continue
 		}
+
+		log.Printf("Recovering machine '%s' for target '%s'\n", entry.ID, entry.Target)
+		id := entry.ID
+		mach := mgr.newMachine(entry.Target, target, nil, func(mach *providers.Machine) error {
+			return recoverer.RecoverMachine(mach, id)
+		})
+		mgr.state.record(mach, entry)
+		tracked[entry.Target] = append(tracked[entry.Target], entry.ID)
 	}
 
-	// Further connection setup is async, don't block the Manager message loop.
-	go connectChannel(newChan, mach, input)
+	// Write the state file even if nothing was recovered, to drop entries we
+	// could not recover.
+	mgr.state.mu.Lock()
+	mgr.state.write()
+	mgr.state.mu.Unlock()
+	return tracked
 }
 
 // connectChannel connects an SSH channel to a TCP port on a machine.
 //
-// Runs on a dedicated goroutine per channel, so is free to block.
-func connectChannel(newChan ssh.NewChannel, mach *machine, input channelOpenDirectMsg) {
+// Runs on a dedicated goroutine per channel, so is free to block. Only
+// accesses Manager fields that are not modified after NewManager.
+//
+// The span covers the channel lifetime, and is ended here.
+func (mgr *Manager) connectChannel(newChan ssh.NewChannel, remoteAddr net.Addr, mach *machine, target *Target, input channelOpenDirectMsg, span *tracing.Span) {
+	defer span.End()
+
 	// Inform the Provider about active connections.
 	incActive(mach)
 	defer decActive(mach)
@@ -184,47 +592,113 @@ func connectChannel(newChan ssh.NewChannel, mach *machine, input channelOpenDire
 	msg := &providers.TranslateMsg{
 		Addr:  input.RemoteAddr,
 		Port:  uint16(input.RemotePort),
-		Reply: make(chan string),
+		Reply: make(chan providers.TranslateReply),
 	}
 	mach.Translate <- msg
-	addr := <-msg.Reply
-	if addr == "" {
-		// Usually happens when a request arrives during machine shutdown, but the
-		// Provider may also send this as an abort instruction for whatever reason.
-		newChan.Reject(ssh.ConnectionFailed, "service not available")
+	reply := <-msg.Reply
+	if reply.Addr == "" {
+		// Usually happens when a request arrives during machine shutdown, or when
+		// the machine failed to start, but the Provider may also send this as an
+		// abort instruction for whatever reason.
+		reason := "service not available"
+		if reply.Err != nil {
+			reason = reply.Err.Error()
+		}
+		span.SetError(errors.New(reason))
+		newChan.Reject(ssh.ConnectionFailed, reason)
 		return
 	}
+	if atomic.CompareAndSwapInt32(&mach.ready, 0, 1) {
+		mgr.machReady <- mach
+	}
 
-	// Connect and drive I/O in separate goroutines.
-	conn, err := net.Dial("tcp", addr)
+	if id := mach.InstanceID(); id != "" {
+		log.Printf("%v connected to target '%s' port %d via instance '%s' at %s\n", remoteAddr, mach.target, input.RemotePort, id, reply.Addr)
+	} else {
+		log.Printf("%v connected to target '%s' port %d at %s\n", remoteAddr, mach.target, input.RemotePort, reply.Addr)
+	}
+
+	// Connect and drive I/O in separate goroutines. Unix sockets are local, so
+	// never go through the target Dialer.
+	network := reply.Network
+	if network == "" {
+		network = "tcp"
+	}
+	var dialer providers.Dialer = mgr.dialer
+	if target.Dialer != nil && network == "tcp" {
+		dialer = target.Dialer
+	}
+	conn, err := dialer.DialContext(context.Background(), network, reply.Addr)
 	if err != nil {
+		span.SetError(err)
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	if reply.ProxyProtocol {
+		if _, err := conn.Write(proxyHeader(remoteAddr, conn.RemoteAddr())); err != nil {
+			span.SetError(err)
+			conn.Close()
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+	}
+
+	// Dialers normally return a *net.TCPConn, but any connection that supports
+	// half-close will do, which allows tests to use other Dialers.
+	tcp, ok := conn.(halfCloseConn)
+	if !ok {
+		err = fmt.Errorf("connection type %T does not support half-close", conn)
+		span.SetError(err)
+		conn.Close()
 		newChan.Reject(ssh.ConnectionFailed, err.Error())
 		return
 	}
 
-	tcp := conn.(*net.TCPConn)
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
+		span.SetError(err)
 		tcp.Close()
 		return
 	}
 
 	defer ch.Close()
 	go ssh.DiscardRequests(reqs)
+
+	// The remainder of the channel lifetime is the forwarded connection.
+	connSpan := tracing.NewSpan(span, "connection")
+	connSpan.SetAttribute("lazyssh.dial_addr", reply.Addr)
+	defer connSpan.End()
+
+	// Optionally track activity to close idle connections.
+	var chReader io.Reader = ch
+	var tcpReader io.Reader = tcp
+	if target.IdleTimeout > 0 {
+		act := &activity{last: time.Now().UnixNano()}
+		chReader = &activityReader{ch, act, &act.bytesIn}
+		tcpReader = &activityReader{tcp, act, &act.bytesOut}
+		done := make(chan struct{})
+		defer close(done)
+		go watchIdle(mach.target, act, target.IdleTimeout, done, func() {
+			tcp.Close()
+			ch.Close()
+		})
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
 		defer tcp.CloseWrite()
-		io.Copy(tcp, ch)
+		copyBuffer(tcp, chReader, mgr.bufPool)
 	}()
 
 	go func() {
 		defer wg.Done()
 		defer tcp.CloseRead()
 		defer ch.CloseWrite()
-		io.Copy(ch, tcp)
+		copyBuffer(ch, tcpReader, mgr.bufPool)
 	}()
 
 	// The WaitGroup ensures defers wait until I/O in *both* directions ends.
@@ -236,29 +710,154 @@ func connectChannel(newChan ssh.NewChannel, mach *machine, input channelOpenDire
 // Runs on the Manager message loop goroutine. When the Provider RunMachine
 // method ends, a message is sent to the Manager, which brings us here.
 func (mgr *Manager) handleMachineStopped(mach *machine) {
-	log.Printf("Stopped machine for target '%s'\n", mach.target)
+	if mach.err != nil {
+		log.Printf("Stopped machine for target '%s' after error: %s\n", mach.target, mach.err.Error())
+	} else {
+		log.Printf("Stopped machine for target '%s'\n", mach.target)
+	}
+	for _, err := range mach.StopErrors() {
+		mgr.stopErrors = append(mgr.stopErrors, fmt.Sprintf("target '%s': %s", mach.target, err.Error()))
+	}
 	delete(mgr.machines, mach)
-	if mach.shared {
-		delete(mgr.sharedMachines, mach.target)
+	mgr.removeShared(mach)
+	// A machine stopped by us while starting, for drain or shutdown, did not
+	// fail to start.
+	if mach.starting && mach.err != nil && !mach.stopping {
+		metrics.IncStartFailure(mach.target, mgr.targets[mach.target].Type)
+	}
+	mgr.releaseStart(mach)
+	if mgr.state != nil {
+		mgr.state.remove(mach)
 	}
 
 	// Discard any connectChannel messages that may have raced us here. 5 seconds
 	// should be ample, because this should only have the cover the time between
 	// the above deletes and any in-progress connectChannel goroutine startup.
 	go func() {
+		timeout := time.NewTimer(5 * time.Second)
+		defer timeout.Stop()
 		for {
 			select {
 			case <-mach.ModActive:
 				continue
 			case msg := <-mach.Translate:
-				msg.Reply <- ""
-			case <-time.After(5 * time.Second):
+				msg.Reply <- providers.TranslateReply{Err: mach.err}
+			case <-timeout.C:
 				return
 			}
 		}
 	}()
 }
 
+// abandonMachines gives up on machines that did not stop within the shutdown
+// timeout, so the Manager loop can exit. They are reported in the stop
+// summary, and remain in the state file so they can be recovered later.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) abandonMachines() {
+	for mach := range mgr.machines {
+		desc := fmt.Sprintf("target '%s': machine did not stop within the shutdown timeout", mach.target)
+		if id := mach.InstanceID(); id != "" {
+			desc = fmt.Sprintf("target '%s': instance '%s' did not stop within the shutdown timeout", mach.target, id)
+		}
+		log.Printf("Giving up waiting for machine for target '%s' to stop\n", mach.target)
+		mgr.stopErrors = append(mgr.stopErrors, desc)
+		delete(mgr.machines, mach)
+	}
+}
+
+// logStopSummary logs any errors reported while stopping machines, so
+// operators know to check for resources that may have been left behind.
+//
+// Runs on the Manager message loop goroutine, once all machines stopped.
+func (mgr *Manager) logStopSummary() {
+	if len(mgr.stopErrors) == 0 {
+		log.Printf("All machines stopped cleanly\n")
+		return
+	}
+	log.Printf("%d error(s) while stopping machines, resources may have been left behind:\n", len(mgr.stopErrors))
+	for _, desc := range mgr.stopErrors {
+		log.Printf("- %s\n", desc)
+	}
+}
+
+// logHeartbeat logs the uptime and connection count of every running machine.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) logHeartbeat() {
+	for mach := range mgr.machines {
+		uptime := time.Since(mach.started).Round(time.Second)
+		log.Printf("Machine for target '%s' up for %s with %d active connection(s)\n", mach.target, uptime, mach.conns)
+	}
+}
+
+// stopIdleMachines stops machines for shutdown, except those with active
+// connections, so in-flight transfers have a chance to complete. Those
+// machines are stopped once their last connection closes. Machines that are
+// not ready yet are stopped regardless, because none of their connections
+// transferred data yet.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) stopIdleMachines() {
+	active := 0
+	for mach := range mgr.machines {
+		if mach.conns > 0 && atomic.LoadInt32(&mach.ready) != 0 {
+			active += mach.conns
+			mgr.removeShared(mach)
+		} else {
+			mgr.stopMachine(mach)
+		}
+	}
+	if active > 0 {
+		log.Printf("Waiting for %d active connection(s) to close before stopping their machines\n", active)
+	}
+}
+
+// stopMachine sends a Stop message to a machine, if not already sent.
+//
+// Runs on the Manager message loop goroutine. The machine is no longer
+// considered for new connections.
+func (mgr *Manager) stopMachine(mach *machine) {
+	if mach.stopping {
+		return
+	}
+	mach.stopping = true
+	mach.Stop <- struct{}{}
+	mgr.removeShared(mach)
+}
+
+// removeShared removes a machine from sharedMachines, if present.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) removeShared(mach *machine) {
+	if !mach.shared {
+		return
+	}
+	pool := mgr.sharedMachines[mach.target]
+	for i, shared := range pool {
+		if shared == mach {
+			pool = append(pool[:i], pool[i+1:]...)
+			break
+		}
+	}
+	if len(pool) == 0 {
+		delete(mgr.sharedMachines, mach.target)
+	} else {
+		mgr.sharedMachines[mach.target] = pool
+	}
+}
+
+// copyBuffer copies from src to dst using a buffer from the pool.
+func copyBuffer(dst io.Writer, src io.Reader, bufPool *sync.Pool) {
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+
+	// Hide ReaderFrom and WriterTo implementations, because net.TCPConn falls
+	// back to io.Copy with its own small buffer when the other side is not a
+	// socket, which an SSH channel never is.
+	io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
 func incActive(mach *machine) {
 	mach.ModActive <- +1
 }
@@ -0,0 +1,653 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephank/lazyssh/metrics"
+	"github.com/stephank/lazyssh/providers/mock"
+	"golang.org/x/crypto/ssh"
+)
+
+// waitTimeout bounds every wait in these tests, so a broken Manager fails the
+// test instead of hanging it.
+const waitTimeout = 5 * time.Second
+
+// testNewChannel is an ssh.NewChannel for a direct-tcpip channel, as if opened
+// by an SSH client.
+type testNewChannel struct {
+	extra    []byte
+	accepted chan *testChannel
+	rejected chan string
+}
+
+// testChannel is the ssh.Channel the Manager receives when it accepts a
+// testNewChannel. The test side uses the client methods.
+type testChannel struct {
+	inR  *io.PipeReader
+	inW  *io.PipeWriter
+	outR *io.PipeReader
+	outW *io.PipeWriter
+}
+
+func (nc *testNewChannel) ChannelType() string {
+	return "direct-tcpip"
+}
+
+func (nc *testNewChannel) ExtraData() []byte {
+	return nc.extra
+}
+
+func (nc *testNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	ch := &testChannel{}
+	ch.inR, ch.inW = io.Pipe()
+	ch.outR, ch.outW = io.Pipe()
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	nc.accepted <- ch
+	return ch, reqs, nil
+}
+
+func (nc *testNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	nc.rejected <- message
+	return nil
+}
+
+// wait returns the channel once accepted, or fails the test if rejected.
+func (nc *testNewChannel) wait(t *testing.T) *testChannel {
+	t.Helper()
+	select {
+	case ch := <-nc.accepted:
+		return ch
+	case reason := <-nc.rejected:
+		t.Fatalf("channel rejected: %s", reason)
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for channel to be accepted")
+	}
+	return nil
+}
+
+// waitRejected returns the rejection reason, or fails the test if accepted.
+func (nc *testNewChannel) waitRejected(t *testing.T) string {
+	t.Helper()
+	select {
+	case ch := <-nc.accepted:
+		ch.Close()
+		t.Fatalf("channel accepted, expected a rejection")
+	case reason := <-nc.rejected:
+		return reason
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for channel to be rejected")
+	}
+	return ""
+}
+
+func (ch *testChannel) Read(p []byte) (int, error) {
+	return ch.inR.Read(p)
+}
+
+func (ch *testChannel) Write(p []byte) (int, error) {
+	return ch.outW.Write(p)
+}
+
+func (ch *testChannel) Close() error {
+	ch.inR.Close()
+	ch.outW.Close()
+	return nil
+}
+
+func (ch *testChannel) CloseWrite() error {
+	return ch.outW.Close()
+}
+
+func (ch *testChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (ch *testChannel) Stderr() io.ReadWriter {
+	return &bytes.Buffer{}
+}
+
+// clientWrite writes data as the SSH client.
+func (ch *testChannel) clientWrite(p []byte) (int, error) {
+	return ch.inW.Write(p)
+}
+
+// clientRead reads data as the SSH client.
+func (ch *testChannel) clientRead(p []byte) (int, error) {
+	return ch.outR.Read(p)
+}
+
+// clientClose closes the client side, and waits for the Manager to close the
+// other direction, which happens once the connection is torn down.
+func (ch *testChannel) clientClose(t *testing.T) {
+	t.Helper()
+	ch.inW.Close()
+	done := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(ch.outR)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for connection to close")
+	}
+}
+
+// roundTrip checks data makes it to the echo server and back.
+func (ch *testChannel) roundTrip(t *testing.T) {
+	t.Helper()
+	if _, err := ch.clientWrite([]byte("ping")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(struct{ io.Reader }{readerFunc(ch.clientRead)}, buf); err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("expected echo of 'ping', got '%s'", buf)
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (fn readerFunc) Read(p []byte) (int, error) {
+	return fn(p)
+}
+
+// startEchoServer starts a TCP server on loopback that echoes data back, and
+// half-closes once the client half-closes. Returns the port.
+func startEchoServer(t *testing.T) uint32 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	return uint32(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// openChannel sends a new direct-tcpip channel for target and port to the
+// Manager.
+func openChannel(mgr *Manager, target string, port uint32) *testNewChannel {
+	nc := &testNewChannel{
+		extra: ssh.Marshal(&channelOpenDirectMsg{
+			RemoteAddr: target,
+			RemotePort: port,
+			LocalAddr:  "127.0.0.1",
+			LocalPort:  50000,
+		}),
+		accepted: make(chan *testChannel, 1),
+		rejected: make(chan string, 1),
+	}
+	mgr.NewChannel(nc, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000})
+	return nc
+}
+
+// stopManager calls Stop, and fails the test if it does not return in time.
+func stopManager(t *testing.T, mgr *Manager) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		mgr.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for Manager to stop")
+	}
+}
+
+// eventually polls cond until it is true, or fails the test.
+func eventually(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for: %s", desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startFailures returns the start failure count of a mock target from the
+// metrics endpoint. Metrics are global, so tests compare counts before and
+// after.
+func startFailures(target string) int {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	prefix := fmt.Sprintf("lazyssh_machine_start_failures_total{target=\"%s\",provider=\"mock\"} ", target)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			var count int
+			fmt.Sscanf(strings.TrimPrefix(line, prefix), "%d", &count)
+			return count
+		}
+	}
+	return 0
+}
+
+// countMachines returns the number of machines of a target in Status.
+func countMachines(mgr *Manager, target string) int {
+	for _, status := range mgr.Status().Targets {
+		if status.Addr == target {
+			return len(status.Machines)
+		}
+	}
+	return 0
+}
+
+func TestSharedMachineReuse(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", Shared: true, Linger: time.Hour}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+
+	ch1 := openChannel(mgr, "test", port).wait(t)
+	ch1.roundTrip(t)
+	ch2 := openChannel(mgr, "test", port).wait(t)
+	ch2.roundTrip(t)
+	ch1.clientClose(t)
+	ch2.clientClose(t)
+
+	// The machine lingers, so a later connection reuses it too.
+	ch3 := openChannel(mgr, "test", port).wait(t)
+	ch3.roundTrip(t)
+	ch3.clientClose(t)
+
+	if counts := prov.Counts(); counts.Started != 1 {
+		t.Fatalf("expected 1 machine started, got %d", counts.Started)
+	}
+
+	stopManager(t, mgr)
+	if counts := prov.Counts(); counts.Running != 0 || counts.Stopped != 1 {
+		t.Fatalf("expected the machine to be stopped, got %+v", counts)
+	}
+}
+
+func TestLingerStopsIdleMachine(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", Shared: true, Linger: 50 * time.Millisecond}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+	defer stopManager(t, mgr)
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	ch.roundTrip(t)
+	ch.clientClose(t)
+
+	eventually(t, "machine to stop after linger", func() bool {
+		return prov.Counts().Stopped == 1 && countMachines(mgr, "test") == 0
+	})
+
+	// A new connection starts a new machine.
+	ch = openChannel(mgr, "test", port).wait(t)
+	ch.roundTrip(t)
+	ch.clientClose(t)
+	if counts := prov.Counts(); counts.Started != 2 {
+		t.Fatalf("expected 2 machines started, got %d", counts.Started)
+	}
+}
+
+func TestUnsharedMachinePerConnection(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1"}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+
+	ch1 := openChannel(mgr, "test", port).wait(t)
+	ch2 := openChannel(mgr, "test", port).wait(t)
+	ch1.roundTrip(t)
+	ch2.roundTrip(t)
+	if counts := prov.Counts(); counts.Started != 2 {
+		t.Fatalf("expected 2 machines started, got %d", counts.Started)
+	}
+
+	ch1.clientClose(t)
+	ch2.clientClose(t)
+	stopManager(t, mgr)
+	if counts := prov.Counts(); counts.Running != 0 {
+		t.Fatalf("expected no running machines, got %d", counts.Running)
+	}
+}
+
+func TestMaxConnectionsPerMachine(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", Shared: true, Linger: time.Hour}
+	mgr := NewManager(Targets{"test": {
+		Provider:                 prov,
+		Type:                     "mock",
+		MaxConnectionsPerMachine: 1,
+	}}, Options{})
+	defer stopManager(t, mgr)
+
+	ch1 := openChannel(mgr, "test", port).wait(t)
+	ch2 := openChannel(mgr, "test", port).wait(t)
+	ch1.roundTrip(t)
+	ch2.roundTrip(t)
+	if counts := prov.Counts(); counts.Started != 2 {
+		t.Fatalf("expected 2 machines started, got %d", counts.Started)
+	}
+
+	// Once a machine has room again, it is reused.
+	ch1.clientClose(t)
+	eventually(t, "connection to be released", func() bool {
+		conns := 0
+		for _, status := range mgr.Status().Targets {
+			for _, mach := range status.Machines {
+				conns += mach.Connections
+			}
+		}
+		return conns == 1
+	})
+	ch3 := openChannel(mgr, "test", port).wait(t)
+	ch3.roundTrip(t)
+	if counts := prov.Counts(); counts.Started != 2 {
+		t.Fatalf("expected 2 machines started, got %d", counts.Started)
+	}
+
+	ch2.clientClose(t)
+	ch3.clientClose(t)
+}
+
+func TestMaxStartingQueuesChannels(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", StartDelay: 100 * time.Millisecond}
+	mgr := NewManager(Targets{"test": {
+		Provider:    prov,
+		Type:        "mock",
+		MaxStarting: 1,
+	}}, Options{})
+	defer stopManager(t, mgr)
+
+	nc1 := openChannel(mgr, "test", port)
+	nc2 := openChannel(mgr, "test", port)
+	if n := countMachines(mgr, "test"); n != 1 {
+		t.Fatalf("expected 1 machine while the second channel is queued, got %d", n)
+	}
+
+	ch1 := nc1.wait(t)
+	ch2 := nc2.wait(t)
+	ch1.roundTrip(t)
+	ch2.roundTrip(t)
+	if n := countMachines(mgr, "test"); n != 2 {
+		t.Fatalf("expected 2 machines once the queue is processed, got %d", n)
+	}
+
+	ch1.clientClose(t)
+	ch2.clientClose(t)
+}
+
+func TestStartFailureRejectsChannel(t *testing.T) {
+	prov := &mock.Provider{
+		Addr:     "127.0.0.1",
+		StartErr: func() error { return errors.New("out of capacity") },
+	}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+	defer stopManager(t, mgr)
+	failures := startFailures("test")
+
+	reason := openChannel(mgr, "test", 22).waitRejected(t)
+	if reason != "out of capacity" {
+		t.Fatalf("expected the start error as reason, got '%s'", reason)
+	}
+	eventually(t, "failed machine to be removed", func() bool {
+		return countMachines(mgr, "test") == 0
+	})
+	if count := startFailures("test"); count != failures+1 {
+		t.Fatalf("expected the start failure to be counted, got %d after %d", count, failures)
+	}
+}
+
+func TestUnknownTargetRejected(t *testing.T) {
+	prov := &mock.Provider{Addr: "127.0.0.1"}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+	defer stopManager(t, mgr)
+
+	reason := openChannel(mgr, "other", 22).waitRejected(t)
+	if reason != "unknown remote address" {
+		t.Fatalf("unexpected reason '%s'", reason)
+	}
+	if counts := prov.Counts(); counts.Started != 0 {
+		t.Fatalf("expected no machines started, got %d", counts.Started)
+	}
+}
+
+func TestShutdownDuringStart(t *testing.T) {
+	prov := &mock.Provider{Addr: "127.0.0.1", StartDelay: time.Hour}
+	mgr := NewManager(Targets{"test": {
+		Provider:    prov,
+		Type:        "mock",
+		MaxStarting: 1,
+	}}, Options{})
+	failures := startFailures("test")
+
+	// One channel waits for a machine that never finishes starting, another is
+	// queued behind it.
+	nc1 := openChannel(mgr, "test", 22)
+	nc2 := openChannel(mgr, "test", 22)
+	eventually(t, "machine to start", func() bool {
+		return prov.Counts().Started == 1
+	})
+
+	stopManager(t, mgr)
+	nc1.waitRejected(t)
+	if reason := nc2.waitRejected(t); reason != "this server is shutting down" {
+		t.Fatalf("unexpected reason for queued channel '%s'", reason)
+	}
+	if counts := prov.Counts(); counts.Running != 0 || counts.Started != 1 {
+		t.Fatalf("expected the starting machine to be stopped, got %+v", counts)
+	}
+	if count := startFailures("test"); count != failures {
+		t.Fatalf("expected no start failure for a stop on shutdown, got %d after %d", count, failures)
+	}
+}
+
+func TestShutdownRejectsNewChannels(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{
+		Addr:      "127.0.0.1",
+		Shared:    true,
+		Linger:    time.Hour,
+		StopDelay: time.Second,
+	}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	ch.roundTrip(t)
+	ch.clientClose(t)
+
+	// While the machine takes its time to stop, new channels are rejected
+	// instead of reusing it.
+	done := make(chan struct{})
+	go func() {
+		mgr.Stop()
+		close(done)
+	}()
+	eventually(t, "shutdown to begin", func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+		}
+		nc := openChannel(mgr, "test", port)
+		select {
+		case reason := <-nc.rejected:
+			// A channel that raced the Stop call may instead be rejected by the
+			// stopping machine.
+			return reason == "this server is shutting down"
+		case ch := <-nc.accepted:
+			ch.clientClose(t)
+			return false
+		}
+	})
+
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for Manager to stop")
+	}
+	if counts := prov.Counts(); counts.Started != 1 || counts.Running != 0 {
+		t.Fatalf("expected one machine, stopped, got %+v", counts)
+	}
+}
+
+// startIdleMachines starts a lingering machine for every target, and leaves it
+// without connections.
+func startIdleMachines(t *testing.T, mgr *Manager, targets []string, port uint32) {
+	t.Helper()
+	for _, target := range targets {
+		ch := openChannel(mgr, target, port).wait(t)
+		ch.roundTrip(t)
+		ch.clientClose(t)
+	}
+}
+
+func TestShutdownStopsMachinesConcurrently(t *testing.T) {
+	port := startEchoServer(t)
+	fast := &mock.Provider{Addr: "127.0.0.1", Shared: true, Linger: time.Hour}
+	slow := &mock.Provider{
+		Addr:      "127.0.0.1",
+		Shared:    true,
+		Linger:    time.Hour,
+		StopDelay: 500 * time.Millisecond,
+	}
+	names := []string{"fast1", "fast2", "slow1", "slow2", "slow3"}
+	mgr := NewManager(Targets{
+		"fast1": {Provider: fast, Type: "mock"},
+		"fast2": {Provider: fast, Type: "mock"},
+		"slow1": {Provider: slow, Type: "mock"},
+		"slow2": {Provider: slow, Type: "mock"},
+		"slow3": {Provider: slow, Type: "mock"},
+	}, Options{ShutdownTimeout: time.Minute})
+	startIdleMachines(t, mgr, names, port)
+
+	// Slow machines stopping one after another would take 1.5 seconds.
+	start := time.Now()
+	stopManager(t, mgr)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Fatalf("expected machines to stop concurrently, but shutdown took %s", elapsed)
+	}
+	if counts := fast.Counts(); counts.Running != 0 || counts.Stopped != 2 {
+		t.Fatalf("expected fast machines to be stopped, got %+v", counts)
+	}
+	if counts := slow.Counts(); counts.Running != 0 || counts.Stopped != 3 {
+		t.Fatalf("expected slow machines to be stopped, got %+v", counts)
+	}
+	if len(mgr.stopErrors) != 0 {
+		t.Fatalf("expected no stop errors, got %v", mgr.stopErrors)
+	}
+}
+
+func TestShutdownTimeoutAbandonsSlowMachines(t *testing.T) {
+	port := startEchoServer(t)
+	fast := &mock.Provider{Addr: "127.0.0.1", Shared: true, Linger: time.Hour}
+	stuck := &mock.Provider{
+		Addr:      "127.0.0.1",
+		Shared:    true,
+		Linger:    time.Hour,
+		StopDelay: 10 * time.Second,
+	}
+	mgr := NewManager(Targets{
+		"fast":  {Provider: fast, Type: "mock"},
+		"stuck": {Provider: stuck, Type: "mock"},
+	}, Options{ShutdownTimeout: 300 * time.Millisecond})
+	startIdleMachines(t, mgr, []string{"fast", "stuck"}, port)
+
+	start := time.Now()
+	stopManager(t, mgr)
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Fatalf("expected shutdown to be bounded by the timeout, but it took %s", elapsed)
+	}
+	if counts := fast.Counts(); counts.Running != 0 {
+		t.Fatalf("expected the fast machine to be stopped, got %+v", counts)
+	}
+	if len(mgr.stopErrors) != 1 || mgr.stopErrors[0] != "target 'stuck': instance 'mock-1' did not stop within the shutdown timeout" {
+		t.Fatalf("expected the stuck machine to be reported, got %v", mgr.stopErrors)
+	}
+}
+
+func TestShutdownWaitsForActiveConnections(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", Shared: true}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{ShutdownTimeout: time.Minute})
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	ch.roundTrip(t)
+
+	done := make(chan struct{})
+	go func() {
+		mgr.Stop()
+		close(done)
+	}()
+
+	// The connection keeps working, and shutdown completes once it closes.
+	ch.roundTrip(t)
+	select {
+	case <-done:
+		t.Fatalf("Manager stopped while a connection was active")
+	case <-time.After(100 * time.Millisecond):
+	}
+	ch.clientClose(t)
+	select {
+	case <-done:
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for Manager to stop")
+	}
+	if counts := prov.Counts(); counts.Running != 0 {
+		t.Fatalf("expected the machine to be stopped, got %+v", counts)
+	}
+}
+
+func TestShutdownClosesConnectionsAfterTimeout(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", Shared: true}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{ShutdownTimeout: 400 * time.Millisecond})
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	ch.roundTrip(t)
+
+	// The connection is never closed by the client, so the machine is stopped
+	// after half the shutdown timeout.
+	stopManager(t, mgr)
+	if counts := prov.Counts(); counts.Running != 0 || counts.Stopped != 1 {
+		t.Fatalf("expected the machine to be stopped, got %+v", counts)
+	}
+	ch.Close()
+}
+
+func TestShutdownWithoutTimeoutStopsImmediately(t *testing.T) {
+	port := startEchoServer(t)
+	prov := &mock.Provider{Addr: "127.0.0.1", Shared: true}
+	mgr := NewManager(Targets{"test": {Provider: prov, Type: "mock"}}, Options{})
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	ch.roundTrip(t)
+
+	// Without a shutdown timeout, an open connection does not hold up Stop.
+	stopManager(t, mgr)
+	if counts := prov.Counts(); counts.Running != 0 || counts.Stopped != 1 {
+		t.Fatalf("expected the machine to be stopped, got %+v", counts)
+	}
+	ch.Close()
+}
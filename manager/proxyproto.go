@@ -0,0 +1,45 @@
+package manager
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// proxySignature starts every PROXY protocol v2 header.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader builds a PROXY protocol v2 header, which tells the upstream
+// the address of the SSH client. If either address is not a TCP address, a
+// LOCAL header is built instead, which tells the upstream to use the
+// connection addresses.
+func proxyHeader(client net.Addr, upstream net.Addr) []byte {
+	header := append([]byte{}, proxySignature...)
+
+	src, srcOk := client.(*net.TCPAddr)
+	dst, dstOk := upstream.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		// Version 2, command LOCAL, family UNSPEC, no addresses.
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	// Version 2, command PROXY. Use IPv4 only if both addresses are IPv4,
+	// otherwise map to IPv6.
+	header = append(header, 0x21)
+	var addrs []byte
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		header = append(header, 0x11) // TCP over IPv4
+		addrs = append(append(addrs, src4...), dst4...)
+	} else {
+		header = append(header, 0x21) // TCP over IPv6
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+	addrs = append(addrs, ports[:]...)
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(addrs)))
+	header = append(header, length[:]...)
+	return append(header, addrs...)
+}
@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	for _, tc := range []struct {
+		name     string
+		client   net.Addr
+		upstream net.Addr
+		expected string
+	}{
+		{
+			name:     "ipv4",
+			client:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000},
+			upstream: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 22},
+			expected: sig + "\x21\x11\x00\x0c" +
+				"\xc0\x00\x02\x01" + "\x0a\x00\x00\x02" +
+				"\xc3\x50" + "\x00\x16",
+		},
+		{
+			name:     "ipv6",
+			client:   &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+			upstream: &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 2222},
+			expected: sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xfd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xc3\x50" + "\x08\xae",
+		},
+		{
+			name:     "mixed",
+			client:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000},
+			upstream: &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 22},
+			expected: sig + "\x21\x21\x00\x24" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc0\x00\x02\x01" +
+				"\xfd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xc3\x50" + "\x00\x16",
+		},
+		{
+			name:     "unix upstream",
+			client:   &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000},
+			upstream: &net.UnixAddr{Name: "/run/sshd.sock", Net: "unix"},
+			expected: sig + "\x20\x00\x00\x00",
+		},
+		{
+			name:     "non-tcp client",
+			client:   &net.UnixAddr{Name: "@", Net: "unix"},
+			upstream: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 22},
+			expected: sig + "\x20\x00\x00\x00",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			header := proxyHeader(tc.client, tc.upstream)
+			if !bytes.Equal(header, []byte(tc.expected)) {
+				t.Fatalf("expected header:\n%x\ngot:\n%x", tc.expected, header)
+			}
+		})
+	}
+}
+
+// With 'send_proxy_protocol', the upstream receives the header before any
+// client data.
+func TestProxyHeaderSent(t *testing.T) {
+	received := make(chan []byte, 1)
+	port := startServer(t, func(conn *net.TCPConn) {
+		data, _ := ioutil.ReadAll(conn)
+		received <- data
+	})
+	target := newForward(t, "to = \"127.0.0.1\"\nsend_proxy_protocol = true")
+	mgr := NewManager(Targets{"test": target}, Options{})
+	defer stopManager(t, mgr)
+
+	ch := openChannel(mgr, "test", port).wait(t)
+	if _, err := ch.clientWrite([]byte("SSH-2.0-test\r\n")); err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	ch.inW.Close()
+
+	// openChannel uses client address 127.0.0.1:50000.
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"+
+		"\x7f\x00\x00\x01\x7f\x00\x00\x01\xc3\x50"), byte(port>>8), byte(port))
+	expected = append(expected, "SSH-2.0-test\r\n"...)
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("expected upstream to receive:\n%x\ngot:\n%x", expected, data)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for upstream to receive data")
+	}
+}
@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// stateEntry is a running machine as recorded in the state file.
+type stateEntry struct {
+	Target string `json:"target"`
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+}
+
+// stateFileContents is the JSON structure of the state file.
+type stateFileContents struct {
+	Machines []stateEntry `json:"machines"`
+}
+
+// stateFile persists the instance IDs of running machines, so they can be
+// recovered after a restart.
+//
+// Unlike most Manager state, this is accessed from Provider goroutines, so
+// is protected by a mutex.
+type stateFile struct {
+	path    string
+	mu      sync.Mutex
+	entries map[*machine]stateEntry
+}
+
+// Read the state file, if it exists.
+func loadStateFile(path string) ([]stateEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents := stateFileContents{}
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, err
+	}
+	return contents.Machines, nil
+}
+
+// Record the instance ID of a machine, and write the state file.
+func (sf *stateFile) record(mach *machine, entry stateEntry) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	sf.entries[mach] = entry
+	sf.write()
+}
+
+// Remove a machine from the state file, if present.
+func (sf *stateFile) remove(mach *machine) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if _, ok := sf.entries[mach]; ok {
+		delete(sf.entries, mach)
+		sf.write()
+	}
+}
+
+// Write the state file. The mutex must be held.
+//
+// Writes to a temporary file first, then renames, so the state file is never
+// partially written.
+func (sf *stateFile) write() {
+	contents := stateFileContents{Machines: make([]stateEntry, 0, len(sf.entries))}
+	for _, entry := range sf.entries {
+		contents.Machines = append(contents.Machines, entry)
+	}
+	sort.Slice(contents.Machines, func(i, j int) bool {
+		a, b := contents.Machines[i], contents.Machines[j]
+		return a.Target < b.Target || (a.Target == b.Target && a.ID < b.ID)
+	})
+
+	data, err := json.MarshalIndent(&contents, "", "  ")
+	if err != nil {
+		log.Printf("Could not encode state file: %s\n", err.Error())
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(sf.path), ".lazyssh-state-")
+	if err != nil {
+		log.Printf("Could not write state file: %s\n", err.Error())
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sf.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Could not write state file: %s\n", err.Error())
+	}
+}
+
+// machineRecorder implements providers.InstanceRecorder for a machine.
+type machineRecorder struct {
+	file *stateFile
+	mach *machine
+	typ  string
+}
+
+func (rec *machineRecorder) RecordInstance(id string) {
+	rec.file.record(rec.mach, stateEntry{
+		Target: rec.mach.target,
+		Type:   rec.typ,
+		ID:     id,
+	})
+}
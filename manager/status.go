@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Status is a snapshot of the Manager state, returned by Manager.Status.
+//
+// This is also the JSON format of the 'status' control command.
+type Status struct {
+	// Drain is the drain mode, one of: off, machines, connections
+	Drain   string          `json:"drain"`
+	Targets []*TargetStatus `json:"targets"`
+}
+
+// TargetStatus is the status of a single target.
+type TargetStatus struct {
+	Addr     string           `json:"addr"`
+	Type     string           `json:"type"`
+	Machines []*MachineStatus `json:"machines"`
+}
+
+// MachineStatus is the status of a single machine.
+type MachineStatus struct {
+	// State is one of: starting, running, stopping
+	State       string    `json:"state"`
+	Shared      bool      `json:"shared"`
+	Connections int       `json:"connections"`
+	Started     time.Time `json:"started"`
+	// InstanceID is the ID set by the Provider, if any.
+	InstanceID string `json:"instance_id,omitempty"`
+	// Info holds provider-specific details, if any. See Machine.SetInfo.
+	Info map[string]string `json:"info,omitempty"`
+}
+
+// stopTargetMsg is the message sent to the Manager goroutine by StopTarget.
+type stopTargetMsg struct {
+	target string
+	reply  chan error
+}
+
+// Status returns a snapshot of the Manager state.
+func (mgr *Manager) Status() *Status {
+	replyCh := make(chan *Status)
+	mgr.status <- replyCh
+	return <-replyCh
+}
+
+// StopTarget instructs the Manager to stop all machines of a target.
+//
+// This does not wait for the machines to stop. An error is returned if the
+// target address is not known.
+func (mgr *Manager) StopTarget(target string) error {
+	msg := &stopTargetMsg{target, make(chan error)}
+	mgr.stopTarget <- msg
+	return <-msg.reply
+}
+
+// handleStatus builds a Status snapshot.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) handleStatus() *Status {
+	index := make(map[string]*TargetStatus)
+	status := &Status{Drain: mgr.drainMode.String()}
+	for addr, target := range mgr.targets {
+		targetStatus := &TargetStatus{
+			Addr:     addr,
+			Type:     target.Type,
+			Machines: []*MachineStatus{},
+		}
+		index[addr] = targetStatus
+		status.Targets = append(status.Targets, targetStatus)
+	}
+	sort.Slice(status.Targets, func(i, j int) bool {
+		return status.Targets[i].Addr < status.Targets[j].Addr
+	})
+
+	for mach := range mgr.machines {
+		state := "starting"
+		if mach.stopping {
+			state = "stopping"
+		} else if atomic.LoadInt32(&mach.ready) != 0 {
+			state = "running"
+		}
+		targetStatus := index[mach.target]
+		targetStatus.Machines = append(targetStatus.Machines, &MachineStatus{
+			State:       state,
+			Shared:      mach.shared,
+			Connections: mach.conns,
+			Started:     mach.started,
+			InstanceID:  mach.InstanceID(),
+			Info:        mach.Info(),
+		})
+	}
+	for _, targetStatus := range status.Targets {
+		machines := targetStatus.Machines
+		sort.Slice(machines, func(i, j int) bool {
+			return machines[i].Started.Before(machines[j].Started)
+		})
+	}
+
+	return status
+}
+
+// handleStopTarget stops all machines of a target.
+//
+// Runs on the Manager message loop goroutine.
+func (mgr *Manager) handleStopTarget(target string) error {
+	if _, ok := mgr.targets[target]; !ok {
+		return fmt.Errorf("unknown target '%s'", target)
+	}
+	for mach := range mgr.machines {
+		if mach.target == target {
+			mgr.stopMachine(mach)
+		}
+	}
+	return nil
+}
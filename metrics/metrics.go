@@ -0,0 +1,148 @@
+/*
+Package metrics implements a small set of LazySSH metrics, exposed in the
+Prometheus text format.
+
+Metrics are always collected, and served by Handler. Every metric is labeled
+with the target address and provider type.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startBuckets are the upper bounds in seconds of the start duration
+// histogram buckets. Machines take anywhere from seconds to minutes to start,
+// depending on the provider.
+var startBuckets = []float64{1, 2, 5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600}
+
+// labels identifies a series by target address and provider type.
+type labels struct {
+	target   string
+	provider string
+}
+
+// histogram holds cumulative bucket counts, like a Prometheus histogram.
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+var (
+	mu             sync.Mutex
+	startDurations = make(map[labels]*histogram)
+	startFailures  = make(map[labels]uint64)
+)
+
+// ObserveStart records the time a machine took from start until it was ready
+// for connections.
+//
+// Safe to call from any goroutine.
+func ObserveStart(target string, provider string, duration time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	key := labels{target, provider}
+	hist, ok := startDurations[key]
+	if !ok {
+		hist = &histogram{buckets: make([]uint64, len(startBuckets))}
+		startDurations[key] = hist
+	}
+	seconds := duration.Seconds()
+	for i, bound := range startBuckets {
+		if seconds <= bound {
+			hist.buckets[i]++
+		}
+	}
+	hist.sum += seconds
+	hist.count++
+}
+
+// IncStartFailure counts a machine that failed with an error before it was
+// ready for connections.
+//
+// Safe to call from any goroutine.
+func IncStartFailure(target string, provider string) {
+	mu.Lock()
+	defer mu.Unlock()
+	startFailures[labels{target, provider}]++
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write writes the metrics in the Prometheus text format.
+func Write(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP lazyssh_machine_start_duration_seconds Time from machine start until it is ready for connections.\n")
+	fmt.Fprintf(w, "# TYPE lazyssh_machine_start_duration_seconds histogram\n")
+	for _, key := range sortedKeys(startDurations) {
+		hist := startDurations[key]
+		for i, bound := range startBuckets {
+			fmt.Fprintf(w, "lazyssh_machine_start_duration_seconds_bucket{%s,le=\"%s\"} %d\n", key, formatFloat(bound), hist.buckets[i])
+		}
+		fmt.Fprintf(w, "lazyssh_machine_start_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", key, hist.count)
+		fmt.Fprintf(w, "lazyssh_machine_start_duration_seconds_sum{%s} %s\n", key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "lazyssh_machine_start_duration_seconds_count{%s} %d\n", key, hist.count)
+	}
+
+	fmt.Fprintf(w, "# HELP lazyssh_machine_start_failures_total Machines that failed with an error before they were ready for connections.\n")
+	fmt.Fprintf(w, "# TYPE lazyssh_machine_start_failures_total counter\n")
+	keys := make([]labels, 0, len(startFailures))
+	for key := range startFailures {
+		keys = append(keys, key)
+	}
+	sortLabels(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "lazyssh_machine_start_failures_total{%s} %d\n", key, startFailures[key])
+	}
+}
+
+// String formats the labels for a series, without braces.
+func (key labels) String() string {
+	return fmt.Sprintf("target=\"%s\",provider=\"%s\"", escape(key.target), escape(key.provider))
+}
+
+// Sort the keys of a histogram map, for stable output.
+func sortedKeys(m map[labels]*histogram) []labels {
+	keys := make([]labels, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sortLabels(keys)
+	return keys
+}
+
+func sortLabels(keys []labels) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].target != keys[j].target {
+			return keys[i].target < keys[j].target
+		}
+		return keys[i].provider < keys[j].provider
+	})
+}
+
+// escaper escapes label values, as required by the text format.
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
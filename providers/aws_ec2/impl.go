@@ -3,22 +3,37 @@
 package aws_ec2
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
 	"golang.org/x/net/context"
 
 	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
 )
 
 func init() {
@@ -28,41 +43,142 @@ func init() {
 type Factory struct{}
 
 type Provider struct {
-	BlockDeviceMappings []*types.BlockDeviceMapping
+	BlockDeviceMappings []types.BlockDeviceMapping
+	RootVolume          *types.EbsBlockDevice
 	AttachVolumes       []*ec2.AttachVolumeInput
 	IamInstanceProfile  *types.IamInstanceProfileSpecification
 	ImageId             string
-	InstanceType        types.InstanceType
+	InstanceId          string
+	InstanceTypes       []types.InstanceType
+	AvailabilityZones   []string
 	KeyName             string
-	Placement           *types.Placement
+	MetadataOptions     *types.InstanceMetadataOptionsRequest
+	InstanceConnect     *instanceConnect
+	TagSpecifications   []types.TagSpecification
 	SubnetId            *string
+	SubnetIds           []string
+	SubnetOrder         string
+	AssociatePublicIp   *bool
+	ElasticIpAllocId    *string
 	UserData64          *string
+	CheckAddr           *string
 	CheckPort           uint16
+	Check               *providers.ConnectivityCheck
+	UsePrivateIp        bool
+	PrivateIpFallback   bool
+	StartRetries        int
+	Target              string
+	GcOnStart           bool
+	GcMinAge            time.Duration
+	AdoptExisting       bool
+	AdoptFilters        []types.Filter
+	TerminateAdopted    bool
+	OnIdle              string
+	TerminateOnShutdown bool
+	HibernationOptions  *types.HibernationOptionsRequest
 	Shared              bool
 	Linger              time.Duration
+	MinUptime           time.Duration
+	MonitorInterval     time.Duration
+	StartTimeout        time.Duration
+	RequestTimeout      time.Duration
+	AttachTimeout       time.Duration
+	WaitForStatusChecks bool
+	DryRun              bool
+	ConnectVia          string
+	SsmPlugin           string
+	Region              string
 	Ec2                 *ec2.Client
+	Ssm                 *ssm.Client
+
+	// inUseMu protects inUse, the set of instance IDs currently used by a
+	// machine, so that 'adopt_existing' doesn't pick an instance twice.
+	inUseMu sync.Mutex
+	inUse   map[string]bool
 }
 
 type state struct {
 	id   string
 	addr *string
+	// availabilityZone is where the instance runs, for 'instance_connect'.
+	availabilityZone string
+	// keyPushed is when the 'instance_connect' key was last pushed.
+	keyPushed time.Time
+	// adopted is set if the instance was found by 'adopt_existing'.
+	adopted bool
+	// deadline is when the instance must be ready, according to
+	// 'start_timeout'.
+	deadline time.Time
+	// attached holds the IDs of 'attach_volume' volumes attached to the
+	// instance, which are detached before it is terminated.
+	attached []string
+	// ssm holds SSM sessions by instance port, for 'connect_via = "ssm"'.
+	ssm map[uint16]*ssmSession
+	// associationId is set once the 'elastic_ip_allocation_id' address has
+	// been associated with the instance.
+	associationId *string
+	// gone is set if the instance was found terminated while in use, so
+	// there is nothing left to stop.
+	gone bool
 }
 
 type hclTarget struct {
-	EbsBlockDevice     []*hclEbsBlockDevice `hcl:"ebs_block_device,block"`
-	AttachVolumes      []*hclVolume         `hcl:"attach_volume,block"`
-	Placement          *hclPlacement        `hcl:"placement,block"`
-	ImageId            string               `hcl:"image_id,attr"`
-	InstanceType       string               `hcl:"instance_type,attr"`
-	KeyName            string               `hcl:"key_name,attr"`
-	SubnetId           *string              `hcl:"subnet_id,optional"`
-	UserData           *string              `hcl:"user_data,optional"`
-	IamInstanceProfile string               `hcl:"iam_instance_profile,optional"`
-	Profile            *string              `hcl:"profile,optional"`
-	Region             *string              `hcl:"region,optional"`
-	CheckPort          uint16               `hcl:"check_port,optional"`
-	Shared             *bool                `hcl:"shared,optional"`
-	Linger             string               `hcl:"linger,optional"`
+	EbsBlockDevice      []*hclEbsBlockDevice `hcl:"ebs_block_device,block"`
+	RootVolume          *hclRootVolume       `hcl:"root_volume,block"`
+	AttachVolumes       []*hclVolume         `hcl:"attach_volume,block"`
+	Placement           *hclPlacement        `hcl:"placement,block"`
+	AssumeRole          *hclAssumeRole       `hcl:"assume_role,block"`
+	MetadataOptions     *hclMetadataOptions  `hcl:"metadata_options,block"`
+	InstanceConnect     *hclInstanceConnect  `hcl:"instance_connect,block"`
+	ImageId             string               `hcl:"image_id,optional"`
+	InstanceId          string               `hcl:"instance_id,optional"`
+	InstanceType        cty.Value            `hcl:"instance_type,optional"`
+	KeyName             string               `hcl:"key_name,optional"`
+	SubnetId            *string              `hcl:"subnet_id,optional"`
+	SubnetIds           []string             `hcl:"subnet_ids,optional"`
+	SubnetOrder         *string              `hcl:"subnet_order,optional"`
+	AssociatePublicIp   *bool                `hcl:"associate_public_ip,optional"`
+	ElasticIpAllocId    *string              `hcl:"elastic_ip_allocation_id,optional"`
+	UserData            *string              `hcl:"user_data,optional"`
+	UserDataFile        *string              `hcl:"user_data_file,optional"`
+	UserDataBase64      *string              `hcl:"user_data_base64,optional"`
+	Gzip                bool                 `hcl:"gzip,optional"`
+	IamInstanceProfile  string               `hcl:"iam_instance_profile,optional"`
+	Profile             *string              `hcl:"profile,optional"`
+	AccessKeyId         *string              `hcl:"access_key_id,optional"`
+	SecretAccessKey     *string              `hcl:"secret_access_key,optional"`
+	SecretAccessKeyFile *string              `hcl:"secret_access_key_file,optional"`
+	Region              *string              `hcl:"region,optional"`
+	CheckAddr           *string              `hcl:"check_addr,optional"`
+	CheckPort           uint16               `hcl:"check_port,optional"`
+	CheckType           string               `hcl:"check_type,optional"`
+	CheckServerName     string               `hcl:"check_servername,optional"`
+	CheckInsecure       bool                 `hcl:"check_insecure,optional"`
+	CheckCommand        string               `hcl:"check_command,optional"`
+	CheckCommandTimeout string               `hcl:"check_command_timeout,optional"`
+	UsePrivateIp        bool                 `hcl:"use_private_ip,optional"`
+	PrivateIpFallback   bool                 `hcl:"private_ip_fallback,optional"`
+	ConnectVia          string               `hcl:"connect_via,optional"`
+	SsmPlugin           string               `hcl:"ssm_plugin,optional"`
+	StartRetries        int                  `hcl:"start_retries,optional"`
+	GcOnStart           bool                 `hcl:"gc_on_start,optional"`
+	GcMinAge            string               `hcl:"gc_min_age,optional"`
+	AdoptExisting       bool                 `hcl:"adopt_existing,optional"`
+	AdoptFilter         map[string]string    `hcl:"adopt_filter,optional"`
+	TerminateAdopted    *bool                `hcl:"terminate_adopted,optional"`
+	OnIdle              string               `hcl:"on_idle,optional"`
+	TerminateOnShutdown bool                 `hcl:"terminate_on_shutdown,optional"`
+	Shared              *bool                `hcl:"shared,optional"`
+	Linger              string               `hcl:"linger,optional"`
+	MinUptime           string               `hcl:"min_uptime,optional"`
+	MonitorInterval     string               `hcl:"monitor_interval,optional"`
+	StartTimeout        string               `hcl:"start_timeout,optional"`
+	RequestTimeout      string               `hcl:"request_timeout,optional"`
+	AttachTimeout       string               `hcl:"attach_timeout,optional"`
+	WaitForStatusChecks bool                 `hcl:"wait_for_status_checks,optional"`
+	DryRun              bool                 `hcl:"dry_run,optional"`
+	Name                *string              `hcl:"name,optional"`
+	Tags                map[string]string    `hcl:"tags,optional"`
 }
 
 type hclEbsBlockDevice struct {
@@ -74,6 +190,17 @@ type hclEbsBlockDevice struct {
 	SnapshotId          *string `hcl:"snapshot_id,optional"`
 	VolumeSize          *int32  `hcl:"volume_size,optional"`
 	VolumeType          string  `hcl:"volume_type,optional"`
+	Throughput          *int32  `hcl:"throughput,optional"`
+}
+
+// Overrides for the root device of the AMI, see hclEbsBlockDevice.
+type hclRootVolume struct {
+	VolumeSize *int32  `hcl:"volume_size,optional"`
+	VolumeType string  `hcl:"volume_type,optional"`
+	Iops       *int32  `hcl:"iops,optional"`
+	Throughput *int32  `hcl:"throughput,optional"`
+	Encrypted  *bool   `hcl:"encrypted,optional"`
+	KmsKeyId   *string `hcl:"kms_key_id,optional"`
 }
 
 type hclVolume struct {
@@ -83,42 +210,334 @@ type hclVolume struct {
 
 // See https://docs.aws.amazon.com/AWSEC2/latest/APIReference/API_Placement.html
 type hclPlacement struct {
-	AvailabilityZone string `hcl:"availability_zone,optional"`
+	AvailabilityZone cty.Value `hcl:"availability_zone,optional"`
+}
+
+// See https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRole.html
+type hclAssumeRole struct {
+	RoleArn     string  `hcl:"role_arn,attr"`
+	SessionName string  `hcl:"session_name,optional"`
+	ExternalId  *string `hcl:"external_id,optional"`
+	Duration    string  `hcl:"duration,optional"`
+	Validate    bool    `hcl:"validate,optional"`
+}
+
+// See https://docs.aws.amazon.com/AWSEC2/latest/APIReference/API_InstanceMetadataOptionsRequest.html
+type hclMetadataOptions struct {
+	HttpTokens              string `hcl:"http_tokens,optional"`
+	HttpPutResponseHopLimit *int32 `hcl:"http_put_response_hop_limit,optional"`
+	HttpEndpoint            string `hcl:"http_endpoint,optional"`
+	InstanceMetadataTags    string `hcl:"instance_metadata_tags,optional"`
 }
 
-var errAttachVolume = errors.New("failed to attach volume")
+var (
+	errAttachVolume     = errors.New("failed to attach volume")
+	errNoAddress        = errors.New("does not have an IP address to connect to")
+	errAssociateAddress = errors.New("failed to associate Elastic IP address")
+	errDryRunSucceeded  = errors.New("dry run succeeded, the request would have been allowed")
+)
 
-const requestTimeout = 30 * time.Second
+// maxUserDataSize is the EC2 limit on user data, before base64 encoding.
+const maxUserDataSize = 16 * 1024
 
-func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers.Provider, error) {
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
 	parsed := &hclTarget{}
-	diags := gohcl.DecodeBody(hclBlock, nil, parsed)
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
 	if diags.HasErrors() {
 		return nil, diags
 	}
 
-	var cfgMods []config.Config
+	instanceTypes, typeDiags := providers.DecodeStringOrList("instance_type", parsed.InstanceType)
+	diags = append(diags, typeDiags...)
+
+	var availabilityZones []string
+	if parsed.Placement != nil {
+		var zoneDiags hcl.Diagnostics
+		availabilityZones, zoneDiags = providers.DecodeStringOrList("availability_zone", parsed.Placement.AvailabilityZone)
+		diags = append(diags, zoneDiags...)
+	}
+
+	if len(parsed.SubnetIds) != 0 {
+		switch {
+		case parsed.SubnetId != nil:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'subnet_id' and 'subnet_ids' fields",
+				Detail:   "Set either 'subnet_id' or 'subnet_ids', but not both",
+			})
+		case len(availabilityZones) != 0:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'subnet_ids' and 'availability_zone' fields",
+				Detail:   "A subnet determines the availability zone of the instance, so 'availability_zone' in the 'placement' block cannot be combined with 'subnet_ids'",
+			})
+		}
+	}
+	subnetOrder := "ordered"
+	if parsed.SubnetOrder != nil {
+		subnetOrder = *parsed.SubnetOrder
+		switch {
+		case subnetOrder != "ordered" && subnetOrder != "random":
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'subnet_order' field",
+				Detail:   "The 'subnet_order' field must be \"ordered\" or \"random\"",
+			})
+		case len(parsed.SubnetIds) == 0:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Field 'subnet_order' was ignored",
+				Detail:   "The 'subnet_order' field only has effect when 'subnet_ids' is set",
+			})
+		}
+	}
+
+	var cfgMods []func(*config.LoadOptions) error
 	if parsed.Profile != nil {
 		cfgMods = append(cfgMods, config.WithSharedConfigProfile(*parsed.Profile))
 	}
 	if parsed.Region != nil {
 		cfgMods = append(cfgMods, config.WithRegion(*parsed.Region))
 	}
-	awsCfg, err := config.LoadDefaultConfig(cfgMods...)
-	if err != nil {
+	secretAccessKey, secretDiags := providers.ResolveSecret("secret_access_key", parsed.SecretAccessKey, parsed.SecretAccessKeyFile)
+	diags = append(diags, secretDiags...)
+	if (parsed.AccessKeyId == nil) != (secretAccessKey == "") && !secretDiags.HasErrors() {
 		diags = append(diags, &hcl.Diagnostic{
 			Severity: hcl.DiagError,
+			Summary:  "Incomplete static credentials",
+			Detail:   "Both 'access_key_id' and 'secret_access_key' (or 'secret_access_key_file') must be set to use static credentials",
+		})
+	} else if parsed.AccessKeyId != nil {
+		cfgMods = append(cfgMods, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(*parsed.AccessKeyId, secretAccessKey, ""),
+		))
+	}
+	awsCfg, err := config.LoadDefaultConfig(context.Background(), cfgMods...)
+	if err == nil && parsed.AssumeRole != nil {
+		var roleDiags hcl.Diagnostics
+		awsCfg.Credentials, roleDiags = buildAssumeRole(awsCfg, parsed.AssumeRole)
+		diags = append(diags, roleDiags...)
+	}
+	if err != nil {
+		// In check mode, the environment may lack AWS configuration entirely.
+		severity := hcl.DiagError
+		if cfgCtx.CheckOnly {
+			severity = hcl.DiagWarning
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: severity,
 			Summary:  "Error loading AWS SDK configuration",
 			Detail:   fmt.Sprintf("The AWS SDK reported an error while loading configuration: %s", err.Error()),
 		})
 	}
 
 	prov := &Provider{
-		Ec2:          ec2.NewFromConfig(awsCfg),
-		ImageId:      parsed.ImageId,
-		InstanceType: types.InstanceType(parsed.InstanceType),
-		KeyName:      parsed.KeyName,
-		SubnetId:     parsed.SubnetId,
+		Ec2:                 ec2.NewFromConfig(awsCfg),
+		Ssm:                 ssm.NewFromConfig(awsCfg),
+		Region:              awsCfg.Region,
+		ConnectVia:          parsed.ConnectVia,
+		SsmPlugin:           parsed.SsmPlugin,
+		ImageId:             parsed.ImageId,
+		InstanceId:          parsed.InstanceId,
+		KeyName:             parsed.KeyName,
+		SubnetId:            parsed.SubnetId,
+		SubnetIds:           parsed.SubnetIds,
+		SubnetOrder:         subnetOrder,
+		AssociatePublicIp:   parsed.AssociatePublicIp,
+		ElasticIpAllocId:    parsed.ElasticIpAllocId,
+		CheckAddr:           parsed.CheckAddr,
+		UsePrivateIp:        parsed.UsePrivateIp,
+		PrivateIpFallback:   parsed.PrivateIpFallback,
+		StartRetries:        parsed.StartRetries,
+		Target:              target,
+		GcOnStart:           parsed.GcOnStart,
+		GcMinAge:            time.Hour,
+		StartTimeout:        3 * time.Minute,
+		RequestTimeout:      30 * time.Second,
+		MonitorInterval:     time.Minute,
+		AttachTimeout:       2 * time.Minute,
+		WaitForStatusChecks: parsed.WaitForStatusChecks,
+		DryRun:              parsed.DryRun,
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
+	}
+	prov.AdoptExisting = parsed.AdoptExisting && parsed.InstanceId == ""
+	prov.TerminateAdopted = parsed.TerminateAdopted == nil || *parsed.TerminateAdopted
+	prov.inUse = make(map[string]bool)
+	adoptFilter := parsed.AdoptFilter
+	if len(adoptFilter) == 0 {
+		adoptFilter = map[string]string{"lazyssh:target": target}
+	}
+	for key, value := range adoptFilter {
+		if key == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'adopt_filter' field",
+				Detail:   "Tag keys must not be empty",
+			})
+			continue
+		}
+		prov.AdoptFilters = append(prov.AdoptFilters, types.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []string{value},
+		})
+	}
+	if parsed.AdoptExisting && parsed.InstanceId != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'adopt_existing' was ignored",
+			Detail:   "The 'adopt_existing' field has no effect when 'instance_id' is set",
+		})
+	}
+
+	switch parsed.OnIdle {
+	case "", "terminate":
+		prov.OnIdle = "terminate"
+	case "stop":
+		prov.OnIdle = parsed.OnIdle
+	case "hibernate":
+		prov.OnIdle = parsed.OnIdle
+		if parsed.InstanceId == "" {
+			prov.HibernationOptions = &types.HibernationOptionsRequest{Configured: aws.Bool(true)}
+			encrypted := parsed.RootVolume != nil && parsed.RootVolume.Encrypted != nil && *parsed.RootVolume.Encrypted
+			if parsed.RootVolume == nil {
+				// An encrypted 'ebs_block_device' may be for the root device, but
+				// the root device name comes from the AMI, so this is checked
+				// again at launch. See launchInput.
+				for _, device := range parsed.EbsBlockDevice {
+					if device.Encrypted != nil && *device.Encrypted {
+						encrypted = true
+					}
+				}
+			}
+			if !encrypted {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Hibernation requires an encrypted root volume",
+					Detail:   "With 'on_idle = \"hibernate\"', add a 'root_volume' block with 'encrypted = true'",
+				})
+			}
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'on_idle' field",
+			Detail:   fmt.Sprintf("The 'on_idle' value must be one of 'terminate', 'stop' or 'hibernate', but got '%s'", parsed.OnIdle),
+		})
+	}
+	prov.TerminateOnShutdown = parsed.TerminateOnShutdown
+
+	if parsed.GcOnStart && parsed.InstanceId != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'gc_on_start' was ignored",
+			Detail:   "The 'gc_on_start' field has no effect when 'instance_id' is set",
+		})
+	}
+
+	switch {
+	case parsed.ImageId != "" && parsed.InstanceId != "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'image_id' and 'instance_id' fields",
+			Detail:   "Set 'image_id' to launch new instances, or 'instance_id' to start and stop an existing instance, but not both",
+		})
+	case parsed.ImageId == "" && parsed.InstanceId == "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'image_id' or 'instance_id' field",
+			Detail:   "Set 'image_id' to launch new instances, or 'instance_id' to start and stop an existing instance",
+		})
+	case parsed.ImageId != "":
+		if len(instanceTypes) == 0 && !typeDiags.HasErrors() {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'instance_type' field",
+				Detail:   "The 'instance_type' field is required when 'image_id' is set",
+			})
+		}
+		if parsed.KeyName == "" && parsed.InstanceConnect == nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'key_name' field",
+				Detail:   "The 'key_name' field or an 'instance_connect' block is required when 'image_id' is set",
+			})
+		}
+	case parsed.InstanceId != "":
+		if parsed.Shared != nil && !*parsed.Shared {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'shared' field",
+				Detail:   "An existing instance set with 'instance_id' is always shared",
+			})
+		}
+		if len(instanceTypes) != 0 || parsed.KeyName != "" ||
+			parsed.UserData != nil || parsed.UserDataFile != nil || parsed.UserDataBase64 != nil ||
+			len(parsed.EbsBlockDevice) != 0 || parsed.RootVolume != nil || len(parsed.AttachVolumes) != 0 || len(parsed.Tags) != 0 || parsed.Name != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Launch settings were ignored",
+				Detail:   "Settings used to launch new instances, like 'instance_type', 'key_name', 'user_data', 'ebs_block_device', 'root_volume', 'attach_volume', 'name' and 'tags', have no effect when 'instance_id' is set",
+			})
+		}
+	}
+
+	switch parsed.ConnectVia {
+	case "":
+		prov.ConnectVia = "direct"
+	case "direct", "ssm":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'connect_via' field",
+			Detail:   fmt.Sprintf("The 'connect_via' value must be one of 'direct' or 'ssm', but got '%s'", parsed.ConnectVia),
+		})
+	}
+	if prov.SsmPlugin == "" {
+		prov.SsmPlugin = "session-manager-plugin"
+	}
+	if prov.ConnectVia == "ssm" && (parsed.UsePrivateIp || parsed.PrivateIpFallback || parsed.CheckAddr != nil || parsed.ElasticIpAllocId != nil) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Address settings were ignored",
+			Detail:   "Settings that select the instance address, like 'use_private_ip', 'private_ip_fallback' and 'check_addr', have no effect with 'connect_via = \"ssm\"'",
+		})
+	}
+	if prov.ConnectVia == "ssm" && cfgCtx.Dialer != nil {
+		// Connections go to the local port of the session manager plugin.
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'dial_proxy' and 'connect_via' fields",
+			Detail:   "The 'dial_proxy' field cannot be used with 'connect_via = \"ssm\"'",
+		})
+	}
+
+	if parsed.AssociatePublicIp != nil && !*parsed.AssociatePublicIp && parsed.ElasticIpAllocId == nil && parsed.ConnectVia != "ssm" &&
+		!parsed.UsePrivateIp && !parsed.PrivateIpFallback {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Instances will not be reachable",
+			Detail:   "When 'associate_public_ip' is false, either 'connect_via = \"ssm\"', 'elastic_ip_allocation_id', 'use_private_ip' or 'private_ip_fallback' must be set",
+		})
+	}
+
+	if parsed.UsePrivateIp && parsed.PrivateIpFallback {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'private_ip_fallback' was ignored",
+			Detail:   "The 'private_ip_fallback' field has no effect when 'use_private_ip' is set",
+		})
 	}
 
 	if parsed.CheckPort == 0 {
@@ -127,22 +546,45 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		prov.CheckPort = parsed.CheckPort
 	}
 
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
 	if parsed.Shared == nil {
 		prov.Shared = true
 	} else {
 		prov.Shared = *parsed.Shared
 	}
 
+	if parsed.ElasticIpAllocId != nil && !prov.Shared {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "An Elastic IP address can only be associated with one instance at a time, so 'elastic_ip_allocation_id' requires 'shared = true'",
+		})
+	}
+
 	if prov.Shared {
-		linger, err := time.ParseDuration(parsed.Linger)
-		if err == nil {
-			prov.Linger = linger
-		} else {
-			diags = append(diags, &hcl.Diagnostic{
-				Severity: hcl.DiagError,
-				Summary:  "Invalid duration for 'linger' field",
-				Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration: %s", parsed.Linger, err.Error()),
-			})
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
 		}
 	} else if parsed.Linger != "" {
 		diags = append(diags, &hcl.Diagnostic{
@@ -153,7 +595,8 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 	}
 
 	for _, device := range parsed.EbsBlockDevice {
-		prov.BlockDeviceMappings = append(prov.BlockDeviceMappings, &types.BlockDeviceMapping{
+		diags = append(diags, validateVolume("ebs_block_device", device.VolumeType, device.Iops, device.Throughput)...)
+		prov.BlockDeviceMappings = append(prov.BlockDeviceMappings, types.BlockDeviceMapping{
 			DeviceName: aws.String(device.DeviceName),
 			Ebs: &types.EbsBlockDevice{
 				DeleteOnTermination: device.DeleteOnTermination,
@@ -163,10 +606,24 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 				SnapshotId:          device.SnapshotId,
 				VolumeSize:          device.VolumeSize,
 				VolumeType:          types.VolumeType(device.VolumeType),
+				Throughput:          device.Throughput,
 			},
 		})
 	}
 
+	if parsed.RootVolume != nil {
+		root := parsed.RootVolume
+		diags = append(diags, validateVolume("root_volume", root.VolumeType, root.Iops, root.Throughput)...)
+		prov.RootVolume = &types.EbsBlockDevice{
+			Encrypted:  root.Encrypted,
+			Iops:       root.Iops,
+			KmsKeyId:   root.KmsKeyId,
+			VolumeSize: root.VolumeSize,
+			VolumeType: types.VolumeType(root.VolumeType),
+			Throughput: root.Throughput,
+		}
+	}
+
 	for _, volume := range parsed.AttachVolumes {
 		prov.AttachVolumes = append(prov.AttachVolumes, &ec2.AttachVolumeInput{
 			Device:   aws.String(volume.DeviceName),
@@ -174,13 +631,32 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		})
 	}
 
-	prov.Placement = &types.Placement{}
-	if parsed.Placement != nil {
-		prov.Placement.AvailabilityZone = aws.String(parsed.Placement.AvailabilityZone)
+	for _, instanceType := range instanceTypes {
+		prov.InstanceTypes = append(prov.InstanceTypes, types.InstanceType(instanceType))
+	}
+	prov.AvailabilityZones = availabilityZones
+
+	if parsed.MetadataOptions != nil {
+		var metadataDiags hcl.Diagnostics
+		prov.MetadataOptions, metadataDiags = buildMetadataOptions(parsed.MetadataOptions)
+		diags = append(diags, metadataDiags...)
 	}
 
-	if parsed.UserData != nil {
-		prov.UserData64 = aws.String(base64.StdEncoding.EncodeToString([]byte(*parsed.UserData)))
+	tags, tagDiags := buildTags(target, parsed.Name, parsed.Tags)
+	diags = append(diags, tagDiags...)
+	prov.TagSpecifications = []types.TagSpecification{
+		{ResourceType: types.ResourceTypeInstance, Tags: tags},
+		{ResourceType: types.ResourceTypeVolume, Tags: tags},
+	}
+
+	userData64, userDataDiags := buildUserData(hclBlock, parsed)
+	diags = append(diags, userDataDiags...)
+	prov.UserData64 = userData64
+
+	if parsed.InstanceConnect != nil {
+		var connectDiags hcl.Diagnostics
+		prov.InstanceConnect, connectDiags = buildInstanceConnect(hclBlock, awsCfg, parsed.InstanceConnect)
+		diags = append(diags, connectDiags...)
 	}
 
 	if parsed.IamInstanceProfile != "" {
@@ -189,162 +665,1439 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		}
 	}
 
-	if diags.HasErrors() {
-		return nil, diags
+	if parsed.RequestTimeout != "" {
+		requestTimeout, err := time.ParseDuration(parsed.RequestTimeout)
+		if err == nil && requestTimeout > 0 {
+			prov.RequestTimeout = requestTimeout
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'request_timeout' field",
+				Detail:   fmt.Sprintf("The 'request_timeout' value '%s' is not a valid positive duration", parsed.RequestTimeout),
+			})
+		}
 	}
 
-	return prov, diags
-}
+	if parsed.AttachTimeout != "" {
+		attachTimeout, err := time.ParseDuration(parsed.AttachTimeout)
+		if err == nil && attachTimeout > 0 {
+			prov.AttachTimeout = attachTimeout
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'attach_timeout' field",
+				Detail:   fmt.Sprintf("The 'attach_timeout' value '%s' is not a valid positive duration", parsed.AttachTimeout),
+			})
+		}
+	}
 
-func (prov *Provider) IsShared() bool {
-	return prov.Shared
-}
+	if parsed.StartTimeout != "" {
+		startTimeout, err := time.ParseDuration(parsed.StartTimeout)
+		if err == nil && startTimeout > 0 {
+			prov.StartTimeout = startTimeout
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'start_timeout' field",
+				Detail:   fmt.Sprintf("The 'start_timeout' value '%s' is not a valid positive duration", parsed.StartTimeout),
+			})
+		}
+	}
 
-func (prov *Provider) RunMachine(mach *providers.Machine) {
-	if err := prov.start(mach); err != nil {
-		if errors.Is(err, errAttachVolume) {
-			fmt.Printf("Error in Attaching Volumes. Stopping instance\n")
-			prov.stop(mach)
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
 		} else {
-			fmt.Printf("Error in starting machine: %v\n", err)
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if parsed.MonitorInterval != "" {
+		monitorInterval, err := time.ParseDuration(parsed.MonitorInterval)
+		if err == nil && monitorInterval >= 0 {
+			prov.MonitorInterval = monitorInterval
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'monitor_interval' field",
+				Detail:   fmt.Sprintf("The 'monitor_interval' value '%s' is not a valid duration", parsed.MonitorInterval),
+			})
+		}
+	}
+	if !diags.HasErrors() && parsed.AssumeRole != nil && parsed.AssumeRole.Validate {
+		// Assume the role once now, so failures are reported as config errors.
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		_, err := sts.NewFromConfig(awsCfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		cancel()
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Could not assume IAM role",
+				Detail:   fmt.Sprintf("Failed to assume role '%s': %s", parsed.AssumeRole.RoleArn, err.Error()),
+			})
 		}
-		return
 	}
 
-	if prov.connectivityTest(mach) {
-		prov.msgLoop(mach)
+	if diags.HasErrors() {
+		return nil, diags
 	}
-	prov.stop(mach)
+
+	return prov, diags
 }
 
-func (prov *Provider) start(mach *providers.Machine) error {
-	bgCtx := context.Background()
+// Build a credentials provider that assumes the role in 'assume_role', using
+// the credentials from the base configuration. Credentials are cached, and
+// refreshed when the role session expires.
+func buildAssumeRole(awsCfg aws.Config, parsed *hclAssumeRole) (aws.CredentialsProvider, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	var duration time.Duration
+	if parsed.Duration != "" {
+		var err error
+		duration, err = time.ParseDuration(parsed.Duration)
+		if err != nil || duration < 15*time.Minute || duration > 12*time.Hour {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'duration' field in 'assume_role'",
+				Detail:   fmt.Sprintf("The 'duration' value '%s' must be a duration between 15m and 12h", parsed.Duration),
+			})
+		}
+	}
 
-	ctx, _ := context.WithTimeout(bgCtx, requestTimeout)
-	res, err := prov.Ec2.RunInstances(ctx, &ec2.RunInstancesInput{
-		BlockDeviceMappings: prov.BlockDeviceMappings,
-		MinCount:            aws.Int32(1),
-		MaxCount:            aws.Int32(1),
-		ImageId:             &prov.ImageId,
-		InstanceType:        prov.InstanceType,
-		KeyName:             &prov.KeyName,
-		SubnetId:            prov.SubnetId,
-		UserData:            prov.UserData64,
-		IamInstanceProfile:  prov.IamInstanceProfile,
-		Placement:           prov.Placement,
+	roleProvider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(awsCfg), parsed.RoleArn, func(opts *stscreds.AssumeRoleOptions) {
+		opts.RoleSessionName = parsed.SessionName
+		opts.ExternalID = parsed.ExternalId
+		opts.Duration = duration
 	})
-	if err != nil {
-		log.Printf("EC2 instance failed to start: %s\n", err.Error())
-		return nil
-	}
+	return aws.NewCredentialsCache(roleProvider), diags
+}
 
-	inst := res.Instances[0]
-	log.Printf("Created EC2 instance '%s'\n", *inst.InstanceId)
+// Build and validate instance metadata options.
+func buildMetadataOptions(parsed *hclMetadataOptions) (*types.InstanceMetadataOptionsRequest, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	opts := &types.InstanceMetadataOptionsRequest{
+		HttpTokens:              types.HttpTokensState(parsed.HttpTokens),
+		HttpEndpoint:            types.InstanceMetadataEndpointState(parsed.HttpEndpoint),
+		HttpPutResponseHopLimit: parsed.HttpPutResponseHopLimit,
+		InstanceMetadataTags:    types.InstanceMetadataTagsState(parsed.InstanceMetadataTags),
+	}
 
-	for i := 0; i < 20 && inst.State.Name == "pending"; i++ {
-		<-time.After(3 * time.Second)
+	switch parsed.HttpTokens {
+	case "", "optional", "required":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'http_tokens' field",
+			Detail:   fmt.Sprintf("The 'http_tokens' value must be one of 'optional' or 'required', but got '%s'", parsed.HttpTokens),
+		})
+	}
 
-		ctx, _ := context.WithTimeout(bgCtx, requestTimeout)
-		res, err := prov.Ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-			InstanceIds: []*string{inst.InstanceId},
+	switch parsed.HttpEndpoint {
+	case "", "enabled", "disabled":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'http_endpoint' field",
+			Detail:   fmt.Sprintf("The 'http_endpoint' value must be one of 'enabled' or 'disabled', but got '%s'", parsed.HttpEndpoint),
 		})
-		if err != nil {
-			log.Printf("Could not check EC2 instance '%s' state: %s\n", *inst.InstanceId, err.Error())
-			return nil
-		}
-		if res.Reservations == nil || res.Reservations[0].Instances == nil {
-			log.Printf("EC2 instance '%s' disappeared while waiting for it to start\n", *inst.InstanceId)
-			return nil
-		}
+	}
 
-		inst = res.Reservations[0].Instances[0]
+	if limit := parsed.HttpPutResponseHopLimit; limit != nil && (*limit < 1 || *limit > 64) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'http_put_response_hop_limit' field",
+			Detail:   fmt.Sprintf("The 'http_put_response_hop_limit' value must be between 1 and 64, but got %d", *limit),
+		})
 	}
 
-	if inst.State.Name != "running" {
-		log.Printf("EC2 instance '%s' in unexpected state '%s'\n", *inst.InstanceId, inst.State.Name)
-		return nil
+	switch parsed.InstanceMetadataTags {
+	case "", "enabled", "disabled":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'instance_metadata_tags' field",
+			Detail:   fmt.Sprintf("The 'instance_metadata_tags' value must be one of 'enabled' or 'disabled', but got '%s'", parsed.InstanceMetadataTags),
+		})
 	}
 
-	log.Printf("EC2 instance '%s' is running\n", *inst.InstanceId)
+	return opts, diags
+}
 
-	mach.State = &state{
-		id:   *inst.InstanceId,
-		addr: inst.PublicIpAddress,
+// Build the list of tags applied to instances and volumes.
+//
+// Always includes built-in tags identifying the target. The name, if set, is
+// applied as the 'Name' tag shown in the AWS console.
+func buildTags(target string, name *string, userTags map[string]string) ([]types.Tag, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	tagMap := make(map[string]string)
+	for key, value := range userTags {
+		switch {
+		case key == "":
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'tags' field",
+				Detail:   "Tag keys must not be empty",
+			})
+		case strings.HasPrefix(key, "aws:") || strings.HasPrefix(key, "lazyssh:"):
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'tags' field",
+				Detail:   fmt.Sprintf("The tag key '%s' uses a reserved prefix, 'aws:' or 'lazyssh:'", key),
+			})
+		case key == "ManagedBy":
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'tags' field",
+				Detail:   "The tag key 'ManagedBy' is reserved, LazySSH sets it to 'lazyssh'",
+			})
+		case len(key) > 128 || len(value) > 256:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'tags' field",
+				Detail:   fmt.Sprintf("The tag '%s' is too long, keys are limited to 128 characters and values to 256 characters", key),
+			})
+		case key == "Name" && name != nil:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting instance name",
+				Detail:   "Only one of the 'name' field and a 'Name' key in 'tags' may be set",
+			})
+		default:
+			tagMap[key] = value
+		}
+	}
+	if name != nil {
+		tagMap["Name"] = *name
 	}
+	tagMap["ManagedBy"] = "lazyssh"
+	tagMap["lazyssh:target"] = target
 
-	// We're running, we can attach the volumes
-	for _, v := range prov.AttachVolumes {
-		v.InstanceId = inst.InstanceId
-		_, err := prov.Ec2.AttachVolume(ctx, v)
-		if err != nil {
-			fmt.Printf("Error in attaching volume: %v\n", err)
-			return fmt.Errorf("%w: %v", errAttachVolume, err)
-		}
+	keys := make([]string, 0, len(tagMap))
+	for key := range tagMap {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	return nil
+	tags := make([]types.Tag, 0, len(keys))
+	for _, key := range keys {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tagMap[key]),
+		})
+	}
+	return tags, diags
 }
 
-func (prov *Provider) stop(mach *providers.Machine) {
-	state := mach.State.(*state)
-	bgCtx := context.Background()
-	ctx, _ := context.WithTimeout(bgCtx, requestTimeout)
-	_, err := prov.Ec2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
-		InstanceIds: []*string{aws.String(state.id)},
-	})
-	if err != nil {
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	if prov.DryRun {
+		err := prov.dryRun()
+		log.Printf("EC2 %s\n", err.Error())
+		return err
+	}
+
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially started instance before a retry.
+			prov.stop(mach, false)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("EC2 instance failed to start: %s\n", err.Error())
+		return err
+	}
+
+	if prov.WaitForStatusChecks {
+		span = tracing.NewSpan(mach.Span, "status_checks")
+		err = prov.waitStatusChecks(mach)
+		span.SetError(err)
+		span.End()
+	}
+
+	if err == nil {
+		span = tracing.NewSpan(mach.Span, "connectivity_test")
+		err = prov.connectivityTest(mach)
+		span.SetError(err)
+		span.End()
+	}
+	stopRequested := false
+	if err == nil {
+		stopRequested, err = prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach, stopRequested && prov.TerminateOnShutdown)
+	return err
+}
+
+// RecoverMachine adopts a shared EC2 instance left running by a previous
+// process. Other instances are terminated, because they were dedicated to an
+// SSH connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{id},
+	})
+	cancel()
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check EC2 instance '%s' state: %w", id, err)
+	}
+	if len(res.Reservations) == 0 || len(res.Reservations[0].Instances) == 0 {
+		return nil
+	}
+
+	inst := res.Reservations[0].Instances[0]
+	switch inst.State.Name {
+	case "shutting-down", "terminated", "stopping", "stopped":
+		return nil
+	}
+
+	mach.State = &state{
+		id:       id,
+		addr:     prov.instanceAddr(&inst),
+		deadline: time.Now().Add(prov.StartTimeout),
+	}
+	if inst.Placement != nil {
+		mach.State.(*state).availabilityZone = aws.ToString(inst.Placement.AvailabilityZone)
+	}
+	mach.SetInstanceID(id)
+	prov.inUseMu.Lock()
+	prov.inUse[id] = true
+	prov.inUseMu.Unlock()
+
+	if prov.ElasticIpAllocId != nil {
+		// Find the existing association, so it is undone on stop.
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		addrRes, err := prov.Ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+			AllocationIds: []string{*prov.ElasticIpAllocId},
+		})
+		cancel()
+		if err == nil && len(addrRes.Addresses) != 0 && aws.ToString(addrRes.Addresses[0].InstanceId) == id {
+			mach.State.(*state).associationId = addrRes.Addresses[0].AssociationId
+		}
+	}
+
+	if !prov.Shared || inst.State.Name != "running" || (mach.State.(*state).addr == nil && prov.ConnectVia != "ssm") {
+		log.Printf("Terminating orphaned EC2 instance '%s'\n", id)
+		prov.stop(mach, true)
+		return nil
+	}
+
+	log.Printf("Adopted EC2 instance '%s'\n", id)
+	err = prov.connectivityTest(mach)
+	stopRequested := false
+	if err == nil {
+		stopRequested, err = prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach, stopRequested && prov.TerminateOnShutdown)
+	return err
+}
+
+// Sweep terminates instances tagged for this target that are older than
+// 'gc_min_age', if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart || prov.InstanceId != "" {
+		return
+	}
+
+	// Instances stopped according to 'on_idle' are not orphaned.
+	states := []string{"pending", "running"}
+	if prov.OnIdle == "terminate" {
+		states = append(states, "stopping", "stopped")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:ManagedBy"),
+				Values: []string{"lazyssh"},
+			},
+			{
+				Name:   aws.String("tag:lazyssh:target"),
+				Values: []string{prov.Target},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: states,
+			},
+		},
+	})
+	cancel()
+	if err != nil {
+		log.Printf("Could not list EC2 instances for target '%s': %s\n", prov.Target, err.Error())
+		return
+	}
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	var ids []string
+	for _, reservation := range res.Reservations {
+		for _, inst := range reservation.Instances {
+			if skip[*inst.InstanceId] || inst.LaunchTime == nil || time.Since(*inst.LaunchTime) < prov.GcMinAge {
+				continue
+			}
+			log.Printf("Terminating orphaned EC2 instance '%s' for target '%s', launched at %s\n", *inst.InstanceId, prov.Target, inst.LaunchTime.Format(time.RFC3339))
+			ids = append(ids, *inst.InstanceId)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), prov.RequestTimeout)
+	_, err = prov.Ec2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: ids,
+	})
+	cancel()
+	if err != nil {
+		log.Printf("Could not terminate orphaned EC2 instances for target '%s': %s\n", prov.Target, err.Error())
+	}
+}
+
+func (prov *Provider) start(mach *providers.Machine) error {
+	if prov.InstanceId != "" {
+		return prov.startInstance(mach, prov.InstanceId)
+	}
+
+	if prov.OnIdle != "terminate" {
+		id, err := prov.findStopped()
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			return prov.startInstance(mach, id)
+		}
+	}
+
+	if prov.AdoptExisting {
+		adopted, err := prov.adoptExisting(mach)
+		if adopted || err != nil {
+			return err
+		}
+	}
+
+	input, err := prov.launchInput()
+	if err != nil {
+		return err
+	}
+	inst, err := prov.runInstance(input)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Created EC2 instance '%s'\n", *inst.InstanceId)
+
+	prov.inUseMu.Lock()
+	prov.inUse[*inst.InstanceId] = true
+	prov.inUseMu.Unlock()
+
+	// From here on, the instance exists, so set state for cleanup on failure.
+	mach.State = &state{
+		id: *inst.InstanceId,
+	}
+	mach.SetInstanceID(*inst.InstanceId)
+
+	inst, err = prov.waitRunning(mach, inst)
+	if err != nil {
+		return err
+	}
+
+	// We're running, we can attach the volumes
+	return prov.attachVolumes(mach)
+}
+
+// Attach the 'attach_volume' volumes to the instance, and wait for each to be
+// attached. Attaching may fail shortly after the instance starts running, so
+// is retried with backoff until 'attach_timeout' passes.
+func (prov *Provider) attachVolumes(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	for _, v := range prov.AttachVolumes {
+		deadline := time.Now().Add(prov.AttachTimeout)
+		delay := 2 * time.Second
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+			_, err := prov.Ec2.AttachVolume(ctx, &ec2.AttachVolumeInput{
+				Device:     v.Device,
+				VolumeId:   v.VolumeId,
+				InstanceId: aws.String(state.id),
+			})
+			cancel()
+			if err == nil {
+				break
+			}
+			if !isAttachRetryable(err) || time.Now().Add(delay).After(deadline) {
+				return prov.attachError(state, *v.VolumeId, err)
+			}
+			log.Printf("Attaching volume '%s' to EC2 instance '%s' failed, retrying in %s: %s\n", *v.VolumeId, state.id, delay, err.Error())
+			time.Sleep(delay)
+			if delay *= 2; delay > 15*time.Second {
+				delay = 15 * time.Second
+			}
+		}
+
+		state.attached = append(state.attached, *v.VolumeId)
+		// The guest may mount the device on boot, so only continue once the
+		// volume is in use and the attachment is complete.
+		err := prov.waitVolume(*v.VolumeId, deadline, "attached", func(vol *types.Volume) bool {
+			if vol.State != types.VolumeStateInUse {
+				return false
+			}
+			for _, attachment := range vol.Attachments {
+				if aws.ToString(attachment.InstanceId) == state.id && attachment.State == types.VolumeAttachmentStateAttached {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return prov.attachError(state, *v.VolumeId, err)
+		}
+		log.Printf("Attached volume '%s' to EC2 instance '%s'\n", *v.VolumeId, state.id)
+	}
+	return nil
+}
+
+// Build an error for a failed volume attachment, that includes which volumes
+// were attached successfully.
+func (prov *Provider) attachError(state *state, volumeId string, err error) error {
+	attached := len(state.attached)
+	if attached != 0 && state.attached[attached-1] == volumeId {
+		// The attach call succeeded, but the wait did not.
+		attached--
+	}
+	return fmt.Errorf("%w '%s' to EC2 instance '%s' (%d of %d volumes attached): %v",
+		errAttachVolume, volumeId, state.id, attached, len(prov.AttachVolumes), err)
+}
+
+// Poll a volume every 3 seconds until the check function returns true, or the
+// deadline passes. The desired state describes the check in timeout errors.
+func (prov *Provider) waitVolume(volumeId string, deadline time.Time, desired string, check func(*types.Volume) bool) error {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		res, err := prov.Ec2.DescribeVolumes(ctx, &ec2.DescribeVolumesInput{
+			VolumeIds: []string{volumeId},
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check volume state: %w", err)
+		}
+		if len(res.Volumes) != 0 && check(&res.Volumes[0]) {
+			return nil
+		}
+		if time.Now().Add(3 * time.Second).After(deadline) {
+			return fmt.Errorf("timed out waiting for volume to be %s, see 'attach_timeout'", desired)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// Detach volumes attached by attachVolumes, and wait for them to be
+// available again, so they are not left busy when the instance terminates.
+func (prov *Provider) detachVolumes(state *state) {
+	for _, volumeId := range state.attached {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		_, err := prov.Ec2.DetachVolume(ctx, &ec2.DetachVolumeInput{
+			VolumeId:   aws.String(volumeId),
+			InstanceId: aws.String(state.id),
+		})
+		cancel()
+		if err == nil {
+			err = prov.waitVolume(volumeId, time.Now().Add(prov.AttachTimeout), "available", func(vol *types.Volume) bool {
+				return vol.State == types.VolumeStateAvailable
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to detach volume '%s' from EC2 instance '%s': %s\n", volumeId, state.id, err.Error())
+		} else {
+			log.Printf("Detached volume '%s' from EC2 instance '%s'\n", volumeId, state.id)
+		}
+	}
+	state.attached = nil
+}
+
+// Build the RunInstances input to launch a new instance. The instance type
+// and placement are set separately, see runInstance.
+func (prov *Provider) launchInput() (*ec2.RunInstancesInput, error) {
+	input := &ec2.RunInstancesInput{
+		BlockDeviceMappings: prov.BlockDeviceMappings,
+		MinCount:            aws.Int32(1),
+		MaxCount:            aws.Int32(1),
+		ImageId:             &prov.ImageId,
+		SubnetId:            prov.SubnetId,
+		UserData:            prov.UserData64,
+		IamInstanceProfile:  prov.IamInstanceProfile,
+		HibernationOptions:  prov.HibernationOptions,
+		MetadataOptions:     prov.MetadataOptions,
+		TagSpecifications:   prov.TagSpecifications,
+	}
+	if prov.KeyName != "" {
+		input.KeyName = &prov.KeyName
+	}
+	if prov.AssociatePublicIp != nil {
+		// The public IP setting is only available on a network interface
+		// specification, which then also carries the subnet.
+		input.SubnetId = nil
+		input.NetworkInterfaces = []types.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int32(0),
+			SubnetId:                 prov.SubnetId,
+			AssociatePublicIpAddress: prov.AssociatePublicIp,
+			DeleteOnTermination:      aws.Bool(true),
+		}}
+	}
+
+	if prov.RootVolume != nil {
+		rootDevice, err := prov.rootDeviceName()
+		if err != nil {
+			return nil, err
+		}
+		input.BlockDeviceMappings = append([]types.BlockDeviceMapping{{
+			DeviceName: rootDevice,
+			Ebs:        prov.RootVolume,
+		}}, input.BlockDeviceMappings...)
+	} else if prov.HibernationOptions != nil {
+		// Without 'root_volume', hibernation requires the 'ebs_block_device'
+		// for the root device to be encrypted.
+		rootDevice, err := prov.imageRootDevice()
+		if err != nil {
+			return nil, err
+		}
+		encrypted := false
+		for _, mapping := range prov.BlockDeviceMappings {
+			if *mapping.DeviceName == *rootDevice && mapping.Ebs != nil && mapping.Ebs.Encrypted != nil && *mapping.Ebs.Encrypted {
+				encrypted = true
+			}
+		}
+		if !encrypted {
+			return nil, fmt.Errorf("hibernation requires an encrypted root volume, but root device '%s' of AMI '%s' has no encrypted 'ebs_block_device'", *rootDevice, prov.ImageId)
+		}
+	}
+
+	return input, nil
+}
+
+// Look up the root device name of the AMI, for 'root_volume'. Fails if an
+// 'ebs_block_device' is also for the root device.
+func (prov *Provider) rootDeviceName() (*string, error) {
+	rootDevice, err := prov.imageRootDevice()
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range prov.BlockDeviceMappings {
+		if *mapping.DeviceName == *rootDevice {
+			return nil, fmt.Errorf("'ebs_block_device' for '%s' conflicts with 'root_volume' for AMI '%s'", *rootDevice, prov.ImageId)
+		}
+	}
+	return rootDevice, nil
+}
+
+// Look up the root device name of the AMI.
+func (prov *Provider) imageRootDevice() (*string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ec2.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{prov.ImageId},
+	})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("could not look up AMI '%s': %w", prov.ImageId, err)
+	}
+	if len(res.Images) == 0 || res.Images[0].RootDeviceName == nil {
+		return nil, fmt.Errorf("could not find the root device name of AMI '%s'", prov.ImageId)
+	}
+
+	return res.Images[0].RootDeviceName, nil
+}
+
+// Check permissions and parameters by launching or starting an instance with
+// DryRun set, which doesn't create anything. Always returns an error, which
+// reports the result to SSH clients.
+func (prov *Provider) dryRun() error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	defer cancel()
+	var err error
+	if prov.InstanceId != "" {
+		_, err = prov.Ec2.StartInstances(ctx, &ec2.StartInstancesInput{
+			InstanceIds: []string{prov.InstanceId},
+			DryRun:      aws.Bool(true),
+		})
+	} else {
+		var input *ec2.RunInstancesInput
+		input, err = prov.launchInput()
+		if err != nil {
+			return fmt.Errorf("dry run failed: %w", err)
+		}
+		input.DryRun = aws.Bool(true)
+		input.InstanceType = prov.InstanceTypes[0]
+		if len(prov.SubnetIds) != 0 {
+			setSubnet(input, aws.String(prov.SubnetIds[0]))
+		}
+		if len(prov.AvailabilityZones) != 0 {
+			input.Placement = &types.Placement{AvailabilityZone: aws.String(prov.AvailabilityZones[0])}
+		}
+		_, err = prov.Ec2.RunInstances(ctx, input)
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "DryRunOperation" {
+		return errDryRunSucceeded
+	}
+	if err == nil {
+		err = errors.New("request unexpectedly succeeded")
+	}
+	return fmt.Errorf("dry run failed: %w", err)
+}
+
+// Set the subnet to launch an instance in, which lives on the network
+// interface specification if there is one.
+func setSubnet(input *ec2.RunInstancesInput, subnetId *string) {
+	if len(input.NetworkInterfaces) != 0 {
+		input.NetworkInterfaces[0].SubnetId = subnetId
+	} else {
+		input.SubnetId = subnetId
+	}
+}
+
+// Launch an instance, trying each combination of instance type and
+// availability zone or subnet until one has capacity.
+func (prov *Provider) runInstance(input *ec2.RunInstancesInput) (*types.Instance, error) {
+	zones := []*string{nil}
+	if len(prov.AvailabilityZones) != 0 {
+		zones = zones[:0]
+		for _, zone := range prov.AvailabilityZones {
+			zones = append(zones, aws.String(zone))
+		}
+	}
+
+	subnets := []*string{nil}
+	if len(prov.SubnetIds) != 0 {
+		subnets = subnets[:0]
+		for _, subnet := range prov.SubnetIds {
+			subnets = append(subnets, aws.String(subnet))
+		}
+		if prov.SubnetOrder == "random" {
+			rand.Shuffle(len(subnets), func(i, j int) {
+				subnets[i], subnets[j] = subnets[j], subnets[i]
+			})
+		}
+	}
+
+	var tried []string
+	var err error
+	for _, instanceType := range prov.InstanceTypes {
+		for _, zone := range zones {
+			for _, subnet := range subnets {
+				desc := string(instanceType)
+				switch {
+				case zone != nil:
+					desc = fmt.Sprintf("%s in %s", desc, *zone)
+				case subnet != nil:
+					desc = fmt.Sprintf("%s in %s", desc, *subnet)
+				}
+				log.Printf("Launching EC2 instance of type %s\n", desc)
+
+				input.InstanceType = instanceType
+				input.Placement = &types.Placement{AvailabilityZone: zone}
+				if subnet != nil {
+					setSubnet(input, subnet)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+				var res *ec2.RunInstancesOutput
+				res, err = prov.Ec2.RunInstances(ctx, input)
+				cancel()
+				if err == nil {
+					return &res.Instances[0], nil
+				}
+				if !isCapacityError(err) {
+					return nil, err
+				}
+
+				log.Printf("No capacity for EC2 instance of type %s: %s\n", desc, err.Error())
+				tried = append(tried, desc)
+			}
+		}
+	}
+
+	if len(tried) == 1 {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no capacity for any of the instance types, availability zones and subnets, tried %s: %w",
+		strings.Join(tried, ", "), err)
+}
+
+// Look for a running instance matching 'adopt_filter', and use it for the
+// machine if found. Returns whether an instance was adopted.
+func (prov *Provider) adoptExisting(mach *providers.Machine) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: append([]types.Filter{
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"pending", "running"},
+			},
+		}, prov.AdoptFilters...),
+	})
+	cancel()
+	if err != nil {
+		return false, fmt.Errorf("could not look for EC2 instances to adopt: %w", err)
+	}
+
+	// Pick the newest instance not already used by another machine.
+	prov.inUseMu.Lock()
+	var candidates []*types.Instance
+	for _, reservation := range res.Reservations {
+		for i := range reservation.Instances {
+			inst := &reservation.Instances[i]
+			if !prov.inUse[*inst.InstanceId] && inst.LaunchTime != nil {
+				candidates = append(candidates, inst)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		prov.inUseMu.Unlock()
+		return false, nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LaunchTime.After(*candidates[j].LaunchTime)
+	})
+	inst := candidates[0]
+	if len(candidates) > 1 {
+		log.Printf("Found %d EC2 instances to adopt, using the newest '%s'\n", len(candidates), *inst.InstanceId)
+	}
+
+	prov.inUse[*inst.InstanceId] = true
+	prov.inUseMu.Unlock()
+
+	log.Printf("Adopted existing EC2 instance '%s'\n", *inst.InstanceId)
+	mach.State = &state{
+		id:      *inst.InstanceId,
+		adopted: true,
+	}
+	mach.SetInstanceID(*inst.InstanceId)
+	_, err = prov.waitRunning(mach, inst)
+	return true, err
+}
+
+// Find an instance for this target that was stopped when idle, and mark it
+// in use. Returns an empty ID if there is none.
+func (prov *Provider) findStopped() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		Filters: []types.Filter{
+			{
+				Name:   aws.String("tag:lazyssh:target"),
+				Values: []string{prov.Target},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []string{"stopping", "stopped"},
+			},
+		},
+	})
+	cancel()
+	if err != nil {
+		return "", fmt.Errorf("could not look for stopped EC2 instances: %w", err)
+	}
+
+	// Prefer instances that are fully stopped, because starting an instance
+	// that is still stopping fails until it has stopped.
+	prov.inUseMu.Lock()
+	defer prov.inUseMu.Unlock()
+	var found *types.Instance
+	for _, reservation := range res.Reservations {
+		for i := range reservation.Instances {
+			inst := &reservation.Instances[i]
+			if prov.inUse[*inst.InstanceId] {
+				continue
+			}
+			if found == nil || (found.State.Name != "stopped" && inst.State.Name == "stopped") {
+				found = inst
+			}
+		}
+	}
+	if found == nil {
+		return "", nil
+	}
+	prov.inUse[*found.InstanceId] = true
+	return *found.InstanceId, nil
+}
+
+// Start an existing, stopped instance. This is either the instance set with
+// 'instance_id', or one stopped when idle according to 'on_idle'.
+func (prov *Provider) startInstance(mach *providers.Machine, id string) error {
+	// Set state for cleanup on failure, also because the instance may already
+	// be marked in use.
+	mach.State = &state{
+		id: id,
+	}
+	mach.SetInstanceID(id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	_, err := prov.Ec2.StartInstances(ctx, &ec2.StartInstancesInput{
+		InstanceIds: []string{id},
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Starting EC2 instance '%s'\n", id)
+
+	// The IP address may change on every start, so it is read again here.
+	_, err = prov.waitRunning(mach, &types.Instance{
+		InstanceId: aws.String(id),
+		State:      &types.InstanceState{Name: types.InstanceStateNamePending},
+	})
+	return err
+}
+
+// Wait for a pending instance to be running, then set the address in state.
+// This also starts the 'start_timeout' deadline.
+func (prov *Provider) waitRunning(mach *providers.Machine, inst *types.Instance) (*types.Instance, error) {
+	state := mach.State.(*state)
+	state.deadline = time.Now().Add(prov.StartTimeout)
+
+	if inst.State.Name != types.InstanceStateNameRunning {
+		// The waiter fails early if the instance ends up in any state other than
+		// running, like when it is terminated because of a launch failure. That
+		// error is kept, to tell it apart from the waiter running out of time.
+		var failed error
+		waiter := ec2.NewInstanceRunningWaiter(prov.Ec2, func(opts *ec2.InstanceRunningWaiterOptions) {
+			opts.MinDelay = 3 * time.Second
+			opts.MaxDelay = 10 * time.Second
+			retryable := opts.Retryable
+			opts.Retryable = func(ctx context.Context, input *ec2.DescribeInstancesInput, output *ec2.DescribeInstancesOutput, err error) (bool, error) {
+				retry, err := retryable(ctx, input, output, err)
+				failed = err
+				return retry, err
+			}
+		})
+		res, err := waiter.WaitForOutput(context.Background(), &ec2.DescribeInstancesInput{
+			InstanceIds: []string{*inst.InstanceId},
+		}, time.Until(state.deadline))
+		switch {
+		case failed != nil:
+			return nil, fmt.Errorf("EC2 instance '%s' did not become running: %w", *inst.InstanceId, failed)
+		case err != nil:
+			return nil, fmt.Errorf("timed out waiting for EC2 instance '%s' to be running", *inst.InstanceId)
+		case len(res.Reservations) == 0 || len(res.Reservations[0].Instances) == 0:
+			return nil, fmt.Errorf("EC2 instance '%s' disappeared while waiting for it to start", *inst.InstanceId)
+		}
+		inst = &res.Reservations[0].Instances[0]
+	}
+
+	log.Printf("EC2 instance '%s' is running\n", *inst.InstanceId)
+
+	mach.SetInfo("instance_type", string(inst.InstanceType))
+	if inst.Placement != nil {
+		mach.SetInfo("availability_zone", aws.ToString(inst.Placement.AvailabilityZone))
+	}
+
+	if prov.ElasticIpAllocId != nil {
+		publicIp, err := prov.associateAddress(mach, *inst.InstanceId)
+		if err != nil {
+			return nil, err
+		}
+		inst.PublicIpAddress = publicIp
+	}
+
+	addr := prov.instanceAddr(inst)
+	if addr == nil && prov.ConnectVia != "ssm" {
+		return nil, fmt.Errorf("EC2 instance '%s' %w, consider setting 'use_private_ip' or 'private_ip_fallback'", *inst.InstanceId, errNoAddress)
+	}
+	state.addr = addr
+	if inst.Placement != nil {
+		state.availabilityZone = aws.ToString(inst.Placement.AvailabilityZone)
+	}
+	return inst, nil
+}
+
+// Wait for the EC2 instance and system status checks to pass, until the
+// 'start_timeout' deadline.
+func (prov *Provider) waitStatusChecks(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	var failed error
+	waiter := ec2.NewInstanceStatusOkWaiter(prov.Ec2, func(opts *ec2.InstanceStatusOkWaiterOptions) {
+		opts.MinDelay = 10 * time.Second
+		opts.MaxDelay = 10 * time.Second
+		// By default, only the instance status check is waited on. Also wait for
+		// the system status check, and fail early if either is impaired.
+		retryable := opts.Retryable
+		opts.Retryable = func(ctx context.Context, input *ec2.DescribeInstanceStatusInput, output *ec2.DescribeInstanceStatusOutput, err error) (bool, error) {
+			if err != nil || len(output.InstanceStatuses) == 0 {
+				var retry bool
+				retry, failed = retryable(ctx, input, output, err)
+				return retry, failed
+			}
+			status := output.InstanceStatuses[0]
+			var instanceStatus, systemStatus types.SummaryStatus
+			if status.InstanceStatus != nil {
+				instanceStatus = status.InstanceStatus.Status
+			}
+			if status.SystemStatus != nil {
+				systemStatus = status.SystemStatus.Status
+			}
+			switch {
+			case instanceStatus == types.SummaryStatusImpaired || systemStatus == types.SummaryStatusImpaired:
+				failed = fmt.Errorf("EC2 instance '%s' failed status checks (instance: %s, system: %s)", state.id, instanceStatus, systemStatus)
+				return false, failed
+			case instanceStatus == types.SummaryStatusOk && systemStatus == types.SummaryStatusOk:
+				return false, nil
+			default:
+				return true, nil
+			}
+		}
+	})
+	err := waiter.Wait(context.Background(), &ec2.DescribeInstanceStatusInput{
+		InstanceIds: []string{state.id},
+	}, time.Until(state.deadline))
+	switch {
+	case failed != nil:
+		return failed
+	case err != nil:
+		return fmt.Errorf("timed out waiting for EC2 instance '%s' status checks", state.id)
+	}
+	log.Printf("Status checks passed for EC2 instance '%s'\n", state.id)
+	return nil
+}
+
+// Associate the 'elastic_ip_allocation_id' address with the instance, and
+// return its public IP address.
+func (prov *Provider) associateAddress(mach *providers.Machine, id string) (*string, error) {
+	bgCtx := context.Background()
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+	res, err := prov.Ec2.AssociateAddress(ctx, &ec2.AssociateAddressInput{
+		AllocationId: prov.ElasticIpAllocId,
+		InstanceId:   aws.String(id),
+	})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("%w '%s' with EC2 instance '%s': %v", errAssociateAddress, *prov.ElasticIpAllocId, id, err)
+	}
+	mach.State.(*state).associationId = res.AssociationId
+
+	ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+	addrRes, err := prov.Ec2.DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		AllocationIds: []string{*prov.ElasticIpAllocId},
+	})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("could not check Elastic IP address '%s': %w", *prov.ElasticIpAllocId, err)
+	}
+	if len(addrRes.Addresses) == 0 || addrRes.Addresses[0].PublicIp == nil {
+		return nil, fmt.Errorf("%w '%s' with EC2 instance '%s': address not found", errAssociateAddress, *prov.ElasticIpAllocId, id)
+	}
+
+	log.Printf("Associated Elastic IP address '%s' with EC2 instance '%s'\n", *addrRes.Addresses[0].PublicIp, id)
+	return addrRes.Addresses[0].PublicIp, nil
+}
+
+// Select the address LazySSH connects to for an instance, based on settings.
+// Returns nil if the instance has no suitable address.
+func (prov *Provider) instanceAddr(inst *types.Instance) *string {
+	if prov.UsePrivateIp {
+		return inst.PrivateIpAddress
+	}
+	if inst.PublicIpAddress == nil && prov.PrivateIpFallback {
+		return inst.PrivateIpAddress
+	}
+	return inst.PublicIpAddress
+}
+
+// isCapacityError checks whether an error from RunInstances indicates a lack
+// of capacity, in which case another instance type or zone may succeed.
+func isCapacityError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "InsufficientInstanceCapacity", "InsufficientHostCapacity", "InsufficientCapacity", "Unsupported":
+		return true
+	default:
+		return false
+	}
+}
+
+// isAttachRetryable checks whether an AttachVolume error may resolve itself,
+// typically because the instance is not ready yet.
+func isAttachRetryable(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "IncorrectState", "IncorrectInstanceState":
+			return true
+		}
+	}
+	return isRetryable(err)
+}
+
+// isRetryable classifies errors from start. Throttling and server-side errors
+// are retried, while capacity, quota and validation errors are not.
+func isRetryable(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		// Network errors and the like.
+		return !errors.Is(err, errAttachVolume) && !errors.Is(err, errNoAddress) &&
+			!errors.Is(err, errAssociateAddress)
+	}
+	switch apiErr.ErrorCode() {
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException", "IncorrectInstanceState",
+		"InternalError", "InternalFailure", "ServiceUnavailable", "Unavailable":
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the instance when idle, according to 'on_idle'. If terminate is set,
+// the instance is terminated regardless, unless it is the instance set with
+// 'instance_id'.
+func (prov *Provider) stop(mach *providers.Machine, terminate bool) {
+	state := mach.State.(*state)
+	prov.inUseMu.Lock()
+	delete(prov.inUse, state.id)
+	prov.inUseMu.Unlock()
+	if state.adopted && !prov.TerminateAdopted {
+		log.Printf("Leaving adopted EC2 instance '%s' running\n", state.id)
+		return
+	}
+
+	if len(state.ssm) != 0 {
+		prov.closeSsmSessions(state)
+	}
+	if state.gone {
+		log.Printf("EC2 instance '%s' was already terminated\n", state.id)
+		return
+	}
+
+	bgCtx := context.Background()
+	if state.associationId != nil {
+		// The address is pre-allocated, so is only disassociated, not released.
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		_, err := prov.Ec2.DisassociateAddress(ctx, &ec2.DisassociateAddressInput{
+			AssociationId: state.associationId,
+		})
+		cancel()
+		if err != nil {
+			err = fmt.Errorf("failed to disassociate Elastic IP address from EC2 instance '%s': %w", state.id, err)
+			log.Printf("%s\n", err.Error())
+			mach.ReportStopError(err)
+		}
+		state.associationId = nil
+	}
+
+	stopOnly := prov.InstanceId != "" || (prov.OnIdle != "terminate" && !terminate)
+	if !stopOnly && len(state.attached) != 0 {
+		prov.detachVolumes(state)
+	}
+
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+	defer cancel()
+	if stopOnly {
+		_, err := prov.Ec2.StopInstances(ctx, &ec2.StopInstancesInput{
+			InstanceIds: []string{state.id},
+			Hibernate:   aws.Bool(prov.OnIdle == "hibernate"),
+		})
+		if err != nil {
+			log.Printf("EC2 instance '%s' failed to stop: %s\n", state.id, err.Error())
+			mach.ReportStopError(fmt.Errorf("EC2 instance '%s' failed to stop: %w", state.id, err))
+			return
+		}
+		log.Printf("Stopped EC2 instance '%s'\n", state.id)
+		return
+	}
+	_, err := prov.Ec2.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{state.id},
+	})
+	if err != nil {
 		log.Printf("EC2 instance '%s' failed to stop: %s\n", state.id, err.Error())
+		mach.ReportStopError(fmt.Errorf("EC2 instance '%s' failed to terminate: %w", state.id, err))
+		return
 	}
 	log.Printf("Terminated EC2 instance '%s'\n", state.id)
 }
 
-// Check port every 3 seconds for 2 minutes.
-func (prov *Provider) connectivityTest(mach *providers.Machine) bool {
+// Check port every 3 seconds until the 'start_timeout' deadline.
+//
+// With 'connect_via = "ssm"', instead wait for the instance to register with
+// SSM, and check a port forwarding session can be started to the port.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
 	state := mach.State.(*state)
-	if state.addr == nil {
-		log.Printf("EC2 instance '%s' does not have a public IP address\n", state.id)
-		return false
+	if prov.ConnectVia == "ssm" {
+		if err := prov.waitSsmOnline(mach); err != nil {
+			return err
+		}
+		if _, err := prov.ssmForward(state, prov.CheckPort); err != nil {
+			return err
+		}
+		log.Printf("Connectivity test succeeded for EC2 instance '%s'\n", state.id)
+		return nil
+	}
+	checkHost := *state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
 	}
-	checkAddr := fmt.Sprintf("%s:%d", *state.addr, prov.CheckPort)
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
 	checkTimeout := 3 * time.Second
 	var err error
-	var conn net.Conn
-	for i := 0; i < 40; i++ {
+	for {
 		checkStart := time.Now()
-		conn, err = net.DialTimeout("tcp", checkAddr, checkTimeout)
+		err = prov.Check.Dial(checkAddr, checkTimeout)
 		if err == nil {
-			conn.Close()
 			log.Printf("Connectivity test succeeded for EC2 instance '%s'\n", state.id)
-			return true
+			return nil
+		}
+		if checkStart.Add(checkTimeout).After(state.deadline) {
+			break
 		}
 		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
 	}
-	log.Printf("EC2 instance '%s' port check failed: %s\n", state.id, err.Error())
-	return false
+	return fmt.Errorf("EC2 instance '%s' port check on '%s' timed out: %w", state.id, checkAddr, err)
+}
+
+// Determine the address to forward a connection to.
+func (prov *Provider) translate(state *state, msg *providers.TranslateMsg) providers.TranslateReply {
+	if err := prov.pushKey(state); err != nil {
+		log.Printf("%s\n", err.Error())
+		return providers.TranslateReply{Err: err}
+	}
+
+	if prov.ConnectVia != "ssm" {
+		return providers.TranslateReply{Addr: fmt.Sprintf("%s:%d", *state.addr, msg.Port)}
+	}
+	addr, err := prov.ssmForward(state, msg.Port)
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+		return providers.TranslateReply{Err: err}
+	}
+	return providers.TranslateReply{Addr: addr}
 }
 
-func (prov *Provider) msgLoop(mach *providers.Machine) {
-	// TODO: Monitor machine status
+// Push the 'instance_connect' key, if configured. Pushed keys are only valid
+// for a short time, so the key is pushed again for new connections once it
+// is about to expire.
+func (prov *Provider) pushKey(state *state) error {
+	if prov.InstanceConnect == nil || time.Since(state.keyPushed) < instanceConnectRepushAfter {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	err := prov.InstanceConnect.sendKey(ctx, state.id, state.availabilityZone)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not push SSH key to EC2 instance '%s' with EC2 Instance Connect: %w", state.id, err)
+	}
+	state.keyPushed = time.Now()
+	return nil
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections. Returns true if the Manager requested the machine stop, and an
+// error if 'monitor_interval' checks found the instance is no longer running.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) (bool, error) {
 	state := mach.State.(*state)
-	active := <-mach.ModActive
-	for active > 0 {
+	monitor := providers.NewMonitor(prov.MonitorInterval)
+	defer monitor.Stop()
+	ready := time.Now()
+	for {
 		for active > 0 {
 			select {
 			case mod := <-mach.ModActive:
 				active += mod
 			case msg := <-mach.Translate:
-				msg.Reply <- fmt.Sprintf("%s:%d", *state.addr, msg.Port)
+				msg.Reply <- prov.translate(state, msg)
+			case <-monitor.C:
+				if !prov.checkAlive(state) {
+					err := fmt.Errorf("EC2 instance '%s' %w", state.id, providers.ErrMachineDied)
+					providers.RejectPending(mach, err)
+					return false, err
+				}
 			case <-mach.Stop:
-				return
+				return true, nil
 			}
 		}
 
-		// Linger
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
 		select {
 		case mod := <-mach.ModActive:
 			active += mod
-		case <-time.After(prov.Linger):
-			return
+		case <-time.After(linger):
+			return false, nil
+		case <-mach.Stop:
+			return true, nil
+		}
+	}
+}
+
+// Check whether the instance is still running. API errors are logged, but
+// otherwise ignored, because they are usually transient.
+func (prov *Provider) checkAlive(state *state) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{state.id},
+	})
+	cancel()
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidInstanceID.NotFound" {
+		log.Printf("EC2 instance '%s' no longer exists\n", state.id)
+		state.gone = true
+		return false
+	}
+	if err != nil {
+		log.Printf("Could not check EC2 instance '%s' state: %s\n", state.id, err.Error())
+		return true
+	}
+	if len(res.Reservations) == 0 || len(res.Reservations[0].Instances) == 0 {
+		log.Printf("EC2 instance '%s' no longer exists\n", state.id)
+		state.gone = true
+		return false
+	}
+
+	inst := res.Reservations[0].Instances[0]
+	switch inst.State.Name {
+	case "pending", "running":
+		return true
+	case "shutting-down", "terminated":
+		state.gone = true
+	}
+	log.Printf("EC2 instance '%s' is unexpectedly in state '%s'\n", state.id, inst.State.Name)
+	return false
+}
+
+// Build the base64 encoded user data from one of 'user_data',
+// 'user_data_file' or 'user_data_base64', optionally compressed with 'gzip'.
+func buildUserData(hclBlock hcl.Body, parsed *hclTarget) (*string, hcl.Diagnostics) {
+	sources := 0
+	for _, source := range []*string{parsed.UserData, parsed.UserDataFile, parsed.UserDataBase64} {
+		if source != nil {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return nil, hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting user data fields",
+			Detail:   "Only one of 'user_data', 'user_data_file' and 'user_data_base64' may be set",
+		}}
+	}
+
+	var data []byte
+	switch {
+	case parsed.UserData != nil:
+		data = []byte(*parsed.UserData)
+	case parsed.UserDataFile != nil:
+		var err error
+		data, err = ioutil.ReadFile(providers.ResolvePath(hclBlock, *parsed.UserDataFile))
+		if err != nil {
+			return nil, hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Could not read 'user_data_file'",
+				Detail:   err.Error(),
+			}}
+		}
+	case parsed.UserDataBase64 != nil:
+		if parsed.Gzip {
+			return nil, hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'gzip' field",
+				Detail:   "The 'gzip' field cannot be used with 'user_data_base64', which is passed through as is",
+			}}
 		}
+		var err error
+		data, err = base64.StdEncoding.DecodeString(*parsed.UserDataBase64)
+		if err != nil {
+			return nil, hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'user_data_base64' field",
+				Detail:   fmt.Sprintf("The 'user_data_base64' value is not valid base64: %s", err.Error()),
+			}}
+		}
+	default:
+		if parsed.Gzip {
+			return nil, hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Field 'gzip' was ignored",
+				Detail:   "The 'gzip' field has no effect without 'user_data' or 'user_data_file'",
+			}}
+		}
+		return nil, nil
+	}
+
+	if parsed.Gzip {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		writer.Write(data)
+		writer.Close()
+		data = buf.Bytes()
+	}
+
+	if len(data) > maxUserDataSize {
+		return nil, hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "User data is too large",
+			Detail:   fmt.Sprintf("EC2 limits user data to %d bytes before base64 encoding, but got %d bytes; consider setting 'gzip = true'", maxUserDataSize, len(data)),
+		}}
+	}
+
+	return aws.String(base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// Validate IOPS and throughput settings against the volume type, for the
+// named block type.
+func validateVolume(block string, volumeType string, iops *int32, throughput *int32) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	switch volumeType {
+	case "io1", "io2":
+		if iops == nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Missing 'iops' field in '%s'", block),
+				Detail:   fmt.Sprintf("The 'iops' field is required for volume type '%s'", volumeType),
+			})
+		}
+	case "gp3":
+	default:
+		if iops != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid 'iops' field in '%s'", block),
+				Detail:   "The 'iops' field is only supported for volume types 'io1', 'io2' and 'gp3'",
+			})
+		}
+	}
+	if throughput != nil && volumeType != "gp3" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid 'throughput' field in '%s'", block),
+			Detail:   "The 'throughput' field is only supported for volume type 'gp3'",
+		})
 	}
+	return diags
 }
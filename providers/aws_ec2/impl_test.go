@@ -0,0 +1,165 @@
+package aws_ec2
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+)
+
+// parseTarget creates a Provider from the body of a target block. The
+// Provider is nil if there are errors.
+func parseTarget(t *testing.T, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	if prov == nil {
+		return nil, diags
+	}
+	return prov.(*Provider), diags
+}
+
+// baseConfig has the required fields for a target that launches instances.
+const baseConfig = `
+image_id = "ami-00000000000000000"
+instance_type = "t3.micro"
+region = "eu-west-1"
+access_key_id = "AKIAEXAMPLE"
+secret_access_key = "secret"
+key_name = "test"
+`
+
+func TestThroughput(t *testing.T) {
+	prov, diags := parseTarget(t, baseConfig+`
+ebs_block_device {
+  device_name = "/dev/xvdb"
+  volume_type = "gp3"
+  throughput = 250
+}
+root_volume {
+  volume_type = "gp3"
+  throughput = 500
+}
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if ebs := prov.BlockDeviceMappings[0].Ebs; ebs.Throughput == nil || *ebs.Throughput != 250 {
+		t.Fatalf("expected ebs_block_device throughput 250, got: %v", ebs.Throughput)
+	}
+	if root := prov.RootVolume; root.Throughput == nil || *root.Throughput != 500 {
+		t.Fatalf("expected root_volume throughput 500, got: %v", root.Throughput)
+	}
+}
+
+func TestThroughputRequiresGp3(t *testing.T) {
+	for _, block := range []string{"ebs_block_device", "root_volume"} {
+		body := baseConfig + block + " {\n"
+		if block == "ebs_block_device" {
+			body += "  device_name = \"/dev/xvdb\"\n"
+		}
+		body += "  volume_type = \"gp2\"\n  throughput = 250\n}\n"
+		prov, diags := parseTarget(t, body)
+		if prov != nil || !diags.HasErrors() {
+			t.Fatalf("expected an error for throughput in %s with volume type gp2", block)
+		}
+		if expected := "Invalid 'throughput' field in '" + block + "'"; diags[0].Summary != expected {
+			t.Fatalf("expected error '%s', got: %s", expected, diags.Error())
+		}
+	}
+}
+
+func TestInstanceMetadataTags(t *testing.T) {
+	prov, diags := parseTarget(t, baseConfig+`
+metadata_options {
+  http_tokens = "required"
+  instance_metadata_tags = "enabled"
+}
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if opts := prov.MetadataOptions; opts.InstanceMetadataTags != types.InstanceMetadataTagsStateEnabled {
+		t.Fatalf("expected instance_metadata_tags 'enabled', got: '%s'", opts.InstanceMetadataTags)
+	}
+
+	prov, diags = parseTarget(t, baseConfig+`
+metadata_options {
+  instance_metadata_tags = "on"
+}
+`)
+	if prov != nil || !diags.HasErrors() || diags[0].Summary != "Invalid value for 'instance_metadata_tags' field" {
+		t.Fatalf("expected an error for an invalid value, got: %v", diags)
+	}
+}
+
+func TestHibernateRequiresEncryptedRoot(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		err  bool
+	}{
+		{
+			name: "encrypted root_volume",
+			body: "root_volume {\n  encrypted = true\n}\n",
+		},
+		{
+			name: "encrypted ebs_block_device",
+			body: "ebs_block_device {\n  device_name = \"/dev/xvda\"\n  encrypted = true\n}\n",
+		},
+		{
+			name: "unencrypted root_volume",
+			body: "root_volume {\n  encrypted = false\n}\nebs_block_device {\n  device_name = \"/dev/xvdb\"\n  encrypted = true\n}\n",
+			err:  true,
+		},
+		{
+			name: "no encryption",
+			body: "",
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, diags := parseTarget(t, baseConfig+"on_idle = \"hibernate\"\n"+tc.body)
+			if diags.HasErrors() != tc.err {
+				t.Fatalf("expected error to be %v, got: %v", tc.err, diags)
+			}
+			if tc.err && diags[0].Summary != "Hibernation requires an encrypted root volume" {
+				t.Fatalf("unexpected error: %s", diags.Error())
+			}
+		})
+	}
+}
+
+// An encrypted 'ebs_block_device' only passes the config check, and must be
+// for the root device of the AMI at launch.
+func TestHibernateLaunchChecksRootDevice(t *testing.T) {
+	for _, tc := range []struct {
+		device string
+		err    bool
+	}{
+		{device: "/dev/xvda"},
+		{device: "/dev/xvdb", err: true},
+	} {
+		prov := fakeEc2(t, map[string]string{
+			"DescribeImages": `<imagesSet><item><imageId>ami-00000000000000000</imageId><rootDeviceName>/dev/xvda</rootDeviceName></item></imagesSet>`,
+		})
+		prov.ImageId = "ami-00000000000000000"
+		prov.HibernationOptions = &types.HibernationOptionsRequest{Configured: aws.Bool(true)}
+		prov.BlockDeviceMappings = []types.BlockDeviceMapping{{
+			DeviceName: aws.String(tc.device),
+			Ebs:        &types.EbsBlockDevice{Encrypted: aws.Bool(true)},
+		}}
+
+		_, err := prov.launchInput()
+		if (err != nil) != tc.err {
+			t.Fatalf("expected error to be %v for device '%s', got: %v", tc.err, tc.device, err)
+		}
+	}
+}
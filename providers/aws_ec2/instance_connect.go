@@ -0,0 +1,165 @@
+package aws_ec2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/hashicorp/hcl/v2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+// Keys pushed with EC2 Instance Connect remain valid for 60 seconds. New
+// connections after this time push the key again.
+const instanceConnectRepushAfter = 30 * time.Second
+
+// See https://docs.aws.amazon.com/ec2-instance-connect/latest/APIReference/API_SendSSHPublicKey.html
+type hclInstanceConnect struct {
+	OsUser        string  `hcl:"os_user,attr"`
+	PublicKey     *string `hcl:"public_key,optional"`
+	PublicKeyFile *string `hcl:"public_key_file,optional"`
+}
+
+// instanceConnect pushes an SSH public key to instances using the EC2
+// Instance Connect API.
+//
+// The API is called directly, because there is no EC2 Instance Connect
+// service client for the AWS SDK version in use.
+type instanceConnect struct {
+	osUser      string
+	publicKey   string
+	region      string
+	credentials aws.CredentialsProvider
+	httpClient  aws.HTTPClient
+	signer      *v4.Signer
+}
+
+func buildInstanceConnect(hclBlock hcl.Body, awsCfg aws.Config, parsed *hclInstanceConnect) (*instanceConnect, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+
+	keyFile := parsed.PublicKeyFile
+	if keyFile != nil {
+		resolved := providers.ResolvePath(hclBlock, *keyFile)
+		keyFile = &resolved
+	}
+	publicKey, keyDiags := providers.ResolveSecret("public_key", parsed.PublicKey, keyFile)
+	diags = append(diags, keyDiags...)
+	if keyDiags.HasErrors() {
+		return nil, diags
+	}
+
+	if publicKey == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'public_key' field",
+			Detail:   "Either 'public_key' or 'public_key_file' must be set in the 'instance_connect' block",
+		})
+	} else if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey)); err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'public_key' field",
+			Detail:   fmt.Sprintf("The public key could not be parsed: %s", err.Error()),
+		})
+	}
+
+	if parsed.OsUser == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'os_user' field",
+			Detail:   "The 'os_user' field must not be empty",
+		})
+	}
+
+	httpClient := awsCfg.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	return &instanceConnect{
+		osUser:      parsed.OsUser,
+		publicKey:   publicKey,
+		region:      awsCfg.Region,
+		credentials: awsCfg.Credentials,
+		httpClient:  httpClient,
+		signer:      v4.NewSigner(),
+	}, diags
+}
+
+// Push the public key to an instance. The key remains valid for 60 seconds.
+func (ic *instanceConnect) sendKey(ctx context.Context, instanceId string, availabilityZone string) error {
+	input := map[string]string{
+		"InstanceId":     instanceId,
+		"InstanceOSUser": ic.osUser,
+		"SSHPublicKey":   ic.publicKey,
+	}
+	if availabilityZone != "" {
+		input["AvailabilityZone"] = availabilityZone
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://ec2-instance-connect.%s.amazonaws.com/", ic.region)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AWSEC2InstanceConnectService.SendSSHPublicKey")
+
+	creds, err := ic.credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	payloadHash := sha256.Sum256(body)
+	err = ic.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "ec2-instance-connect", ic.region, time.Now())
+	if err != nil {
+		return err
+	}
+
+	res, err := ic.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		// JSON protocol errors have a type like 'prefix#ThrottlingException'.
+		apiErr := struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(resBody, &apiErr) != nil || apiErr.Type == "" {
+			return fmt.Errorf("status %s", res.Status)
+		}
+		code := apiErr.Type[strings.LastIndex(apiErr.Type, "#")+1:]
+		return fmt.Errorf("%s: %s", code, apiErr.Message)
+	}
+
+	result := struct {
+		Success bool
+	}{}
+	if err := json.Unmarshal(resBody, &result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("request was not successful")
+	}
+	return nil
+}
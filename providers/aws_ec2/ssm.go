@@ -0,0 +1,183 @@
+package aws_ec2
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+// ssmSession is an SSM port forwarding session, for 'connect_via = "ssm"'.
+//
+// The session data channel is handled by the Session Manager plugin, which
+// listens on a local port and forwards connections into the session.
+type ssmSession struct {
+	id        string
+	localAddr string
+	cmd       *exec.Cmd
+	exited    chan struct{}
+}
+
+// Wait for the instance to register with SSM, until the 'start_timeout'
+// deadline.
+func (prov *Provider) waitSsmOnline(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		res, err := prov.Ssm.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
+			Filters: []ssmtypes.InstanceInformationStringFilter{{
+				Key:    aws.String("InstanceIds"),
+				Values: []string{state.id},
+			}},
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check SSM registration of EC2 instance '%s': %w", state.id, err)
+		}
+		if len(res.InstanceInformationList) != 0 && res.InstanceInformationList[0].PingStatus == ssmtypes.PingStatusOnline {
+			log.Printf("EC2 instance '%s' is online in SSM\n", state.id)
+			return nil
+		}
+
+		if time.Now().Add(5 * time.Second).After(state.deadline) {
+			return fmt.Errorf("timed out waiting for EC2 instance '%s' to register with SSM", state.id)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Return the local address of an SSM port forwarding session to a port on
+// the instance, starting a session if necessary. Sessions are reused for
+// further connections to the same port, until the machine stops.
+func (prov *Provider) ssmForward(state *state, port uint16) (string, error) {
+	if session := state.ssm[port]; session != nil {
+		select {
+		case <-session.exited:
+			log.Printf("SSM session '%s' for EC2 instance '%s' ended, starting a new one\n", session.id, state.id)
+			prov.closeSsmSession(session)
+			delete(state.ssm, port)
+		default:
+			return session.localAddr, nil
+		}
+	}
+
+	// Find a free local port for the plugin to listen on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	localAddr := listener.Addr().String()
+	listener.Close()
+	_, localPort, _ := net.SplitHostPort(localAddr)
+
+	input := &ssm.StartSessionInput{
+		Target:       aws.String(state.id),
+		DocumentName: aws.String("AWS-StartPortForwardingSession"),
+		Parameters: map[string][]string{
+			"portNumber":      {strconv.Itoa(int(port))},
+			"localPortNumber": {localPort},
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	res, err := prov.Ssm.StartSession(ctx, input)
+	cancel()
+	if err != nil {
+		return "", fmt.Errorf("could not start SSM session to EC2 instance '%s': %w", state.id, err)
+	}
+
+	session := &ssmSession{
+		id:        *res.SessionId,
+		localAddr: localAddr,
+		exited:    make(chan struct{}),
+	}
+
+	// The plugin takes the same arguments the AWS CLI passes it.
+	resJson, _ := json.Marshal(map[string]*string{
+		"SessionId":  res.SessionId,
+		"StreamUrl":  res.StreamUrl,
+		"TokenValue": res.TokenValue,
+	})
+	inputJson, _ := json.Marshal(input)
+	endpoint := fmt.Sprintf("https://ssm.%s.amazonaws.com", prov.Region)
+	session.cmd = exec.Command(prov.SsmPlugin, string(resJson), prov.Region, "StartSession", "", string(inputJson), endpoint)
+	if err := session.cmd.Start(); err != nil {
+		prov.terminateSsmSession(session.id)
+		return "", fmt.Errorf("could not run Session Manager plugin: %w", err)
+	}
+	go func() {
+		session.cmd.Wait()
+		close(session.exited)
+	}()
+
+	// Wait for the plugin to listen.
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", localAddr, time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-session.exited:
+			prov.terminateSsmSession(session.id)
+			return "", fmt.Errorf("Session Manager plugin for EC2 instance '%s' exited unexpectedly", state.id)
+		case <-time.After(time.Second):
+		}
+		if i == 30 {
+			prov.closeSsmSession(session)
+			return "", fmt.Errorf("timed out waiting for SSM session to EC2 instance '%s'", state.id)
+		}
+	}
+
+	log.Printf("Started SSM session '%s' to port %d of EC2 instance '%s'\n", session.id, port, state.id)
+	if state.ssm == nil {
+		state.ssm = make(map[uint16]*ssmSession)
+	}
+	state.ssm[port] = session
+	return localAddr, nil
+}
+
+// Stop the plugin process and terminate the session.
+func (prov *Provider) closeSsmSession(session *ssmSession) {
+	select {
+	case <-session.exited:
+	default:
+		session.cmd.Process.Signal(os.Interrupt)
+		select {
+		case <-session.exited:
+		case <-time.After(5 * time.Second):
+			session.cmd.Process.Kill()
+			<-session.exited
+		}
+	}
+	prov.terminateSsmSession(session.id)
+}
+
+func (prov *Provider) terminateSsmSession(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	_, err := prov.Ssm.TerminateSession(ctx, &ssm.TerminateSessionInput{
+		SessionId: aws.String(id),
+	})
+	cancel()
+	if err != nil {
+		log.Printf("Could not terminate SSM session '%s': %s\n", id, err.Error())
+	}
+}
+
+// Close all SSM sessions of a machine.
+func (prov *Provider) closeSsmSessions(state *state) {
+	for port, session := range state.ssm {
+		prov.closeSsmSession(session)
+		delete(state.ssm, port)
+	}
+}
@@ -0,0 +1,167 @@
+package aws_ec2
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+// fakeEc2 creates a Provider with an EC2 client that talks to a local server.
+// The server responds to each API action with the given XML body.
+func fakeEc2(t *testing.T, responses map[string]string) *Provider {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		action := r.Form.Get("Action")
+		body, ok := responses[action]
+		if !ok {
+			http.Error(w, "unexpected action "+action, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<%sResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">%s</%sResponse>`, action, body, action)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Provider{
+		Ec2: ec2.New(ec2.Options{
+			Region:       "eu-west-1",
+			BaseEndpoint: aws.String(srv.URL),
+			Credentials:  credentials.NewStaticCredentialsProvider("AKIAEXAMPLE", "secret", ""),
+		}),
+		StartTimeout:   time.Minute,
+		RequestTimeout: 5 * time.Second,
+	}
+}
+
+// describeInstances is a DescribeInstances response body for one instance.
+func describeInstances(stateName string) string {
+	return fmt.Sprintf(`
+<reservationSet><item><instancesSet><item>
+  <instanceId>i-0123456789abcdef0</instanceId>
+  <instanceType>t3.micro</instanceType>
+  <instanceState><name>%s</name></instanceState>
+  <ipAddress>192.0.2.10</ipAddress>
+  <placement><availabilityZone>eu-west-1a</availabilityZone></placement>
+</item></instancesSet></item></reservationSet>`, stateName)
+}
+
+// describeInstanceStatus is a DescribeInstanceStatus response body for one
+// instance.
+func describeInstanceStatus(instanceStatus string, systemStatus string) string {
+	return fmt.Sprintf(`
+<instanceStatusSet><item>
+  <instanceId>i-0123456789abcdef0</instanceId>
+  <instanceStatus><status>%s</status></instanceStatus>
+  <systemStatus><status>%s</status></systemStatus>
+</item></instanceStatusSet>`, instanceStatus, systemStatus)
+}
+
+func pendingInstance() *types.Instance {
+	return &types.Instance{
+		InstanceId: aws.String("i-0123456789abcdef0"),
+		State:      &types.InstanceState{Name: types.InstanceStateNamePending},
+	}
+}
+
+func TestWaitRunning(t *testing.T) {
+	prov := fakeEc2(t, map[string]string{
+		"DescribeInstances": describeInstances("running"),
+	})
+	mach := &providers.Machine{State: &state{id: "i-0123456789abcdef0"}}
+
+	inst, err := prov.waitRunning(mach, pendingInstance())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if inst.State.Name != types.InstanceStateNameRunning {
+		t.Fatalf("expected a running instance, got state '%s'", inst.State.Name)
+	}
+	state := mach.State.(*state)
+	if aws.ToString(state.addr) != "192.0.2.10" || state.availabilityZone != "eu-west-1a" {
+		t.Fatalf("unexpected state: addr %v, availability zone '%s'", aws.ToString(state.addr), state.availabilityZone)
+	}
+}
+
+func TestWaitRunningTerminated(t *testing.T) {
+	prov := fakeEc2(t, map[string]string{
+		"DescribeInstances": describeInstances("terminated"),
+	})
+	mach := &providers.Machine{State: &state{id: "i-0123456789abcdef0"}}
+
+	_, err := prov.waitRunning(mach, pendingInstance())
+	if err == nil || !strings.HasPrefix(err.Error(), "EC2 instance 'i-0123456789abcdef0' did not become running:") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitRunningTimeout(t *testing.T) {
+	prov := fakeEc2(t, map[string]string{
+		"DescribeInstances": describeInstances("pending"),
+	})
+	prov.StartTimeout = 100 * time.Millisecond
+	mach := &providers.Machine{State: &state{id: "i-0123456789abcdef0"}}
+
+	_, err := prov.waitRunning(mach, pendingInstance())
+	if err == nil || err.Error() != "timed out waiting for EC2 instance 'i-0123456789abcdef0' to be running" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWaitStatusChecks(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		instance string
+		system   string
+		err      string
+	}{
+		{name: "ok", instance: "ok", system: "ok"},
+		{
+			name:     "instance impaired",
+			instance: "impaired",
+			system:   "ok",
+			err:      "EC2 instance 'i-0123456789abcdef0' failed status checks (instance: impaired, system: ok)",
+		},
+		{
+			name:     "system impaired",
+			instance: "ok",
+			system:   "impaired",
+			err:      "EC2 instance 'i-0123456789abcdef0' failed status checks (instance: ok, system: impaired)",
+		},
+		{
+			// The default waiter only checks the instance status.
+			name:     "system initializing",
+			instance: "ok",
+			system:   "initializing",
+			err:      "timed out waiting for EC2 instance 'i-0123456789abcdef0' status checks",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov := fakeEc2(t, map[string]string{
+				"DescribeInstanceStatus": describeInstanceStatus(tc.instance, tc.system),
+			})
+			mach := &providers.Machine{State: &state{
+				id:       "i-0123456789abcdef0",
+				deadline: time.Now().Add(100 * time.Millisecond),
+			}}
+
+			err := prov.waitStatusChecks(mach)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("unexpected error: %s", err)
+			case tc.err != "" && (err == nil || !strings.HasSuffix(err.Error(), tc.err)):
+				t.Fatalf("expected error '%s', got: %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package azure_vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v7"
+	"golang.org/x/net/context"
+)
+
+// pollFrequency is how often long-running operations are polled, unless the
+// server requests a different delay with Retry-After.
+const pollFrequency = 5 * time.Second
+
+// client holds the Azure Resource Manager clients used by the provider.
+type client struct {
+	vms  *armcompute.VirtualMachinesClient
+	nics *armnetwork.InterfacesClient
+	pips *armnetwork.PublicIPAddressesClient
+}
+
+// Use a service principal if clientId is set. Otherwise, use
+// DefaultAzureCredential, which tries environment variables, workload
+// identity, managed identity and the Azure CLI, in that order.
+func newCredential(tenantId string, clientId string, clientSecret string) (azcore.TokenCredential, error) {
+	if clientId != "" {
+		return azidentity.NewClientSecretCredential(tenantId, clientId, clientSecret, nil)
+	}
+	return azidentity.NewDefaultAzureCredential(nil)
+}
+
+// Create clients for a subscription. Options are used by tests to point the
+// clients at a local server.
+func newClient(subscription string, cred azcore.TokenCredential, opts *arm.ClientOptions) (*client, error) {
+	computeClients, err := armcompute.NewClientFactory(subscription, cred, opts)
+	if err != nil {
+		return nil, err
+	}
+	networkClients, err := armnetwork.NewClientFactory(subscription, cred, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &client{
+		vms:  computeClients.NewVirtualMachinesClient(),
+		nics: networkClients.NewInterfacesClient(),
+		pips: networkClients.NewPublicIPAddressesClient(),
+	}, nil
+}
+
+// Wait for a long-running operation started with one of the Begin methods.
+func wait[T any](ctx context.Context, poller *runtime.Poller[T], err error) error {
+	if err != nil {
+		return err
+	}
+	_, err = poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{Frequency: pollFrequency})
+	return err
+}
+
+// List all VMs in a resource group.
+func (c *client) listVms(ctx context.Context, group string) ([]*armcompute.VirtualMachine, error) {
+	var vms []*armcompute.VirtualMachine
+	pager := c.vms.NewListPager(group, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, page.Value...)
+	}
+	return vms, nil
+}
+
+// Get the power state of a VM, like 'running' or 'deallocated'.
+func (c *client) vmPowerState(ctx context.Context, group string, name string) (string, error) {
+	res, err := c.vms.InstanceView(ctx, group, name, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, status := range res.Statuses {
+		if code := stringValue(status.Code); strings.HasPrefix(code, "PowerState/") {
+			return strings.TrimPrefix(code, "PowerState/"), nil
+		}
+	}
+	return "", nil
+}
+
+// Find the private IP address of the primary NIC of a VM, and the public IP
+// address associated with it, if any.
+func (c *client) vmAddresses(ctx context.Context, vm *armcompute.VirtualMachine) (string, string, error) {
+	if vm.Properties == nil || vm.Properties.NetworkProfile == nil || len(vm.Properties.NetworkProfile.NetworkInterfaces) == 0 {
+		return "", "", nil
+	}
+	refs := vm.Properties.NetworkProfile.NetworkInterfaces
+	nicId := stringValue(refs[0].ID)
+	for _, ref := range refs {
+		if ref.Properties != nil && ref.Properties.Primary != nil && *ref.Properties.Primary {
+			nicId = stringValue(ref.ID)
+		}
+	}
+
+	group, name, err := parseResourceId(nicId)
+	if err != nil {
+		return "", "", err
+	}
+	nic, err := c.nics.Get(ctx, group, name, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if nic.Properties == nil || len(nic.Properties.IPConfigurations) == 0 || nic.Properties.IPConfigurations[0].Properties == nil {
+		return "", "", nil
+	}
+	ipConfig := nic.Properties.IPConfigurations[0].Properties
+	privateIp := stringValue(ipConfig.PrivateIPAddress)
+	if ipConfig.PublicIPAddress == nil {
+		return privateIp, "", nil
+	}
+
+	group, name, err = parseResourceId(stringValue(ipConfig.PublicIPAddress.ID))
+	if err != nil {
+		return "", "", err
+	}
+	pip, err := c.pips.Get(ctx, group, name, nil)
+	if err != nil {
+		return "", "", err
+	}
+	if pip.Properties == nil {
+		return privateIp, "", nil
+	}
+	return privateIp, stringValue(pip.Properties.IPAddress), nil
+}
+
+// Build a resource ID in a resource group.
+func resourceId(subscription string, group string, kind string, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s",
+		url.PathEscape(subscription), url.PathEscape(group), kind, url.PathEscape(name))
+}
+
+// Split a resource ID into the resource group and name.
+func parseResourceId(id string) (string, string, error) {
+	parsed, err := arm.ParseResourceID(id)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid resource ID '%s': %w", id, err)
+	}
+	return parsed.ResourceGroupName, parsed.Name, nil
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// apiError extracts the API error from an error returned by a client, along
+// with the message in the error response. The message of a failed
+// long-running operation is in the same place.
+func apiError(err error) (respErr *azcore.ResponseError, message string, ok bool) {
+	if !errors.As(err, &respErr) {
+		return nil, "", false
+	}
+	message = http.StatusText(respErr.StatusCode)
+	if respErr.RawResponse != nil {
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		payload, _ := runtime.Payload(respErr.RawResponse)
+		if json.Unmarshal(payload, &body) == nil && body.Error.Message != "" {
+			message = body.Error.Message
+		}
+	}
+	return respErr, message, true
+}
+
+// isNotFound checks whether an error indicates a resource does not exist.
+func isNotFound(err error) bool {
+	respErr, _, ok := apiError(err)
+	return ok && respErr.StatusCode == http.StatusNotFound
+}
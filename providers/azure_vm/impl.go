@@ -0,0 +1,989 @@
+// Implements the 'azure_vm' target type, which uses the Azure Resource Manager
+// API to create and delete Azure virtual machines, or start and deallocate an
+// existing virtual machine.
+package azure_vm
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/network/armnetwork/v7"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("azure_vm", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target        string
+	Subscription  string
+	ResourceGroup string
+	// VmName is set to start and deallocate an existing VM, instead of
+	// creating and deleting VMs.
+	VmName string
+	// Vm is the template for new VMs. The OS profile and network profile are
+	// set per machine.
+	Vm            *armcompute.VirtualMachine
+	AdminUsername string
+	SshPublicKey  string
+	CustomData    string
+	SubnetId      string
+	// PublicIp is 'create', 'none', or the resource ID of an existing public
+	// IP address to associate with the VM.
+	PublicIp       string
+	UsePrivateIp   bool
+	CheckAddr      *string
+	CheckPort      uint16
+	Check          *providers.ConnectivityCheck
+	StartRetries   int
+	Shared         bool
+	Linger         time.Duration
+	MinUptime      time.Duration
+	StartTimeout   time.Duration
+	RequestTimeout time.Duration
+	GcOnStart      bool
+	GcMinAge       time.Duration
+	Azure          *client
+}
+
+type state struct {
+	name string
+	// nicName is set if the NIC was created by us, and pipName if the public
+	// IP address was created by us.
+	nicName string
+	pipName string
+	addr    string
+	// created is set if the VM was created by us, and started if an existing
+	// VM was started by us.
+	created bool
+	started bool
+	// deadline is when the VM must be ready, according to 'start_timeout'.
+	deadline time.Time
+}
+
+type hclTarget struct {
+	Image               *hclImage         `hcl:"image,block"`
+	SubscriptionId      string            `hcl:"subscription_id,optional"`
+	TenantId            string            `hcl:"tenant_id,optional"`
+	ClientId            string            `hcl:"client_id,optional"`
+	ClientSecret        *string           `hcl:"client_secret,optional"`
+	ClientSecretFile    *string           `hcl:"client_secret_file,optional"`
+	ResourceGroup       string            `hcl:"resource_group,attr"`
+	Location            string            `hcl:"location,optional"`
+	VmName              string            `hcl:"vm_name,optional"`
+	VmSize              string            `hcl:"vm_size,optional"`
+	ImageId             string            `hcl:"image_id,optional"`
+	AdminUsername       string            `hcl:"admin_username,optional"`
+	SshPublicKey        string            `hcl:"ssh_public_key,optional"`
+	CustomData          *string           `hcl:"custom_data,optional"`
+	SubnetId            string            `hcl:"subnet_id,optional"`
+	Vnet                string            `hcl:"vnet,optional"`
+	Subnet              string            `hcl:"subnet,optional"`
+	VnetResourceGroup   string            `hcl:"vnet_resource_group,optional"`
+	PublicIp            string            `hcl:"public_ip,optional"`
+	UsePrivateIp        bool              `hcl:"use_private_ip,optional"`
+	OsDiskType          string            `hcl:"os_disk_type,optional"`
+	OsDiskSizeGb        int32             `hcl:"os_disk_size_gb,optional"`
+	Spot                bool              `hcl:"spot,optional"`
+	EvictionPolicy      string            `hcl:"eviction_policy,optional"`
+	MaxPrice            *float64          `hcl:"max_price,optional"`
+	Tags                map[string]string `hcl:"tags,optional"`
+	CheckAddr           *string           `hcl:"check_addr,optional"`
+	CheckPort           uint16            `hcl:"check_port,optional"`
+	CheckType           string            `hcl:"check_type,optional"`
+	CheckServerName     string            `hcl:"check_servername,optional"`
+	CheckInsecure       bool              `hcl:"check_insecure,optional"`
+	CheckCommand        string            `hcl:"check_command,optional"`
+	CheckCommandTimeout string            `hcl:"check_command_timeout,optional"`
+	StartRetries        int               `hcl:"start_retries,optional"`
+	Shared              *bool             `hcl:"shared,optional"`
+	Linger              string            `hcl:"linger,optional"`
+	MinUptime           string            `hcl:"min_uptime,optional"`
+	StartTimeout        string            `hcl:"start_timeout,optional"`
+	RequestTimeout      string            `hcl:"request_timeout,optional"`
+	GcOnStart           bool              `hcl:"gc_on_start,optional"`
+	GcMinAge            string            `hcl:"gc_min_age,optional"`
+}
+
+// A marketplace image, see:
+// https://learn.microsoft.com/en-us/azure/virtual-machines/linux/cli-ps-findimage
+type hclImage struct {
+	Publisher string `hcl:"publisher,attr"`
+	Offer     string `hcl:"offer,attr"`
+	Sku       string `hcl:"sku,attr"`
+	Version   string `hcl:"version,optional"`
+}
+
+// managedTag and targetTag are added to every VM LazySSH creates, with the
+// values 'lazyssh' and the target address, so orphaned VMs can be found by
+// Sweep.
+const (
+	managedTag = "ManagedBy"
+	targetTag  = "lazyssh:target"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]`)
+
+var (
+	errNoAddress = errors.New("does not have an IP address to connect to")
+	errNoQuota   = errors.New("Azure quota or capacity exceeded")
+)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	clientSecret, secretDiags := providers.ResolveSecret("client_secret", parsed.ClientSecret, parsed.ClientSecretFile)
+	diags = append(diags, secretDiags...)
+	if parsed.ClientId != "" && (parsed.TenantId == "" || clientSecret == "") && !secretDiags.HasErrors() {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Incomplete service principal credentials",
+			Detail:   "All of 'tenant_id', 'client_id' and 'client_secret' (or 'client_secret_file') must be set to use a service principal",
+		})
+	} else if parsed.ClientId == "" && (parsed.TenantId != "" || clientSecret != "") {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Incomplete service principal credentials",
+			Detail:   "The 'client_id' field is required with 'tenant_id' and 'client_secret'",
+		})
+	}
+
+	subscription := parsed.SubscriptionId
+	if subscription == "" {
+		subscription = os.Getenv("AZURE_SUBSCRIPTION_ID")
+	}
+	if subscription == "" {
+		// In check mode, the environment may lack Azure configuration entirely.
+		severity := hcl.DiagError
+		if cfgCtx.CheckOnly {
+			severity = hcl.DiagWarning
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: severity,
+			Summary:  "Missing Azure subscription",
+			Detail:   "Set 'subscription_id', or the AZURE_SUBSCRIPTION_ID environment variable for 'azure_vm' targets",
+		})
+	}
+
+	prov := &Provider{
+		Target:         target,
+		Subscription:   subscription,
+		ResourceGroup:  parsed.ResourceGroup,
+		VmName:         parsed.VmName,
+		AdminUsername:  parsed.AdminUsername,
+		SshPublicKey:   strings.TrimSpace(parsed.SshPublicKey),
+		UsePrivateIp:   parsed.UsePrivateIp,
+		CheckAddr:      parsed.CheckAddr,
+		StartRetries:   parsed.StartRetries,
+		StartTimeout:   5 * time.Minute,
+		RequestTimeout: 30 * time.Second,
+		GcOnStart:      parsed.GcOnStart,
+		GcMinAge:       time.Hour,
+	}
+
+	// Incomplete service principal credentials were reported above.
+	if !diags.HasErrors() {
+		cred, err := newCredential(parsed.TenantId, parsed.ClientId, clientSecret)
+		if err == nil {
+			prov.Azure, err = newClient(subscription, cred, nil)
+		}
+		if err != nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Error loading Azure credentials",
+				Detail:   err.Error(),
+			})
+		}
+	}
+
+	if parsed.VmName != "" {
+		if parsed.Shared != nil && !*parsed.Shared {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'shared' field",
+				Detail:   "An existing VM set with 'vm_name' is always shared",
+			})
+		}
+		if parsed.Location != "" || parsed.VmSize != "" || parsed.Image != nil || parsed.ImageId != "" ||
+			parsed.AdminUsername != "" || parsed.SshPublicKey != "" || parsed.CustomData != nil ||
+			parsed.SubnetId != "" || parsed.Vnet != "" || parsed.PublicIp != "" ||
+			parsed.OsDiskType != "" || parsed.OsDiskSizeGb != 0 || parsed.Spot || len(parsed.Tags) != 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Launch settings were ignored",
+				Detail:   "Settings used to create new VMs, like 'location', 'vm_size', 'image', 'subnet_id', 'public_ip', 'spot' and 'tags', have no effect when 'vm_name' is set",
+			})
+		}
+	} else {
+		diags = append(diags, prov.buildVm(target, parsed)...)
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
+	if parsed.Shared == nil {
+		prov.Shared = true
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+
+	if prov.PublicIp != "create" && prov.PublicIp != "none" && prov.VmName == "" && !prov.Shared {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "An existing public IP address can only be associated with one VM at a time, so it requires 'shared = true'",
+		})
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'azure_vm' targets with 'shared = false'"),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"start_timeout", parsed.StartTimeout, &prov.StartTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+// Validate settings used to create new VMs, and build the VM template.
+func (prov *Provider) buildVm(target string, parsed *hclTarget) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	for _, field := range []struct {
+		name  string
+		value string
+	}{
+		{"location", parsed.Location},
+		{"vm_size", parsed.VmSize},
+		{"admin_username", parsed.AdminUsername},
+		{"ssh_public_key", parsed.SshPublicKey},
+	} {
+		if field.value == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Missing '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' field is required unless 'vm_name' is set", field.name),
+			})
+		}
+	}
+
+	image := &armcompute.ImageReference{}
+	switch {
+	case parsed.Image != nil && parsed.ImageId != "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'image' and 'image_id' fields",
+			Detail:   "Only one of an 'image' block and 'image_id' may be set",
+		})
+	case parsed.Image != nil:
+		image.Publisher = to.Ptr(parsed.Image.Publisher)
+		image.Offer = to.Ptr(parsed.Image.Offer)
+		image.SKU = to.Ptr(parsed.Image.Sku)
+		image.Version = to.Ptr(parsed.Image.Version)
+		if parsed.Image.Version == "" {
+			image.Version = to.Ptr("latest")
+		}
+	case parsed.ImageId != "":
+		image.ID = to.Ptr(parsed.ImageId)
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'image' or 'image_id' field",
+			Detail:   "An 'image' block or 'image_id' is required unless 'vm_name' is set",
+		})
+	}
+
+	switch {
+	case parsed.SubnetId != "" && (parsed.Vnet != "" || parsed.Subnet != ""):
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'subnet_id' and 'vnet' fields",
+			Detail:   "Set either 'subnet_id', or 'vnet' and 'subnet', but not both",
+		})
+	case parsed.SubnetId != "":
+		prov.SubnetId = parsed.SubnetId
+	case parsed.Vnet != "" && parsed.Subnet != "":
+		group := parsed.VnetResourceGroup
+		if group == "" {
+			group = parsed.ResourceGroup
+		}
+		prov.SubnetId = resourceId(prov.Subscription, group, "Microsoft.Network/virtualNetworks", parsed.Vnet) +
+			"/subnets/" + parsed.Subnet
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'subnet_id' field",
+			Detail:   "Set 'subnet_id', or 'vnet' and 'subnet', unless 'vm_name' is set",
+		})
+	}
+
+	switch {
+	case parsed.PublicIp == "" || parsed.PublicIp == "create":
+		prov.PublicIp = "create"
+	case parsed.PublicIp == "none":
+		prov.PublicIp = "none"
+		if !parsed.UsePrivateIp {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "VMs will not be reachable",
+				Detail:   "When 'public_ip' is \"none\", 'use_private_ip' must be set",
+			})
+		}
+	case strings.HasPrefix(parsed.PublicIp, "/subscriptions/"):
+		prov.PublicIp = parsed.PublicIp
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'public_ip' field",
+			Detail:   fmt.Sprintf("The 'public_ip' value must be \"create\", \"none\", or the resource ID of a public IP address, but got '%s'", parsed.PublicIp),
+		})
+	}
+
+	if parsed.CustomData != nil {
+		prov.CustomData = base64.StdEncoding.EncodeToString([]byte(*parsed.CustomData))
+	}
+
+	disk := &armcompute.OSDisk{
+		CreateOption: to.Ptr(armcompute.DiskCreateOptionTypesFromImage),
+		DeleteOption: to.Ptr(armcompute.DiskDeleteOptionTypesDelete),
+	}
+	if parsed.OsDiskSizeGb > 0 {
+		disk.DiskSizeGB = to.Ptr(parsed.OsDiskSizeGb)
+	}
+	if parsed.OsDiskType != "" {
+		disk.ManagedDisk = &armcompute.ManagedDiskParameters{
+			StorageAccountType: to.Ptr(armcompute.StorageAccountTypes(parsed.OsDiskType)),
+		}
+	}
+	if parsed.OsDiskSizeGb < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'os_disk_size_gb' field",
+			Detail:   fmt.Sprintf("The 'os_disk_size_gb' value must not be negative, but got %d", parsed.OsDiskSizeGb),
+		})
+	}
+
+	tags := map[string]*string{
+		managedTag: to.Ptr("lazyssh"),
+		targetTag:  to.Ptr(target),
+	}
+	for key, value := range parsed.Tags {
+		if key == managedTag || key == targetTag {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'tags' field",
+				Detail:   fmt.Sprintf("The tag '%s' is reserved, LazySSH sets it on every VM", key),
+			})
+			continue
+		}
+		tags[key] = to.Ptr(value)
+	}
+
+	prov.Vm = &armcompute.VirtualMachine{
+		Location: to.Ptr(parsed.Location),
+		Tags:     tags,
+		Properties: &armcompute.VirtualMachineProperties{
+			HardwareProfile: &armcompute.HardwareProfile{
+				VMSize: to.Ptr(armcompute.VirtualMachineSizeTypes(parsed.VmSize)),
+			},
+			StorageProfile: &armcompute.StorageProfile{
+				ImageReference: image,
+				OSDisk:         disk,
+			},
+		},
+	}
+
+	if parsed.Spot {
+		switch parsed.EvictionPolicy {
+		case "", "Delete":
+			prov.Vm.Properties.EvictionPolicy = to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDelete)
+		case "Deallocate":
+			prov.Vm.Properties.EvictionPolicy = to.Ptr(armcompute.VirtualMachineEvictionPolicyTypesDeallocate)
+		default:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'eviction_policy' field",
+				Detail:   fmt.Sprintf("The 'eviction_policy' value must be one of 'Delete' or 'Deallocate', but got '%s'", parsed.EvictionPolicy),
+			})
+		}
+		maxPrice := -1.0
+		if parsed.MaxPrice != nil {
+			maxPrice = *parsed.MaxPrice
+		}
+		prov.Vm.Properties.Priority = to.Ptr(armcompute.VirtualMachinePriorityTypesSpot)
+		prov.Vm.Properties.BillingProfile = &armcompute.BillingProfile{MaxPrice: to.Ptr(maxPrice)}
+	} else if parsed.EvictionPolicy != "" || parsed.MaxPrice != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Spot settings were ignored",
+			Detail:   "The 'eviction_policy' and 'max_price' fields have no effect unless 'spot' is set",
+		})
+	}
+
+	return diags
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially created VM before a retry.
+			prov.stop(mach)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("Azure VM failed to start: %s\n", err.Error())
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared Azure VM left running by a previous process.
+// Other VMs are deleted, because they were dedicated to an SSH connection
+// that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	state := prov.newState(id)
+	mach.State = state
+	mach.SetInstanceID(id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	powerState, err := prov.Azure.vmPowerState(ctx, prov.ResourceGroup, state.name)
+	cancel()
+	if isNotFound(err) {
+		if state.created {
+			// The VM is gone, but the NIC and public IP may be left.
+			prov.stop(mach)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check Azure VM '%s' state: %w", id, err)
+	}
+
+	if !prov.Shared || powerState != "running" {
+		if state.created {
+			log.Printf("Deleting orphaned Azure VM '%s'\n", id)
+			prov.stop(mach)
+		}
+		return nil
+	}
+
+	log.Printf("Adopted Azure VM '%s'\n", id)
+	state.started = true
+	state.deadline = time.Now().Add(prov.StartTimeout)
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		err = prov.connectivityTest(mach)
+	}
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Sweep deletes VMs created for this target that are older than 'gc_min_age',
+// along with their NIC and public IP address, if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart || prov.VmName != "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	vms, err := prov.Azure.listVms(ctx, prov.ResourceGroup)
+	cancel()
+	if err != nil {
+		log.Printf("Could not list Azure VMs for target '%s': %s\n", prov.Target, err.Error())
+		return
+	}
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	for _, vm := range vms {
+		name := stringValue(vm.Name)
+		if skip[name] || stringValue(vm.Tags[managedTag]) != "lazyssh" || stringValue(vm.Tags[targetTag]) != prov.Target {
+			continue
+		}
+		if vm.Properties == nil || vm.Properties.TimeCreated == nil || time.Since(*vm.Properties.TimeCreated) < prov.GcMinAge {
+			continue
+		}
+		log.Printf("Deleting orphaned Azure VM '%s' for target '%s', created at %s\n", name, prov.Target, vm.Properties.TimeCreated.Format(time.RFC3339))
+		prov.stop(&providers.Machine{State: prov.newState(name)})
+	}
+}
+
+// Build the state for a VM name. VMs created by us have a NIC and public IP
+// address named after the VM.
+func (prov *Provider) newState(name string) *state {
+	state := &state{
+		name:    name,
+		created: prov.VmName == "",
+	}
+	if state.created {
+		state.nicName = name + "-nic"
+		if prov.PublicIp == "create" {
+			state.pipName = name + "-ip"
+		}
+	}
+	return state
+}
+
+// Create a VM, or start the existing VM set with 'vm_name', and find its
+// address.
+func (prov *Provider) start(mach *providers.Machine) error {
+	if prov.VmName != "" {
+		if err := prov.startExisting(mach); err != nil {
+			return err
+		}
+	} else if err := prov.create(mach); err != nil {
+		return err
+	}
+	return prov.resolveAddr(mach)
+}
+
+// Start the existing VM, unless it is already running.
+func (prov *Provider) startExisting(mach *providers.Machine) error {
+	state := prov.newState(prov.VmName)
+	state.deadline = time.Now().Add(prov.StartTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	powerState, err := prov.Azure.vmPowerState(ctx, prov.ResourceGroup, state.name)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not check Azure VM '%s' state: %w", state.name, err)
+	}
+	mach.State = state
+	mach.SetInstanceID(state.name)
+	if powerState == "running" {
+		log.Printf("Azure VM '%s' is already running\n", state.name)
+		return nil
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), state.deadline)
+	poller, err := prov.Azure.vms.BeginStart(ctx, prov.ResourceGroup, state.name, nil)
+	err = wait(ctx, poller, err)
+	cancel()
+	if err != nil {
+		return describeError(fmt.Sprintf("could not start Azure VM '%s'", state.name), err)
+	}
+	state.started = true
+	log.Printf("Started Azure VM '%s'\n", state.name)
+	return nil
+}
+
+// Create the public IP address, NIC and VM. The state is set before anything
+// is created, so partial resources are cleaned up on failure.
+func (prov *Provider) create(mach *providers.Machine) error {
+	state := prov.newState(vmName(prov.Target))
+	state.deadline = time.Now().Add(prov.StartTimeout)
+	mach.State = state
+	mach.SetInstanceID(state.name)
+
+	ctx, cancel := context.WithDeadline(context.Background(), state.deadline)
+	defer cancel()
+
+	log.Printf("Creating Azure VM '%s'\n", state.name)
+	group := prov.ResourceGroup
+	pipId := prov.PublicIp
+	if state.pipName != "" {
+		pip := armnetwork.PublicIPAddress{
+			Location: prov.Vm.Location,
+			Tags:     prov.Vm.Tags,
+			SKU:      &armnetwork.PublicIPAddressSKU{Name: to.Ptr(armnetwork.PublicIPAddressSKUNameStandard)},
+			Properties: &armnetwork.PublicIPAddressPropertiesFormat{
+				PublicIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodStatic),
+			},
+		}
+		poller, err := prov.Azure.pips.BeginCreateOrUpdate(ctx, group, state.pipName, pip, nil)
+		if err := wait(ctx, poller, err); err != nil {
+			return describeError(fmt.Sprintf("could not create public IP address for Azure VM '%s'", state.name), err)
+		}
+		pipId = resourceId(prov.Subscription, group, "Microsoft.Network/publicIPAddresses", state.pipName)
+	}
+
+	ipConfig := &armnetwork.InterfaceIPConfigurationPropertiesFormat{
+		Subnet:                    &armnetwork.Subnet{ID: to.Ptr(prov.SubnetId)},
+		PrivateIPAllocationMethod: to.Ptr(armnetwork.IPAllocationMethodDynamic),
+	}
+	if pipId != "none" {
+		ipConfig.PublicIPAddress = &armnetwork.PublicIPAddress{ID: to.Ptr(pipId)}
+	}
+	nic := armnetwork.Interface{
+		Location: prov.Vm.Location,
+		Tags:     prov.Vm.Tags,
+		Properties: &armnetwork.InterfacePropertiesFormat{
+			IPConfigurations: []*armnetwork.InterfaceIPConfiguration{{
+				Name:       to.Ptr("ipconfig1"),
+				Properties: ipConfig,
+			}},
+		},
+	}
+	nicPoller, err := prov.Azure.nics.BeginCreateOrUpdate(ctx, group, state.nicName, nic, nil)
+	if err := wait(ctx, nicPoller, err); err != nil {
+		return describeError(fmt.Sprintf("could not create network interface for Azure VM '%s'", state.name), err)
+	}
+
+	vm := *prov.Vm
+	props := *prov.Vm.Properties
+	vm.Properties = &props
+	props.OSProfile = &armcompute.OSProfile{
+		ComputerName:  to.Ptr(state.name),
+		AdminUsername: to.Ptr(prov.AdminUsername),
+		LinuxConfiguration: &armcompute.LinuxConfiguration{
+			DisablePasswordAuthentication: to.Ptr(true),
+			SSH: &armcompute.SSHConfiguration{
+				PublicKeys: []*armcompute.SSHPublicKey{{
+					Path:    to.Ptr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", prov.AdminUsername)),
+					KeyData: to.Ptr(prov.SshPublicKey),
+				}},
+			},
+		},
+	}
+	if prov.CustomData != "" {
+		props.OSProfile.CustomData = to.Ptr(prov.CustomData)
+	}
+	props.NetworkProfile = &armcompute.NetworkProfile{
+		NetworkInterfaces: []*armcompute.NetworkInterfaceReference{{
+			ID: to.Ptr(resourceId(prov.Subscription, group, "Microsoft.Network/networkInterfaces", state.nicName)),
+			Properties: &armcompute.NetworkInterfaceReferenceProperties{
+				Primary:      to.Ptr(true),
+				DeleteOption: to.Ptr(armcompute.DeleteOptionsDelete),
+			},
+		}},
+	}
+	vmPoller, err := prov.Azure.vms.BeginCreateOrUpdate(ctx, group, state.name, vm, nil)
+	if err := wait(ctx, vmPoller, err); err != nil {
+		return describeError(fmt.Sprintf("could not create Azure VM '%s'", state.name), err)
+	}
+
+	log.Printf("Created Azure VM '%s'\n", state.name)
+	mach.SetInfo("vm_size", string(*props.HardwareProfile.VMSize))
+	mach.SetInfo("location", *vm.Location)
+	return nil
+}
+
+// Generate a VM name for a target, followed by a random string. VM names may
+// only contain letters, digits and dashes, and double as the hostname.
+func vmName(target string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(target), "-"), "-")
+	if len(name) > 50 {
+		name = strings.TrimRight(name[:50], "-")
+	}
+	if name == "" {
+		name = "lazyssh"
+	}
+	return name + "-" + randomString(8)
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// Set the VM address in state: the public IP address, or the private IP
+// address with 'use_private_ip'.
+func (prov *Provider) resolveAddr(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	defer cancel()
+
+	vm, err := prov.Azure.vms.Get(ctx, prov.ResourceGroup, state.name, nil)
+	if err != nil {
+		return fmt.Errorf("could not get Azure VM '%s': %w", state.name, err)
+	}
+	privateIp, publicIp, err := prov.Azure.vmAddresses(ctx, &vm.VirtualMachine)
+	if err != nil {
+		return fmt.Errorf("could not get Azure VM '%s' addresses: %w", state.name, err)
+	}
+
+	state.addr = publicIp
+	if prov.UsePrivateIp {
+		state.addr = privateIp
+	}
+	if state.addr == "" {
+		return fmt.Errorf("Azure VM '%s' %w, consider setting 'use_private_ip'", state.name, errNoAddress)
+	}
+	log.Printf("Azure VM '%s' has address %s\n", state.name, state.addr)
+	mach.SetInfo("addr", state.addr)
+	return nil
+}
+
+// describeError wraps an API error. Quota and capacity errors are marked, so
+// they are not retried, and reported to SSH clients as such.
+func describeError(msg string, err error) error {
+	if respErr, message, ok := apiError(err); ok {
+		switch respErr.ErrorCode {
+		case "QuotaExceeded", "OperationNotAllowed", "SkuNotAvailable", "AllocationFailed",
+			"ZonalAllocationFailed", "OverconstrainedAllocationRequest", "OverconstrainedZonalAllocationRequest":
+			return fmt.Errorf("%s: %w: %s", msg, errNoQuota, message)
+		}
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// isRetryable classifies errors from start. Throttling and server-side errors
+// are retried, while quota, capacity and validation errors are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, errNoQuota) || errors.Is(err, errNoAddress) {
+		return false
+	}
+	respErr, _, ok := apiError(err)
+	if !ok {
+		// Network errors and the like.
+		return true
+	}
+	return respErr.StatusCode == 429 || respErr.StatusCode >= 500
+}
+
+// Deallocate an existing VM if it was started by us, or delete a VM created by
+// us, along with its NIC and public IP address. Deallocating, rather than
+// only powering off, releases the compute resources, so they are not billed.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	if !state.created {
+		if !state.started {
+			log.Printf("Leaving Azure VM '%s' running, because it was not started by LazySSH\n", state.name)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), prov.StartTimeout)
+		poller, err := prov.Azure.vms.BeginDeallocate(ctx, prov.ResourceGroup, state.name, nil)
+		err = wait(ctx, poller, err)
+		cancel()
+		if err != nil {
+			log.Printf("Azure VM '%s' failed to deallocate: %s\n", state.name, err.Error())
+			mach.ReportStopError(fmt.Errorf("Azure VM '%s' failed to deallocate: %w", state.name, err))
+			return
+		}
+		log.Printf("Deallocated Azure VM '%s'\n", state.name)
+		return
+	}
+
+	// The NIC is deleted along with the VM, but may exist on its own if
+	// creating the VM failed. The public IP address can only be deleted once
+	// the NIC is gone.
+	for _, resource := range []struct {
+		desc   string
+		name   string
+		delete func(ctx context.Context, name string) error
+	}{
+		{"VM", state.name, func(ctx context.Context, name string) error {
+			poller, err := prov.Azure.vms.BeginDelete(ctx, prov.ResourceGroup, name, nil)
+			return wait(ctx, poller, err)
+		}},
+		{"network interface", state.nicName, func(ctx context.Context, name string) error {
+			poller, err := prov.Azure.nics.BeginDelete(ctx, prov.ResourceGroup, name, nil)
+			return wait(ctx, poller, err)
+		}},
+		{"public IP address", state.pipName, func(ctx context.Context, name string) error {
+			poller, err := prov.Azure.pips.BeginDelete(ctx, prov.ResourceGroup, name, nil)
+			return wait(ctx, poller, err)
+		}},
+	} {
+		if resource.name == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), prov.StartTimeout)
+		err := resource.delete(ctx, resource.name)
+		cancel()
+		if err != nil && !isNotFound(err) {
+			log.Printf("Azure VM '%s' %s failed to delete: %s\n", state.name, resource.desc, err.Error())
+			mach.ReportStopError(fmt.Errorf("Azure VM '%s' %s failed to delete: %w", state.name, resource.desc, err))
+			return
+		}
+	}
+	log.Printf("Deleted Azure VM '%s'\n", state.name)
+}
+
+// Check port every 3 seconds until the 'start_timeout' deadline.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for Azure VM '%s'\n", state.name)
+			return nil
+		}
+		if checkStart.Add(checkTimeout).After(state.deadline) {
+			break
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("Azure VM '%s' port check on '%s' timed out: %w", state.name, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
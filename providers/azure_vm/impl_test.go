@@ -0,0 +1,264 @@
+package azure_vm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute/v6"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+const groupPath = "/subscriptions/sub/resourceGroups/group/providers"
+
+// generatedName matches VM names generated for the 'test' target.
+var generatedName = regexp.MustCompile(`/test-[a-z0-9]{8}`)
+
+// staticCredential is a TokenCredential that always returns the same token.
+type staticCredential struct{}
+
+func (staticCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// fakeArm creates a Provider with clients that talk to a fake API server, with
+// responses keyed by method and path relative to the resource group.
+// Generated names are replaced with 'vm' in the path. A response starting
+// with 'async ' is returned as a long-running operation, which reports the
+// rest of the response as its status. Request bodies are returned by the
+// bodies function.
+func fakeArm(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{
+		TLS: true,
+		Key: func(r *http.Request) string {
+			return r.Method + " " + generatedName.ReplaceAllString(strings.TrimPrefix(r.URL.Path, groupPath), "/vm")
+		},
+		Respond: func(s *apitest.Server, w http.ResponseWriter, r *http.Request, key string, res string) string {
+			if !strings.HasPrefix(res, "async ") {
+				return res
+			}
+			path := strings.SplitN(key, " ", 2)[1]
+			s.SetResponse("GET /operations"+path, strings.TrimPrefix(res, "async "))
+			w.Header().Set("Azure-AsyncOperation", s.URL+groupPath+"/operations"+path)
+			status := http.StatusCreated
+			if r.Method == "DELETE" {
+				status = http.StatusAccepted
+			}
+			return fmt.Sprintf(`%d {"properties": {"provisioningState": "Creating"}}`, status)
+		},
+	})
+
+	azure, err := newClient("sub", staticCredential{}, &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				ActiveDirectoryAuthorityHost: srv.URL,
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {Endpoint: srv.URL, Audience: "https://management.azure.com"},
+				},
+			},
+			Retry:     policy.RetryOptions{MaxRetries: -1},
+			Transport: srv.Client(),
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+
+	prov = &Provider{
+		Target:        "test",
+		Subscription:  "sub",
+		ResourceGroup: "group",
+		Vm: &armcompute.VirtualMachine{
+			Location: to.Ptr("westeurope"),
+			Properties: &armcompute.VirtualMachineProperties{
+				HardwareProfile: &armcompute.HardwareProfile{VMSize: to.Ptr(armcompute.VirtualMachineSizeTypesStandardB1S)},
+			},
+		},
+		AdminUsername:  "admin",
+		SshPublicKey:   "ssh-ed25519 AAAA",
+		SubnetId:       groupPath + "/Microsoft.Network/virtualNetworks/vnet/subnets/default",
+		PublicIp:       "create",
+		StartTimeout:   time.Minute,
+		RequestTimeout: 5 * time.Second,
+		Azure:          azure,
+	}
+	return prov, srv.Bodies
+}
+
+const (
+	vmResponse = `{
+		"name": "vm",
+		"properties": {
+			"provisioningState": "Succeeded",
+			"networkProfile": {"networkInterfaces": [{
+				"id": "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Network/networkInterfaces/vm-nic",
+				"properties": {"primary": true}
+			}]}
+		}
+	}`
+	nicResponse = `{
+		"name": "vm-nic",
+		"properties": {
+			"provisioningState": "Succeeded",
+			"ipConfigurations": [{"name": "ipconfig1", "properties": {
+				"privateIPAddress": "10.0.0.4",
+				"publicIPAddress": {"id": "/subscriptions/sub/resourceGroups/group/providers/Microsoft.Network/publicIPAddresses/vm-ip"}
+			}}]
+		}
+	}`
+	pipResponse = `{
+		"name": "vm-ip",
+		"properties": {"provisioningState": "Succeeded", "ipAddress": "192.0.2.10"}
+	}`
+)
+
+func TestStartCreate(t *testing.T) {
+	prov, bodies := fakeArm(t, map[string]string{
+		"PUT /Microsoft.Network/publicIPAddresses/vm-ip":  pipResponse,
+		"PUT /Microsoft.Network/networkInterfaces/vm-nic": nicResponse,
+		"PUT /Microsoft.Compute/virtualMachines/vm":       `async {"status": "Succeeded"}`,
+		"GET /Microsoft.Compute/virtualMachines/vm":       vmResponse,
+		"GET /Microsoft.Network/networkInterfaces/vm-nic": nicResponse,
+		"GET /Microsoft.Network/publicIPAddresses/vm-ip":  pipResponse,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if !strings.HasPrefix(state.name, "test-") || state.addr != "192.0.2.10" {
+		t.Fatalf("unexpected state: name '%s', addr '%s'", state.name, state.addr)
+	}
+
+	received := bodies()
+	nic := received["PUT /Microsoft.Network/networkInterfaces/vm-nic"]
+	if !strings.Contains(nic, `"publicIPAddress":{"id":"`+groupPath+`/Microsoft.Network/publicIPAddresses/`+state.name+`-ip"}`) {
+		t.Fatalf("expected the NIC to reference the public IP address, got: %s", nic)
+	}
+	vm := received["PUT /Microsoft.Compute/virtualMachines/vm"]
+	if !strings.Contains(vm, `"keyData":"ssh-ed25519 AAAA"`) ||
+		!strings.Contains(vm, `"id":"`+groupPath+`/Microsoft.Network/networkInterfaces/`+state.name+`-nic"`) {
+		t.Fatalf("unexpected VM request: %s", vm)
+	}
+}
+
+func TestStartCreateQuotaExceeded(t *testing.T) {
+	prov, _ := fakeArm(t, map[string]string{
+		"PUT /Microsoft.Network/publicIPAddresses/vm-ip":  pipResponse,
+		"PUT /Microsoft.Network/networkInterfaces/vm-nic": nicResponse,
+		"PUT /Microsoft.Compute/virtualMachines/vm": `async {"status": "Failed", "error": {
+			"code": "QuotaExceeded",
+			"message": "Operation could not be completed as it results in exceeding approved Total Regional Cores quota."
+		}}`,
+	})
+
+	mach := &providers.Machine{}
+	err := prov.start(mach)
+	if !errors.Is(err, errNoQuota) || !strings.HasSuffix(err.Error(), "exceeding approved Total Regional Cores quota.") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isRetryable(err) {
+		t.Fatalf("expected error not to be retried: %s", err)
+	}
+	if mach.State == nil {
+		t.Fatalf("expected state to be set for cleanup")
+	}
+}
+
+func TestStartRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		response  string
+		retryable bool
+	}{
+		{
+			name:      "throttled",
+			response:  `429 {"error": {"code": "TooManyRequests", "message": "Too many requests"}}`,
+			retryable: true,
+		},
+		{
+			name:     "invalid",
+			response: `400 {"error": {"code": "InvalidParameter", "message": "The value of parameter sku is invalid."}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, _ := fakeArm(t, map[string]string{
+				"PUT /Microsoft.Network/publicIPAddresses/vm-ip": tc.response,
+			})
+
+			err := prov.start(&providers.Machine{})
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if isRetryable(err) != tc.retryable {
+				t.Fatalf("expected retryable to be %v for: %s", tc.retryable, err)
+			}
+		})
+	}
+}
+
+func TestStopDeletesResources(t *testing.T) {
+	prov, bodies := fakeArm(t, map[string]string{
+		"DELETE /Microsoft.Compute/virtualMachines/vm":       "async {\"status\": \"Succeeded\"}",
+		"DELETE /Microsoft.Network/networkInterfaces/vm-nic": `404 {"error": {"code": "NotFound", "message": "Not found"}}`,
+		"DELETE /Microsoft.Network/publicIPAddresses/vm-ip":  "204 {}",
+	})
+
+	mach := &providers.Machine{State: prov.newState("test-abcd1234")}
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+	received := bodies()
+	for _, key := range []string{
+		"DELETE /Microsoft.Compute/virtualMachines/vm",
+		"DELETE /Microsoft.Network/networkInterfaces/vm-nic",
+		"DELETE /Microsoft.Network/publicIPAddresses/vm-ip",
+	} {
+		if _, ok := received[key]; !ok {
+			t.Fatalf("expected request %s", key)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	vm := func(name string, target string, created string) string {
+		return `{"name": "` + name + `", "tags": {"ManagedBy": "lazyssh", "lazyssh:target": "` + target + `"},
+			"properties": {"timeCreated": "` + created + `"}}`
+	}
+	prov, bodies := fakeArm(t, map[string]string{
+		"GET /Microsoft.Compute/virtualMachines": `{"value": [` +
+			vm("tracked", "test", old) + `, ` +
+			vm("orphaned", "test", old) + `, ` +
+			vm("starting", "test", recent) + `, ` +
+			vm("other", "other", old) + `, ` +
+			`{"name": "unmanaged", "properties": {"timeCreated": "` + old + `"}}]}`,
+		"DELETE /Microsoft.Compute/virtualMachines/orphaned":       "async {\"status\": \"Succeeded\"}",
+		"DELETE /Microsoft.Network/networkInterfaces/orphaned-nic": "204 {}",
+		"DELETE /Microsoft.Network/publicIPAddresses/orphaned-ip":  "204 {}",
+	})
+	prov.GcOnStart = true
+	prov.GcMinAge = time.Hour
+
+	prov.Sweep([]string{"tracked"})
+	received := bodies()
+	if _, ok := received["DELETE /Microsoft.Compute/virtualMachines/orphaned"]; !ok || len(received) != 5 {
+		t.Fatalf("expected only the orphaned VM to be deleted, got requests: %v", received)
+	}
+}
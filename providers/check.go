@@ -0,0 +1,180 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// ConnectivityCheck performs the connectivity test of a Provider, which
+// determines whether a machine is ready to accept connections.
+type ConnectivityCheck struct {
+	// TLS is set for 'check_type = "tls"', in which case a TLS handshake is
+	// performed after connecting.
+	TLS *tls.Config
+	// Dialer is set if the target has a 'dial_proxy', so the test uses the
+	// same path as forwarded connections.
+	Dialer Dialer
+	// Command is set for 'check_command', a shell command that must exit with
+	// status 0 after the port check succeeds. CommandTimeout limits how long
+	// it may run.
+	Command        string
+	CommandTimeout time.Duration
+}
+
+// NewConnectivityCheck creates a ConnectivityCheck from the 'check_type',
+// 'check_servername' and 'check_insecure' fields of a target. The dialer is
+// ConfigContext.Dialer, and may be nil.
+func NewConnectivityCheck(checkType string, serverName string, insecure bool, dialer Dialer) (*ConnectivityCheck, hcl.Diagnostics) {
+	check := &ConnectivityCheck{Dialer: dialer}
+	switch checkType {
+	case "", "tcp":
+		if serverName != "" || insecure {
+			return check, hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "TLS check settings were ignored",
+				Detail:   "The 'check_servername' and 'check_insecure' fields have no effect unless 'check_type' is 'tls'",
+			}}
+		}
+	case "tls":
+		check.TLS = &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: insecure,
+		}
+	default:
+		return check, hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'check_type' field",
+			Detail:   fmt.Sprintf("The 'check_type' value must be one of 'tcp' or 'tls', but got '%s'", checkType),
+		}}
+	}
+	return check, nil
+}
+
+// SetCommand configures the check from the 'check_command' and
+// 'check_command_timeout' fields of a target.
+func (check *ConnectivityCheck) SetCommand(command string, timeout string) hcl.Diagnostics {
+	check.Command = command
+	check.CommandTimeout = 30 * time.Second
+	if timeout == "" {
+		return nil
+	}
+	commandTimeout, err := time.ParseDuration(timeout)
+	if err != nil || commandTimeout <= 0 {
+		return hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid duration for 'check_command_timeout' field",
+			Detail:   fmt.Sprintf("The 'check_command_timeout' value '%s' is not a valid positive duration", timeout),
+		}}
+	}
+	if command == "" {
+		return hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'check_command_timeout' was ignored",
+			Detail:   "The 'check_command_timeout' field has no effect without 'check_command'",
+		}}
+	}
+	check.CommandTimeout = commandTimeout
+	return nil
+}
+
+// Dial checks a single time whether the address accepts connections, then
+// runs the check command, if any.
+func (check *ConnectivityCheck) Dial(addr string, timeout time.Duration) error {
+	if err := check.dial(addr, timeout); err != nil {
+		return err
+	}
+	if check.Command != "" {
+		return check.runCommand(addr)
+	}
+	return nil
+}
+
+// Run the check command, with the checked host and port in environment
+// variables LAZYSSH_ADDR and LAZYSSH_PORT.
+func (check *ConnectivityCheck) runCommand(addr string) error {
+	host, port, _ := net.SplitHostPort(addr)
+	ctx, cancel := context.WithTimeout(context.Background(), check.CommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", check.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", check.Command)
+	}
+	cmd.Env = append(os.Environ(), "LAZYSSH_ADDR="+host, "LAZYSSH_PORT="+port)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("check command timed out after %s", check.CommandTimeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("check command failed: %w: %s", err, msg)
+		}
+		return fmt.Errorf("check command failed: %w", err)
+	}
+	return nil
+}
+
+// dial checks a single time whether the address accepts connections.
+func (check *ConnectivityCheck) dial(addr string, timeout time.Duration) error {
+	if check.Dialer != nil {
+		return check.dialProxy(addr, timeout)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	if check.TLS == nil {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	// The dialer timeout covers the TLS handshake as well.
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, check.TLS)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dialProxy is like Dial, but uses the Dialer. The timeout covers both the
+// proxy and TLS handshakes.
+func (check *ConnectivityCheck) dialProxy(addr string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := check.Dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if check.TLS == nil {
+		return conn.Close()
+	}
+
+	config := check.TLS
+	if config.ServerName == "" {
+		// Same default as tls.Dial.
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.Handshake()
+	conn.Close()
+	return err
+}
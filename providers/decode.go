@@ -0,0 +1,43 @@
+package providers
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// DecodeStringOrList decodes an attribute that may be either a single string
+// or a list of strings. The name is the name of the field, used in
+// diagnostics. Returns nil if the attribute is not set.
+func DecodeStringOrList(name string, val cty.Value) ([]string, hcl.Diagnostics) {
+	if val == cty.NilVal || val.IsNull() {
+		return nil, nil
+	}
+	if val.Type() == cty.String {
+		return []string{val.AsString()}, nil
+	}
+
+	list, err := convert.Convert(val, cty.List(cty.String))
+	if err != nil || !list.IsWhollyKnown() {
+		return nil, hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid value for '%s' field", name),
+			Detail:   fmt.Sprintf("The '%s' field must be a string or a list of strings", name),
+		}}
+	}
+
+	var result []string
+	for _, item := range list.AsValueSlice() {
+		if item.IsNull() {
+			return nil, hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid value for '%s' field", name),
+				Detail:   fmt.Sprintf("The '%s' list must not contain null values", name),
+			}}
+		}
+		result = append(result, item.AsString())
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package digitalocean
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// client wraps the godo client with the helpers the provider needs on top.
+type client struct {
+	*godo.Client
+}
+
+// errActionErrored is returned by waitAction for an action that errored.
+var errActionErrored = errors.New("errored")
+
+// Create a client for an API token. Requests are not retried by the client,
+// because start and stop have their own retry logic. Options are used by
+// tests to point the client at a local server.
+func newClient(token string, opts ...godo.ClientOpt) (*client, error) {
+	httpClient := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+	do, err := godo.New(httpClient, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &client{do}, nil
+}
+
+// Find the ID of the create action linked in the response to a create
+// request, or 0 if the response did not link it.
+func createActionId(res *godo.Response) int {
+	if res == nil || res.Links == nil {
+		return 0
+	}
+	for _, link := range res.Links.Actions {
+		if link.Rel == "create" {
+			return link.ID
+		}
+	}
+	return 0
+}
+
+// Poll an action every 3 seconds until it completes, and return an error if
+// it errored.
+func (c *client) waitAction(ctx context.Context, id int) error {
+	for {
+		act, _, err := c.Actions.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		switch act.Status {
+		case godo.ActionCompleted:
+			return nil
+		case "errored":
+			return fmt.Errorf("%s action %d %w", act.Type, id, errActionErrored)
+		}
+
+		select {
+		case <-time.After(3 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Start a droplet action, like 'power_on' or 'shutdown', and wait for it to
+// finish.
+func (c *client) dropletAction(ctx context.Context, id int, typ string) error {
+	var act *godo.Action
+	var err error
+	switch typ {
+	case "power_on":
+		act, _, err = c.DropletActions.PowerOn(ctx, id)
+	case "shutdown":
+		act, _, err = c.DropletActions.Shutdown(ctx, id)
+	case "power_off":
+		act, _, err = c.DropletActions.PowerOff(ctx, id)
+	default:
+		return fmt.Errorf("unsupported droplet action '%s'", typ)
+	}
+	if err != nil {
+		return err
+	}
+	return c.waitAction(ctx, act.ID)
+}
+
+// List all droplets with a tag, fetching every page.
+func (c *client) listDropletsByTag(ctx context.Context, tag string) ([]godo.Droplet, error) {
+	var all []godo.Droplet
+	opts := &godo.ListOptions{PerPage: 200}
+	for {
+		droplets, res, err := c.Droplets.ListByTag(ctx, tag, opts)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, droplets...)
+		if res.Links == nil || res.Links.IsLastPage() {
+			return all, nil
+		}
+		page, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opts.Page = page + 1
+	}
+}
+
+// apiError extracts the API error from an error returned by the client, along
+// with the HTTP status code of the response.
+func apiError(err error) (errRes *godo.ErrorResponse, status int, ok bool) {
+	if !errors.As(err, &errRes) || errRes.Response == nil {
+		return nil, 0, false
+	}
+	return errRes, errRes.Response.StatusCode, true
+}
+
+// isNotFound checks whether an error indicates a resource does not exist.
+func isNotFound(err error) bool {
+	_, status, ok := apiError(err)
+	return ok && status == http.StatusNotFound
+}
@@ -0,0 +1,859 @@
+// Implements the 'digitalocean' target type, which uses the DigitalOcean API
+// to create and delete droplets.
+package digitalocean
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("digitalocean", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target string
+	// DropletName is set to power on and off an existing droplet, instead of
+	// creating and deleting droplets.
+	DropletName string
+	// Droplet is the template for new droplets. The name and SSH keys are set
+	// per machine.
+	Droplet        *godo.DropletCreateRequest
+	SshKeys        []string
+	UsePrivateIp   bool
+	CheckAddr      *string
+	CheckPort      uint16
+	Check          *providers.ConnectivityCheck
+	StartRetries   int
+	Shared         bool
+	Linger         time.Duration
+	MinUptime      time.Duration
+	StartTimeout   time.Duration
+	RequestTimeout time.Duration
+	GcOnStart      bool
+	GcMinAge       time.Duration
+	DO             *client
+}
+
+type state struct {
+	id   int
+	name string
+	addr string
+	// created is set if the droplet was created by us, and started if an
+	// existing droplet was powered on by us.
+	created bool
+	started bool
+	// deadline is when the droplet must be ready, according to
+	// 'start_timeout'.
+	deadline time.Time
+}
+
+type hclTarget struct {
+	Token               *string  `hcl:"token,optional"`
+	TokenFile           *string  `hcl:"token_file,optional"`
+	TokenEnv            *string  `hcl:"token_env,optional"`
+	DropletName         string   `hcl:"droplet_name,optional"`
+	Region              string   `hcl:"region,optional"`
+	Size                string   `hcl:"size,optional"`
+	Image               string   `hcl:"image,optional"`
+	SshKeys             []string `hcl:"ssh_keys,optional"`
+	UserData            *string  `hcl:"user_data,optional"`
+	VpcUuid             string   `hcl:"vpc_uuid,optional"`
+	Tags                []string `hcl:"tags,optional"`
+	Monitoring          bool     `hcl:"monitoring,optional"`
+	Ipv6                bool     `hcl:"ipv6,optional"`
+	UsePrivateIp        bool     `hcl:"use_private_ip,optional"`
+	CheckAddr           *string  `hcl:"check_addr,optional"`
+	CheckPort           uint16   `hcl:"check_port,optional"`
+	CheckType           string   `hcl:"check_type,optional"`
+	CheckServerName     string   `hcl:"check_servername,optional"`
+	CheckInsecure       bool     `hcl:"check_insecure,optional"`
+	CheckCommand        string   `hcl:"check_command,optional"`
+	CheckCommandTimeout string   `hcl:"check_command_timeout,optional"`
+	StartRetries        int      `hcl:"start_retries,optional"`
+	Shared              *bool    `hcl:"shared,optional"`
+	Linger              string   `hcl:"linger,optional"`
+	MinUptime           string   `hcl:"min_uptime,optional"`
+	StartTimeout        string   `hcl:"start_timeout,optional"`
+	RequestTimeout      string   `hcl:"request_timeout,optional"`
+	GcOnStart           bool     `hcl:"gc_on_start,optional"`
+	GcMinAge            string   `hcl:"gc_min_age,optional"`
+}
+
+// managedTag is added to every droplet LazySSH creates, so orphaned droplets
+// can be found. This is the ManagedBy=lazyssh tag of other providers, but
+// tags may not contain '='.
+const managedTag = "ManagedBy:lazyssh"
+
+// targetTagPrefix is followed by the target address in a tag added to every
+// droplet LazySSH creates, so droplets can be matched to targets.
+const targetTagPrefix = "lazyssh-target:"
+
+var (
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]`)
+	invalidTagChars  = regexp.MustCompile(`[^A-Za-z0-9_:-]`)
+	validTag         = regexp.MustCompile(`^[A-Za-z0-9_:-]{1,255}$`)
+)
+
+var (
+	errNoAddress = errors.New("does not have an IP address to connect to")
+	errNoQuota   = errors.New("DigitalOcean droplet limit or capacity exceeded")
+)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	token, tokenDiags := providers.ResolveSecret("token", parsed.Token, parsed.TokenFile)
+	diags = append(diags, tokenDiags...)
+	if (parsed.Token != nil || parsed.TokenFile != nil) && parsed.TokenEnv != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'token' and 'token_env' fields",
+			Detail:   "Only one of 'token', 'token_file' and 'token_env' may be set",
+		})
+	}
+	if parsed.Token == nil && parsed.TokenFile == nil {
+		// Fall back to the environment.
+		tokenEnv := "DIGITALOCEAN_TOKEN"
+		if parsed.TokenEnv != nil {
+			tokenEnv = *parsed.TokenEnv
+		}
+		token = strings.TrimSpace(os.Getenv(tokenEnv))
+		if token == "" {
+			// In check mode, the environment may lack credentials entirely.
+			severity := hcl.DiagError
+			if cfgCtx.CheckOnly {
+				severity = hcl.DiagWarning
+			}
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: severity,
+				Summary:  "Missing API token",
+				Detail:   fmt.Sprintf("Set one of 'token' or 'token_file', or set the '%s' environment variable for 'digitalocean' targets", tokenEnv),
+			})
+		}
+	} else if token == "" && !tokenDiags.HasErrors() {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing API token",
+			Detail:   "The 'token' or 'token_file' value is empty",
+		})
+	}
+
+	do, err := newClient(token)
+	if err != nil {
+		return nil, err
+	}
+
+	prov := &Provider{
+		DO:             do,
+		Target:         target,
+		DropletName:    parsed.DropletName,
+		SshKeys:        parsed.SshKeys,
+		UsePrivateIp:   parsed.UsePrivateIp,
+		CheckAddr:      parsed.CheckAddr,
+		StartRetries:   parsed.StartRetries,
+		StartTimeout:   5 * time.Minute,
+		RequestTimeout: 30 * time.Second,
+		GcOnStart:      parsed.GcOnStart,
+		GcMinAge:       time.Hour,
+	}
+
+	if parsed.DropletName != "" {
+		if parsed.Shared != nil && !*parsed.Shared {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'shared' field",
+				Detail:   "An existing droplet set with 'droplet_name' is always shared",
+			})
+		}
+		if parsed.Region != "" || parsed.Size != "" || parsed.Image != "" || len(parsed.SshKeys) != 0 ||
+			parsed.UserData != nil || parsed.VpcUuid != "" || len(parsed.Tags) != 0 || parsed.Monitoring || parsed.Ipv6 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Droplet settings were ignored",
+				Detail:   "Settings used to create droplets, like 'region', 'size', 'image', 'ssh_keys', 'user_data' and 'tags', have no effect when 'droplet_name' is set",
+			})
+		}
+		if parsed.GcOnStart {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Field 'gc_on_start' was ignored",
+				Detail:   "The 'gc_on_start' field has no effect when 'droplet_name' is set",
+			})
+		}
+	} else {
+		diags = append(diags, prov.buildDroplet(target, parsed)...)
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
+	if parsed.Shared == nil {
+		prov.Shared = true
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'digitalocean' targets with 'shared = false'"),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"start_timeout", parsed.StartTimeout, &prov.StartTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+// Build the template for new droplets.
+func (prov *Provider) buildDroplet(target string, parsed *hclTarget) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	if parsed.Region == "" || parsed.Size == "" || parsed.Image == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required field",
+			Detail:   "The 'region', 'size' and 'image' fields are required, unless 'droplet_name' is set",
+		})
+	}
+
+	drop := &godo.DropletCreateRequest{
+		Region:     parsed.Region,
+		Size:       parsed.Size,
+		VPCUUID:    parsed.VpcUuid,
+		Tags:       []string{managedTag, targetTag(target)},
+		Monitoring: parsed.Monitoring,
+		IPv6:       parsed.Ipv6,
+	}
+	prov.Droplet = drop
+
+	// Snapshots and custom images are referred to by numeric ID, public
+	// images by slug.
+	if imageId, err := strconv.Atoi(parsed.Image); err == nil {
+		drop.Image = godo.DropletCreateImage{ID: imageId}
+	} else {
+		drop.Image = godo.DropletCreateImage{Slug: parsed.Image}
+	}
+
+	if parsed.UserData != nil {
+		drop.UserData = *parsed.UserData
+	}
+
+	for _, tag := range parsed.Tags {
+		if !validTag.MatchString(tag) {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid tag in 'tags' field",
+				Detail:   fmt.Sprintf("Tag '%s' is invalid. Tags may only contain letters, digits, colons, dashes and underscores, up to 255 characters", tag),
+			})
+			continue
+		}
+		if tag != managedTag && tag != targetTag(target) {
+			drop.Tags = append(drop.Tags, tag)
+		}
+	}
+
+	if parsed.UsePrivateIp && parsed.VpcUuid == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Droplets use the default VPC",
+			Detail:   "With 'use_private_ip' but no 'vpc_uuid', droplets are connected to the default VPC of the region",
+		})
+	}
+
+	return diags
+}
+
+// The tag added to droplets of a target. Characters not allowed in tags are
+// replaced with '_'.
+func targetTag(target string) string {
+	tag := targetTagPrefix + invalidTagChars.ReplaceAllString(target, "_")
+	if len(tag) > 255 {
+		tag = tag[:255]
+	}
+	return tag
+}
+
+// Check whether a list of tags contains a tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially created droplet before a retry.
+			prov.stop(mach)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("DigitalOcean droplet failed to start: %s\n", err.Error())
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared droplet left running by a previous process.
+// Other droplets created by us are deleted, because they were dedicated to an
+// SSH connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	dropletId, err := strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("invalid DigitalOcean droplet ID '%s'", id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	drop, _, err := prov.DO.Droplets.Get(ctx, dropletId)
+	cancel()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check DigitalOcean droplet '%s' state: %w", id, err)
+	}
+
+	state := &state{
+		id:       dropletId,
+		name:     drop.Name,
+		created:  prov.DropletName == "",
+		deadline: time.Now().Add(prov.StartTimeout),
+	}
+	mach.State = state
+	mach.SetInstanceID(id)
+
+	if drop.Status == "active" {
+		state.addr = prov.dropletAddr(drop)
+	}
+	if !prov.Shared || state.addr == "" {
+		if state.created {
+			log.Printf("Deleting orphaned DigitalOcean droplet '%s'\n", state.name)
+			prov.stop(mach)
+		}
+		return nil
+	}
+
+	log.Printf("Adopted DigitalOcean droplet '%s'\n", state.name)
+	state.started = true
+	err = prov.connectivityTest(mach)
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Sweep deletes droplets created for this target that are older than
+// 'gc_min_age', if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart || prov.DropletName != "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	droplets, err := prov.DO.listDropletsByTag(ctx, managedTag)
+	cancel()
+	if err != nil {
+		log.Printf("Could not list DigitalOcean droplets for target '%s': %s\n", prov.Target, err.Error())
+		return
+	}
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	tag := targetTag(prov.Target)
+	for _, drop := range droplets {
+		createdAt, err := time.Parse(time.RFC3339, drop.Created)
+		if skip[strconv.Itoa(drop.ID)] || !hasTag(drop.Tags, tag) || err != nil || time.Since(createdAt) < prov.GcMinAge {
+			continue
+		}
+		log.Printf("Deleting orphaned DigitalOcean droplet '%s' for target '%s', created at %s\n", drop.Name, prov.Target, drop.Created)
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		_, err = prov.DO.Droplets.Delete(ctx, drop.ID)
+		cancel()
+		if err != nil {
+			log.Printf("Could not delete orphaned DigitalOcean droplet '%s': %s\n", drop.Name, err.Error())
+		}
+	}
+}
+
+// Create a droplet, or power on the existing droplet set with 'droplet_name',
+// and wait for it to be active.
+func (prov *Provider) start(mach *providers.Machine) error {
+	if prov.DropletName != "" {
+		if err := prov.startExisting(mach); err != nil {
+			return err
+		}
+	} else if err := prov.create(mach); err != nil {
+		return err
+	}
+	return prov.waitActive(mach)
+}
+
+// Power on the existing droplet, unless it is already active.
+func (prov *Provider) startExisting(mach *providers.Machine) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	droplets, _, err := prov.DO.Droplets.ListByName(ctx, prov.DropletName, &godo.ListOptions{PerPage: 200})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not find DigitalOcean droplet '%s': %w", prov.DropletName, err)
+	}
+	switch len(droplets) {
+	case 0:
+		return fmt.Errorf("DigitalOcean droplet '%s' does not exist", prov.DropletName)
+	case 1:
+	default:
+		return fmt.Errorf("found %d DigitalOcean droplets named '%s', but names must be unique", len(droplets), prov.DropletName)
+	}
+
+	drop := droplets[0]
+	state := &state{
+		id:       drop.ID,
+		name:     drop.Name,
+		deadline: time.Now().Add(prov.StartTimeout),
+	}
+	mach.State = state
+	mach.SetInstanceID(strconv.Itoa(drop.ID))
+	if drop.Status == "active" {
+		log.Printf("DigitalOcean droplet '%s' is already active\n", state.name)
+		return nil
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), state.deadline)
+	defer cancel()
+	if err := prov.DO.dropletAction(ctx, state.id, "power_on"); err != nil {
+		return describeError(fmt.Sprintf("could not power on DigitalOcean droplet '%s'", state.name), err)
+	}
+	state.started = true
+	log.Printf("Powered on DigitalOcean droplet '%s'\n", state.name)
+	return nil
+}
+
+// Create a droplet, and wait for the create action to finish.
+func (prov *Provider) create(mach *providers.Machine) error {
+	deadline := time.Now().Add(prov.StartTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	sshKeys, err := prov.resolveSshKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	req := *prov.Droplet
+	req.Name = dropletName(prov.Target)
+	req.SSHKeys = sshKeys
+
+	log.Printf("Creating DigitalOcean droplet '%s'\n", req.Name)
+	drop, res, err := prov.DO.Droplets.Create(ctx, &req)
+	if err != nil {
+		return describeError(fmt.Sprintf("could not create DigitalOcean droplet '%s'", req.Name), err)
+	}
+
+	state := &state{
+		id:       drop.ID,
+		name:     req.Name,
+		created:  true,
+		deadline: deadline,
+	}
+	mach.State = state
+	mach.SetInstanceID(strconv.Itoa(drop.ID))
+	mach.SetInfo("size", req.Size)
+	mach.SetInfo("region", req.Region)
+
+	if actionId := createActionId(res); actionId != 0 {
+		if err := prov.DO.waitAction(ctx, actionId); err != nil {
+			return fmt.Errorf("DigitalOcean droplet '%s' failed to create: %w", state.name, err)
+		}
+	}
+	log.Printf("Created DigitalOcean droplet '%s'\n", state.name)
+	return nil
+}
+
+// Resolve 'ssh_keys' to IDs or fingerprints. Names are looked up in the
+// account, which takes an extra request.
+func (prov *Provider) resolveSshKeys(ctx context.Context) ([]godo.DropletCreateSSHKey, error) {
+	var keys []godo.DropletCreateSSHKey
+	var names []string
+	for _, key := range prov.SshKeys {
+		if id, err := strconv.Atoi(key); err == nil {
+			keys = append(keys, godo.DropletCreateSSHKey{ID: id})
+		} else if strings.Contains(key, ":") {
+			keys = append(keys, godo.DropletCreateSSHKey{Fingerprint: key})
+		} else {
+			names = append(names, key)
+		}
+	}
+	if len(names) == 0 {
+		return keys, nil
+	}
+
+	accountKeys, _, err := prov.DO.Keys.List(ctx, &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, fmt.Errorf("could not list DigitalOcean SSH keys: %w", err)
+	}
+	for _, name := range names {
+		found := false
+		for _, key := range accountKeys {
+			if key.Name == name {
+				keys = append(keys, godo.DropletCreateSSHKey{ID: key.ID})
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("DigitalOcean SSH key '%s' does not exist", name)
+		}
+	}
+	return keys, nil
+}
+
+// Generate a droplet name for a target, followed by a random string. Droplet
+// names double as the hostname, so may only contain letters, digits, dots and
+// dashes.
+func dropletName(target string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(target), "-"), ".-")
+	if len(name) > 50 {
+		name = strings.TrimRight(name[:50], ".-")
+	}
+	if name == "" {
+		name = "lazyssh"
+	}
+	return name + "-" + randomString(8)
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// Wait for the droplet to be active with an address, then set the address in
+// state.
+func (prov *Provider) waitActive(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	bgCtx := context.Background()
+	for {
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		drop, _, err := prov.DO.Droplets.Get(ctx, state.id)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check DigitalOcean droplet '%s' state: %w", state.name, err)
+		}
+
+		switch drop.Status {
+		case "active":
+			state.addr = prov.dropletAddr(drop)
+			if state.addr != "" {
+				log.Printf("DigitalOcean droplet '%s' is active with address %s\n", state.name, state.addr)
+				mach.SetInfo("addr", state.addr)
+				return nil
+			}
+		case "new", "off":
+		default:
+			return fmt.Errorf("DigitalOcean droplet '%s' in unexpected state '%s'", state.name, drop.Status)
+		}
+
+		if time.Now().Add(3 * time.Second).After(state.deadline) {
+			if drop.Status == "active" {
+				return fmt.Errorf("DigitalOcean droplet '%s' %w", state.name, errNoAddress)
+			}
+			return fmt.Errorf("timed out waiting for DigitalOcean droplet '%s' to be active", state.name)
+		}
+		<-time.After(3 * time.Second)
+	}
+}
+
+// Select the address LazySSH connects to for a droplet: the public IPv4
+// address, or the private IPv4 address with 'use_private_ip'. Returns an
+// empty string if the droplet has no suitable address.
+func (prov *Provider) dropletAddr(drop *godo.Droplet) string {
+	var addr string
+	if prov.UsePrivateIp {
+		addr, _ = drop.PrivateIPv4()
+	} else {
+		addr, _ = drop.PublicIPv4()
+	}
+	return addr
+}
+
+// describeError wraps an API error. Droplet limit and capacity errors are
+// marked, so they are not retried, and reported to SSH clients as such.
+func describeError(msg string, err error) error {
+	if errRes, status, ok := apiError(err); ok && status == http.StatusUnprocessableEntity {
+		lower := strings.ToLower(errRes.Message)
+		if strings.Contains(lower, "limit") || strings.Contains(lower, "not available") || strings.Contains(lower, "unavailable") {
+			return fmt.Errorf("%s: %w: %s", msg, errNoQuota, errRes.Message)
+		}
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// isRetryable classifies errors from start. Rate limiting and server-side
+// errors are retried, while limit, capacity and validation errors are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, errNoQuota) || errors.Is(err, errNoAddress) {
+		return false
+	}
+	_, status, ok := apiError(err)
+	if !ok {
+		// Network errors, errored actions and the like.
+		return true
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Power off an existing droplet if it was powered on by us, or delete a
+// droplet created by us.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	if !state.created {
+		if !state.started {
+			log.Printf("Leaving DigitalOcean droplet '%s' running, because it was not powered on by LazySSH\n", state.name)
+			return
+		}
+		prov.powerOff(mach)
+		return
+	}
+
+	// Deleting a droplet that is still provisioning fails with a 422, so keep
+	// trying for a while.
+	deadline := time.Now().Add(prov.StartTimeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		_, err := prov.DO.Droplets.Delete(ctx, state.id)
+		cancel()
+		if err == nil || isNotFound(err) {
+			log.Printf("Deleted DigitalOcean droplet '%s'\n", state.name)
+			return
+		}
+
+		_, status, ok := apiError(err)
+		retry := ok && (status == http.StatusUnprocessableEntity ||
+			status == http.StatusTooManyRequests || status >= 500)
+		if !retry || time.Now().Add(5*time.Second).After(deadline) {
+			log.Printf("DigitalOcean droplet '%s' failed to delete: %s\n", state.name, err.Error())
+			mach.ReportStopError(fmt.Errorf("DigitalOcean droplet '%s' failed to delete: %w", state.name, err))
+			return
+		}
+		log.Printf("Retrying to delete DigitalOcean droplet '%s': %s\n", state.name, err.Error())
+		<-time.After(5 * time.Second)
+	}
+}
+
+// Shut down the droplet, and force it off if a clean shutdown fails.
+func (prov *Provider) powerOff(mach *providers.Machine) {
+	state := mach.State.(*state)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.StartTimeout)
+	defer cancel()
+
+	err := prov.DO.dropletAction(ctx, state.id, "shutdown")
+	if err == nil {
+		log.Printf("Shut down DigitalOcean droplet '%s'\n", state.name)
+		return
+	}
+	log.Printf("DigitalOcean droplet '%s' did not shut down cleanly, forcing it off: %s\n", state.name, err.Error())
+
+	if err := prov.DO.dropletAction(ctx, state.id, "power_off"); err != nil {
+		log.Printf("DigitalOcean droplet '%s' failed to power off: %s\n", state.name, err.Error())
+		mach.ReportStopError(fmt.Errorf("DigitalOcean droplet '%s' failed to power off: %w", state.name, err))
+		return
+	}
+	log.Printf("Powered off DigitalOcean droplet '%s'\n", state.name)
+}
+
+// Check port every 3 seconds until the 'start_timeout' deadline.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for DigitalOcean droplet '%s'\n", state.name)
+			return nil
+		}
+		if checkStart.Add(checkTimeout).After(state.deadline) {
+			break
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("DigitalOcean droplet '%s' port check on '%s' timed out: %w", state.name, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
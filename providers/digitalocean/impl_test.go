@@ -0,0 +1,220 @@
+package digitalocean
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/godo"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+// fakeApi creates a Provider with a client that talks to a fake API server.
+// Request bodies are returned by the bodies function.
+func fakeApi(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{})
+	do, err := newClient("token", godo.SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	prov = &Provider{
+		Target: "test",
+		Droplet: &godo.DropletCreateRequest{
+			Region: "ams3",
+			Size:   "s-1vcpu-1gb",
+			Image:  godo.DropletCreateImage{Slug: "debian-12-x64"},
+			Tags:   []string{managedTag, targetTag("test")},
+		},
+		SshKeys:        []string{"laptop"},
+		StartTimeout:   time.Minute,
+		RequestTimeout: 5 * time.Second,
+		DO:             do,
+	}
+	return prov, srv.Bodies
+}
+
+const activeDroplet = `{"droplet": {
+	"id": 123,
+	"name": "test-abcd1234",
+	"status": "active",
+	"networks": {"v4": [
+		{"ip_address": "10.110.0.2", "type": "private"},
+		{"ip_address": "192.0.2.10", "type": "public"}
+	]}
+}}`
+
+func TestStartCreate(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /v2/account/keys": `{"ssh_keys": [{"id": 42, "name": "laptop", "fingerprint": "aa:bb"}]}`,
+		"POST /v2/droplets": `202 {
+			"droplet": {"id": 123, "name": "test-abcd1234", "status": "new"},
+			"links": {"actions": [{"id": 456, "rel": "create"}]}
+		}`,
+		"GET /v2/actions/456":  `{"action": {"id": 456, "status": "completed", "type": "create"}}`,
+		"GET /v2/droplets/123": activeDroplet,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if state.id != 123 || state.addr != "192.0.2.10" {
+		t.Fatalf("unexpected state: id %d, addr '%s'", state.id, state.addr)
+	}
+
+	req := bodies()["POST /v2/droplets"]
+	if !strings.Contains(req, `"image":"debian-12-x64"`) || !strings.Contains(req, `"ssh_keys":[42]`) ||
+		!strings.Contains(req, `"tags":["ManagedBy:lazyssh","lazyssh-target:test"]`) {
+		t.Fatalf("unexpected create request: %s", req)
+	}
+}
+
+func TestStartCreateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		response  string
+		err       error
+		retryable bool
+	}{
+		{
+			name:     "droplet limit",
+			response: `422 {"id": "unprocessable_entity", "message": "creating this/these droplet(s) will exceed your droplet limit"}`,
+			err:      errNoQuota,
+		},
+		{
+			name:     "invalid size",
+			response: `422 {"id": "unprocessable_entity", "message": "You specified an invalid size for Droplet creation."}`,
+		},
+		{
+			name:      "rate limited",
+			response:  `429 {"id": "too_many_requests", "message": "API Rate limit exceeded."}`,
+			retryable: true,
+		},
+		{
+			name:      "server error",
+			response:  `500 {"id": "server_error", "message": "Server was unable to give you a response."}`,
+			retryable: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, _ := fakeApi(t, map[string]string{
+				"GET /v2/account/keys": `{"ssh_keys": [{"id": 42, "name": "laptop", "fingerprint": "aa:bb"}]}`,
+				"POST /v2/droplets":    tc.response,
+			})
+
+			mach := &providers.Machine{}
+			err := prov.start(mach)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%s', got: %s", tc.err, err)
+			}
+			if isRetryable(err) != tc.retryable {
+				t.Fatalf("expected retryable to be %v for: %s", tc.retryable, err)
+			}
+			if mach.State != nil {
+				t.Fatalf("expected no state for a droplet that was not created")
+			}
+		})
+	}
+}
+
+func TestStartCreateActionErrored(t *testing.T) {
+	prov, _ := fakeApi(t, map[string]string{
+		"GET /v2/account/keys": `{"ssh_keys": [{"id": 42, "name": "laptop", "fingerprint": "aa:bb"}]}`,
+		"POST /v2/droplets": `202 {
+			"droplet": {"id": 123, "name": "test-abcd1234", "status": "new"},
+			"links": {"actions": [{"id": 456, "rel": "create"}]}
+		}`,
+		"GET /v2/actions/456": `{"action": {"id": 456, "status": "errored", "type": "create"}}`,
+	})
+
+	mach := &providers.Machine{}
+	err := prov.start(mach)
+	if !errors.Is(err, errActionErrored) || !isRetryable(err) {
+		t.Fatalf("expected a retryable action error, got: %v", err)
+	}
+	if mach.State == nil {
+		t.Fatalf("expected state to be set for cleanup")
+	}
+}
+
+func TestRecoverMachineNotFound(t *testing.T) {
+	prov, _ := fakeApi(t, map[string]string{
+		"GET /v2/droplets/123": `404 {"id": "not_found", "message": "The resource you were accessing could not be found."}`,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.RecoverMachine(mach, "123"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if mach.State != nil {
+		t.Fatalf("expected no state for a missing droplet")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /v2/droplets": `{"droplets": [
+			{"id": 1, "name": "test-tracked1", "created_at": "` + old + `", "tags": ["ManagedBy:lazyssh", "lazyssh-target:test"]},
+			{"id": 2, "name": "test-orphaned", "created_at": "` + old + `", "tags": ["ManagedBy:lazyssh", "lazyssh-target:test"]},
+			{"id": 3, "name": "test-starting", "created_at": "` + recent + `", "tags": ["ManagedBy:lazyssh", "lazyssh-target:test"]},
+			{"id": 4, "name": "other-orphaned", "created_at": "` + old + `", "tags": ["ManagedBy:lazyssh", "lazyssh-target:other"]}
+		]}`,
+		"DELETE /v2/droplets/2": "204 ",
+	})
+	prov.GcOnStart = true
+	prov.GcMinAge = time.Hour
+
+	prov.Sweep([]string{"1"})
+	received := bodies()
+	if _, ok := received["DELETE /v2/droplets/2"]; !ok || len(received) != 2 {
+		t.Fatalf("expected only the orphaned droplet to be deleted, got requests: %v", received)
+	}
+}
+
+func TestSweepPages(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	srv := apitest.NewServer(t, map[string]string{
+		"GET /v2/droplets?page=": `{"droplets": [
+			{"id": 1, "name": "test-orphaned1", "created_at": "` + old + `", "tags": ["ManagedBy:lazyssh", "lazyssh-target:test"]}
+		], "links": {"pages": {"next": "https://api.digitalocean.com/v2/droplets?page=2", "last": "https://api.digitalocean.com/v2/droplets?page=2"}}}`,
+		"GET /v2/droplets?page=2": `{"droplets": [
+			{"id": 2, "name": "test-orphaned2", "created_at": "` + old + `", "tags": ["ManagedBy:lazyssh", "lazyssh-target:test"]}
+		], "links": {"pages": {"prev": "https://api.digitalocean.com/v2/droplets?page=1", "first": "https://api.digitalocean.com/v2/droplets?page=1"}}}`,
+		"DELETE /v2/droplets/1?page=": "204 ",
+		"DELETE /v2/droplets/2?page=": "204 ",
+	}, apitest.Options{
+		Key: func(r *http.Request) string {
+			return r.Method + " " + r.URL.Path + "?page=" + r.URL.Query().Get("page")
+		},
+	})
+	do, err := newClient("token", godo.SetBaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	prov := &Provider{
+		Target:         "test",
+		RequestTimeout: 5 * time.Second,
+		GcOnStart:      true,
+		GcMinAge:       time.Hour,
+		DO:             do,
+	}
+
+	prov.Sweep(nil)
+	received := srv.Bodies()
+	for _, key := range []string{"DELETE /v2/droplets/1?page=", "DELETE /v2/droplets/2?page="} {
+		if _, ok := received[key]; !ok {
+			t.Fatalf("expected request %s, got requests: %v", key, received)
+		}
+	}
+}
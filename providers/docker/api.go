@@ -0,0 +1,286 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// apiVersion is the Docker Engine API version requested, which is supported
+// by Docker 19.03 and later.
+const apiVersion = "v1.40"
+
+// client is a minimal Docker Engine API client, covering only what the
+// provider needs.
+type client struct {
+	http *http.Client
+	base string
+}
+
+// apiError is an error response from the Docker Engine API.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("Docker API error %d: %s", err.Status, err.Message)
+}
+
+// Check whether an error is a 404 response.
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
+
+// Create a client for a Docker host in the DOCKER_HOST format, which is
+// either unix:///path/to/socket or tcp://host:port.
+func newClient(host string) (*client, error) {
+	hostUrl, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Docker host '%s': %w", host, err)
+	}
+
+	transport := &http.Transport{}
+	var base string
+	switch hostUrl.Scheme {
+	case "unix":
+		socket := hostUrl.Path
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		// The host is ignored, because we always dial the socket.
+		base = "http://docker"
+	case "tcp":
+		if hostUrl.Port() == "" {
+			return nil, fmt.Errorf("invalid Docker host '%s': missing port", host)
+		}
+		base = "http://" + hostUrl.Host
+	default:
+		return nil, fmt.Errorf("invalid Docker host '%s': scheme must be unix or tcp", host)
+	}
+
+	return &client{
+		http: &http.Client{Transport: transport},
+		base: base + "/" + apiVersion,
+	}, nil
+}
+
+// Send a request with an optional JSON body, and return the response if the
+// status is successful. The caller must close the response body.
+func (c *client) request(ctx context.Context, method string, path string, query url.Values, body interface{}) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	reqUrl := c.base + path
+	if len(query) != 0 {
+		reqUrl += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, reqUrl, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		apiErr := &apiError{Status: res.StatusCode}
+		var errBody struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(res.Body).Decode(&errBody) == nil {
+			apiErr.Message = errBody.Message
+		} else {
+			apiErr.Message = res.Status
+		}
+		return nil, apiErr
+	}
+	return res, nil
+}
+
+// Send a request, and decode the JSON response into out, if not nil.
+func (c *client) do(ctx context.Context, method string, path string, query url.Values, body interface{}, out interface{}) error {
+	res, err := c.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out != nil {
+		return json.NewDecoder(res.Body).Decode(out)
+	}
+	return nil
+}
+
+// Check whether an image exists locally.
+func (c *client) imageExists(ctx context.Context, image string) (bool, error) {
+	err := c.do(ctx, "GET", "/images/"+image+"/json", nil, nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// pullMessage is a progress message streamed while pulling an image.
+type pullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress"`
+	Error    string `json:"error"`
+}
+
+// Pull an image, and call logf with progress. Progress bars are reported at
+// most every 5 seconds per layer, other status messages immediately.
+func (c *client) pullImage(ctx context.Context, image string, logf func(string)) error {
+	query := url.Values{}
+	query.Set("fromImage", image)
+	if !strings.Contains(image, "@") {
+		// Split the tag after the last path component, so registry ports are not
+		// mistaken for tags.
+		if idx := strings.LastIndexByte(image, ':'); idx > strings.LastIndexByte(image, '/') {
+			query.Set("fromImage", image[:idx])
+			query.Set("tag", image[idx+1:])
+		} else {
+			query.Set("tag", "latest")
+		}
+	}
+
+	res, err := c.request(ctx, "POST", "/images/create", query, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	lastProgress := make(map[string]time.Time)
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var msg pullMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+
+		line := msg.Status
+		if msg.ID != "" {
+			line = msg.ID + ": " + line
+		}
+		if msg.Progress != "" {
+			if time.Since(lastProgress[msg.ID]) < 5*time.Second {
+				continue
+			}
+			lastProgress[msg.ID] = time.Now()
+			line += " " + msg.Progress
+		}
+		logf(line)
+	}
+}
+
+// containerConfig is the request body to create a container.
+type containerConfig struct {
+	Image        string              `json:"Image"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   hostConfig          `json:"HostConfig"`
+}
+
+type hostConfig struct {
+	Binds        []string                 `json:"Binds,omitempty"`
+	NetworkMode  string                   `json:"NetworkMode,omitempty"`
+	PortBindings map[string][]portBinding `json:"PortBindings,omitempty"`
+}
+
+type portBinding struct {
+	HostIp   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+// Create a container, and return its ID.
+func (c *client) createContainer(ctx context.Context, name string, config *containerConfig) (string, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	var out struct {
+		ID string `json:"Id"`
+	}
+	err := c.do(ctx, "POST", "/containers/create", query, config, &out)
+	return out.ID, err
+}
+
+func (c *client) startContainer(ctx context.Context, id string) error {
+	return c.do(ctx, "POST", "/containers/"+id+"/start", nil, nil, nil)
+}
+
+// Stop a container, giving it the timeout to exit before it is killed.
+func (c *client) stopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	query := url.Values{}
+	query.Set("t", strconv.Itoa(int(timeout/time.Second)))
+	err := c.do(ctx, "POST", "/containers/"+id+"/stop", query, nil, nil)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotModified {
+		// Already stopped.
+		return nil
+	}
+	return err
+}
+
+// Remove a container, and its anonymous volumes.
+func (c *client) removeContainer(ctx context.Context, id string) error {
+	query := url.Values{}
+	query.Set("force", "true")
+	query.Set("v", "true")
+	return c.do(ctx, "DELETE", "/containers/"+id, query, nil, nil)
+}
+
+// containerInfo is the subset of the container inspect response we use.
+type containerInfo struct {
+	ID    string `json:"Id"`
+	Name  string `json:"Name"`
+	State struct {
+		Running bool   `json:"Running"`
+		Status  string `json:"Status"`
+	} `json:"State"`
+	NetworkSettings struct {
+		IPAddress string                   `json:"IPAddress"`
+		Ports     map[string][]portBinding `json:"Ports"`
+		Networks  map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (c *client) inspectContainer(ctx context.Context, id string) (*containerInfo, error) {
+	info := &containerInfo{}
+	err := c.do(ctx, "GET", "/containers/"+id+"/json", nil, nil, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
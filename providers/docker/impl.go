@@ -0,0 +1,636 @@
+// Implements the 'docker' target type, which uses the Docker Engine API to
+// create and remove containers on demand.
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("docker", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Name    string
+	Image   string
+	Command []string
+	Env     []string
+	Network string
+	Volumes []string
+	Labels  map[string]string
+	// Publish is the list of container ports published on the Docker host.
+	// If set, connections go to the published ports at PublishAddr, instead of
+	// the container address.
+	Publish     []uint16
+	PublishAddr string
+	PublishBind string
+	// Pull is one of 'missing', 'always' or 'never'.
+	Pull           string
+	PullTimeout    time.Duration
+	Remove         bool
+	StopTimeout    time.Duration
+	CheckAddr      *string
+	CheckPort      uint16
+	Check          *providers.ConnectivityCheck
+	Shared         bool
+	Linger         time.Duration
+	MinUptime      time.Duration
+	RequestTimeout time.Duration
+	Docker         *client
+}
+
+type state struct {
+	// id is the container name, used in logs.
+	id          string
+	containerId string
+	info        *containerInfo
+}
+
+type hclTarget struct {
+	Host                string            `hcl:"host,optional"`
+	Image               string            `hcl:"image,attr"`
+	Command             []string          `hcl:"command,optional"`
+	Env                 map[string]string `hcl:"env,optional"`
+	Network             string            `hcl:"network,optional"`
+	Volumes             []string          `hcl:"volumes,optional"`
+	Labels              map[string]string `hcl:"labels,optional"`
+	Publish             []uint16          `hcl:"publish,optional"`
+	PublishAddr         string            `hcl:"publish_addr,optional"`
+	Pull                string            `hcl:"pull,optional"`
+	PullTimeout         string            `hcl:"pull_timeout,optional"`
+	Remove              *bool             `hcl:"remove,optional"`
+	StopTimeout         string            `hcl:"stop_timeout,optional"`
+	CheckAddr           *string           `hcl:"check_addr,optional"`
+	CheckPort           uint16            `hcl:"check_port,optional"`
+	CheckType           string            `hcl:"check_type,optional"`
+	CheckServerName     string            `hcl:"check_servername,optional"`
+	CheckInsecure       bool              `hcl:"check_insecure,optional"`
+	CheckCommand        string            `hcl:"check_command,optional"`
+	CheckCommandTimeout string            `hcl:"check_command_timeout,optional"`
+	Shared              *bool             `hcl:"shared,optional"`
+	Linger              string            `hcl:"linger,optional"`
+	MinUptime           string            `hcl:"min_uptime,optional"`
+	RequestTimeout      string            `hcl:"request_timeout,optional"`
+}
+
+// targetLabel is added to every container LazySSH creates, with the target
+// address as value.
+const targetLabel = "lazyssh.target"
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+var errStopped = errors.New("stopped while starting")
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	prov := &Provider{
+		Name:           target,
+		Image:          parsed.Image,
+		Command:        parsed.Command,
+		Network:        parsed.Network,
+		Volumes:        parsed.Volumes,
+		Publish:        parsed.Publish,
+		PublishAddr:    parsed.PublishAddr,
+		CheckAddr:      parsed.CheckAddr,
+		Labels:         make(map[string]string),
+		Remove:         true,
+		PullTimeout:    10 * time.Minute,
+		StopTimeout:    10 * time.Second,
+		RequestTimeout: 30 * time.Second,
+	}
+
+	host := parsed.Host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+	docker, err := newClient(host)
+	if err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'host' field",
+			Detail:   err.Error(),
+		})
+	}
+	prov.Docker = docker
+
+	// Published ports are only bound to loopback for a local Docker host, so
+	// they are not exposed to the network.
+	if strings.HasPrefix(host, "unix://") {
+		prov.PublishBind = "127.0.0.1"
+		if prov.PublishAddr == "" {
+			prov.PublishAddr = "127.0.0.1"
+		}
+	} else if prov.PublishAddr == "" {
+		if hostUrl, err := url.Parse(host); err == nil {
+			prov.PublishAddr = hostUrl.Hostname()
+		}
+	}
+
+	// Sort for a stable container configuration.
+	for key, value := range parsed.Env {
+		prov.Env = append(prov.Env, key+"="+value)
+	}
+	sort.Strings(prov.Env)
+
+	for key, value := range parsed.Labels {
+		prov.Labels[key] = value
+	}
+	prov.Labels[targetLabel] = target
+
+	for _, port := range parsed.Publish {
+		if port == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'publish' field",
+				Detail:   "The 'publish' field must only contain valid port numbers",
+			})
+			break
+		}
+	}
+
+	switch parsed.Pull {
+	case "missing", "always", "never":
+		prov.Pull = parsed.Pull
+	case "":
+		prov.Pull = "missing"
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid pull",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for pull. Must be one of: missing, always, never", parsed.Pull),
+		})
+	}
+
+	if parsed.Remove != nil {
+		prov.Remove = *parsed.Remove
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+	prov.Check = check
+
+	if len(prov.Publish) != 0 && prov.CheckAddr == nil && !prov.publishes(prov.CheckPort) {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'publish' field",
+			Detail:   fmt.Sprintf("The check port %d must be in 'publish', because connections go to published ports", prov.CheckPort),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"pull_timeout", parsed.PullTimeout, &prov.PullTimeout},
+		{"stop_timeout", parsed.StopTimeout, &prov.StopTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.Shared == nil {
+		prov.Shared = true
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'docker' targets with 'shared = false'"),
+		})
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	// Honor Stop while starting, because pulling an image can take a long
+	// time. The watcher goroutine is done before we continue, so a Stop
+	// message is either consumed here, or left for msgLoop.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-mach.Stop:
+			close(stopped)
+			cancel()
+		case <-done:
+		}
+	}()
+
+	span := tracing.NewSpan(mach.Span, "start")
+	err := prov.start(ctx, mach)
+	close(done)
+	wg.Wait()
+	cancel()
+	select {
+	case <-stopped:
+		err = errStopped
+	default:
+	}
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("Docker container failed to start: %s\n", err.Error())
+		if mach.State != nil {
+			prov.stop(mach)
+		}
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared container left running by a previous
+// process. Other containers are stopped, because they were dedicated to an SSH
+// connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	info, err := prov.Docker.inspectContainer(ctx, id)
+	cancel()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check Docker container '%s' state: %w", id, err)
+	}
+
+	mach.State = &state{
+		id:          strings.TrimPrefix(info.Name, "/"),
+		containerId: info.ID,
+		info:        info,
+	}
+	mach.SetInstanceID(info.ID)
+	if !prov.Shared || !info.State.Running {
+		log.Printf("Stopping orphaned Docker container '%s'\n", mach.State.(*state).id)
+		prov.stop(mach)
+		return nil
+	}
+
+	log.Printf("Adopted Docker container '%s'\n", mach.State.(*state).id)
+	err = prov.connectivityTest(mach)
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Pull the image if necessary, then create and start the container. The
+// context is cancelled if the Manager requests a stop.
+func (prov *Provider) start(ctx context.Context, mach *providers.Machine) error {
+	if err := prov.pullImage(ctx); err != nil {
+		return err
+	}
+
+	name := containerName(prov.Name)
+	config := &containerConfig{
+		Image:  prov.Image,
+		Cmd:    prov.Command,
+		Env:    prov.Env,
+		Labels: prov.Labels,
+		HostConfig: hostConfig{
+			Binds:       prov.Volumes,
+			NetworkMode: prov.Network,
+		},
+	}
+	if len(prov.Publish) != 0 {
+		config.ExposedPorts = make(map[string]struct{})
+		config.HostConfig.PortBindings = make(map[string][]portBinding)
+		for _, port := range prov.Publish {
+			// An empty host port lets Docker pick a free one.
+			key := fmt.Sprintf("%d/tcp", port)
+			config.ExposedPorts[key] = struct{}{}
+			config.HostConfig.PortBindings[key] = []portBinding{{HostIp: prov.PublishBind}}
+		}
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, prov.RequestTimeout)
+	containerId, err := prov.Docker.createContainer(reqCtx, name, config)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not create Docker container: %w", err)
+	}
+
+	mach.State = &state{
+		id:          name,
+		containerId: containerId,
+	}
+	mach.SetInstanceID(containerId)
+	mach.SetInfo("name", name)
+	mach.SetInfo("image", prov.Image)
+	log.Printf("Created Docker container '%s'\n", name)
+
+	reqCtx, cancel = context.WithTimeout(ctx, prov.RequestTimeout)
+	err = prov.Docker.startContainer(reqCtx, containerId)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not start Docker container '%s': %w", name, err)
+	}
+
+	// Inspect after start, because addresses and published ports are only
+	// assigned then.
+	reqCtx, cancel = context.WithTimeout(ctx, prov.RequestTimeout)
+	info, err := prov.Docker.inspectContainer(reqCtx, containerId)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not inspect Docker container '%s': %w", name, err)
+	}
+	mach.State.(*state).info = info
+	log.Printf("Started Docker container '%s'\n", name)
+	return nil
+}
+
+// Pull the image according to the 'pull' setting, logging progress.
+func (prov *Provider) pullImage(ctx context.Context) error {
+	if prov.Pull == "never" {
+		return nil
+	}
+	if prov.Pull == "missing" {
+		reqCtx, cancel := context.WithTimeout(ctx, prov.RequestTimeout)
+		exists, err := prov.Docker.imageExists(reqCtx, prov.Image)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check Docker image '%s': %w", prov.Image, err)
+		}
+		if exists {
+			return nil
+		}
+	}
+
+	log.Printf("Pulling Docker image '%s' for target '%s'\n", prov.Image, prov.Name)
+	pullCtx, cancel := context.WithTimeout(ctx, prov.PullTimeout)
+	defer cancel()
+	err := prov.Docker.pullImage(pullCtx, prov.Image, func(line string) {
+		log.Printf("%s: docker pull: %s\n", prov.Name, line)
+	})
+	if err != nil {
+		return fmt.Errorf("could not pull Docker image '%s': %w", prov.Image, err)
+	}
+	log.Printf("Pulled Docker image '%s'\n", prov.Image)
+	return nil
+}
+
+// Generate a container name for a target, followed by a random string.
+func containerName(target string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(target, "_"), "_.-")
+	if name == "" {
+		name = "lazyssh"
+	}
+	return name + "-" + randomString(5)
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// Check whether a container port is in 'publish'.
+func (prov *Provider) publishes(port uint16) bool {
+	for _, published := range prov.Publish {
+		if published == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Translate a container port to a dial address. With 'publish', this is the
+// published port on the Docker host, otherwise the container address.
+func (prov *Provider) dialAddr(state *state, port uint16) (string, error) {
+	info := state.info
+	if len(prov.Publish) != 0 {
+		for _, binding := range info.NetworkSettings.Ports[fmt.Sprintf("%d/tcp", port)] {
+			if binding.HostPort != "" {
+				return net.JoinHostPort(prov.PublishAddr, binding.HostPort), nil
+			}
+		}
+		return "", fmt.Errorf("port %d is not published by Docker container '%s'", port, state.id)
+	}
+
+	ip := info.NetworkSettings.IPAddress
+	if prov.Network != "" {
+		if network, ok := info.NetworkSettings.Networks[prov.Network]; ok {
+			ip = network.IPAddress
+		}
+	}
+	if ip == "" {
+		for _, network := range info.NetworkSettings.Networks {
+			if network.IPAddress != "" {
+				ip = network.IPAddress
+				break
+			}
+		}
+	}
+	if ip == "" {
+		return "", fmt.Errorf("Docker container '%s' does not have an IP address", state.id)
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(int(port))), nil
+}
+
+// Stop the container, then remove it unless 'remove = false'.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	bgCtx := context.Background()
+
+	// The stop request waits for the container to exit.
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout+prov.StopTimeout)
+	err := prov.Docker.stopContainer(ctx, state.containerId, prov.StopTimeout)
+	cancel()
+	if isNotFound(err) {
+		// Already gone, so nothing was left behind.
+		log.Printf("Docker container '%s' failed to stop: container not found\n", state.id)
+		return
+	}
+	if err != nil {
+		log.Printf("Docker container '%s' failed to stop: %s\n", state.id, err.Error())
+	}
+
+	if !prov.Remove {
+		if err != nil {
+			mach.ReportStopError(fmt.Errorf("Docker container '%s' failed to stop: %w", state.id, err))
+			return
+		}
+		log.Printf("Stopped Docker container '%s'\n", state.id)
+		return
+	}
+
+	// Removal is forced, so also kills the container if stopping failed.
+	ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+	err = prov.Docker.removeContainer(ctx, state.containerId)
+	cancel()
+	if err != nil && !isNotFound(err) {
+		log.Printf("Docker container '%s' failed to be removed: %s\n", state.id, err.Error())
+		mach.ReportStopError(fmt.Errorf("Docker container '%s' failed to be removed: %w", state.id, err))
+		return
+	}
+	log.Printf("Removed Docker container '%s'\n", state.id)
+}
+
+// Check port every 3 seconds for 2 minutes.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	var checkAddr string
+	if prov.CheckAddr != nil {
+		checkAddr = net.JoinHostPort(*prov.CheckAddr, strconv.Itoa(int(prov.CheckPort)))
+	} else {
+		var err error
+		checkAddr, err = prov.dialAddr(state, prov.CheckPort)
+		if err != nil {
+			return err
+		}
+	}
+	checkTimeout := 3 * time.Second
+	var err error
+	for i := 0; i < 40; i++ {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for Docker container '%s'\n", state.id)
+			return nil
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("Docker container '%s' port check on '%s' failed: %w", state.id, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				addr, err := prov.dialAddr(state, msg.Port)
+				msg.Reply <- providers.TranslateReply{Addr: addr, Err: err}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package docker
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+// parseTarget creates a Provider from the body of a target block. The
+// Provider is nil if there are errors.
+func parseTarget(t *testing.T, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	if prov == nil {
+		return nil, diags
+	}
+	return prov.(*Provider), diags
+}
+
+// fakeApi creates a Provider with a client that talks to a fake Docker
+// Engine API. Request bodies are returned by the bodies function.
+func fakeApi(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{})
+	prov, diags := parseTarget(t, `
+host = "tcp://`+srv.Listener.Addr().String()+`"
+image = "alpine:3"
+env = { B = "2", A = "1" }
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	prov.RequestTimeout = 5 * time.Second
+	return prov, srv.Bodies
+}
+
+func TestDefaults(t *testing.T) {
+	prov, diags := parseTarget(t, `
+host = "unix:///run/docker.sock"
+image = "alpine:3"
+env = { B = "2", A = "1" }
+labels = { team = "infra" }
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if prov.Pull != "missing" || !prov.Remove || !prov.Shared || prov.CheckPort != 22 {
+		t.Fatalf("unexpected defaults: pull '%s', remove %v, shared %v, check port %d", prov.Pull, prov.Remove, prov.Shared, prov.CheckPort)
+	}
+	if strings.Join(prov.Env, ",") != "A=1,B=2" {
+		t.Fatalf("expected sorted env, got: %v", prov.Env)
+	}
+	if prov.Labels["team"] != "infra" || prov.Labels[targetLabel] != "test" {
+		t.Fatalf("unexpected labels: %v", prov.Labels)
+	}
+	if prov.PublishAddr != "127.0.0.1" || prov.PublishBind != "127.0.0.1" {
+		t.Fatalf("expected publish on loopback for a local host, got addr '%s', bind '%s'", prov.PublishAddr, prov.PublishBind)
+	}
+}
+
+func TestPublishAddrFromHost(t *testing.T) {
+	prov, diags := parseTarget(t, `
+host = "tcp://docker.example.com:2375"
+image = "alpine:3"
+publish = [22]
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if prov.PublishAddr != "docker.example.com" || prov.PublishBind != "" {
+		t.Fatalf("unexpected publish addr '%s', bind '%s'", prov.PublishAddr, prov.PublishBind)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		summary string
+	}{
+		{`host = "ssh://docker.example.com"`, "Invalid value for 'host' field"},
+		{`host = "tcp://docker.example.com"`, "Invalid value for 'host' field"},
+		{`pull = "sometimes"`, "Invalid pull"},
+		{`publish = [80]`, "Invalid value for 'publish' field"},
+		{`stop_timeout = "-1s"`, "Invalid duration for 'stop_timeout' field"},
+	} {
+		body := "image = \"alpine:3\"\n" + tc.body
+		prov, diags := parseTarget(t, body)
+		if prov != nil || !diags.HasErrors() {
+			t.Fatalf("expected an error for config:\n%s", body)
+		}
+		if diags[0].Summary != tc.summary {
+			t.Fatalf("expected error '%s', got: %s", tc.summary, diags.Error())
+		}
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /v1.40/images/alpine:3/json":   `{"Id": "sha256:0000"}`,
+		"POST /v1.40/containers/create":     `201 {"Id": "abcd"}`,
+		"POST /v1.40/containers/abcd/start": "204 ",
+		"GET /v1.40/containers/abcd/json": `{"Id": "abcd", "Name": "/test-abcde", "State": {"Running": true},
+			"NetworkSettings": {"IPAddress": "172.17.0.2"}}`,
+		"POST /v1.40/containers/abcd/stop": "204 ",
+		"DELETE /v1.40/containers/abcd":    "204 ",
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(context.Background(), mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if addr, err := prov.dialAddr(state, 22); err != nil || addr != "172.17.0.2:22" {
+		t.Fatalf("unexpected dial address '%s': %v", addr, err)
+	}
+
+	req := bodies()["POST /v1.40/containers/create"]
+	if !strings.Contains(req, `"Env":["A=1","B=2"]`) || !strings.Contains(req, `"Labels":{"lazyssh.target":"test"}`) {
+		t.Fatalf("unexpected create request: %s", req)
+	}
+
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+	if _, ok := bodies()["DELETE /v1.40/containers/abcd"]; !ok {
+		t.Fatalf("expected the container to be removed")
+	}
+}
+
+func TestStopNotFound(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"POST /v1.40/containers/abcd/stop": `404 {"message": "No such container: abcd"}`,
+	})
+
+	mach := &providers.Machine{State: &state{id: "test-abcde", containerId: "abcd"}}
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+	if len(bodies()) != 1 {
+		t.Fatalf("expected no removal of a missing container, got requests: %v", bodies())
+	}
+}
@@ -0,0 +1,134 @@
+// Implements the 'fallback' type, which tries a list of providers in order,
+// until one of them manages to start a machine.
+package fallback
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+func init() {
+	providers.Register("fallback", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target    string
+	Providers []providers.Provider
+	Types     []string
+}
+
+type hclTarget struct {
+	Providers []*hclProvider `hcl:"provider,block"`
+}
+
+type hclProvider struct {
+	Type     string `hcl:"type,label"`
+	hcl.Body `hcl:"body,remain"`
+}
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	if len(parsed.Providers) == 0 {
+		return nil, hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'provider' block",
+			Detail:   "A 'fallback' target must contain at least one 'provider' block",
+		}}
+	}
+
+	prov := &Provider{Target: target}
+	for i, hclProv := range parsed.Providers {
+		factory, ok := providers.FactoryMap[hclProv.Type]
+		if !ok || hclProv.Type == "fallback" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid provider type",
+				Detail:   fmt.Sprintf("Provider %d of target '%s' has invalid provider type '%s'", i+1, target, hclProv.Type),
+			})
+			continue
+		}
+
+		child, err := factory.NewProvider(target, hclProv.Body, cfgCtx)
+		childDiags, ok := err.(hcl.Diagnostics)
+		if !ok && err != nil {
+			childDiags = hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Provider configuration error",
+				Detail:   fmt.Sprintf("Error in '%s' provider %d configuration for target '%s': %s", hclProv.Type, i+1, target, err.Error()),
+			}}
+		}
+		diags = append(diags, childDiags...)
+		if childDiags.HasErrors() {
+			continue
+		}
+
+		prov.Providers = append(prov.Providers, child)
+		prov.Types = append(prov.Types, hclProv.Type)
+	}
+
+	// The Manager decides whether to start a new machine before we know which
+	// provider will be used, so all must agree.
+	for _, child := range prov.Providers {
+		if child.IsShared() != prov.Providers[0].IsShared() {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'shared' settings",
+				Detail:   fmt.Sprintf("All providers of target '%s' must have the same 'shared' setting", target),
+			})
+			break
+		}
+	}
+
+	return prov, diags
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Providers[0].IsShared()
+}
+
+// Try each provider in order. Providers signal they could not start a machine
+// with a StartError, in which case the next provider is tried. Any other
+// result, including errors after the machine was started, is final.
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	var err error
+	for i, child := range prov.Providers {
+		if i != 0 {
+			log.Printf("Trying provider %d of %d ('%s') for target '%s'\n", i+1, len(prov.Providers), prov.Types[i], prov.Target)
+		}
+
+		mach.State = nil
+		err = child.RunMachine(mach)
+		if !providers.IsStartError(err) {
+			return err
+		}
+
+		// Don't try further providers if the Manager asked us to stop.
+		select {
+		case <-mach.Stop:
+			return err
+		default:
+		}
+	}
+	return err
+}
+
+// Sweep is delegated to every provider that supports it.
+func (prov *Provider) Sweep(tracked []string) {
+	for _, child := range prov.Providers {
+		if sweeper, ok := child.(providers.Sweeper); ok {
+			sweeper.Sweep(tracked)
+		}
+	}
+}
@@ -4,10 +4,19 @@
 package forward
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
 
 	"github.com/stephank/lazyssh/providers"
 )
@@ -19,31 +28,241 @@ func init() {
 type Factory struct{}
 
 type Provider struct {
-	To string
+	// To lists the upstream hosts. If empty, the address requested by the
+	// client is used.
+	To []string
+	// Strategy is 'failover' or 'round-robin', and determines how an upstream
+	// is picked from To.
+	Strategy string
+	// Socket is set to forward all connections to a unix socket instead.
+	Socket string
+	// SendProxyProtocol means a PROXY protocol v2 header is sent to the
+	// upstream, with the SSH client address.
+	SendProxyProtocol bool
+	Port              uint16
+	PortMap           map[uint16]uint16
+	// DenyUnmapped means ports missing from PortMap are rejected, instead of
+	// passed through as-is.
+	DenyUnmapped bool
+	CheckPort    uint16
+	Check        *providers.ConnectivityCheck
+	Resolve      bool
+	// CheckInterval is set to check CheckPort periodically in the background,
+	// instead of for every connection.
+	CheckInterval time.Duration
+
+	// health holds the result of the last periodic check of each upstream,
+	// or of each resolved address with Resolve. Only used with CheckInterval.
+	healthMu sync.Mutex
+	health   map[string]error
+
+	// upstreamNext is the round-robin index into To, and upstreamActive is
+	// the last upstream used with failover.
+	upstreamMu     sync.Mutex
+	upstreamNext   int
+	upstreamActive string
+
+	// resolved holds the addresses from the last DNS lookup, and next is the
+	// round-robin index into it. Only used with Resolve.
+	resolvedMu sync.Mutex
+	resolved   []string
+	next       int
 }
 
 type hclTarget struct {
-	To string `hcl:"to,attr"`
+	To              cty.Value         `hcl:"to,optional"`
+	Strategy        string            `hcl:"strategy,optional"`
+	Socket          string            `hcl:"socket,optional"`
+	SendProxyProto  bool              `hcl:"send_proxy_protocol,optional"`
+	Port            uint16            `hcl:"port,optional"`
+	PortMap         map[string]uint16 `hcl:"port_map,optional"`
+	PortMappings    []*hclPortMapping `hcl:"port_mapping,block"`
+	DefaultAction   string            `hcl:"default_action,optional"`
+	CheckPort       uint16            `hcl:"check_port,optional"`
+	CheckType       string            `hcl:"check_type,optional"`
+	CheckServerName string            `hcl:"check_servername,optional"`
+	CheckInsecure   bool              `hcl:"check_insecure,optional"`
+	CheckInterval   string            `hcl:"check_interval,optional"`
+	Resolve         bool              `hcl:"resolve,optional"`
 }
 
-func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers.Provider, error) {
+type hclPortMapping struct {
+	From uint16 `hcl:"from,attr"`
+	To   uint16 `hcl:"to,attr"`
+}
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
 	parsed := &hclTarget{}
-	if diags := gohcl.DecodeBody(hclBlock, nil, parsed); diags != nil {
+	if diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed); diags != nil {
 		return nil, diags
 	}
 
 	prov := &Provider{
-		To: parsed.To,
+		Socket:            parsed.Socket,
+		SendProxyProtocol: parsed.SendProxyProto,
+		Port:              parsed.Port,
+		PortMap:           make(map[uint16]uint16),
+		CheckPort:         parsed.CheckPort,
+		Resolve:           parsed.Resolve,
+		health:            make(map[string]error),
+	}
+
+	to, diags := providers.DecodeStringOrList("to", parsed.To)
+	prov.To = to
+
+	if prov.Socket != "" {
+		if len(prov.To) != 0 || prov.Port != 0 || len(parsed.PortMap) != 0 || len(parsed.PortMappings) != 0 || prov.Resolve || prov.CheckPort != 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'socket' field",
+				Detail:   "The 'socket' field cannot be combined with 'to', 'port', 'port_map', 'port_mapping', 'resolve' or 'check_port'",
+			})
+		}
+		if prov.SendProxyProtocol {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'socket' and 'send_proxy_protocol' fields",
+				Detail:   "The 'send_proxy_protocol' field is only supported for TCP upstreams",
+			})
+		}
+	}
+
+	switch parsed.Strategy {
+	case "failover", "":
+		prov.Strategy = "failover"
+		if len(prov.To) > 1 && prov.CheckPort == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Missing 'check_port' field",
+				Detail:   "Without 'check_port', strategy 'failover' cannot detect failed upstreams, and always uses the first",
+			})
+		}
+	case "round-robin":
+		prov.Strategy = parsed.Strategy
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid strategy",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for strategy. Must be one of: failover, round-robin", parsed.Strategy),
+		})
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	if prov.Resolve && len(prov.To) != 1 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid 'to' field for 'resolve'",
+			Detail:   "The 'resolve' field requires the 'to' field to be set to a single host",
+		})
+	}
+	if parsed.CheckInterval != "" {
+		checkInterval, err := time.ParseDuration(parsed.CheckInterval)
+		if err == nil && checkInterval > 0 {
+			prov.CheckInterval = checkInterval
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'check_interval' field",
+				Detail:   fmt.Sprintf("The 'check_interval' value '%s' is not a valid positive duration", parsed.CheckInterval),
+			})
+		}
+		if prov.CheckPort == 0 || len(prov.To) == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'check_port' or 'to' field",
+				Detail:   "The 'check_interval' field requires the 'check_port' and 'to' fields to be set",
+			})
+		}
+	}
+	for from, to := range parsed.PortMap {
+		fromPort, err := strconv.ParseUint(from, 10, 16)
+		if err != nil || fromPort == 0 || to == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid entry in 'port_map' field",
+				Detail:   fmt.Sprintf("The 'port_map' entry '%s' = %d must map a port number to a port number", from, to),
+			})
+			continue
+		}
+		diags = append(diags, prov.addPortMapping(uint16(fromPort), to)...)
+	}
+	for _, mapping := range parsed.PortMappings {
+		if mapping.From == 0 || mapping.To == 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid 'port_mapping' block",
+				Detail:   fmt.Sprintf("The 'port_mapping' from %d to %d must map a port number to a port number", mapping.From, mapping.To),
+			})
+			continue
+		}
+		diags = append(diags, prov.addPortMapping(mapping.From, mapping.To)...)
+	}
+
+	switch parsed.DefaultAction {
+	case "passthrough", "":
+	case "deny":
+		prov.DenyUnmapped = true
+		if prov.Port != 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'port' and 'default_action' fields",
+				Detail:   "The 'port' field cannot be used with default_action 'deny', because it maps every port",
+			})
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid default_action",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for default_action. Must be one of: passthrough, deny", parsed.DefaultAction),
+		})
+	}
+
+	// Forwarding to the requested address only makes sense for the catch-all
+	// target, because other targets only ever receive their own address.
+	if prov.Socket == "" && len(prov.To) == 0 && target != "*" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'to' field",
+			Detail:   "The 'to' field can only be omitted for the catch-all target \"*\", or when 'socket' is set",
+		})
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
 	}
 
 	return prov, nil
 }
 
+// Add an entry to the port map, or return a diagnostic if the port is already
+// mapped.
+func (prov *Provider) addPortMapping(from uint16, to uint16) hcl.Diagnostics {
+	if existing, ok := prov.PortMap[from]; ok {
+		return hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Overlapping port mappings",
+			Detail:   fmt.Sprintf("Port %d is mapped to both %d and %d", from, existing, to),
+		}}
+	}
+	prov.PortMap[from] = to
+	return nil
+}
+
 func (prov *Provider) IsShared() bool {
 	return true
 }
 
-func (prov *Provider) RunMachine(mach *providers.Machine) {
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	// Check health once before accepting connections, then periodically.
+	if prov.CheckInterval > 0 {
+		prov.checkHealth()
+		done := make(chan struct{})
+		defer close(done)
+		go prov.watchHealth(done)
+	}
+
 	// Once started, we just never stop the shared Machine. This means we waste a
 	// goroutine per 'forward' target, but that's negligible.
 	for {
@@ -51,9 +270,237 @@ func (prov *Provider) RunMachine(mach *providers.Machine) {
 		case <-mach.ModActive:
 			continue
 		case msg := <-mach.Translate:
-			msg.Reply <- fmt.Sprintf("%s:%d", prov.To, msg.Port)
+			if prov.Resolve || (prov.CheckPort != 0 && prov.CheckInterval == 0) {
+				// Don't block the loop while resolving or checking.
+				go prov.translate(msg)
+			} else {
+				prov.translate(msg)
+			}
 		case <-mach.Stop:
+			return nil
+		}
+	}
+}
+
+// Run the periodic health check until done is closed.
+func (prov *Provider) watchHealth(done <-chan struct{}) {
+	ticker := time.NewTicker(prov.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			prov.checkHealth()
+		case <-done:
 			return
 		}
 	}
 }
+
+// Check every upstream, and store the results for translate. Logs when an
+// upstream becomes healthy or unhealthy.
+//
+// With Resolve, the resolved addresses are checked instead of the hostname,
+// because translate forwards to those.
+func (prov *Provider) checkHealth() {
+	hosts := prov.To
+	if prov.Resolve {
+		addrs, err := prov.lookup()
+		if err != nil {
+			log.Printf("%s\n", err.Error())
+			return
+		}
+		hosts = addrs
+	}
+
+	for _, host := range hosts {
+		err := prov.connectivityTest(host)
+
+		prov.healthMu.Lock()
+		prev := prov.health[host]
+		switch {
+		case err != nil && prev == nil:
+			log.Printf("Forward destination '%s' is unhealthy: %s\n", host, err.Error())
+		case err == nil && prev != nil:
+			log.Printf("Forward destination '%s' is healthy again\n", host)
+		}
+		prov.health[host] = err
+		prov.healthMu.Unlock()
+	}
+
+	// Forget addresses that no longer resolve.
+	if prov.Resolve {
+		prov.healthMu.Lock()
+		for host := range prov.health {
+			if !containsString(hosts, host) {
+				delete(prov.health, host)
+			}
+		}
+		prov.healthMu.Unlock()
+	}
+}
+
+// Reply to a Translate message, after resolving and checking the destination
+// as configured.
+func (prov *Provider) translate(msg *providers.TranslateMsg) {
+	if prov.Socket != "" {
+		msg.Reply <- providers.TranslateReply{Addr: prov.Socket, Network: "unix"}
+		return
+	}
+
+	port, ok := prov.translatePort(msg.Port)
+	if !ok {
+		msg.Reply <- providers.TranslateReply{Err: fmt.Errorf("port %d is not allowed by forward target", msg.Port)}
+		return
+	}
+
+	if prov.Resolve {
+		host, err := prov.resolve()
+		if err == nil {
+			err = prov.checkUpstream(host)
+		}
+		if err != nil {
+			log.Printf("%s\n", err.Error())
+			msg.Reply <- providers.TranslateReply{Err: err}
+			return
+		}
+		msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(host, strconv.Itoa(int(port))), ProxyProtocol: prov.SendProxyProtocol}
+		return
+	}
+
+	// Use the first upstream that passes the check, in order of preference.
+	var err error
+	for _, host := range prov.candidates(msg) {
+		if err = prov.checkUpstream(host); err != nil {
+			log.Printf("%s\n", err.Error())
+			continue
+		}
+		prov.setActive(host)
+		msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(host, strconv.Itoa(int(port))), ProxyProtocol: prov.SendProxyProtocol}
+		return
+	}
+	if len(prov.To) > 1 {
+		err = fmt.Errorf("all %d forward destinations are unavailable, last error: %w", len(prov.To), err)
+	}
+	msg.Reply <- providers.TranslateReply{Err: err}
+}
+
+// Check an upstream before forwarding to it, using either the result of the
+// last periodic check, or a check right now. An upstream missing from the
+// periodic results, like an address that was only just resolved, is also
+// checked right now.
+func (prov *Provider) checkUpstream(host string) error {
+	if prov.CheckInterval > 0 {
+		prov.healthMu.Lock()
+		err, ok := prov.health[host]
+		prov.healthMu.Unlock()
+		if ok {
+			return err
+		}
+	}
+	if prov.CheckPort != 0 {
+		return prov.connectivityTest(host)
+	}
+	return nil
+}
+
+// Determine the upstreams to try, in order of preference. Without 'to', this
+// is the address requested by the client, which is useful for a catch-all
+// target. With round-robin, the order rotates for every call.
+func (prov *Provider) candidates(msg *providers.TranslateMsg) []string {
+	if len(prov.To) == 0 {
+		return []string{msg.Addr}
+	}
+	if prov.Strategy != "round-robin" || len(prov.To) == 1 {
+		return prov.To
+	}
+
+	prov.upstreamMu.Lock()
+	start := prov.upstreamNext
+	prov.upstreamNext = (start + 1) % len(prov.To)
+	prov.upstreamMu.Unlock()
+
+	hosts := make([]string, 0, len(prov.To))
+	hosts = append(hosts, prov.To[start:]...)
+	return append(hosts, prov.To[:start]...)
+}
+
+// Record the upstream used with failover, and log when traffic shifts to a
+// different upstream.
+func (prov *Provider) setActive(host string) {
+	if prov.Strategy != "failover" || len(prov.To) < 2 {
+		return
+	}
+	prov.upstreamMu.Lock()
+	defer prov.upstreamMu.Unlock()
+	if prov.upstreamActive != "" && prov.upstreamActive != host {
+		log.Printf("Forward target traffic shifted from '%s' to '%s'\n", prov.upstreamActive, host)
+	}
+	prov.upstreamActive = host
+}
+
+// Look up the destination hostname, and pick one of its addresses in
+// round-robin fashion.
+func (prov *Provider) resolve() (string, error) {
+	addrs, err := prov.lookup()
+	if err != nil {
+		return "", err
+	}
+
+	prov.resolvedMu.Lock()
+	defer prov.resolvedMu.Unlock()
+	prov.next = (prov.next + 1) % len(addrs)
+	return addrs[prov.next], nil
+}
+
+// Look up the sorted addresses of the destination hostname. Logs when the set
+// of addresses changes.
+func (prov *Provider) lookup() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	addrs, err := net.DefaultResolver.LookupHost(ctx, prov.To[0])
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve forward destination '%s': %w", prov.To[0], err)
+	}
+	sort.Strings(addrs)
+
+	prov.resolvedMu.Lock()
+	defer prov.resolvedMu.Unlock()
+	if strings.Join(addrs, " ") != strings.Join(prov.resolved, " ") {
+		log.Printf("Forward destination '%s' resolved to: %s\n", prov.To[0], strings.Join(addrs, ", "))
+		prov.resolved = addrs
+	}
+	return addrs, nil
+}
+
+// Check whether a list of strings contains a value.
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify the destination accepts connections on the check port.
+func (prov *Provider) connectivityTest(host string) error {
+	checkAddr := net.JoinHostPort(host, strconv.Itoa(int(prov.CheckPort)))
+	if err := prov.Check.Dial(checkAddr, 3*time.Second); err != nil {
+		return fmt.Errorf("forward destination '%s' connectivity test failed: %w", checkAddr, err)
+	}
+	return nil
+}
+
+// Determine the destination port for the port requested by the client.
+//
+// Entries in the port map take precedence, then the fixed port, and otherwise
+// the requested port is used as-is. Returns false if the port is denied.
+func (prov *Provider) translatePort(port uint16) (uint16, bool) {
+	if mapped, ok := prov.PortMap[port]; ok {
+		return mapped, true
+	}
+	if prov.Port != 0 {
+		return prov.Port, true
+	}
+	return port, !prov.DenyUnmapped
+}
@@ -0,0 +1,163 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+)
+
+// parseTarget creates a Provider from the body of a target block. The
+// Provider is nil if there are errors.
+func parseTarget(t *testing.T, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	return parseTargetFor(t, "test", body)
+}
+
+// parseTargetFor is parseTarget for a target with the given address.
+func parseTargetFor(t *testing.T, target string, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider(target, file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	if prov == nil {
+		return nil, diags
+	}
+	return prov.(*Provider), diags
+}
+
+// listenPort listens on a loopback port, and returns it. With closed set, the
+// listener is closed right away, so the port refuses connections.
+func listenPort(t *testing.T, closed bool) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err)
+	}
+	if closed {
+		ln.Close()
+	} else {
+		t.Cleanup(func() { ln.Close() })
+	}
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// translate sends a Translate message for port 22 and returns the reply.
+func translate(prov *Provider) providers.TranslateReply {
+	msg := &providers.TranslateMsg{
+		Addr:  "test",
+		Port:  22,
+		Reply: make(chan providers.TranslateReply, 1),
+	}
+	prov.translate(msg)
+	return <-msg.Reply
+}
+
+func TestCheckIntervalRequiresTo(t *testing.T) {
+	for _, body := range []string{
+		"check_port = 22\ncheck_interval = \"10s\"",
+		"to = \"10.0.0.1\"\ncheck_interval = \"10s\"",
+	} {
+		prov, diags := parseTarget(t, body)
+		if prov != nil || !diags.HasErrors() {
+			t.Fatalf("expected an error for config:\n%s", body)
+		}
+		if diags[0].Summary != "Missing 'check_port' or 'to' field" {
+			t.Fatalf("unexpected error: %s", diags.Error())
+		}
+	}
+}
+
+func TestToRequiredExceptCatchAll(t *testing.T) {
+	prov, diags := parseTarget(t, "port = 22")
+	if prov != nil || !diags.HasErrors() {
+		t.Fatal("expected an error for a missing 'to' field")
+	}
+	if diags[0].Summary != "Missing 'to' field" {
+		t.Fatalf("unexpected error: %s", diags.Error())
+	}
+
+	if _, diags := parseTargetFor(t, "*", "port = 22"); diags.HasErrors() {
+		t.Fatalf("unexpected error for the catch-all target: %s", diags.Error())
+	}
+	if _, diags := parseTarget(t, "socket = \"/var/run/docker.sock\""); diags.HasErrors() {
+		t.Fatalf("unexpected error with 'socket': %s", diags.Error())
+	}
+}
+
+// With resolve, periodic checks are keyed by the resolved addresses, which
+// is what translate looks up.
+func TestCheckIntervalWithResolve(t *testing.T) {
+	port := listenPort(t, false)
+	prov, diags := parseTarget(t, fmt.Sprintf(`
+to = "127.0.0.1"
+resolve = true
+check_port = %d
+check_interval = "1h"
+`, port))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+
+	prov.health["stale"] = nil
+	prov.checkHealth()
+	if err, ok := prov.health["127.0.0.1"]; !ok || err != nil {
+		t.Fatalf("expected a healthy result for the resolved address, got: %v", prov.health)
+	}
+	if _, ok := prov.health["stale"]; ok {
+		t.Fatalf("expected addresses that no longer resolve to be forgotten")
+	}
+
+	reply := translate(prov)
+	if reply.Err != nil || reply.Addr != "127.0.0.1:22" {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+}
+
+// An unhealthy resolved address is rejected based on the periodic check,
+// which must not be confused by the hostname in to.
+func TestCheckIntervalWithResolveUnhealthy(t *testing.T) {
+	port := listenPort(t, true)
+	prov, diags := parseTarget(t, fmt.Sprintf(`
+to = "localhost"
+resolve = true
+check_port = %d
+check_interval = "1h"
+`, port))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+
+	prov.checkHealth()
+	reply := translate(prov)
+	if reply.Err == nil || !strings.Contains(reply.Err.Error(), "connectivity test failed") {
+		t.Fatalf("expected the connection to be rejected, got: %+v", reply)
+	}
+}
+
+// An address that was not part of the last periodic check is checked right
+// away, instead of assumed healthy.
+func TestCheckIntervalUncheckedAddress(t *testing.T) {
+	port := listenPort(t, true)
+	prov, diags := parseTarget(t, fmt.Sprintf(`
+to = "127.0.0.1"
+resolve = true
+check_port = %d
+check_interval = "1h"
+`, port))
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+
+	reply := translate(prov)
+	if reply.Err == nil || !strings.Contains(reply.Err.Error(), "connectivity test failed") {
+		t.Fatalf("expected the connection to be rejected, got: %+v", reply)
+	}
+}
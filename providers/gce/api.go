@@ -0,0 +1,159 @@
+package gce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	compute "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+)
+
+// client wraps the Compute Engine instances client with the project and zone
+// of a target.
+type client struct {
+	instances *compute.InstancesClient
+	project   string
+	zone      string
+}
+
+// Find credentials with Application Default Credentials, unless a path to a
+// service account key or user credentials file is given.
+func findCredentials(ctx context.Context, path string) (*google.Credentials, error) {
+	scopes := compute.DefaultAuthScopes()
+	if path == "" {
+		return google.FindDefaultCredentials(ctx, scopes...)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read credentials file: %w", err)
+	}
+	var file struct {
+		Type google.CredentialsType `json:"type"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("could not parse credentials file '%s': %w", path, err)
+	}
+	switch file.Type {
+	case google.ServiceAccount, google.AuthorizedUser:
+		return google.CredentialsFromJSONWithType(ctx, data, file.Type, scopes...)
+	default:
+		return nil, fmt.Errorf("unsupported credentials type '%s' in credentials file '%s', must be one of: service_account, authorized_user", file.Type, path)
+	}
+}
+
+// Create a client for the given credentials. Additional options are used by
+// tests to point the client at a local server.
+func newClient(ctx context.Context, project string, zone string, opts ...option.ClientOption) (*client, error) {
+	instances, err := compute.NewInstancesRESTClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &client{instances: instances, project: project, zone: zone}, nil
+}
+
+// Create an instance, and wait for the insert operation to finish.
+func (c *client) insertInstance(ctx context.Context, inst *computepb.Instance) error {
+	op, err := c.instances.Insert(ctx, &computepb.InsertInstanceRequest{
+		Project:          c.project,
+		Zone:             c.zone,
+		InstanceResource: inst,
+	})
+	if err != nil {
+		return err
+	}
+	return waitOperation(ctx, op)
+}
+
+// Get an instance by name.
+func (c *client) getInstance(ctx context.Context, name string) (*computepb.Instance, error) {
+	return c.instances.Get(ctx, &computepb.GetInstanceRequest{
+		Project:  c.project,
+		Zone:     c.zone,
+		Instance: name,
+	})
+}
+
+// List all instances matching a filter expression.
+func (c *client) listInstances(ctx context.Context, filter string) ([]*computepb.Instance, error) {
+	it := c.instances.List(ctx, &computepb.ListInstancesRequest{
+		Project: c.project,
+		Zone:    c.zone,
+		Filter:  proto.String(filter),
+	})
+	var instances []*computepb.Instance
+	for {
+		inst, err := it.Next()
+		if err == iterator.Done {
+			return instances, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, inst)
+	}
+}
+
+// Delete an instance, and wait for the delete operation to finish.
+func (c *client) deleteInstance(ctx context.Context, name string) error {
+	op, err := c.instances.Delete(ctx, &computepb.DeleteInstanceRequest{
+		Project:  c.project,
+		Zone:     c.zone,
+		Instance: name,
+	})
+	if err != nil {
+		return err
+	}
+	return waitOperation(ctx, op)
+}
+
+// Wait for an operation to finish. The SDK reports a failed operation with
+// just a message, so the errors of the operation are turned into a
+// googleapi.Error here, which keeps the reason codes, like 'QUOTA_EXCEEDED',
+// for describeError and isRetryable.
+func waitOperation(ctx context.Context, op *compute.Operation) error {
+	err := op.Wait(ctx)
+	opErrs := op.Proto().GetError().GetErrors()
+	if len(opErrs) == 0 {
+		return err
+	}
+	apiErr := &googleapi.Error{Code: int(op.Proto().GetHttpErrorStatusCode())}
+	var msgs []string
+	for _, opErr := range opErrs {
+		msgs = append(msgs, opErr.GetMessage())
+		apiErr.Errors = append(apiErr.Errors, googleapi.ErrorItem{
+			Reason:  opErr.GetCode(),
+			Message: opErr.GetMessage(),
+		})
+	}
+	apiErr.Message = strings.Join(msgs, "; ")
+	return apiErr
+}
+
+// apiError extracts the API error from an error returned by the client.
+// Reason is the machine readable reason of the first error, like 'notFound',
+// 'forbidden' or 'QUOTA_EXCEEDED'.
+func apiError(err error) (apiErr *googleapi.Error, reason string, ok bool) {
+	if !errors.As(err, &apiErr) {
+		return nil, "", false
+	}
+	if len(apiErr.Errors) != 0 {
+		reason = apiErr.Errors[0].Reason
+	}
+	return apiErr, reason, true
+}
+
+// isNotFound checks whether an error indicates a resource does not exist.
+func isNotFound(err error) bool {
+	apiErr, _, ok := apiError(err)
+	return ok && apiErr.Code == 404
+}
@@ -0,0 +1,779 @@
+// Implements the 'gce' target type, which uses the Compute Engine API to
+// create and delete Google Cloud virtual machines.
+package gce
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("gce", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target string
+	// Instance is the template for new instances. The name is set per machine.
+	Instance       *computepb.Instance
+	UsePrivateIp   bool
+	CheckAddr      *string
+	CheckPort      uint16
+	Check          *providers.ConnectivityCheck
+	StartRetries   int
+	Shared         bool
+	Linger         time.Duration
+	MinUptime      time.Duration
+	StartTimeout   time.Duration
+	RequestTimeout time.Duration
+	GcOnStart      bool
+	GcMinAge       time.Duration
+	Compute        *client
+}
+
+type state struct {
+	name string
+	addr string
+	// deadline is when the instance must be ready, according to
+	// 'start_timeout'.
+	deadline time.Time
+}
+
+type hclTarget struct {
+	Project             string            `hcl:"project,attr"`
+	Zone                string            `hcl:"zone,attr"`
+	MachineType         string            `hcl:"machine_type,attr"`
+	Image               string            `hcl:"image,optional"`
+	ImageFamily         string            `hcl:"image_family,optional"`
+	ImageProject        string            `hcl:"image_project,optional"`
+	Network             string            `hcl:"network,optional"`
+	Subnetwork          string            `hcl:"subnetwork,optional"`
+	ServiceAccount      string            `hcl:"service_account,optional"`
+	Scopes              []string          `hcl:"scopes,optional"`
+	Preemptible         bool              `hcl:"preemptible,optional"`
+	Spot                bool              `hcl:"spot,optional"`
+	Metadata            map[string]string `hcl:"metadata,optional"`
+	StartupScript       *string           `hcl:"startup_script,optional"`
+	Labels              map[string]string `hcl:"labels,optional"`
+	DiskSizeGb          int64             `hcl:"disk_size_gb,optional"`
+	DiskType            string            `hcl:"disk_type,optional"`
+	CredentialsFile     string            `hcl:"credentials_file,optional"`
+	UsePrivateIp        bool              `hcl:"use_private_ip,optional"`
+	CheckAddr           *string           `hcl:"check_addr,optional"`
+	CheckPort           uint16            `hcl:"check_port,optional"`
+	CheckType           string            `hcl:"check_type,optional"`
+	CheckServerName     string            `hcl:"check_servername,optional"`
+	CheckInsecure       bool              `hcl:"check_insecure,optional"`
+	CheckCommand        string            `hcl:"check_command,optional"`
+	CheckCommandTimeout string            `hcl:"check_command_timeout,optional"`
+	StartRetries        int               `hcl:"start_retries,optional"`
+	Shared              *bool             `hcl:"shared,optional"`
+	Linger              string            `hcl:"linger,optional"`
+	MinUptime           string            `hcl:"min_uptime,optional"`
+	StartTimeout        string            `hcl:"start_timeout,optional"`
+	RequestTimeout      string            `hcl:"request_timeout,optional"`
+	GcOnStart           bool              `hcl:"gc_on_start,optional"`
+	GcMinAge            string            `hcl:"gc_min_age,optional"`
+}
+
+// managedLabel is added to every instance LazySSH creates with the value
+// 'lazyssh', so orphaned instances can be found by Sweep. This is the
+// ManagedBy=lazyssh tag of other providers, but label keys must be lowercase.
+const managedLabel = "managed-by"
+
+// targetLabel is added to every instance LazySSH creates, with the target
+// address as value, so instances can be matched to targets.
+const targetLabel = "lazyssh-target"
+
+var (
+	invalidNameChars       = regexp.MustCompile(`[^a-z0-9-]`)
+	invalidLabelValueChars = regexp.MustCompile(`[^a-z0-9_-]`)
+	labelKeyRegexp         = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValueRegexp       = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+var (
+	errNoAddress        = errors.New("does not have an IP address to connect to")
+	errQuotaExceeded    = errors.New("GCE quota exceeded")
+	errNoCapacity       = errors.New("has no capacity for the requested resources")
+	errPermissionDenied = errors.New("permission denied creating GCE instance")
+)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	credentialsFile := parsed.CredentialsFile
+	if credentialsFile != "" {
+		credentialsFile = providers.ResolvePath(hclBlock, credentialsFile)
+	}
+
+	prov := &Provider{
+		Target:         target,
+		UsePrivateIp:   parsed.UsePrivateIp,
+		CheckAddr:      parsed.CheckAddr,
+		StartRetries:   parsed.StartRetries,
+		StartTimeout:   3 * time.Minute,
+		RequestTimeout: 30 * time.Second,
+		GcOnStart:      parsed.GcOnStart,
+		GcMinAge:       time.Hour,
+	}
+
+	ctx := context.Background()
+	creds, err := findCredentials(ctx, credentialsFile)
+	if err == nil {
+		prov.Compute, err = newClient(ctx, parsed.Project, parsed.Zone, option.WithCredentials(creds))
+	}
+	if err != nil {
+		// In check mode, the environment may lack credentials entirely.
+		severity := hcl.DiagError
+		if cfgCtx.CheckOnly {
+			severity = hcl.DiagWarning
+		}
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: severity,
+			Summary:  "Error loading Google Cloud credentials",
+			Detail:   err.Error(),
+		})
+	}
+
+	inst := &computepb.Instance{
+		MachineType: proto.String(fmt.Sprintf("zones/%s/machineTypes/%s", parsed.Zone, parsed.MachineType)),
+		Labels: map[string]string{
+			managedLabel: "lazyssh",
+			targetLabel:  labelValue(target),
+		},
+	}
+	prov.Instance = inst
+
+	if parsed.Project == "" || parsed.Zone == "" || parsed.MachineType == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required field",
+			Detail:   "The 'project', 'zone' and 'machine_type' fields must not be empty",
+		})
+	}
+
+	imageProject := parsed.ImageProject
+	if imageProject == "" {
+		imageProject = parsed.Project
+	}
+	var sourceImage string
+	switch {
+	case parsed.Image != "" && parsed.ImageFamily != "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'image' and 'image_family' fields",
+			Detail:   "Only one of 'image' and 'image_family' may be set",
+		})
+	case parsed.Image != "":
+		if strings.Contains(parsed.Image, "/") {
+			sourceImage = parsed.Image
+		} else {
+			sourceImage = fmt.Sprintf("projects/%s/global/images/%s", imageProject, parsed.Image)
+		}
+	case parsed.ImageFamily != "":
+		sourceImage = fmt.Sprintf("projects/%s/global/images/family/%s", imageProject, parsed.ImageFamily)
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'image' or 'image_family' field",
+			Detail:   "One of 'image' or 'image_family' must be set for 'gce' targets",
+		})
+	}
+
+	if parsed.DiskSizeGb < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'disk_size_gb' field",
+			Detail:   fmt.Sprintf("The 'disk_size_gb' value must not be negative, but got %d", parsed.DiskSizeGb),
+		})
+	}
+	disk := &computepb.AttachedDiskInitializeParams{SourceImage: proto.String(sourceImage)}
+	if parsed.DiskSizeGb > 0 {
+		disk.DiskSizeGb = proto.Int64(parsed.DiskSizeGb)
+	}
+	if parsed.DiskType != "" {
+		disk.DiskType = proto.String(fmt.Sprintf("zones/%s/diskTypes/%s", parsed.Zone, parsed.DiskType))
+	}
+	inst.Disks = []*computepb.AttachedDisk{{
+		Boot:             proto.Bool(true),
+		AutoDelete:       proto.Bool(true),
+		InitializeParams: disk,
+	}}
+
+	// Short names refer to resources in the same project. Subnetworks are
+	// regional, and the region follows from the zone.
+	iface := &computepb.NetworkInterface{}
+	switch {
+	case parsed.Network == "" && parsed.Subnetwork == "":
+		iface.Network = proto.String("global/networks/default")
+	case strings.Contains(parsed.Network, "/"):
+		iface.Network = proto.String(parsed.Network)
+	case parsed.Network != "":
+		iface.Network = proto.String("global/networks/" + parsed.Network)
+	}
+	if strings.Contains(parsed.Subnetwork, "/") {
+		iface.Subnetwork = proto.String(parsed.Subnetwork)
+	} else if parsed.Subnetwork != "" {
+		region := parsed.Zone
+		if idx := strings.LastIndexByte(region, '-'); idx > 0 {
+			region = region[:idx]
+		}
+		iface.Subnetwork = proto.String(fmt.Sprintf("regions/%s/subnetworks/%s", region, parsed.Subnetwork))
+	}
+	if !parsed.UsePrivateIp {
+		iface.AccessConfigs = []*computepb.AccessConfig{{
+			Type: proto.String("ONE_TO_ONE_NAT"),
+			Name: proto.String("External NAT"),
+		}}
+	}
+	inst.NetworkInterfaces = []*computepb.NetworkInterface{iface}
+
+	if parsed.ServiceAccount != "" {
+		scopes := parsed.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"cloud-platform"}
+		}
+		account := &computepb.ServiceAccount{Email: proto.String(parsed.ServiceAccount)}
+		for _, scope := range scopes {
+			if !strings.HasPrefix(scope, "https://") {
+				scope = "https://www.googleapis.com/auth/" + scope
+			}
+			account.Scopes = append(account.Scopes, scope)
+		}
+		inst.ServiceAccounts = []*computepb.ServiceAccount{account}
+	} else if len(parsed.Scopes) != 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'scopes' was ignored",
+			Detail:   "The 'scopes' field has no effect unless 'service_account' is set",
+		})
+	}
+
+	// Preemptible and spot instances cannot restart on host maintenance.
+	switch {
+	case parsed.Preemptible && parsed.Spot:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'preemptible' and 'spot' fields",
+			Detail:   "Only one of 'preemptible' and 'spot' may be set",
+		})
+	case parsed.Spot:
+		inst.Scheduling = &computepb.Scheduling{
+			ProvisioningModel:         proto.String("SPOT"),
+			InstanceTerminationAction: proto.String("DELETE"),
+			AutomaticRestart:          proto.Bool(false),
+			OnHostMaintenance:         proto.String("TERMINATE"),
+		}
+	case parsed.Preemptible:
+		inst.Scheduling = &computepb.Scheduling{
+			Preemptible:       proto.Bool(true),
+			AutomaticRestart:  proto.Bool(false),
+			OnHostMaintenance: proto.String("TERMINATE"),
+		}
+	}
+
+	items := make(map[string]string)
+	for key, value := range parsed.Metadata {
+		items[key] = value
+	}
+	if parsed.StartupScript != nil {
+		if _, ok := items["startup-script"]; ok {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'startup_script' and 'metadata' fields",
+				Detail:   "The 'startup-script' key in 'metadata' cannot be used together with 'startup_script'",
+			})
+		}
+		items["startup-script"] = *parsed.StartupScript
+	}
+	if len(items) != 0 {
+		inst.Metadata = &computepb.Metadata{}
+		for _, key := range sortedKeys(items) {
+			inst.Metadata.Items = append(inst.Metadata.Items, &computepb.Items{
+				Key:   proto.String(key),
+				Value: proto.String(items[key]),
+			})
+		}
+	}
+
+	for key, value := range parsed.Labels {
+		switch {
+		case !labelKeyRegexp.MatchString(key) || !labelValueRegexp.MatchString(value):
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid label in 'labels' field",
+				Detail:   fmt.Sprintf("Label '%s' is invalid. Keys must start with a lowercase letter, and keys and values may only contain lowercase letters, digits, underscores and dashes, up to 63 characters", key),
+			})
+		case key == managedLabel || key == targetLabel:
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid label in 'labels' field",
+				Detail:   fmt.Sprintf("The label '%s' is reserved, LazySSH sets it on every instance", key),
+			})
+		default:
+			inst.Labels[key] = value
+		}
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
+	if parsed.Shared == nil {
+		prov.Shared = true
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'gce' targets with 'shared = false'"),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"start_timeout", parsed.StartTimeout, &prov.StartTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The value of the target label for a target. Characters not allowed in label
+// values are replaced with '_'.
+func labelValue(target string) string {
+	value := invalidLabelValueChars.ReplaceAllString(strings.ToLower(target), "_")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return value
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially created instance before a retry.
+			prov.stop(mach)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("GCE instance failed to start: %s\n", err.Error())
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared GCE instance left running by a previous
+// process. Other instances are deleted, because they were dedicated to an SSH
+// connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	inst, err := prov.Compute.getInstance(ctx, id)
+	cancel()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check GCE instance '%s' state: %w", id, err)
+	}
+
+	mach.State = &state{
+		name:     id,
+		addr:     prov.instanceAddr(inst),
+		deadline: time.Now().Add(prov.StartTimeout),
+	}
+	mach.SetInstanceID(id)
+
+	if !prov.Shared || inst.GetStatus() != "RUNNING" || mach.State.(*state).addr == "" {
+		log.Printf("Deleting orphaned GCE instance '%s'\n", id)
+		prov.stop(mach)
+		return nil
+	}
+
+	log.Printf("Adopted GCE instance '%s'\n", id)
+	err = prov.connectivityTest(mach)
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Sweep deletes instances created for this target that are older than
+// 'gc_min_age', if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart {
+		return
+	}
+
+	filter := fmt.Sprintf(`(labels.%s = "lazyssh") (labels.%s = "%s")`, managedLabel, targetLabel, prov.Instance.Labels[targetLabel])
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	instances, err := prov.Compute.listInstances(ctx, filter)
+	cancel()
+	if err != nil {
+		log.Printf("Could not list GCE instances for target '%s': %s\n", prov.Target, err.Error())
+		return
+	}
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	for _, inst := range instances {
+		createdAt, err := time.Parse(time.RFC3339, inst.GetCreationTimestamp())
+		if skip[inst.GetName()] || err != nil || time.Since(createdAt) < prov.GcMinAge {
+			continue
+		}
+		log.Printf("Deleting orphaned GCE instance '%s' for target '%s', created at %s\n", inst.GetName(), prov.Target, inst.GetCreationTimestamp())
+		prov.stop(&providers.Machine{State: &state{name: inst.GetName()}})
+	}
+}
+
+// Create an instance, and wait for it to be running.
+func (prov *Provider) start(mach *providers.Machine) error {
+	inst := proto.Clone(prov.Instance).(*computepb.Instance)
+	name := instanceName(prov.Target)
+	inst.Name = proto.String(name)
+
+	log.Printf("Creating GCE instance '%s'\n", name)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.StartTimeout)
+	err := prov.Compute.insertInstance(ctx, inst)
+	cancel()
+	if err != nil {
+		if apiErr, _, ok := apiError(err); !ok || apiErr.Code >= 500 {
+			// The instance may exist, so set state for cleanup.
+			mach.State = &state{name: name}
+		}
+		return describeError(prov, err)
+	}
+
+	log.Printf("Created GCE instance '%s'\n", name)
+	state := &state{
+		name:     name,
+		deadline: time.Now().Add(prov.StartTimeout),
+	}
+	mach.State = state
+	mach.SetInstanceID(name)
+	mach.SetInfo("zone", prov.Compute.zone)
+
+	return prov.waitRunning(mach)
+}
+
+// Generate an instance name for a target, followed by a random string.
+// Instance names must start with a letter, and may only contain lowercase
+// letters, digits and dashes.
+func instanceName(target string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(target), "-"), "-")
+	if len(name) > 50 {
+		name = strings.TrimRight(name[:50], "-")
+	}
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "lazyssh-" + name
+	}
+	return strings.TrimRight(name, "-") + "-" + randomString(8)
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// Wait for the instance to be running, then set the address in state.
+func (prov *Provider) waitRunning(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	bgCtx := context.Background()
+	for {
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		inst, err := prov.Compute.getInstance(ctx, state.name)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check GCE instance '%s' state: %w", state.name, err)
+		}
+
+		switch inst.GetStatus() {
+		case "RUNNING":
+			state.addr = prov.instanceAddr(inst)
+			if state.addr == "" {
+				return fmt.Errorf("GCE instance '%s' %w, consider setting 'use_private_ip'", state.name, errNoAddress)
+			}
+			log.Printf("GCE instance '%s' is running with address %s\n", state.name, state.addr)
+			mach.SetInfo("addr", state.addr)
+			return nil
+		case "PROVISIONING", "STAGING":
+		default:
+			return fmt.Errorf("GCE instance '%s' in unexpected state '%s'", state.name, inst.GetStatus())
+		}
+
+		if time.Now().Add(3 * time.Second).After(state.deadline) {
+			return fmt.Errorf("timed out waiting for GCE instance '%s' to be running", state.name)
+		}
+		<-time.After(3 * time.Second)
+	}
+}
+
+// Select the address LazySSH connects to for an instance: the external NAT IP,
+// or the internal IP with 'use_private_ip'. Returns an empty string if the
+// instance has no suitable address.
+func (prov *Provider) instanceAddr(inst *computepb.Instance) string {
+	if len(inst.GetNetworkInterfaces()) == 0 {
+		return ""
+	}
+	iface := inst.GetNetworkInterfaces()[0]
+	if prov.UsePrivateIp {
+		return iface.GetNetworkIP()
+	}
+	for _, config := range iface.GetAccessConfigs() {
+		if config.GetNatIP() != "" {
+			return config.GetNatIP()
+		}
+	}
+	return ""
+}
+
+// describeError turns quota, capacity and permission errors into messages
+// that make sense to SSH clients, which see them as the rejection reason.
+func describeError(prov *Provider, err error) error {
+	apiErr, reason, ok := apiError(err)
+	if !ok {
+		return fmt.Errorf("could not create GCE instance: %w", err)
+	}
+	switch {
+	case reason == "QUOTA_EXCEEDED" || reason == "quotaExceeded":
+		return fmt.Errorf("%w in project '%s': %s", errQuotaExceeded, prov.Compute.project, apiErr.Message)
+	case reason == "ZONE_RESOURCE_POOL_EXHAUSTED" ||
+		reason == "ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS":
+		return fmt.Errorf("GCE zone '%s' %w: %s", prov.Compute.zone, errNoCapacity, apiErr.Message)
+	case apiErr.Code == 403 || apiErr.Code == 401:
+		return fmt.Errorf("%w in project '%s', check the roles of the credentials: %s", errPermissionDenied, prov.Compute.project, apiErr.Message)
+	default:
+		return fmt.Errorf("could not create GCE instance: %w", err)
+	}
+}
+
+// isRetryable classifies errors from start. Rate limiting and server-side
+// errors are retried, while quota, capacity and validation errors are not.
+func isRetryable(err error) bool {
+	apiErr, reason, ok := apiError(err)
+	if !ok {
+		// Network errors and the like.
+		return !errors.Is(err, errNoAddress) && !errors.Is(err, errQuotaExceeded) &&
+			!errors.Is(err, errNoCapacity) && !errors.Is(err, errPermissionDenied)
+	}
+	return reason == "rateLimitExceeded" || apiErr.Code == 429 || apiErr.Code >= 500
+}
+
+// Delete the instance.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.StartTimeout)
+	err := prov.Compute.deleteInstance(ctx, state.name)
+	cancel()
+	if isNotFound(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("GCE instance '%s' failed to delete: %s\n", state.name, err.Error())
+		mach.ReportStopError(fmt.Errorf("GCE instance '%s' failed to delete: %w", state.name, err))
+		return
+	}
+	log.Printf("Deleted GCE instance '%s'\n", state.name)
+}
+
+// Check port every 3 seconds until the 'start_timeout' deadline.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for GCE instance '%s'\n", state.name)
+			return nil
+		}
+		if checkStart.Add(checkTimeout).After(state.deadline) {
+			break
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("GCE instance '%s' port check on '%s' timed out: %w", state.name, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
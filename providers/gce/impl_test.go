@@ -0,0 +1,227 @@
+package gce
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"golang.org/x/net/context"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+const zonePath = "/compute/v1/projects/my-project/zones/europe-west4-a"
+
+// fakeCompute creates a Provider with a Compute Engine client that talks to a
+// fake API server, with responses keyed by method and path relative to the
+// zone. Request bodies are returned by the bodies function.
+func fakeCompute(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{
+		Key: func(r *http.Request) string {
+			key := r.Method + " " + strings.TrimPrefix(r.URL.Path, zonePath)
+			// Instance names are random, so match any name, unless there is
+			// a response for the exact name.
+			if _, ok := responses[key]; !ok && strings.HasPrefix(key, r.Method+" /instances/") {
+				key = r.Method + " /instances/*"
+			}
+			return key
+		},
+	})
+
+	compute, err := newClient(context.Background(), "my-project", "europe-west4-a",
+		option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	prov = &Provider{
+		Target: "test",
+		Instance: &computepb.Instance{
+			MachineType: proto.String("zones/europe-west4-a/machineTypes/e2-micro"),
+			Labels:      map[string]string{managedLabel: "lazyssh", targetLabel: "test"},
+		},
+		StartTimeout:   time.Minute,
+		RequestTimeout: 5 * time.Second,
+		Compute:        compute,
+	}
+	return prov, srv.Bodies
+}
+
+const doneOperation = `{"name": "operation-1", "status": "DONE"}`
+
+func TestStart(t *testing.T) {
+	prov, _ := fakeCompute(t, map[string]string{
+		"POST /instances":             doneOperation,
+		"GET /operations/operation-1": doneOperation,
+		"GET /instances/*": `{
+			"name": "test-abcd1234",
+			"status": "RUNNING",
+			"networkInterfaces": [{
+				"networkIP": "10.0.0.2",
+				"accessConfigs": [{"type": "ONE_TO_ONE_NAT", "natIP": "192.0.2.10"}]
+			}]
+		}`,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if !strings.HasPrefix(state.name, "test-") || state.addr != "192.0.2.10" {
+		t.Fatalf("unexpected state: name '%s', addr '%s'", state.name, state.addr)
+	}
+}
+
+func TestStartOperationErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		operation string
+		err       error
+	}{
+		{
+			name: "quota exceeded",
+			operation: `{"name": "operation-1", "status": "DONE",
+				"httpErrorStatusCode": 403,
+				"error": {"errors": [{"code": "QUOTA_EXCEEDED", "message": "Quota 'CPUS' exceeded."}]}}`,
+			err: errQuotaExceeded,
+		},
+		{
+			name: "no capacity",
+			operation: `{"name": "operation-1", "status": "DONE",
+				"httpErrorStatusCode": 503,
+				"error": {"errors": [{"code": "ZONE_RESOURCE_POOL_EXHAUSTED", "message": "The zone does not have enough resources."}]}}`,
+			err: errNoCapacity,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, _ := fakeCompute(t, map[string]string{
+				"POST /instances":             `{"name": "operation-1", "status": "RUNNING"}`,
+				"GET /operations/operation-1": tc.operation,
+			})
+
+			err := prov.start(&providers.Machine{})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%s', got: %v", tc.err, err)
+			}
+			if isRetryable(err) {
+				t.Fatalf("expected error not to be retried: %s", err)
+			}
+		})
+	}
+}
+
+func TestStartRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		response  string
+		err       error
+		retryable bool
+		cleanup   bool
+	}{
+		{
+			name: "permission denied",
+			response: `403 {"error": {"code": 403, "message": "Required 'compute.instances.create' permission",
+				"errors": [{"reason": "forbidden", "message": "Required 'compute.instances.create' permission"}]}}`,
+			err: errPermissionDenied,
+		},
+		{
+			name: "rate limited",
+			response: `429 {"error": {"code": 429, "message": "Rate Limit Exceeded",
+				"errors": [{"reason": "rateLimitExceeded", "message": "Rate Limit Exceeded"}]}}`,
+			retryable: true,
+		},
+		{
+			name:      "server error",
+			response:  `500 {"error": {"code": 500, "message": "Internal error"}}`,
+			retryable: true,
+			cleanup:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, _ := fakeCompute(t, map[string]string{
+				"POST /instances": tc.response,
+			})
+
+			mach := &providers.Machine{}
+			err := prov.start(mach)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%s', got: %s", tc.err, err)
+			}
+			if isRetryable(err) != tc.retryable {
+				t.Fatalf("expected retryable to be %v for: %s", tc.retryable, err)
+			}
+			if (mach.State != nil) != tc.cleanup {
+				t.Fatalf("expected cleanup state to be set: %v", tc.cleanup)
+			}
+		})
+	}
+}
+
+func TestRecoverMachineNotFound(t *testing.T) {
+	prov, _ := fakeCompute(t, map[string]string{
+		"GET /instances/*": `404 {"error": {"code": 404, "message": "The resource was not found",
+			"errors": [{"reason": "notFound", "message": "The resource was not found"}]}}`,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.RecoverMachine(mach, "test-abcd1234"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if mach.State != nil {
+		t.Fatalf("expected no state for a missing instance")
+	}
+}
+
+func TestCredentialsFileType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazyssh-gce-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "credentials.json")
+	if err := ioutil.WriteFile(path, []byte(`{"type": "external_account"}`), 0600); err != nil {
+		t.Fatalf("could not write credentials file: %s", err)
+	}
+
+	_, err = findCredentials(context.Background(), path)
+	if err == nil || !strings.HasPrefix(err.Error(), "unsupported credentials type 'external_account'") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	prov, bodies := fakeCompute(t, map[string]string{
+		"GET /instances": `{"items": [
+			{"name": "test-tracked1", "creationTimestamp": "` + old + `"},
+			{"name": "test-orphaned", "creationTimestamp": "` + old + `"},
+			{"name": "test-starting", "creationTimestamp": "` + recent + `"}
+		]}`,
+		"DELETE /instances/test-orphaned": doneOperation,
+		"GET /operations/operation-1":     doneOperation,
+	})
+	prov.GcOnStart = true
+	prov.GcMinAge = time.Hour
+
+	prov.Sweep([]string{"test-tracked1"})
+	received := bodies()
+	_, deleted := received["DELETE /instances/test-orphaned"]
+	_, other := received["DELETE /instances/*"]
+	if !deleted || other {
+		t.Fatalf("expected only the orphaned instance to be deleted, got requests: %v", received)
+	}
+}
@@ -3,11 +3,18 @@
 package hcloud
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hashicorp/hcl/v2"
@@ -16,6 +23,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
 )
 
 func init() {
@@ -25,60 +33,353 @@ func init() {
 type Factory struct{}
 
 type Provider struct {
-	Name       string
-	Image      string
-	ServerType string
-	SSHKey     string
-	UserData   string
-	Location   string
-	Labels     map[string]string
-	Shared     bool
-	CheckPort  uint16
-	Linger     time.Duration
-	HCloud     *hcloud.Client
+	Name           string
+	NameTemplate   *template.Template
+	Image          string
+	ServerType     string
+	SSHKeys        []string
+	UserData       string
+	Location       string
+	Datacenter     string
+	PlacementGroup string
+	Labels         map[string]string
+	Networks       []*hcloud.Network
+	Firewalls      []*hcloud.Firewall
+	ReservedIp     *hcloud.FloatingIP
+	PublicNet      *publicNet
+	AttachVolumes  []*attachVolume
+	AttachTimeout  time.Duration
+	UsePrivateIp   bool
+	Shared         bool
+	// Reuse means an existing server for the target is used, if any, instead
+	// of creating a new one. With PowerOffIdle, idle servers are powered off
+	// instead of deleted, so they can be reused later.
+	Reuse           bool
+	PowerOffIdle    bool
+	CheckAddr       *string
+	CheckPort       uint16
+	Check           *providers.ConnectivityCheck
+	StartRetries    int
+	GcOnStart       bool
+	GcMinAge        time.Duration
+	Linger          time.Duration
+	MinUptime       time.Duration
+	MonitorInterval time.Duration
+	RequestTimeout  time.Duration
+	HCloud          *hcloud.Client
+
+	// resources caches the result of lookupResources. It is cleared when a
+	// start fails, in case the cached resources are the cause.
+	resourcesMu sync.Mutex
+	resources   *resources
+}
+
+// resources holds the API objects referenced by name in the configuration,
+// which are needed to create a server.
+type resources struct {
+	image          *hcloud.Image
+	serverType     *hcloud.ServerType
+	sshKeys        []*hcloud.SSHKey
+	location       *hcloud.Location
+	datacenter     *hcloud.Datacenter
+	placementGroup *hcloud.PlacementGroup
 }
 
 type state struct {
-	id   string
-	addr *string
+	// id is the server name, used in logs.
+	id       string
+	serverId int
+	addr     *string
+	// attached holds 'attach_volume' volumes attached to the server, which are
+	// detached before it is deleted.
+	attached []*hcloud.Volume
+	// reservedIpAssigned is set once the 'reserved_ip' Floating IP has been
+	// assigned to the server.
+	reservedIpAssigned bool
+	// adopted is set if the server already existed, with 'reuse'.
+	adopted bool
 }
 
 type hclTarget struct {
-	Token      string            `hcl:"token,attr"`
-	Image      string            `hcl:"image,attr"`
-	ServerType string            `hcl:"server_type,attr"`
-	SSHKey     string            `hcl:"ssh_key,attr"`
-	Location   string            `hcl:"location,attr"`
-	UserData   string            `hcl:"user_data,optional"`
-	Labels     map[string]string `hcl:"labels,optional"`
-	CheckPort  uint16            `hcl:"check_port,optional"`
-	Shared     *bool             `hcl:"shared,optional"`
-	Linger     string            `hcl:"linger,optional"`
+	Token               *string           `hcl:"token,optional"`
+	TokenFile           *string           `hcl:"token_file,optional"`
+	TokenEnv            *string           `hcl:"token_env,optional"`
+	Image               string            `hcl:"image,attr"`
+	ServerType          string            `hcl:"server_type,attr"`
+	SSHKey              string            `hcl:"ssh_key,optional"`
+	SSHKeys             []string          `hcl:"ssh_keys,optional"`
+	Location            string            `hcl:"location,optional"`
+	Datacenter          string            `hcl:"datacenter,optional"`
+	PlacementGroup      string            `hcl:"placement_group,optional"`
+	UserData            *string           `hcl:"user_data,optional"`
+	UserDataFile        *string           `hcl:"user_data_file,optional"`
+	Labels              map[string]string `hcl:"labels,optional"`
+	Network             string            `hcl:"network,optional"`
+	Networks            []string          `hcl:"networks,optional"`
+	Firewalls           []string          `hcl:"firewalls,optional"`
+	ReservedIp          string            `hcl:"reserved_ip,optional"`
+	PublicNet           *hclPublicNet     `hcl:"public_net,block"`
+	ServerName          *string           `hcl:"name,optional"`
+	AttachVolumes       []*hclVolume      `hcl:"attach_volume,block"`
+	AttachTimeout       string            `hcl:"attach_timeout,optional"`
+	UsePrivateIp        bool              `hcl:"use_private_ip,optional"`
+	CheckAddr           *string           `hcl:"check_addr,optional"`
+	CheckPort           uint16            `hcl:"check_port,optional"`
+	CheckType           string            `hcl:"check_type,optional"`
+	CheckServerName     string            `hcl:"check_servername,optional"`
+	CheckInsecure       bool              `hcl:"check_insecure,optional"`
+	CheckCommand        string            `hcl:"check_command,optional"`
+	CheckCommandTimeout string            `hcl:"check_command_timeout,optional"`
+	StartRetries        int               `hcl:"start_retries,optional"`
+	GcOnStart           bool              `hcl:"gc_on_start,optional"`
+	GcMinAge            string            `hcl:"gc_min_age,optional"`
+	Shared              *bool             `hcl:"shared,optional"`
+	Reuse               bool              `hcl:"reuse,optional"`
+	OnIdle              string            `hcl:"on_idle,optional"`
+	Linger              string            `hcl:"linger,optional"`
+	MinUptime           string            `hcl:"min_uptime,optional"`
+	MonitorInterval     string            `hcl:"monitor_interval,optional"`
+	RequestTimeout      string            `hcl:"request_timeout,optional"`
 }
 
-const requestTimeout = 30 * time.Second
+var errNotFound = errors.New("not found")
+
+// managedLabel and managedValue form the ManagedBy=lazyssh label added to
+// every server LazySSH creates, so orphaned servers can be found by Sweep.
+const (
+	managedLabel = "ManagedBy"
+	managedValue = "lazyssh"
+)
+
+// targetLabel is added to every server LazySSH creates, with the target
+// address as value, so servers can be matched to targets regardless of name.
+const targetLabel = "lazyssh-target"
+
+// startTimeout limits how long to wait for a new server to be created and
+// powered on.
+const startTimeout = 5 * time.Minute
 
-func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers.Provider, error) {
+// defaultServerName is the default for the 'name' field.
+const defaultServerName = "{{.Target}}-{{.Random}}"
+
+// serverNameVars is the data used to execute the 'name' template.
+type serverNameVars struct {
+	Target string
+	Random string
+}
+
+var validServerName = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
 	parsed := &hclTarget{}
-	diags := gohcl.DecodeBody(hclBlock, nil, parsed)
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
 	if diags.HasErrors() {
 		return nil, diags
 	}
 
+	token, tokenDiags := providers.ResolveSecret("token", parsed.Token, parsed.TokenFile)
+	diags = append(diags, tokenDiags...)
+	if (parsed.Token != nil || parsed.TokenFile != nil) && parsed.TokenEnv != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'token' and 'token_env' fields",
+			Detail:   "Only one of 'token', 'token_file' and 'token_env' may be set",
+		})
+	}
+	if parsed.Token == nil && parsed.TokenFile == nil {
+		// Fall back to the environment.
+		tokenEnv := "HCLOUD_TOKEN"
+		if parsed.TokenEnv != nil {
+			tokenEnv = *parsed.TokenEnv
+		}
+		token = strings.TrimSpace(os.Getenv(tokenEnv))
+		if token == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing API token",
+				Detail:   fmt.Sprintf("Set one of 'token' or 'token_file', or set the '%s' environment variable for 'hcloud' targets", tokenEnv),
+			})
+		}
+	} else if token == "" && !tokenDiags.HasErrors() {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing API token",
+			Detail:   "The 'token' or 'token_file' value is empty",
+		})
+	}
+
 	client := hcloud.NewClient(
 		hcloud.WithApplication("lazyssh", ""),
-		hcloud.WithToken(parsed.Token),
+		hcloud.WithToken(token),
+		// Actions take seconds, so the default of polling twice a second mostly
+		// adds API requests.
+		hcloud.WithPollInterval(2*time.Second),
 	)
 
 	prov := &Provider{
-		HCloud:     client,
-		Name:       target,
-		Image:      parsed.Image,
-		ServerType: parsed.ServerType,
-		SSHKey:     parsed.SSHKey,
-		Location:   parsed.Location,
-		Labels:     parsed.Labels,
-		UserData:   strings.Replace(parsed.UserData, "\n", "\\n", -1),
+		HCloud:          client,
+		Name:            target,
+		Image:           parsed.Image,
+		ServerType:      parsed.ServerType,
+		Location:        parsed.Location,
+		Datacenter:      parsed.Datacenter,
+		PlacementGroup:  parsed.PlacementGroup,
+		Labels:          make(map[string]string),
+		CheckAddr:       parsed.CheckAddr,
+		UsePrivateIp:    parsed.UsePrivateIp,
+		StartRetries:    parsed.StartRetries,
+		GcOnStart:       parsed.GcOnStart,
+		GcMinAge:        time.Hour,
+		RequestTimeout:  30 * time.Second,
+		MonitorInterval: time.Minute,
+		AttachTimeout:   2 * time.Minute,
+	}
+	for key, value := range parsed.Labels {
+		prov.Labels[key] = value
+	}
+
+	userData, userDataDiags := buildUserData(hclBlock, parsed)
+	diags = append(diags, userDataDiags...)
+	prov.UserData = userData
+	prov.Labels[managedLabel] = managedValue
+	prov.Labels[targetLabel] = labelValue(target)
+
+	prov.SSHKeys = parsed.SSHKeys
+	if parsed.SSHKey != "" {
+		if len(prov.SSHKeys) != 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'ssh_key' and 'ssh_keys' fields",
+				Detail:   "Only one of 'ssh_key' and 'ssh_keys' may be set",
+			})
+		}
+		prov.SSHKeys = []string{parsed.SSHKey}
+	}
+	if len(prov.SSHKeys) == 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'ssh_keys' field",
+			Detail:   "One of 'ssh_key' and 'ssh_keys' must be set for 'hcloud' targets",
+		})
+	}
+
+	switch {
+	case parsed.Location != "" && parsed.Datacenter != "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'location' and 'datacenter' fields",
+			Detail:   "Only one of 'location' and 'datacenter' may be set",
+		})
+	case parsed.Location == "" && parsed.Datacenter == "":
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'location' field",
+			Detail:   "One of 'location' and 'datacenter' must be set for 'hcloud' targets",
+		})
+	}
+
+	nameTemplate := defaultServerName
+	if parsed.ServerName != nil {
+		nameTemplate = *parsed.ServerName
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err == nil {
+		prov.NameTemplate = tmpl
+		var name string
+		if name, err = prov.serverName(); err == nil && !validServerName.MatchString(name) {
+			err = fmt.Errorf("'%s' is not a valid hostname", name)
+		}
+	}
+	if err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'name' field",
+			Detail:   fmt.Sprintf("The 'name' template is invalid: %s", err.Error()),
+		})
+	}
+
+	if parsed.RequestTimeout != "" {
+		requestTimeout, err := time.ParseDuration(parsed.RequestTimeout)
+		if err == nil && requestTimeout > 0 {
+			prov.RequestTimeout = requestTimeout
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'request_timeout' field",
+				Detail:   fmt.Sprintf("The 'request_timeout' value '%s' is not a valid positive duration", parsed.RequestTimeout),
+			})
+		}
+	}
+
+	networks := parsed.Networks
+	if parsed.Network != "" {
+		if len(networks) != 0 {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'network' and 'networks' fields",
+				Detail:   "Only one of 'network' and 'networks' may be set",
+			})
+		}
+		networks = []string{parsed.Network}
+	}
+
+	if parsed.UsePrivateIp && len(networks) == 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'networks' field",
+			Detail:   "The 'networks' field is required when 'use_private_ip' is set",
+		})
+	}
+
+	publicNet, publicNetDiags := buildPublicNet(parsed.PublicNet, parsed.UsePrivateIp)
+	diags = append(diags, publicNetDiags...)
+	prov.PublicNet = publicNet
+
+	if !cfgCtx.CheckOnly && token != "" {
+		// Look up resources now, so starts don't have to. Skipped if the fields
+		// are invalid, which is already reported above.
+		if len(prov.SSHKeys) != 0 && (prov.Location == "") != (prov.Datacenter == "") {
+			if _, err := prov.lookupResources(); err != nil {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Could not look up HCloud resources",
+					Detail:   err.Error(),
+				})
+			}
+		}
+
+		// Verify the networks exist now, instead of failing every start.
+		for _, name := range networks {
+			ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+			network, _, err := client.Network.Get(ctx, name)
+			cancel()
+			if network == nil && err == nil {
+				err = fmt.Errorf("network '%s' %w", name, errNotFound)
+			}
+			if err == nil {
+				prov.Networks = append(prov.Networks, network)
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid value for 'networks' field",
+					Detail:   fmt.Sprintf("Could not find HCloud network '%s': %s", name, err.Error()),
+				})
+			}
+		}
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
 	}
 
 	if parsed.CheckPort == 0 {
@@ -87,23 +388,192 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		prov.CheckPort = parsed.CheckPort
 	}
 
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if !cfgCtx.CheckOnly && token != "" {
+		// Verify the firewalls exist now, instead of failing every start.
+		for _, name := range parsed.Firewalls {
+			ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+			firewall, _, err := client.Firewall.Get(ctx, name)
+			cancel()
+			if firewall == nil && err == nil {
+				err = fmt.Errorf("firewall '%s' %w", name, errNotFound)
+			}
+			if err == nil {
+				prov.Firewalls = append(prov.Firewalls, firewall)
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid value for 'firewalls' field",
+					Detail:   fmt.Sprintf("Could not find HCloud firewall '%s': %s", name, err.Error()),
+				})
+			}
+		}
+
+		if parsed.ReservedIp != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+			floatingIp, _, err := client.FloatingIP.Get(ctx, parsed.ReservedIp)
+			cancel()
+			if floatingIp == nil && err == nil {
+				err = fmt.Errorf("floating IP '%s' %w", parsed.ReservedIp, errNotFound)
+			}
+			if err == nil {
+				prov.ReservedIp = floatingIp
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid value for 'reserved_ip' field",
+					Detail:   fmt.Sprintf("Could not find HCloud Floating IP '%s': %s", parsed.ReservedIp, err.Error()),
+				})
+			}
+		}
+
+		if parsed.PublicNet != nil && parsed.PublicNet.IPv4 != "" {
+			primaryIp, primaryIpDiags := prov.resolvePrimaryIP("ipv4", parsed.PublicNet.IPv4, hcloud.PrimaryIPTypeIPv4)
+			diags = append(diags, primaryIpDiags...)
+			prov.PublicNet.IPv4 = primaryIp
+		}
+		if parsed.PublicNet != nil && parsed.PublicNet.IPv6 != "" {
+			primaryIp, primaryIpDiags := prov.resolvePrimaryIP("ipv6", parsed.PublicNet.IPv6, hcloud.PrimaryIPTypeIPv6)
+			diags = append(diags, primaryIpDiags...)
+			prov.PublicNet.IPv6 = primaryIp
+		}
+
+		for _, v := range parsed.AttachVolumes {
+			ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+			volume, _, err := client.Volume.Get(ctx, v.Volume)
+			cancel()
+			if volume == nil && err == nil {
+				err = fmt.Errorf("volume '%s' %w", v.Volume, errNotFound)
+			}
+			if err == nil && volume.Location != nil && !prov.inServerLocation(volume.Location) {
+				err = fmt.Errorf("volume is in location '%s', but servers are created in '%s'", volume.Location.Name, prov.serverLocation())
+			}
+			if err == nil {
+				prov.AttachVolumes = append(prov.AttachVolumes, &attachVolume{
+					Volume:    volume,
+					Automount: v.Automount,
+				})
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid value for 'volume' field",
+					Detail:   fmt.Sprintf("Could not use HCloud volume '%s': %s", v.Volume, err.Error()),
+				})
+			}
+		}
+
+		// Firewalls only filter public traffic.
+		if len(prov.Firewalls) != 0 && !prov.UsePrivateIp && !firewallsAllowPort(prov.Firewalls, prov.CheckPort) {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Firewalls block 'check_port'",
+				Detail:   fmt.Sprintf("None of the firewalls of target '%s' have an inbound TCP rule for port %d, so the connectivity test will likely fail", target, prov.CheckPort),
+			})
+		}
+	}
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
 	if parsed.Shared == nil {
 		prov.Shared = true
 	} else {
 		prov.Shared = *parsed.Shared
 	}
 
-	if prov.Shared {
-		linger, err := time.ParseDuration(parsed.Linger)
-		if err == nil {
-			prov.Linger = linger
+	prov.Reuse = parsed.Reuse
+	if prov.Reuse && !prov.Shared {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'reuse' and 'shared' fields",
+			Detail:   "The 'reuse' field requires 'shared = true', because a reused server serves all connections",
+		})
+	}
+
+	switch parsed.OnIdle {
+	case "delete", "":
+	case "poweroff":
+		prov.PowerOffIdle = true
+		if !prov.Reuse {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'reuse' field",
+				Detail:   "The on_idle 'poweroff' setting requires 'reuse = true', because powered off servers are otherwise never started again",
+			})
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid on_idle",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for on_idle. Must be one of: delete, poweroff", parsed.OnIdle),
+		})
+	}
+
+	if parsed.AttachTimeout != "" {
+		attachTimeout, err := time.ParseDuration(parsed.AttachTimeout)
+		if err == nil && attachTimeout > 0 {
+			prov.AttachTimeout = attachTimeout
 		} else {
 			diags = append(diags, &hcl.Diagnostic{
 				Severity: hcl.DiagError,
-				Summary:  "Invalid duration for 'linger' field",
-				Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration: %s", parsed.Linger, err.Error()),
+				Summary:  "Invalid duration for 'attach_timeout' field",
+				Detail:   fmt.Sprintf("The 'attach_timeout' value '%s' is not a valid positive duration", parsed.AttachTimeout),
 			})
 		}
+	}
+	if len(parsed.AttachVolumes) != 0 && !prov.Shared {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "A volume can only be attached to one server at a time, so 'attach_volume' requires 'shared = true'",
+		})
+	}
+
+	if parsed.ReservedIp != "" && !prov.Shared {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "A Floating IP can only be assigned to one server at a time, so 'reserved_ip' requires 'shared = true'",
+		})
+	}
+	if parsed.PublicNet != nil && (parsed.PublicNet.IPv4 != "" || parsed.PublicNet.IPv6 != "") && !prov.Shared {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "A primary IP can only be assigned to one server at a time, so 'ipv4' and 'ipv6' in 'public_net' require 'shared = true'",
+		})
+	}
+
+	if parsed.ReservedIp != "" && parsed.UsePrivateIp {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'reserved_ip' and 'use_private_ip' fields",
+			Detail:   "A Floating IP is a public address, so only one of 'reserved_ip' and 'use_private_ip' may be set",
+		})
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
 	} else if parsed.Linger != "" {
 		diags = append(diags, &hcl.Diagnostic{
 			Severity: hcl.DiagWarning,
@@ -112,6 +582,32 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		})
 	}
 
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if parsed.MonitorInterval != "" {
+		monitorInterval, err := time.ParseDuration(parsed.MonitorInterval)
+		if err == nil && monitorInterval >= 0 {
+			prov.MonitorInterval = monitorInterval
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'monitor_interval' field",
+				Detail:   fmt.Sprintf("The 'monitor_interval' value '%s' is not a valid duration", parsed.MonitorInterval),
+			})
+		}
+	}
+
 	if diags.HasErrors() {
 		return nil, diags
 	}
@@ -123,191 +619,762 @@ func (prov *Provider) IsShared() bool {
 	return prov.Shared
 }
 
-func (prov *Provider) RunMachine(mach *providers.Machine) {
-	if prov.start(mach) {
-		if prov.connectivityTest(mach) {
-			prov.msgLoop(mach)
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil {
+			prov.forgetResources()
 		}
-		prov.stop(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially started server before a retry.
+			prov.stop(mach)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("HCloud server failed to start: %s\n", err.Error())
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		err = prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
 	}
+	prov.stop(mach)
+	return err
 }
 
-func (prov *Provider) start(mach *providers.Machine) bool {
-	bgCtx := context.Background()
+// RecoverMachine adopts a shared HCloud server left running by a previous
+// process. Other servers are deleted, because they were dedicated to an SSH
+// connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	// Older state files record the server name instead of the ID.
+	server, _, err := prov.HCloud.Server.Get(ctx, id)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not check HCloud server '%s' state: %w", id, err)
+	}
+	if server == nil {
+		return nil
+	}
 
-	// We must get the image from API
-	ctx, _ := context.WithTimeout(bgCtx, requestTimeout)
-	image, _, err := prov.HCloud.Image.Get(ctx, prov.Image)
-	if image == nil && err == nil {
-		err = fmt.Errorf("image '%s' not found", prov.Image)
+	mach.State = &state{
+		id:       server.Name,
+		serverId: server.ID,
 	}
+	mach.SetInstanceID(strconv.Itoa(server.ID))
+
+	if prov.PowerOffIdle && server.Status == hcloud.ServerStatusOff {
+		// Left powered off for reuse.
+		return nil
+	}
+	if !prov.Shared || server.Status != hcloud.ServerStatusRunning {
+		prov.findAttached(mach.State.(*state))
+		log.Printf("Deleting orphaned HCloud server '%s'\n", server.Name)
+		prov.stop(mach)
+		return nil
+	}
+
+	log.Printf("Adopted HCloud server '%s'\n", server.Name)
+	if prov.ReservedIp != nil {
+		err = prov.assignReservedIp(mach, server)
+	}
+	if err == nil {
+		err = prov.attachVolumes(mach)
+	}
+	if err == nil {
+		mach.State.(*state).addr, err = prov.serverAddr(server)
+	}
+	if err == nil {
+		err = prov.connectivityTest(mach)
+	}
+	if err == nil {
+		err = prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Sweep deletes servers created for this target that are older than
+// 'gc_min_age', if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	servers, err := prov.HCloud.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: managedLabel + "=" + managedValue},
+	})
+	cancel()
 	if err != nil {
-		log.Printf("HCloud server failed to start: %s\n", err.Error())
-		return false
+		log.Printf("Could not list HCloud servers for target '%s': %s\n", prov.Name, err.Error())
+		return
 	}
-	// We must get the server type from API
-	ctx, _ = context.WithTimeout(bgCtx, requestTimeout)
-	serverType, _, err := prov.HCloud.ServerType.Get(ctx, prov.ServerType)
-	if serverType == nil && err == nil {
-		err = fmt.Errorf("server type '%s' not found", prov.ServerType)
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	for _, server := range servers {
+		if skip[strconv.Itoa(server.ID)] || skip[server.Name] || !prov.isServerForTarget(server) || time.Since(server.Created) < prov.GcMinAge {
+			continue
+		}
+		if prov.PowerOffIdle && server.Status == hcloud.ServerStatusOff {
+			// Left powered off for reuse.
+			continue
+		}
+		log.Printf("Deleting orphaned HCloud server '%s' for target '%s', created at %s\n", server.Name, prov.Name, server.Created.Format(time.RFC3339))
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		_, err := prov.HCloud.Server.Delete(ctx, server)
+		cancel()
+		if err != nil {
+			log.Printf("Could not delete orphaned HCloud server '%s': %s\n", server.Name, err.Error())
+		}
+	}
+}
+
+// Check whether a server was created for the target. Servers created by older
+// versions have no target label, but a name generated by randomName.
+func (prov *Provider) isServerForTarget(server *hcloud.Server) bool {
+	if value, ok := server.Labels[targetLabel]; ok {
+		return value == prov.Labels[targetLabel]
 	}
+	prefix := prov.Name + "-"
+	name := server.Name
+	return strings.HasPrefix(name, prefix) && len(name) == len(prefix)+5 && !strings.Contains(name[len(prefix):], "-")
+}
+
+func (prov *Provider) start(mach *providers.Machine) error {
+	bgCtx := context.Background()
+
+	if prov.Reuse {
+		server, err := prov.findReusable()
+		if err != nil {
+			return err
+		}
+		if server != nil {
+			return prov.startReused(mach, server)
+		}
+	}
+
+	res, err := prov.lookupResources()
 	if err != nil {
-		log.Printf("HCloud server failed to start: %s\n", err.Error())
-		return false
+		return err
 	}
-	// We must get the SSH key from API
-	ctx, _ = context.WithTimeout(bgCtx, requestTimeout)
-	sshKey, _, err := prov.HCloud.SSHKey.Get(ctx, prov.SSHKey)
-	if sshKey == nil && err == nil {
-		err = fmt.Errorf("ssh key '%s' not found", prov.SSHKey)
+
+	name, err := prov.serverName()
+	if err != nil {
+		return err
 	}
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+	created, _, err := prov.HCloud.Server.Create(ctx, prov.serverCreateOpts(name, res))
+	cancel()
 	if err != nil {
-		log.Printf("HCloud server failed to start: %s\n", err.Error())
-		return false
+		return err
 	}
-	// We must get the Location from API
-	ctx, _ = context.WithTimeout(bgCtx, requestTimeout)
-	location, _, err := prov.HCloud.Location.Get(ctx, prov.Location)
-	if location == nil && err == nil {
-		err = fmt.Errorf("location '%s' not found", prov.Location)
+
+	server := created.Server
+	log.Printf("Created HCloud server '%s'\n", server.Name)
+
+	// From here on, the server exists, so set state for cleanup on failure.
+	mach.State = &state{
+		id:       server.Name,
+		serverId: server.ID,
 	}
+	mach.SetInstanceID(strconv.Itoa(server.ID))
+
+	// Wait for the create and power-on actions, then fetch the server again
+	// for its final status and addresses.
+	actions := append([]*hcloud.Action{created.Action}, created.NextActions...)
+	ctx, cancel = context.WithTimeout(bgCtx, startTimeout)
+	_, errCh := prov.HCloud.Action.WatchOverallProgress(ctx, actions)
+	err = <-errCh
+	cancel()
 	if err != nil {
-		log.Printf("HCloud server failed to start: %s\n", err.Error())
-		return false
+		return fmt.Errorf("HCloud server '%s' failed to start: %w", server.Name, err)
 	}
 
+	return prov.finishStart(mach, server.ID)
+}
+
+// Build the options to create a server with the given name.
+func (prov *Provider) serverCreateOpts(name string, res *resources) hcloud.ServerCreateOpts {
 	opts := hcloud.ServerCreateOpts{
-		Name:             randomName(prov.Name),
-		ServerType:       serverType,
-		Image:            image,
-		SSHKeys:          []*hcloud.SSHKey{sshKey},
-		Location:         location,
+		Name:             name,
+		ServerType:       res.serverType,
+		Image:            res.image,
+		SSHKeys:          res.sshKeys,
+		Location:         res.location,
+		Datacenter:       res.datacenter,
+		PlacementGroup:   res.placementGroup,
 		UserData:         prov.UserData,
 		Labels:           prov.Labels,
 		StartAfterCreate: hcloud.Bool(true),
+		PublicNet:        prov.PublicNet.createOpts(),
 	}
+	if len(prov.Networks) != 0 {
+		opts.Networks = prov.Networks
+	}
+	for _, firewall := range prov.Firewalls {
+		opts.Firewalls = append(opts.Firewalls, &hcloud.ServerCreateFirewall{Firewall: *firewall})
+	}
+	return opts
+}
 
-	res, _, err := prov.HCloud.Server.Create(ctx, opts)
+// Find an existing server for the target to reuse, preferring a running
+// server over a powered off one. Returns nil if there is none.
+func (prov *Provider) findReusable() (*hcloud.Server, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	servers, err := prov.HCloud.Server.AllWithOpts(ctx, hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: managedLabel + "=" + managedValue},
+	})
+	cancel()
 	if err != nil {
-		log.Printf("HCloud server failed to start: %s\n", err.Error())
-		return false
+		return nil, fmt.Errorf("could not list HCloud servers for target '%s': %w", prov.Name, err)
 	}
 
-	server := res.Server
-	log.Printf("Created HCloud server '%s'\n", server.Name)
+	var found *hcloud.Server
+	for _, server := range servers {
+		if !prov.isServerForTarget(server) {
+			continue
+		}
+		switch server.Status {
+		case hcloud.ServerStatusRunning:
+			return server, nil
+		case hcloud.ServerStatusOff:
+			if found == nil {
+				found = server
+			}
+		}
+	}
+	return found, nil
+}
 
-	for i := 0; i < 20 && serverIsStarting(server); i++ {
-		<-time.After(3 * time.Second)
+// Adopt an existing server, powering it on if necessary.
+func (prov *Provider) startReused(mach *providers.Machine, server *hcloud.Server) error {
+	mach.State = &state{
+		id:       server.Name,
+		serverId: server.ID,
+		adopted:  true,
+	}
+	mach.SetInstanceID(strconv.Itoa(server.ID))
 
-		ctx, _ := context.WithTimeout(bgCtx, requestTimeout)
-		res, _, err := prov.HCloud.Server.GetByID(ctx, server.ID)
+	if server.Status == hcloud.ServerStatusOff {
+		ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+		action, _, err := prov.HCloud.Server.Poweron(ctx, server)
+		if err == nil {
+			_, errCh := prov.HCloud.Action.WatchProgress(ctx, action)
+			err = <-errCh
+		}
+		cancel()
 		if err != nil {
-			log.Printf("Could not check HCloud server '%s' state: %s\n", server.Name, err.Error())
-			return false
+			return fmt.Errorf("HCloud server '%s' failed to power on: %w", server.Name, err)
 		}
+		log.Printf("Powered on existing HCloud server '%s'\n", server.Name)
+	} else {
+		log.Printf("Reusing running HCloud server '%s'\n", server.Name)
+	}
 
-		server = res
+	return prov.finishStart(mach, server.ID)
+}
+
+// Fetch the started server, and prepare it for connections.
+func (prov *Provider) finishStart(mach *providers.Machine, serverId int) error {
+	bgCtx := context.Background()
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+	server, _, err := prov.HCloud.Server.GetByID(ctx, serverId)
+	cancel()
+	if server == nil && err == nil {
+		err = errNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("could not check HCloud server '%s' state: %w", mach.State.(*state).id, err)
 	}
 
 	if server.Status != hcloud.ServerStatusRunning {
-		log.Printf("HCloud server '%s' in unexpected state '%s'\n", server.Name, server.Status)
-		return false
+		return fmt.Errorf("HCloud server '%s' in unexpected state '%s'", server.Name, server.Status)
 	}
 
 	log.Printf("HCloud server '%s' is running\n", server.Name)
 
-	address := server.PublicNet.IPv4.IP.String()
-	mach.State = &state{
-		id:   server.Name,
-		addr: &address,
+	mach.SetInfo("name", server.Name)
+	if server.ServerType != nil {
+		mach.SetInfo("server_type", server.ServerType.Name)
 	}
-	return true
+	if server.Datacenter != nil {
+		mach.SetInfo("datacenter", server.Datacenter.Name)
+	}
+	if mach.State.(*state).adopted {
+		mach.SetInfo("reused", "true")
+	}
+
+	if prov.ReservedIp != nil {
+		if err := prov.assignReservedIp(mach, server); err != nil {
+			return err
+		}
+	}
+	if err := prov.attachVolumes(mach); err != nil {
+		return err
+	}
+
+	// The private network attachment may not have an IP address yet.
+	addr, err := prov.serverAddr(server)
+	for i := 0; i < 20 && err != nil; i++ {
+		<-time.After(3 * time.Second)
+
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		res, _, getErr := prov.HCloud.Server.GetByID(ctx, server.ID)
+		cancel()
+		if getErr != nil {
+			return fmt.Errorf("could not check HCloud server '%s' state: %w", server.Name, getErr)
+		}
+
+		server = res
+		addr, err = prov.serverAddr(server)
+	}
+
+	mach.State.(*state).addr = addr
+	return err
 }
 
-func randomName(p string) string {
-	var n = 5
+// Look up the image, server type, SSH key and location, or return them from
+// the cache.
+func (prov *Provider) lookupResources() (*resources, error) {
+	prov.resourcesMu.Lock()
+	defer prov.resourcesMu.Unlock()
+	if prov.resources != nil {
+		return prov.resources, nil
+	}
+
+	bgCtx := context.Background()
+	res := &resources{}
+
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+	image, _, err := prov.HCloud.Image.Get(ctx, prov.Image)
+	cancel()
+	if image == nil && err == nil {
+		err = fmt.Errorf("image '%s' %w", prov.Image, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.image = image
+
+	ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+	serverType, _, err := prov.HCloud.ServerType.Get(ctx, prov.ServerType)
+	cancel()
+	if serverType == nil && err == nil {
+		err = fmt.Errorf("server type '%s' %w", prov.ServerType, errNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.serverType = serverType
+
+	for _, name := range prov.SSHKeys {
+		ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+		sshKey, _, err := prov.HCloud.SSHKey.Get(ctx, name)
+		cancel()
+		if sshKey == nil && err == nil {
+			err = fmt.Errorf("ssh key '%s' %w", name, errNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.sshKeys = append(res.sshKeys, sshKey)
+	}
+
+	if prov.Location != "" {
+		ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+		location, _, err := prov.HCloud.Location.Get(ctx, prov.Location)
+		cancel()
+		if location == nil && err == nil {
+			err = fmt.Errorf("location '%s' %w", prov.Location, errNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.location = location
+	}
+
+	if prov.Datacenter != "" {
+		ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+		datacenter, _, err := prov.HCloud.Datacenter.Get(ctx, prov.Datacenter)
+		cancel()
+		if datacenter == nil && err == nil {
+			err = fmt.Errorf("datacenter '%s' %w", prov.Datacenter, errNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.datacenter = datacenter
+	}
+
+	if prov.PlacementGroup != "" {
+		ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+		placementGroup, _, err := prov.HCloud.PlacementGroup.Get(ctx, prov.PlacementGroup)
+		cancel()
+		if placementGroup == nil && err == nil {
+			err = fmt.Errorf("placement group '%s' %w", prov.PlacementGroup, errNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.placementGroup = placementGroup
+	}
+
+	prov.resources = res
+	return res, nil
+}
+
+// Describe where servers are created, for messages. This is the datacenter
+// location, if known, when 'datacenter' is set.
+func (prov *Provider) serverLocation() string {
+	if prov.Location != "" {
+		return prov.Location
+	}
+	prov.resourcesMu.Lock()
+	defer prov.resourcesMu.Unlock()
+	if prov.resources != nil && prov.resources.datacenter != nil && prov.resources.datacenter.Location != nil {
+		return prov.resources.datacenter.Location.Name
+	}
+	return prov.Datacenter
+}
+
+// Check whether a resource in the given location can be used with servers
+// of this target. Always true if the datacenter location is not known.
+func (prov *Provider) inServerLocation(location *hcloud.Location) bool {
+	want := prov.Location
+	if want == "" {
+		prov.resourcesMu.Lock()
+		defer prov.resourcesMu.Unlock()
+		if prov.resources == nil || prov.resources.datacenter == nil || prov.resources.datacenter.Location == nil {
+			return true
+		}
+		want = prov.resources.datacenter.Location.Name
+	}
+	return location.Name == want || strconv.Itoa(location.ID) == want
+}
+
+// Clear the lookupResources cache, so the next start looks them up again.
+func (prov *Provider) forgetResources() {
+	prov.resourcesMu.Lock()
+	prov.resources = nil
+	prov.resourcesMu.Unlock()
+}
+
+// Assign the 'reserved_ip' Floating IP to the server, if not already.
+func (prov *Provider) assignReservedIp(mach *providers.Machine, server *hcloud.Server) error {
+	state := mach.State.(*state)
+	for _, floatingIp := range server.PublicNet.FloatingIPs {
+		if floatingIp.ID == prov.ReservedIp.ID {
+			state.reservedIpAssigned = true
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	defer cancel()
+	action, _, err := prov.HCloud.FloatingIP.Assign(ctx, prov.ReservedIp, server)
+	if err == nil {
+		_, errCh := prov.HCloud.Action.WatchProgress(ctx, action)
+		err = <-errCh
+	}
+	if err != nil {
+		return fmt.Errorf("could not assign Floating IP '%s' to HCloud server '%s': %w", prov.ReservedIp.IP.String(), server.Name, err)
+	}
+	state.reservedIpAssigned = true
+	log.Printf("Assigned Floating IP '%s' to HCloud server '%s'\n", prov.ReservedIp.IP.String(), server.Name)
+	return nil
+}
+
+// Select the address LazySSH connects to for a server, based on settings.
+// With 'use_private_ip', this is the server IP address in the first network.
+// With 'reserved_ip', this is the Floating IP address. Otherwise, this is the
+// public IPv4 or IPv6 address, depending on 'public_net'.
+func (prov *Provider) serverAddr(server *hcloud.Server) (*string, error) {
+	if prov.ReservedIp != nil {
+		ip := prov.ReservedIp.IP
+		if prov.ReservedIp.Type == hcloud.FloatingIPTypeIPv6 {
+			ip = firstHost(ip)
+		}
+		address := ip.String()
+		return &address, nil
+	}
+	if !prov.UsePrivateIp {
+		address, ok := prov.PublicNet.serverAddr(server)
+		if !ok {
+			return nil, fmt.Errorf("HCloud server '%s' has no public IP address", server.Name)
+		}
+		return &address, nil
+	}
+	network := prov.Networks[0]
+	for _, privateNet := range server.PrivateNet {
+		if privateNet.Network != nil && privateNet.Network.ID == network.ID && privateNet.IP != nil {
+			address := privateNet.IP.String()
+			return &address, nil
+		}
+	}
+	return nil, fmt.Errorf("HCloud server '%s' has no IP address in network '%s'", server.Name, network.Name)
+}
+
+// Check whether any inbound TCP rule of the firewalls includes the port.
+// Source IPs are not considered.
+func firewallsAllowPort(firewalls []*hcloud.Firewall, port uint16) bool {
+	for _, firewall := range firewalls {
+		for _, rule := range firewall.Rules {
+			if rule.Direction != hcloud.FirewallRuleDirectionIn || rule.Protocol != hcloud.FirewallRuleProtocolTCP || rule.Port == nil {
+				continue
+			}
+			// The port is either a single port, or a range like '1024-5000'.
+			parts := strings.SplitN(*rule.Port, "-", 2)
+			start, err := strconv.ParseUint(parts[0], 10, 16)
+			if err != nil {
+				continue
+			}
+			end := start
+			if len(parts) == 2 {
+				if end, err = strconv.ParseUint(parts[1], 10, 16); err != nil {
+					continue
+				}
+			}
+			if uint64(port) >= start && uint64(port) <= end {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRetryable classifies errors from start. Rate limiting and transient
+// server-side errors are retried, while capacity, quota and validation errors
+// are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, errNotFound) || errors.Is(err, errAttachVolume) {
+		return false
+	}
+	var apiErr hcloud.Error
+	if !errors.As(err, &apiErr) {
+		// Network errors and the like.
+		return true
+	}
+	switch apiErr.Code {
+	case hcloud.ErrorCodeRateLimitExceeded, hcloud.ErrorCodeServiceError,
+		hcloud.ErrorCodeUnknownError, hcloud.ErrorCodeLocked,
+		hcloud.ErrorCodeConflict, hcloud.ErrorCodeMaintenance:
+		return true
+	default:
+		return false
+	}
+}
+
+// Generate a server name from the 'name' template.
+func (prov *Provider) serverName() (string, error) {
+	var buf strings.Builder
+	err := prov.NameTemplate.Execute(&buf, &serverNameVars{
+		Target: prov.Name,
+		Random: randomString(5),
+	})
+	return buf.String(), err
+}
+
+func randomString(n int) string {
 	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
 	s := make([]rune, n)
 	for i := range s {
 		s[i] = letters[rand.Intn(len(letters))]
 	}
-	return fmt.Sprintf("%s-%s", p, string(s))
+	return string(s)
 }
 
-func serverIsStarting(server *hcloud.Server) bool {
-	return server.Status == hcloud.ServerStatusInitializing ||
-		server.Status == hcloud.ServerStatusStarting ||
-		server.Status == hcloud.ServerStatusOff
+// Convert a string to a valid label value, which is at most 63 characters of
+// alphanumerics and '-', '_' and '.', starting and ending with an
+// alphanumeric character.
+func labelValue(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "_")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "._-")
 }
 
 func (prov *Provider) stop(mach *providers.Machine) {
 	state := mach.State.(*state)
 	bgCtx := context.Background()
-	ctx, _ := context.WithTimeout(bgCtx, requestTimeout)
-	server, _, err := prov.HCloud.Server.GetByName(ctx, state.id)
+	if state.reservedIpAssigned {
+		// The Floating IP is pre-allocated, so is only unassigned, not deleted.
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		_, _, err := prov.HCloud.FloatingIP.Unassign(ctx, prov.ReservedIp)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to unassign Floating IP from HCloud server '%s': %s\n", state.id, err.Error())
+		}
+		state.reservedIpAssigned = false
+	}
+	if len(state.attached) != 0 {
+		prov.detachVolumes(state)
+	}
+
+	ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+	server, _, err := prov.HCloud.Server.GetByID(ctx, state.serverId)
+	cancel()
 	if server == nil && err == nil {
-		err = fmt.Errorf("server '%s' not found", state.id)
+		// Already gone, so nothing was left behind.
+		log.Printf("HCloud server '%s' failed to stop: server not found\n", state.id)
+		return
 	}
-	if err != nil {
-		log.Printf("HCloud server '%s' failed to stop: %s\n", state.id, err.Error())
+	if err == nil && prov.PowerOffIdle {
+		ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+		_, _, err = prov.HCloud.Server.Poweroff(ctx, server)
+		cancel()
+		if err != nil {
+			log.Printf("HCloud server '%s' failed to power off: %s\n", state.id, err.Error())
+			mach.ReportStopError(fmt.Errorf("HCloud server '%s' failed to power off: %w", state.id, err))
+			return
+		}
+		log.Printf("Powered off HCloud server '%s'\n", state.id)
 		return
 	}
-	ctx, _ = context.WithTimeout(bgCtx, requestTimeout)
-	_, err = prov.HCloud.Server.Delete(ctx, server)
+	if err == nil {
+		ctx, cancel = context.WithTimeout(bgCtx, prov.RequestTimeout)
+		_, err = prov.HCloud.Server.Delete(ctx, server)
+		cancel()
+	}
 	if err != nil {
 		log.Printf("HCloud server '%s' failed to stop: %s\n", state.id, err.Error())
+		mach.ReportStopError(fmt.Errorf("HCloud server '%s' failed to stop: %w", state.id, err))
+		return
 	}
 	log.Printf("Terminated HCloud server '%s'\n", state.id)
 }
 
 // Check port every 3 seconds for 2 minutes.
-func (prov *Provider) connectivityTest(mach *providers.Machine) bool {
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
 	state := mach.State.(*state)
 	if state.addr == nil {
-		log.Printf("HCloud server '%s' does not have a public IP address\n", state.id)
-		return false
+		return fmt.Errorf("HCloud server '%s' does not have a public IP address", state.id)
 	}
-	checkAddr := fmt.Sprintf("%s:%d", *state.addr, prov.CheckPort)
+	checkHost := *state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
 	checkTimeout := 3 * time.Second
 	var err error
-	var conn net.Conn
 	for i := 0; i < 40; i++ {
 		checkStart := time.Now()
-		conn, err = net.DialTimeout("tcp", checkAddr, checkTimeout)
+		err = prov.Check.Dial(checkAddr, checkTimeout)
 		if err == nil {
-			conn.Close()
 			log.Printf("Connectivity test succeeded for HCloud server '%s'\n", state.id)
-			return true
+			return nil
 		}
 		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
 	}
-	log.Printf("HCloud server '%s' port check failed: %s\n", state.id, err.Error())
-	return false
+	return fmt.Errorf("HCloud server '%s' port check on '%s' failed: %w", state.id, checkAddr, err)
 }
 
-func (prov *Provider) msgLoop(mach *providers.Machine) {
-	// TODO: Monitor machine status
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections. Returns an error if 'monitor_interval' checks found the server
+// is no longer running.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) error {
 	state := mach.State.(*state)
-	active := <-mach.ModActive
-	for active > 0 {
+	monitor := providers.NewMonitor(prov.MonitorInterval)
+	defer monitor.Stop()
+	ready := time.Now()
+	for {
 		for active > 0 {
 			select {
 			case mod := <-mach.ModActive:
 				active += mod
 			case msg := <-mach.Translate:
-				msg.Reply <- fmt.Sprintf("%s:%d", *state.addr, msg.Port)
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(*state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-monitor.C:
+				if !prov.checkAlive(state) {
+					err := fmt.Errorf("HCloud server '%s' %w", state.id, providers.ErrMachineDied)
+					providers.RejectPending(mach, err)
+					return err
+				}
 			case <-mach.Stop:
-				return
+				return nil
 			}
 		}
 
-		// Linger
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
 		select {
 		case mod := <-mach.ModActive:
 			active += mod
-		case <-time.After(prov.Linger):
-			return
+		case <-time.After(linger):
+			return nil
+		case <-mach.Stop:
+			return nil
+		}
+	}
+}
+
+// Check whether the server is still running. API errors are logged, but
+// otherwise ignored, because they are usually transient.
+func (prov *Provider) checkAlive(state *state) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	server, _, err := prov.HCloud.Server.GetByID(ctx, state.serverId)
+	cancel()
+	if err != nil {
+		log.Printf("Could not check HCloud server '%s' state: %s\n", state.id, err.Error())
+		return true
+	}
+	if server == nil {
+		log.Printf("HCloud server '%s' no longer exists\n", state.id)
+		return false
+	}
+	if server.Status != hcloud.ServerStatusRunning {
+		log.Printf("HCloud server '%s' is unexpectedly in state '%s'\n", state.id, server.Status)
+		return false
+	}
+	return true
+}
+
+// Read the user data from one of 'user_data' or 'user_data_file'. The data is
+// passed to HCloud verbatim.
+func buildUserData(hclBlock hcl.Body, parsed *hclTarget) (string, hcl.Diagnostics) {
+	switch {
+	case parsed.UserData != nil && parsed.UserDataFile != nil:
+		return "", hcl.Diagnostics{&hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting user data fields",
+			Detail:   "Only one of 'user_data' and 'user_data_file' may be set",
+		}}
+	case parsed.UserData != nil:
+		return *parsed.UserData, nil
+	case parsed.UserDataFile != nil:
+		data, err := ioutil.ReadFile(providers.ResolvePath(hclBlock, *parsed.UserDataFile))
+		if err != nil {
+			return "", hcl.Diagnostics{&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Could not read 'user_data_file'",
+				Detail:   err.Error(),
+			}}
 		}
+		return string(data), nil
+	default:
+		return "", nil
 	}
 }
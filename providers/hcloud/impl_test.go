@@ -0,0 +1,153 @@
+package hcloud
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+)
+
+const baseConfig = `
+token = "test-token"
+image = "debian-12"
+server_type = "cx22"
+location = "fsn1"
+ssh_keys = ["deploy"]
+`
+
+// parseTarget creates a Provider from the body of a target block, in check
+// mode so no API requests are made. The Provider is nil if there are errors.
+func parseTarget(t *testing.T, filename string, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), filename)
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	if prov == nil {
+		return nil, diags
+	}
+	return prov.(*Provider), diags
+}
+
+func TestLinger(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   string
+		linger time.Duration
+		err    bool
+	}{
+		{name: "empty", body: ``},
+		{name: "valid", body: `linger = "10m"`, linger: 10 * time.Minute},
+		{name: "invalid", body: `linger = "ten minutes"`, err: true},
+		{name: "negative", body: `linger = "-5s"`, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, diags := parseTarget(t, "test.hcl", baseConfig+tc.body)
+			if tc.err {
+				if !diags.HasErrors() {
+					t.Fatalf("expected an error, got linger %s", prov.Linger)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected error: %s", diags.Error())
+			}
+			if prov.Linger != tc.linger {
+				t.Fatalf("expected linger %s, got %s", tc.linger, prov.Linger)
+			}
+		})
+	}
+}
+
+// cloudConfig is a realistic multi-line cloud-config document, with
+// indentation, quoting, a literal backslash sequence and shell variables that
+// must all reach HCloud untouched.
+const cloudConfig = `#cloud-config
+users:
+  - name: deploy
+    groups: sudo
+    shell: /bin/bash
+    ssh_authorized_keys:
+      - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHx5sUjb0sM4sKlLxZ0n2J6mV9f8 deploy@example
+write_files:
+  - path: /etc/motd
+    content: |
+      Managed by LazySSH.
+      Do not edit.
+  - path: /etc/greeting
+    content: "hello\nworld"
+runcmd:
+  - [sh, -c, 'echo "started at $(date)" >> $HOME/boot.log']
+`
+
+func TestUserDataVerbatim(t *testing.T) {
+	prov, diags := parseTarget(t, "test.hcl", baseConfig+`
+user_data = <<-EOF
+  #cloud-config
+  users:
+    - name: deploy
+      groups: sudo
+      shell: /bin/bash
+      ssh_authorized_keys:
+        - ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHx5sUjb0sM4sKlLxZ0n2J6mV9f8 deploy@example
+  write_files:
+    - path: /etc/motd
+      content: |
+        Managed by LazySSH.
+        Do not edit.
+    - path: /etc/greeting
+      content: "hello\nworld"
+  runcmd:
+    - [sh, -c, 'echo "started at $(date)" >> $HOME/boot.log']
+EOF
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected error: %s", diags.Error())
+	}
+
+	opts := prov.serverCreateOpts("test-server", &resources{})
+	if opts.UserData != cloudConfig {
+		t.Fatalf("user data was modified:\nexpected: %q\ngot:      %q", cloudConfig, opts.UserData)
+	}
+}
+
+func TestUserDataFileVerbatim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazyssh-hcloud")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Relative paths are resolved against the config file.
+	if err := ioutil.WriteFile(filepath.Join(dir, "cloud-config.yaml"), []byte(cloudConfig), 0644); err != nil {
+		t.Fatalf("could not write user data file: %s", err)
+	}
+	prov, diags := parseTarget(t, filepath.Join(dir, "test.hcl"), baseConfig+`
+user_data_file = "cloud-config.yaml"
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected error: %s", diags.Error())
+	}
+
+	opts := prov.serverCreateOpts("test-server", &resources{})
+	if opts.UserData != cloudConfig {
+		t.Fatalf("user data was modified:\nexpected: %q\ngot:      %q", cloudConfig, opts.UserData)
+	}
+}
+
+func TestUserDataConflict(t *testing.T) {
+	_, diags := parseTarget(t, "test.hcl", baseConfig+`
+user_data = "#cloud-config"
+user_data_file = "cloud-config.yaml"
+`)
+	if !diags.HasErrors() {
+		t.Fatalf("expected an error for conflicting user data fields")
+	}
+}
@@ -0,0 +1,133 @@
+package hcloud
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/net/context"
+)
+
+type hclPublicNet struct {
+	EnableIPv4 *bool  `hcl:"enable_ipv4,optional"`
+	EnableIPv6 *bool  `hcl:"enable_ipv6,optional"`
+	IPv4       string `hcl:"ipv4,optional"`
+	IPv6       string `hcl:"ipv6,optional"`
+}
+
+// publicNet is a resolved 'public_net' block.
+type publicNet struct {
+	EnableIPv4 bool
+	EnableIPv6 bool
+	IPv4       *hcloud.PrimaryIP
+	IPv6       *hcloud.PrimaryIP
+}
+
+// Build the public network settings from the 'public_net' block, without
+// resolving primary IPs. Without the block, both address families are
+// enabled, which matches the HCloud defaults.
+func buildPublicNet(parsed *hclPublicNet, usePrivateIp bool) (*publicNet, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	pn := &publicNet{EnableIPv4: true, EnableIPv6: true}
+	if parsed == nil {
+		return pn, diags
+	}
+	if parsed.EnableIPv4 != nil {
+		pn.EnableIPv4 = *parsed.EnableIPv4
+	}
+	if parsed.EnableIPv6 != nil {
+		pn.EnableIPv6 = *parsed.EnableIPv6
+	}
+
+	if parsed.IPv4 != "" && !pn.EnableIPv4 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'ipv4' and 'enable_ipv4' fields",
+			Detail:   "The 'ipv4' primary IP can only be used with 'enable_ipv4 = true'",
+		})
+	}
+	if parsed.IPv6 != "" && !pn.EnableIPv6 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'ipv6' and 'enable_ipv6' fields",
+			Detail:   "The 'ipv6' primary IP can only be used with 'enable_ipv6 = true'",
+		})
+	}
+	if !pn.EnableIPv4 && !pn.EnableIPv6 && !usePrivateIp {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "No public IP address enabled",
+			Detail:   "At least one of 'enable_ipv4' and 'enable_ipv6' must be set, unless 'use_private_ip' is set",
+		})
+	}
+	return pn, diags
+}
+
+// Resolve a primary IP name or ID, and check it can be used for servers
+// created by this target.
+func (prov *Provider) resolvePrimaryIP(field string, nameOrId string, ipType hcloud.PrimaryIPType) (*hcloud.PrimaryIP, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	primaryIp, _, err := prov.HCloud.PrimaryIP.Get(ctx, nameOrId)
+	cancel()
+	if primaryIp == nil && err == nil {
+		err = fmt.Errorf("primary IP '%s' %w", nameOrId, errNotFound)
+	}
+	if err == nil && primaryIp.Type != ipType {
+		err = fmt.Errorf("primary IP is of type '%s', but '%s' is required", primaryIp.Type, ipType)
+	}
+	if err == nil && primaryIp.Datacenter != nil && primaryIp.Datacenter.Location != nil {
+		location := primaryIp.Datacenter.Location
+		if !prov.inServerLocation(location) {
+			err = fmt.Errorf("primary IP is in location '%s', but servers are created in '%s'", location.Name, prov.serverLocation())
+		}
+	}
+	if err != nil {
+		return nil, append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  fmt.Sprintf("Invalid value for '%s' field", field),
+			Detail:   fmt.Sprintf("Could not use HCloud primary IP '%s': %s", nameOrId, err.Error()),
+		})
+	}
+
+	if primaryIp.AutoDelete {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Primary IP is deleted with the server",
+			Detail:   fmt.Sprintf("HCloud primary IP '%s' has auto delete enabled, so it is deleted along with the first server, and the address will not be stable", primaryIp.Name),
+		})
+	}
+	return primaryIp, diags
+}
+
+// Options for ServerCreateOpts.PublicNet.
+func (pn *publicNet) createOpts() *hcloud.ServerCreatePublicNet {
+	return &hcloud.ServerCreatePublicNet{
+		EnableIPv4: pn.EnableIPv4,
+		EnableIPv6: pn.EnableIPv6,
+		IPv4:       pn.IPv4,
+		IPv6:       pn.IPv6,
+	}
+}
+
+// Select the public address of a server. IPv4 is preferred if enabled. HCloud
+// assigns a /64 IPv6 network, of which the server uses the first host address.
+func (pn *publicNet) serverAddr(server *hcloud.Server) (string, bool) {
+	if pn.EnableIPv4 && !server.PublicNet.IPv4.IsUnspecified() {
+		return server.PublicNet.IPv4.IP.String(), true
+	}
+	if pn.EnableIPv6 && !server.PublicNet.IPv6.IsUnspecified() {
+		return firstHost(server.PublicNet.IPv6.IP).String(), true
+	}
+	return "", false
+}
+
+// Return the first host address in the network starting at ip, i.e. '::1' in
+// an IPv6 network.
+func firstHost(ip net.IP) net.IP {
+	host := make(net.IP, len(ip))
+	copy(host, ip)
+	host[len(host)-1]++
+	return host
+}
@@ -0,0 +1,129 @@
+package hcloud
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+var errAttachVolume = errors.New("failed to attach volume")
+
+type hclVolume struct {
+	Volume    string `hcl:"volume,attr"`
+	Automount bool   `hcl:"automount,optional"`
+}
+
+// attachVolume is a resolved 'attach_volume' block.
+type attachVolume struct {
+	Volume    *hcloud.Volume
+	Automount bool
+}
+
+// Attach the 'attach_volume' volumes to the server, retrying transient errors
+// until 'attach_timeout'. Volumes already attached to the server, for example
+// when adopting a server, are skipped.
+func (prov *Provider) attachVolumes(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	for _, v := range prov.AttachVolumes {
+		deadline := time.Now().Add(prov.AttachTimeout)
+		delay := 2 * time.Second
+		for {
+			err := prov.attachVolume(state, v, deadline)
+			if err == nil {
+				break
+			}
+			if !isRetryable(err) || time.Now().Add(delay).After(deadline) {
+				return prov.attachError(state, v.Volume.Name, err)
+			}
+			log.Printf("Attaching volume '%s' to HCloud server '%s' failed, retrying in %s: %s\n", v.Volume.Name, state.id, delay, err.Error())
+			time.Sleep(delay)
+			if delay *= 2; delay > 15*time.Second {
+				delay = 15 * time.Second
+			}
+		}
+		state.attached = append(state.attached, v.Volume)
+	}
+	return nil
+}
+
+// Attach a single volume, and wait for the action to complete.
+func (prov *Provider) attachVolume(state *state, v *attachVolume, deadline time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	volume, _, err := prov.HCloud.Volume.GetByID(ctx, v.Volume.ID)
+	cancel()
+	if volume == nil && err == nil {
+		err = fmt.Errorf("volume '%s' %w", v.Volume.Name, errNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if volume.Server != nil {
+		if volume.Server.ID == state.serverId {
+			return nil
+		}
+		return fmt.Errorf("volume '%s' is attached to another server", volume.Name)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	action, _, err := prov.HCloud.Volume.AttachWithOpts(ctx, volume, hcloud.VolumeAttachOpts{
+		Server:    &hcloud.Server{ID: state.serverId},
+		Automount: hcloud.Bool(v.Automount),
+	})
+	if err == nil {
+		_, errCh := prov.HCloud.Action.WatchProgress(ctx, action)
+		err = <-errCh
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Attached volume '%s' to HCloud server '%s'\n", volume.Name, state.id)
+	return nil
+}
+
+// Build an error for a failed volume attachment, that includes which volumes
+// were attached successfully.
+func (prov *Provider) attachError(state *state, name string, err error) error {
+	return fmt.Errorf("%w '%s' to HCloud server '%s' (%d of %d volumes attached): %v",
+		errAttachVolume, name, state.id, len(state.attached), len(prov.AttachVolumes), err)
+}
+
+// Find 'attach_volume' volumes attached to the server, so they are detached
+// on stop. Used when recovering a server.
+func (prov *Provider) findAttached(state *state) {
+	for _, v := range prov.AttachVolumes {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		volume, _, err := prov.HCloud.Volume.GetByID(ctx, v.Volume.ID)
+		cancel()
+		if err == nil && volume != nil && volume.Server != nil && volume.Server.ID == state.serverId {
+			state.attached = append(state.attached, volume)
+		}
+	}
+}
+
+// Detach volumes before the server is deleted, waiting up to
+// 'attach_timeout' for each. Failures are logged, and the server is deleted
+// regardless, which also detaches the volume.
+func (prov *Provider) detachVolumes(state *state) {
+	for _, volume := range state.attached {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.AttachTimeout)
+		action, _, err := prov.HCloud.Volume.Detach(ctx, volume)
+		if err == nil {
+			_, errCh := prov.HCloud.Action.WatchProgress(ctx, action)
+			err = <-errCh
+		}
+		cancel()
+		if err != nil {
+			log.Printf("Failed to detach volume '%s' from HCloud server '%s': %s\n", volume.Name, state.id, err.Error())
+		} else {
+			log.Printf("Detached volume '%s' from HCloud server '%s'\n", volume.Name, state.id)
+		}
+	}
+	state.attached = nil
+}
@@ -6,8 +6,10 @@ package providers
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/hashicorp/hcl/v2"
+	"github.com/stephank/lazyssh/tracing"
 )
 
 var (
@@ -31,7 +33,22 @@ func Register(id string, f Factory) {
 // Factory produces a Provider for a specific type of Machine, based on
 // 'target' configuration provided by the user.
 type Factory interface {
-	NewProvider(target string, hclBlock hcl.Body) (Provider, error)
+	NewProvider(target string, hclBlock hcl.Body, cfgCtx *ConfigContext) (Provider, error)
+}
+
+// ConfigContext holds information about the configuration as a whole, which
+// is passed to a Factory when creating a Provider.
+type ConfigContext struct {
+	// EvalContext contains variables and locals from the configuration, and
+	// should be used when decoding the 'target' block.
+	EvalContext *hcl.EvalContext
+	// CheckOnly is set when the configuration is only being validated. The
+	// Provider will not be used, and the Factory should avoid failing on errors
+	// unrelated to the configuration itself, like missing credentials.
+	CheckOnly bool
+	// Dialer is set if the target has a 'dial_proxy', and should be used for
+	// connectivity tests. See NewConnectivityCheck.
+	Dialer Dialer
 }
 
 // Factories is an index of Factory objects by Machine type name.
@@ -64,7 +81,11 @@ type Provider interface {
 	// messages, or when it receives a Stop message, it exits the message loop
 	// and makes the necessary external calls to stop the machine again.
 	// Specifically, this method should not return without stopping the machine.
-	RunMachine(mach *Machine)
+	//
+	// If the Machine could not be started, or connectivity could not be
+	// established, an error should be returned. The error message is reported
+	// to SSH clients waiting for the Machine.
+	RunMachine(mach *Machine) error
 }
 
 // Providers is an index of configured Provider instances by Machine type name.
@@ -86,6 +107,127 @@ type Machine struct {
 	Stop chan struct{}
 	// State can be used by the provider to store machine-specific state.
 	State interface{}
+	// Span covers the Machine lifetime. Providers can use it as the parent for
+	// spans of their own, like machine start. It is nil if tracing is disabled,
+	// but tracing functions accept a nil Span.
+	Span *tracing.Span
+	// Recorder is notified of the instance ID via SetInstanceID. It is nil if
+	// the Manager does not persist machine state.
+	Recorder InstanceRecorder
+
+	// instanceID is set by SetInstanceID, and read by the Manager for logging.
+	instanceID atomic.Value
+	// info is set by SetInfo, and read by the Manager for status output.
+	infoMu sync.Mutex
+	info   map[string]string
+	// stopErrs is appended to by ReportStopError.
+	stopErrs []error
+}
+
+// SetInstanceID should be called by the Provider once the machine exists
+// externally, with an ID that identifies it to the Provider. The ID is added
+// to tracing spans, logged for each forwarded connection, and recorded in
+// the state file, if configured, so that the machine can be recovered after a
+// restart. See Recoverer.
+func (mach *Machine) SetInstanceID(id string) {
+	mach.instanceID.Store(id)
+	mach.Span.SetAttribute("lazyssh.instance_id", id)
+	if mach.Recorder != nil {
+		mach.Recorder.RecordInstance(id)
+	}
+}
+
+// InstanceID returns the ID last set with SetInstanceID, or an empty string.
+//
+// Safe to call from any goroutine.
+func (mach *Machine) InstanceID() string {
+	id, _ := mach.instanceID.Load().(string)
+	return id
+}
+
+// SetInfo may be called by the Provider to report a provider-specific detail
+// about the machine, like its instance type or datacenter. These are shown in
+// the status output. An empty value removes the detail.
+//
+// Safe to call from any goroutine.
+func (mach *Machine) SetInfo(key string, value string) {
+	mach.infoMu.Lock()
+	defer mach.infoMu.Unlock()
+	if value == "" {
+		delete(mach.info, key)
+		return
+	}
+	if mach.info == nil {
+		mach.info = make(map[string]string)
+	}
+	mach.info[key] = value
+}
+
+// Info returns a copy of the details set with SetInfo, or nil if there are
+// none.
+//
+// Safe to call from any goroutine.
+func (mach *Machine) Info() map[string]string {
+	mach.infoMu.Lock()
+	defer mach.infoMu.Unlock()
+	if len(mach.info) == 0 {
+		return nil
+	}
+	info := make(map[string]string, len(mach.info))
+	for key, value := range mach.info {
+		info[key] = value
+	}
+	return info
+}
+
+// ReportStopError should be called by the Provider when stopping the machine
+// failed, and external resources may have been left behind. The Manager
+// includes these errors in a summary on shutdown.
+//
+// Called from the Provider RunMachine goroutine.
+func (mach *Machine) ReportStopError(err error) {
+	mach.stopErrs = append(mach.stopErrs, err)
+}
+
+// StopErrors returns the errors reported with ReportStopError. Only safe to
+// call once RunMachine has returned.
+func (mach *Machine) StopErrors() []error {
+	return mach.stopErrs
+}
+
+// InstanceRecorder is implemented by the Manager to persist instance IDs.
+type InstanceRecorder interface {
+	// RecordInstance records the instance ID of a machine.
+	//
+	// Called from the Provider RunMachine goroutine.
+	RecordInstance(id string)
+}
+
+// Recoverer is an optional interface a Provider can implement to deal with
+// machines left running by a previous LazySSH process, for example after a
+// crash.
+type Recoverer interface {
+	// RecoverMachine is called on startup for every instance ID found in the
+	// state file, with a new Machine that has no connections yet.
+	//
+	// Runs on a dedicated goroutine per machine, so is free to block.
+	//
+	// The Provider may either adopt the machine, in which case this method
+	// behaves like RunMachine without the start step, or it may stop the
+	// machine and return. If the machine no longer exists, this method should
+	// simply return nil.
+	RecoverMachine(mach *Machine, id string) error
+}
+
+// Sweeper is an optional interface a Provider can implement to clean up
+// machines it created, which are no longer tracked, for example because a
+// previous LazySSH process crashed.
+type Sweeper interface {
+	// Sweep is called once on startup. The tracked instance IDs are being
+	// recovered from the state file, and must be left alone.
+	//
+	// Runs on a dedicated goroutine, so is free to block.
+	Sweep(tracked []string)
 }
 
 // TranslateMsg is the type sent on the Machine Translate channel.
@@ -95,9 +237,24 @@ type TranslateMsg struct {
 	Addr string
 	// Port is the TCP port the SSH client wants to connect to.
 	Port uint16
-	// Reply is the channel the translation result is sent to. The result is a
-	// Dailer address used to make the actual TCP connection to the Machine. The
-	// provider should not send a reply until it has verified connectivity to the
+	// Reply is the channel the translation result is sent to. The provider
+	// should not send a reply until it has verified connectivity to the
 	// Machine.
-	Reply chan string
+	Reply chan TranslateReply
+}
+
+// TranslateReply is the type sent on the TranslateMsg Reply channel.
+type TranslateReply struct {
+	// Addr is a Dialer address used to make the actual connection to the
+	// Machine. If empty, the SSH channel is rejected.
+	Addr string
+	// Network is the Dialer network, which is either "tcp" or "unix". An empty
+	// value means "tcp".
+	Network string
+	// ProxyProtocol is set to send a PROXY protocol v2 header with the SSH
+	// client address after connecting.
+	ProxyProtocol bool
+	// Err is an optional reason for rejecting the SSH channel, which is
+	// reported to the SSH client. Only used if Addr is empty.
+	Err error
 }
@@ -0,0 +1,112 @@
+// Implements a fake HTTP API server for provider tests. Providers point their
+// API client at the server, and the server responds with canned responses.
+package apitest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Options customize a Server. The zero value is a plain HTTP server keyed by
+// method and path.
+type Options struct {
+	// TLS starts an HTTPS server instead, for clients that require it.
+	TLS bool
+	// Key returns the key of the response for a request. The default is the
+	// method and URL path, like 'GET /v2/droplets'.
+	Key func(r *http.Request) string
+	// Respond, if set, is called with the response found for a request, and
+	// returns the response to write instead. This is used for responses that
+	// depend on the server, like the status of asynchronous operations.
+	Respond func(s *Server, w http.ResponseWriter, r *http.Request, key string, res string) string
+}
+
+// Server is a fake API server. Each response is a body, optionally preceded
+// by an HTTP status code and a space, like `404 {"message": "not found"}`.
+// The default status is 200, and the body is sent as JSON. Requests without a
+// response get a 400 error.
+type Server struct {
+	*httptest.Server
+	opts      Options
+	mu        sync.Mutex
+	responses map[string]string
+	received  map[string]string
+}
+
+// Start a server with the given responses, which is closed when the test
+// ends.
+func NewServer(t *testing.T, responses map[string]string, opts Options) *Server {
+	t.Helper()
+	s := &Server{
+		opts:      opts,
+		responses: make(map[string]string),
+		received:  make(map[string]string),
+	}
+	for key, res := range responses {
+		s.responses[key] = res
+	}
+	if s.opts.Key == nil {
+		s.opts.Key = func(r *http.Request) string {
+			return r.Method + " " + r.URL.Path
+		}
+	}
+	if opts.TLS {
+		s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	} else {
+		s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	key := s.opts.Key(r)
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	s.received[key] = string(body)
+	res, ok := s.responses[key]
+	s.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "unexpected request "+key, http.StatusBadRequest)
+		return
+	}
+	if s.opts.Respond != nil {
+		res = s.opts.Respond(s, w, r, key, res)
+	}
+	status, res := ParseResponse(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write([]byte(res))
+}
+
+// Set or replace the response for a key.
+func (s *Server) SetResponse(key string, res string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[key] = res
+}
+
+// Bodies returns the body of the last request for every key requested so
+// far, including requests without a response.
+func (s *Server) Bodies() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bodies := make(map[string]string, len(s.received))
+	for key, body := range s.received {
+		bodies[key] = body
+	}
+	return bodies
+}
+
+// Split a response into the status code and body.
+func ParseResponse(res string) (int, string) {
+	status := http.StatusOK
+	fmt.Sscanf(res, "%d ", &status)
+	return status, strings.TrimLeft(res, "0123456789 ")
+}
@@ -0,0 +1,463 @@
+// Implements the 'libvirt' target type, which uses the virsh CLI to
+// start/stop existing libvirt domains, like QEMU/KVM virtual machines.
+package libvirt
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("libvirt", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target string
+	// URI is the libvirt connection URI, which may point to a remote host.
+	URI       string
+	Domain    string
+	Addr      string
+	CheckAddr string
+	CheckPort uint16
+	Check     *providers.ConnectivityCheck
+	// AddrMode is 'static' to use Addr, or 'agent' or 'lease' to use the
+	// address reported by the QEMU guest agent or DHCP leases.
+	AddrMode       string
+	GuestIpTimeout time.Duration
+	// StopMode is 'shutdown' to request a graceful shutdown, followed by a
+	// forced stop after ShutdownTimeout, or 'destroy' to stop immediately.
+	StopMode        string
+	ShutdownTimeout time.Duration
+	Linger          time.Duration
+	MinUptime       time.Duration
+	// AdoptRunning means domains that were already running are stopped like
+	// domains we started ourselves. Otherwise, they are left running.
+	AdoptRunning bool
+	// Virsh is the path to the virsh binary, and CommandTimeout the time after
+	// which a virsh command is killed.
+	Virsh          string
+	CommandTimeout time.Duration
+}
+
+type state struct {
+	// addr is the address of the domain, either Addr or a discovered address.
+	addr string
+}
+
+type hclTarget struct {
+	URI                 string `hcl:"uri,optional"`
+	Domain              string `hcl:"domain,attr"`
+	Addr                string `hcl:"addr,optional"`
+	AddrMode            string `hcl:"addr_mode,optional"`
+	GuestIpTimeout      string `hcl:"guest_ip_timeout,optional"`
+	CheckAddr           string `hcl:"check_addr,optional"`
+	CheckPort           uint16 `hcl:"check_port,optional"`
+	CheckType           string `hcl:"check_type,optional"`
+	CheckServerName     string `hcl:"check_servername,optional"`
+	CheckInsecure       bool   `hcl:"check_insecure,optional"`
+	CheckCommand        string `hcl:"check_command,optional"`
+	CheckCommandTimeout string `hcl:"check_command_timeout,optional"`
+	StopMode            string `hcl:"stop_mode,optional"`
+	ShutdownTimeout     string `hcl:"shutdown_timeout,optional"`
+	Linger              string `hcl:"linger,optional"`
+	MinUptime           string `hcl:"min_uptime,optional"`
+	AdoptRunning        bool   `hcl:"adopt_running,optional"`
+	VirshPath           string `hcl:"virsh_path,optional"`
+	CommandTimeout      string `hcl:"command_timeout,optional"`
+}
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	prov := &Provider{
+		Target:          target,
+		URI:             parsed.URI,
+		Domain:          parsed.Domain,
+		Addr:            parsed.Addr,
+		CheckAddr:       parsed.CheckAddr,
+		AdoptRunning:    parsed.AdoptRunning,
+		GuestIpTimeout:  5 * time.Minute,
+		ShutdownTimeout: 2 * time.Minute,
+		Virsh:           parsed.VirshPath,
+		CommandTimeout:  2 * time.Minute,
+	}
+
+	if prov.URI == "" {
+		prov.URI = "qemu:///system"
+	}
+
+	if prov.Virsh == "" {
+		prov.Virsh = "virsh"
+		if _, err := exec.LookPath(prov.Virsh); err != nil {
+			// Depends on the environment, so only warn.
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "virsh not found",
+				Detail:   "Could not find virsh in PATH. Set 'virsh_path' if it is installed elsewhere.",
+			})
+		}
+	}
+
+	switch parsed.AddrMode {
+	case "static", "":
+		prov.AddrMode = "static"
+		if parsed.Addr == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'addr' field",
+				Detail:   "The 'addr' field is required with addr_mode 'static'",
+			})
+		}
+	case "agent", "lease":
+		prov.AddrMode = parsed.AddrMode
+		if parsed.Addr != "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'addr' and 'addr_mode' fields",
+				Detail:   fmt.Sprintf("The 'addr' field cannot be used with addr_mode '%s'", parsed.AddrMode),
+			})
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid addr_mode",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for addr_mode. Must be one of: static, agent, lease", parsed.AddrMode),
+		})
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+	prov.Check = check
+
+	switch parsed.StopMode {
+	case "shutdown", "destroy":
+		prov.StopMode = parsed.StopMode
+	case "":
+		prov.StopMode = "shutdown"
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid stop_mode",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for stop_mode. Must be one of: shutdown, destroy", parsed.StopMode),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"guest_ip_timeout", parsed.GuestIpTimeout, &prov.GuestIpTimeout},
+		{"shutdown_timeout", parsed.ShutdownTimeout, &prov.ShutdownTimeout},
+		{"command_timeout", parsed.CommandTimeout, &prov.CommandTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.Linger != "" {
+		linger, err := time.ParseDuration(parsed.Linger)
+		if err == nil && linger >= 0 {
+			prov.Linger = linger
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'linger' field",
+				Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+			})
+		}
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	return prov, diags
+}
+
+func (prov *Provider) IsShared() bool {
+	// Shared, because we launch an existing domain by name.
+	return true
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	mach.State = &state{}
+	span := tracing.NewSpan(mach.Span, "start")
+	started, err := prov.start()
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+		return &providers.StartError{Err: err}
+	}
+	mach.SetInstanceID(prov.Domain)
+
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		span = tracing.NewSpan(mach.Span, "connectivity_test")
+		err = prov.connectivityTest(mach)
+		span.SetError(err)
+		span.End()
+	}
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	if started || prov.AdoptRunning {
+		prov.stop(mach)
+	} else {
+		log.Printf("Leaving libvirt domain '%s' running, because it was not started by LazySSH\n", prov.Domain)
+	}
+	return err
+}
+
+// RecoverMachine adopts the domain if it was left running by a previous
+// process.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	mach.State = &state{}
+	current, err := prov.domState()
+	if err != nil {
+		return err
+	}
+	if current != "running" {
+		return nil
+	}
+
+	mach.SetInstanceID(prov.Domain)
+	log.Printf("Adopted libvirt domain '%s'\n", prov.Domain)
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		err = prov.connectivityTest(mach)
+	}
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Start the domain, unless it is already running. Returns whether the domain
+// was started by us.
+func (prov *Provider) start() (bool, error) {
+	// Wait for a previous shutdown every 3 seconds for 2 minutes.
+	current, err := prov.domState()
+	for i := 0; i < 40 && err == nil && current == "in shutdown"; i++ {
+		time.Sleep(3 * time.Second)
+		current, err = prov.domState()
+	}
+	switch {
+	case err != nil:
+		return false, err
+	case current == "running":
+		log.Printf("libvirt domain '%s' is already running\n", prov.Domain)
+		return false, nil
+	case current == "paused":
+		if err := prov.virshLogged("resume", prov.Domain); err != nil {
+			return false, fmt.Errorf("libvirt domain '%s' failed to resume: %w", prov.Domain, err)
+		}
+		log.Printf("Resumed libvirt domain '%s'\n", prov.Domain)
+		return true, nil
+	case current == "in shutdown":
+		return false, fmt.Errorf("libvirt domain '%s' is stuck in state '%s'", prov.Domain, current)
+	}
+
+	if err := prov.virshLogged("start", prov.Domain); err != nil {
+		return false, fmt.Errorf("libvirt domain '%s' failed to start: %w", prov.Domain, err)
+	}
+	log.Printf("Started libvirt domain '%s'\n", prov.Domain)
+	return true, nil
+}
+
+// Query the domain state, like 'running' or 'shut off'.
+func (prov *Provider) domState() (string, error) {
+	out, err := prov.virsh("domstate", prov.Domain)
+	if err != nil {
+		return "", fmt.Errorf("could not check libvirt domain '%s' state: %w", prov.Domain, err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Stop the domain. With stop_mode 'shutdown', the domain is destroyed if it
+// does not shut down within shutdown_timeout.
+func (prov *Provider) stop(mach *providers.Machine) {
+	if prov.StopMode == "shutdown" {
+		err := prov.virshLogged("shutdown", prov.Domain)
+		if err == nil {
+			// Wait for shutdown every 3 seconds.
+			deadline := time.Now().Add(prov.ShutdownTimeout)
+			for time.Now().Before(deadline) {
+				current, err := prov.domState()
+				if err == nil && current == "shut off" {
+					log.Printf("Stopped libvirt domain '%s'\n", prov.Domain)
+					return
+				}
+				time.Sleep(3 * time.Second)
+			}
+			log.Printf("libvirt domain '%s' did not shut down after %s, destroying it\n", prov.Domain, prov.ShutdownTimeout)
+		} else {
+			log.Printf("libvirt domain '%s' failed to shut down, destroying it: %s\n", prov.Domain, err.Error())
+		}
+	}
+
+	if err := prov.virshLogged("destroy", prov.Domain); err != nil {
+		log.Printf("libvirt domain '%s' failed to stop: %s\n", prov.Domain, err.Error())
+		mach.ReportStopError(fmt.Errorf("libvirt domain '%s' failed to stop: %w", prov.Domain, err))
+		return
+	}
+	log.Printf("Destroyed libvirt domain '%s'\n", prov.Domain)
+}
+
+// Set the domain address in state, by polling the guest agent or DHCP leases
+// every 3 seconds, unless addr_mode is 'static'.
+func (prov *Provider) resolveAddr(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	if prov.AddrMode == "static" {
+		state.addr = prov.Addr
+		return nil
+	}
+
+	deadline := time.Now().Add(prov.GuestIpTimeout)
+	for {
+		// The guest agent is not available until the guest has booted, so
+		// errors are expected for a while.
+		out, err := prov.virsh("domifaddr", prov.Domain, "--source", prov.AddrMode)
+		if err == nil {
+			if addr := parseDomIfAddr(out); addr != "" {
+				log.Printf("libvirt domain '%s' has address %s\n", prov.Domain, addr)
+				state.addr = addr
+				mach.SetInfo("addr", addr)
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("could not find an IP for libvirt domain '%s' after %s: %w", prov.Domain, prov.GuestIpTimeout, err)
+			}
+			return fmt.Errorf("could not find an IP for libvirt domain '%s' after %s", prov.Domain, prov.GuestIpTimeout)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// Find the first non-loopback IPv4 address in 'virsh domifaddr' output,
+// which is a table like:
+//
+//	 Name       MAC address          Protocol     Address
+//	-------------------------------------------------------------------------------
+//	 vnet0      52:54:00:12:34:56    ipv4         192.168.122.45/24
+func parseDomIfAddr(out string) string {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[len(fields)-2] != "ipv4" {
+			continue
+		}
+		ip, _, err := net.ParseCIDR(fields[len(fields)-1])
+		if err == nil && !ip.IsLoopback() {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// Check port every 3 seconds for 2 minutes.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := prov.CheckAddr
+	if checkHost == "" {
+		checkHost = state.addr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for i := 0; i < 40; i++ {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for libvirt domain '%s'\n", prov.Domain)
+			return nil
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("libvirt domain '%s' connectivity test failed: %w", prov.Domain, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
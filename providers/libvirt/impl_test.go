@@ -0,0 +1,77 @@
+package libvirt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+)
+
+// parseTarget creates a Provider from the body of a target block.
+func parseTarget(t *testing.T, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	return prov.(*Provider), diags
+}
+
+func TestDefaults(t *testing.T) {
+	prov, diags := parseTarget(t, `
+domain = "vm"
+addr = "192.0.2.10"
+virsh_path = "/usr/bin/virsh"
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if prov.URI != "qemu:///system" || prov.AddrMode != "static" || prov.StopMode != "shutdown" {
+		t.Fatalf("unexpected defaults: uri '%s', addr_mode '%s', stop_mode '%s'", prov.URI, prov.AddrMode, prov.StopMode)
+	}
+	if prov.CheckPort != 22 || prov.ShutdownTimeout != 2*time.Minute || prov.CommandTimeout != 2*time.Minute {
+		t.Fatalf("unexpected defaults: check port %d, shutdown timeout %s, command timeout %s", prov.CheckPort, prov.ShutdownTimeout, prov.CommandTimeout)
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		summary string
+	}{
+		{``, "Missing 'addr' field"},
+		{`addr_mode = "agent"` + "\n" + `addr = "192.0.2.10"`, "Conflicting 'addr' and 'addr_mode' fields"},
+		{`addr_mode = "arp"`, "Invalid addr_mode"},
+		{`addr = "192.0.2.10"` + "\n" + `stop_mode = "suspend"`, "Invalid stop_mode"},
+		{`addr = "192.0.2.10"` + "\n" + `shutdown_timeout = "0s"`, "Invalid duration for 'shutdown_timeout' field"},
+		{`addr = "192.0.2.10"` + "\n" + `linger = "ten minutes"`, "Invalid duration for 'linger' field"},
+	} {
+		body := "domain = \"vm\"\nvirsh_path = \"/usr/bin/virsh\"\n" + tc.body
+		_, diags := parseTarget(t, body)
+		if !diags.HasErrors() {
+			t.Fatalf("expected an error for config:\n%s", body)
+		}
+		if diags[0].Summary != tc.summary {
+			t.Fatalf("expected error '%s', got: %s", tc.summary, diags.Error())
+		}
+	}
+}
+
+func TestParseDomIfAddr(t *testing.T) {
+	out := ` Name       MAC address          Protocol     Address
+-------------------------------------------------------------------------------
+ lo         00:00:00:00:00:00    ipv4         127.0.0.1/8
+ eth0       52:54:00:12:34:56    ipv6         fe80::5054:ff:fe12:3456/64
+ eth0       52:54:00:12:34:56    ipv4         192.168.122.45/24
+`
+	if addr := parseDomIfAddr(out); addr != "192.168.122.45" {
+		t.Fatalf("unexpected address: '%s'", addr)
+	}
+	if addr := parseDomIfAddr(""); addr != "" {
+		t.Fatalf("unexpected address for empty output: '%s'", addr)
+	}
+}
@@ -0,0 +1,53 @@
+package libvirt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// Run virsh against the connection URI with a timeout, and return its stdout.
+// Anything written to stderr is logged, and included in the error if the
+// command fails.
+func (prov *Provider) virsh(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.CommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, prov.Virsh, append([]string{"--connect", prov.URI}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	prov.logOutput(stderr.String())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("virsh %s timed out after %s", args[0], prov.CommandTimeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("virsh %s failed: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("virsh %s failed: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// Like virsh, but also log stdout. Used for commands that only report
+// progress on stdout.
+func (prov *Provider) virshLogged(args ...string) error {
+	out, err := prov.virsh(args...)
+	prov.logOutput(out)
+	return err
+}
+
+// Log virsh output line by line, prefixed with the target name.
+func (prov *Provider) logOutput(out string) {
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			log.Printf("%s: virsh: %s\n", prov.Target, line)
+		}
+	}
+}
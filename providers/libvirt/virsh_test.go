@@ -0,0 +1,145 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package libvirt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+// fakeVirsh creates a Provider that runs a shell script in place of virsh.
+// Every invocation appends its arguments to a log file, which is returned by
+// the calls function. The script runs in the temp dir, so it can keep domain
+// state in a file.
+func fakeVirsh(t *testing.T, script string) (prov *Provider, calls func() []string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lazyssh-virsh-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "virsh")
+	callsFile := filepath.Join(dir, "calls")
+	script = "#!/bin/sh\ncd '" + dir + "'\necho \"$*\" >> calls\n" + script
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("could not write script: %s", err)
+	}
+
+	prov = &Provider{
+		Target:          "test",
+		URI:             "qemu:///system",
+		Domain:          "vm",
+		AddrMode:        "static",
+		Addr:            "192.0.2.10",
+		StopMode:        "shutdown",
+		ShutdownTimeout: 10 * time.Second,
+		Virsh:           path,
+		CommandTimeout:  5 * time.Second,
+	}
+	calls = func() []string {
+		data, _ := ioutil.ReadFile(callsFile)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	return prov, calls
+}
+
+// domainScript fakes a domain that is shut off until started, and shuts off
+// again when asked to shut down.
+const domainScript = `
+case "$3" in
+  domstate) cat state 2>/dev/null || echo "shut off" ;;
+  start) echo running > state; echo "Domain 'vm' started" ;;
+  shutdown) echo "shut off" > state; echo "Domain 'vm' is being shutdown" ;;
+  destroy) echo "shut off" > state; echo "Domain 'vm' destroyed" ;;
+esac
+`
+
+func TestStartStop(t *testing.T) {
+	prov, calls := fakeVirsh(t, domainScript)
+	started, err := prov.start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !started {
+		t.Fatalf("expected domain to be reported as started")
+	}
+
+	mach := &providers.Machine{State: &state{}}
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+	expected := []string{
+		"--connect qemu:///system domstate vm",
+		"--connect qemu:///system start vm",
+		"--connect qemu:///system shutdown vm",
+		"--connect qemu:///system domstate vm",
+	}
+	if c := calls(); strings.Join(c, "|") != strings.Join(expected, "|") {
+		t.Fatalf("unexpected calls: %q", c)
+	}
+}
+
+func TestStartAlreadyRunning(t *testing.T) {
+	prov, calls := fakeVirsh(t, "echo running\n")
+	started, err := prov.start()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if started {
+		t.Fatalf("expected running domain not to be reported as started")
+	}
+	if c := calls(); len(c) != 1 {
+		t.Fatalf("expected only a state check, got: %q", c)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	prov, _ := fakeVirsh(t, `
+case "$3" in
+  domstate) echo "shut off" ;;
+  start) echo "error: Failed to start domain 'vm'" >&2; exit 1 ;;
+esac
+`)
+	_, err := prov.start()
+	expected := "libvirt domain 'vm' failed to start: virsh start failed: exit status 1: error: Failed to start domain 'vm'"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error '%s', got: %v", expected, err)
+	}
+}
+
+func TestStopDestroyFailure(t *testing.T) {
+	prov, _ := fakeVirsh(t, `echo "error: Failed to destroy domain 'vm'" >&2; exit 1`+"\n")
+	prov.StopMode = "destroy"
+
+	mach := &providers.Machine{State: &state{}}
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 1 {
+		t.Fatalf("expected a stop error, got: %v", errs)
+	}
+}
+
+func TestResolveAddrAgent(t *testing.T) {
+	prov, _ := fakeVirsh(t, `
+echo " Name       MAC address          Protocol     Address"
+echo " eth0       52:54:00:12:34:56    ipv4         192.168.122.45/24"
+`)
+	prov.AddrMode = "agent"
+	prov.Addr = ""
+
+	mach := &providers.Machine{State: &state{}}
+	if err := prov.resolveAddr(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if addr := mach.State.(*state).addr; addr != "192.168.122.45" {
+		t.Fatalf("unexpected address: '%s'", addr)
+	}
+}
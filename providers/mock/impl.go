@@ -0,0 +1,154 @@
+// Implements an in-memory Provider for driving the Manager in tests. It makes
+// no external calls, and is not registered as a target type, so it cannot be
+// used from the config file.
+package mock
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+type Provider struct {
+	// Addr is the host connections are translated to. The requested port is
+	// kept as is.
+	Addr string
+	// Shared is returned from IsShared.
+	Shared bool
+	// StartDelay is how long starting a machine takes.
+	StartDelay time.Duration
+	// StopDelay is how long stopping a machine takes.
+	StopDelay time.Duration
+	// Linger is how long a machine stays up after the last connection closes.
+	Linger time.Duration
+	// StartErr, if set, is called on every start, and a non-nil result fails
+	// the start with that error.
+	StartErr func() error
+	// StopErr, if set, is called on every stop, and a non-nil result is
+	// reported with ReportStopError.
+	StopErr func() error
+
+	mu      sync.Mutex
+	nextId  int
+	running int
+	started int
+	stopped int
+}
+
+// Counts holds machine lifecycle counters of a Provider.
+type Counts struct {
+	// Running is the number of machines started, but not yet stopped.
+	Running int
+	// Started is the total number of machines successfully started.
+	Started int
+	// Stopped is the total number of machines stopped.
+	Stopped int
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+// Counts returns the current machine lifecycle counters.
+//
+// Safe to call from any goroutine.
+func (prov *Provider) Counts() Counts {
+	prov.mu.Lock()
+	defer prov.mu.Unlock()
+	return Counts{
+		Running: prov.running,
+		Started: prov.started,
+		Stopped: prov.stopped,
+	}
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	stop, err := prov.start(mach)
+	if err != nil {
+		return err
+	}
+	if !stop {
+		prov.msgLoop(mach)
+	}
+	prov.stop(mach)
+	return nil
+}
+
+// Wait for the start delay, while still accepting activity messages. Like
+// real providers, the machine is only considered started once it has seen the
+// first connection, so it doesn't linger out before that arrives. Returns
+// true if a Stop message arrived during start.
+func (prov *Provider) start(mach *providers.Machine) (bool, error) {
+	if prov.StartErr != nil {
+		if err := prov.StartErr(); err != nil {
+			return false, err
+		}
+	}
+
+	prov.mu.Lock()
+	prov.nextId++
+	prov.running++
+	prov.started++
+	id := prov.nextId
+	prov.mu.Unlock()
+	mach.SetInstanceID("mock-" + strconv.Itoa(id))
+
+	active := 0
+	delay := time.NewTimer(prov.StartDelay)
+	defer delay.Stop()
+	delayC := delay.C
+	for delayC != nil || active == 0 {
+		select {
+		case mod := <-mach.ModActive:
+			active += int(mod)
+		case <-delayC:
+			delayC = nil
+		case <-mach.Stop:
+			return true, nil
+		}
+	}
+	mach.State = active
+	return false, nil
+}
+
+func (prov *Provider) stop(mach *providers.Machine) {
+	time.Sleep(prov.StopDelay)
+	if prov.StopErr != nil {
+		if err := prov.StopErr(); err != nil {
+			mach.ReportStopError(err)
+		}
+	}
+
+	prov.mu.Lock()
+	prov.running--
+	prov.stopped++
+	prov.mu.Unlock()
+}
+
+func (prov *Provider) msgLoop(mach *providers.Machine) {
+	active := mach.State.(int)
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += int(mod)
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(prov.Addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		select {
+		case mod := <-mach.ModActive:
+			active += int(mod)
+		case <-time.After(prov.Linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
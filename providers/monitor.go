@@ -0,0 +1,54 @@
+package providers
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrMachineDied is wrapped by the error a Provider returns from RunMachine
+// when its Monitor found the machine is no longer alive, for example because
+// it was terminated outside of LazySSH.
+var ErrMachineDied = errors.New("stopped unexpectedly")
+
+// Monitor periodically asks a Provider to check whether a machine in use is
+// still alive, so that it can be torn down when it dies mid-session, instead
+// of leaving clients connected to a dead machine.
+//
+// A Provider message loop selects on C, and calls its own check when it
+// fires. A Monitor with a zero interval is disabled, and C never fires.
+type Monitor struct {
+	C      <-chan time.Time
+	ticker *time.Ticker
+}
+
+// NewMonitor creates a Monitor that fires every interval. Stop must be called
+// when the message loop exits.
+func NewMonitor(interval time.Duration) *Monitor {
+	if interval <= 0 {
+		return &Monitor{}
+	}
+	ticker := time.NewTicker(interval)
+	return &Monitor{C: ticker.C, ticker: ticker}
+}
+
+// Stop stops the Monitor.
+func (monitor *Monitor) Stop() {
+	if monitor.ticker != nil {
+		monitor.ticker.Stop()
+	}
+}
+
+// RejectPending replies to Translate messages already waiting on the Machine,
+// with the error as the reason, without blocking. Providers call this before
+// leaving the message loop because the machine died, so clients are not kept
+// waiting while the machine is cleaned up.
+func RejectPending(mach *Machine, err error) {
+	for {
+		select {
+		case msg := <-mach.Translate:
+			msg.Reply <- TranslateReply{Err: err}
+		default:
+			return
+		}
+	}
+}
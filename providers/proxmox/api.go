@@ -0,0 +1,226 @@
+package proxmox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// client is a minimal Proxmox VE API client, covering only what the provider
+// needs. It authenticates with an API token.
+type client struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+// apiError is an error response from the Proxmox VE API.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("Proxmox API error %d: %s", err.Status, err.Message)
+}
+
+// Create a client for the API at apiUrl, like 'https://pve.internal:8006'.
+// The token is in the format 'USER@REALM!TOKENID=SECRET'. With insecure, the
+// server certificate is not verified. Otherwise, it is verified against the
+// CA certificates in caFile, if set, or the system CAs.
+func newClient(apiUrl string, token string, insecure bool, caFile string) (*client, error) {
+	parsed, err := url.Parse(apiUrl)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid Proxmox API URL '%s'", apiUrl)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read 'tls_ca_file': %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no PEM certificates found in 'tls_ca_file'")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &client{
+		http: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		base:  strings.TrimSuffix(apiUrl, "/") + "/api2/json",
+		token: token,
+	}, nil
+}
+
+// Send a request with optional form parameters, and decode the 'data' field
+// of the response into out, if not nil.
+func (c *client) do(ctx context.Context, method string, path string, params url.Values, out interface{}) error {
+	reqUrl := c.base + path
+	var body *strings.Reader
+	if method == "GET" || method == "DELETE" {
+		if len(params) != 0 {
+			reqUrl += "?" + params.Encode()
+		}
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+
+	req, err := http.NewRequest(method, reqUrl, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "PVEAPIToken="+c.token)
+	if method == "POST" || method == "PUT" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		// The reason is in the status line. Parameter errors are in the body.
+		apiErr := &apiError{Status: res.StatusCode, Message: strings.TrimSpace(strings.TrimPrefix(res.Status, strconv.Itoa(res.StatusCode)))}
+		var errBody struct {
+			Errors map[string]string `json:"errors"`
+		}
+		if json.NewDecoder(res.Body).Decode(&errBody) == nil {
+			for param, msg := range errBody.Errors {
+				apiErr.Message += fmt.Sprintf("; %s: %s", param, strings.TrimSpace(msg))
+			}
+		}
+		return apiErr
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Data, out)
+	}
+	return nil
+}
+
+// Wait for a task to finish, polling every 2 seconds, and return an error if
+// the task failed.
+func (c *client) waitTask(ctx context.Context, node string, upid string) error {
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", url.PathEscape(node), url.PathEscape(upid))
+	for {
+		var status struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := c.do(ctx, "GET", path, nil, &status); err != nil {
+			return err
+		}
+		if status.Status == "stopped" {
+			if status.ExitStatus != "OK" {
+				return fmt.Errorf("task failed: %s", status.ExitStatus)
+			}
+			return nil
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Send a request that starts a task, and wait for the task to finish.
+func (c *client) doTask(ctx context.Context, node string, method string, path string, params url.Values) error {
+	var upid string
+	if err := c.do(ctx, method, path, params, &upid); err != nil {
+		return err
+	}
+	return c.waitTask(ctx, node, upid)
+}
+
+func vmPath(node string, vmid int) string {
+	return fmt.Sprintf("/nodes/%s/qemu/%d", url.PathEscape(node), vmid)
+}
+
+// Get the VM status, like 'running' or 'stopped'.
+func (c *client) vmStatus(ctx context.Context, node string, vmid int) (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	err := c.do(ctx, "GET", vmPath(node, vmid)+"/status/current", nil, &status)
+	return status.Status, err
+}
+
+// Change the VM status, like 'start', 'shutdown' or 'stop', and wait for the
+// task to finish.
+func (c *client) vmAction(ctx context.Context, node string, vmid int, action string, params url.Values) error {
+	return c.doTask(ctx, node, "POST", vmPath(node, vmid)+"/status/"+action, params)
+}
+
+// Get a free VM ID.
+func (c *client) nextId(ctx context.Context) (int, error) {
+	var id string
+	if err := c.do(ctx, "GET", "/cluster/nextid", nil, &id); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+// Clone a template to a new VM, and wait for the clone to finish.
+func (c *client) cloneVm(ctx context.Context, node string, template int, newid int, name string, full bool) error {
+	params := url.Values{}
+	params.Set("newid", strconv.Itoa(newid))
+	params.Set("name", name)
+	if full {
+		params.Set("full", "1")
+	} else {
+		params.Set("full", "0")
+	}
+	return c.doTask(ctx, node, "POST", vmPath(node, template)+"/clone", params)
+}
+
+// Delete a stopped VM, including its disks, and wait for it to be deleted.
+func (c *client) deleteVm(ctx context.Context, node string, vmid int) error {
+	params := url.Values{}
+	params.Set("purge", "1")
+	params.Set("destroy-unreferenced-disks", "1")
+	return c.doTask(ctx, node, "DELETE", vmPath(node, vmid), params)
+}
+
+// agentInterface is an interface reported by the QEMU guest agent.
+type agentInterface struct {
+	Name        string `json:"name"`
+	IPAddresses []struct {
+		Type    string `json:"ip-address-type"`
+		Address string `json:"ip-address"`
+	} `json:"ip-addresses"`
+}
+
+// Get the network interfaces of a VM from the QEMU guest agent. Fails until
+// the agent is running in the guest.
+func (c *client) agentInterfaces(ctx context.Context, node string, vmid int) ([]agentInterface, error) {
+	var out struct {
+		Result []agentInterface `json:"result"`
+	}
+	err := c.do(ctx, "GET", vmPath(node, vmid)+"/agent/network-get-interfaces", nil, &out)
+	return out.Result, err
+}
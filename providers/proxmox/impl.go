@@ -0,0 +1,693 @@
+// Implements the 'proxmox' target type, which uses the Proxmox VE API to start
+// and stop existing virtual machines, or clones of a template.
+package proxmox
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("proxmox", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Name string
+	Node string
+	// VMID is the VM to start and stop, or with Clone, the template to clone.
+	VMID      int
+	Clone     bool
+	FullClone bool
+	// AddrMode is 'static' to use Addr, or 'agent' to use the address reported
+	// by the QEMU guest agent, optionally on Interface only.
+	AddrMode       string
+	Addr           string
+	Interface      string
+	GuestIpTimeout time.Duration
+	// StopMode is 'shutdown' to request a clean shutdown, followed by a forced
+	// stop after ShutdownTimeout, or 'stop' to stop immediately.
+	StopMode        string
+	ShutdownTimeout time.Duration
+	CheckAddr       *string
+	CheckPort       uint16
+	Check           *providers.ConnectivityCheck
+	Shared          bool
+	AdoptRunning    bool
+	Linger          time.Duration
+	MinUptime       time.Duration
+	RequestTimeout  time.Duration
+	TaskTimeout     time.Duration
+	PVE             *client
+}
+
+type state struct {
+	// id describes the VM in logs.
+	id   string
+	vmid int
+	addr string
+	// created is set if the VM was cloned by us, and started if it was started
+	// by us.
+	created bool
+	started bool
+}
+
+type hclTarget struct {
+	ApiUrl              string  `hcl:"api_url,attr"`
+	Token               *string `hcl:"token,optional"`
+	TokenFile           *string `hcl:"token_file,optional"`
+	TokenEnv            *string `hcl:"token_env,optional"`
+	TLSInsecure         bool    `hcl:"tls_insecure,optional"`
+	TLSCAFile           string  `hcl:"tls_ca_file,optional"`
+	Node                string  `hcl:"node,attr"`
+	VMID                int     `hcl:"vmid,attr"`
+	Clone               bool    `hcl:"clone,optional"`
+	FullClone           bool    `hcl:"full_clone,optional"`
+	Addr                string  `hcl:"addr,optional"`
+	AddrMode            string  `hcl:"addr_mode,optional"`
+	Interface           string  `hcl:"interface,optional"`
+	GuestIpTimeout      string  `hcl:"guest_ip_timeout,optional"`
+	StopMode            string  `hcl:"stop_mode,optional"`
+	ShutdownTimeout     string  `hcl:"shutdown_timeout,optional"`
+	CheckAddr           *string `hcl:"check_addr,optional"`
+	CheckPort           uint16  `hcl:"check_port,optional"`
+	CheckType           string  `hcl:"check_type,optional"`
+	CheckServerName     string  `hcl:"check_servername,optional"`
+	CheckInsecure       bool    `hcl:"check_insecure,optional"`
+	CheckCommand        string  `hcl:"check_command,optional"`
+	CheckCommandTimeout string  `hcl:"check_command_timeout,optional"`
+	Shared              *bool   `hcl:"shared,optional"`
+	AdoptRunning        bool    `hcl:"adopt_running,optional"`
+	Linger              string  `hcl:"linger,optional"`
+	MinUptime           string  `hcl:"min_uptime,optional"`
+	RequestTimeout      string  `hcl:"request_timeout,optional"`
+	TaskTimeout         string  `hcl:"task_timeout,optional"`
+}
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9-]`)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	token, tokenDiags := providers.ResolveSecret("token", parsed.Token, parsed.TokenFile)
+	diags = append(diags, tokenDiags...)
+	if (parsed.Token != nil || parsed.TokenFile != nil) && parsed.TokenEnv != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'token' and 'token_env' fields",
+			Detail:   "Only one of 'token', 'token_file' and 'token_env' may be set",
+		})
+	}
+	if parsed.Token == nil && parsed.TokenFile == nil {
+		// Fall back to the environment.
+		tokenEnv := "PROXMOX_API_TOKEN"
+		if parsed.TokenEnv != nil {
+			tokenEnv = *parsed.TokenEnv
+		}
+		token = strings.TrimSpace(os.Getenv(tokenEnv))
+		if token == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing API token",
+				Detail:   fmt.Sprintf("Set one of 'token' or 'token_file', or set the '%s' environment variable for 'proxmox' targets", tokenEnv),
+			})
+		}
+	} else if token == "" && !tokenDiags.HasErrors() {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing API token",
+			Detail:   "The 'token' or 'token_file' value is empty",
+		})
+	}
+	if token != "" && !strings.Contains(token, "!") {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid API token",
+			Detail:   "The API token must be in the format USER@REALM!TOKENID=SECRET",
+		})
+	}
+
+	pve, err := newClient(parsed.ApiUrl, token, parsed.TLSInsecure, parsed.TLSCAFile)
+	if err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid Proxmox API configuration",
+			Detail:   err.Error(),
+		})
+	}
+	if parsed.TLSInsecure && parsed.TLSCAFile != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'tls_insecure' and 'tls_ca_file' fields",
+			Detail:   "Only one of 'tls_insecure' and 'tls_ca_file' may be set",
+		})
+	}
+
+	prov := &Provider{
+		PVE:             pve,
+		Name:            target,
+		Node:            parsed.Node,
+		VMID:            parsed.VMID,
+		Clone:           parsed.Clone,
+		FullClone:       parsed.FullClone,
+		Addr:            parsed.Addr,
+		Interface:       parsed.Interface,
+		CheckAddr:       parsed.CheckAddr,
+		AdoptRunning:    parsed.AdoptRunning,
+		GuestIpTimeout:  5 * time.Minute,
+		ShutdownTimeout: 2 * time.Minute,
+		RequestTimeout:  30 * time.Second,
+		TaskTimeout:     10 * time.Minute,
+	}
+
+	if prov.VMID < 100 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'vmid' field",
+			Detail:   fmt.Sprintf("The 'vmid' value must be at least 100, but got %d", prov.VMID),
+		})
+	}
+	if parsed.FullClone && !prov.Clone {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'full_clone' was ignored",
+			Detail:   "The 'full_clone' field only applies with 'clone = true'",
+		})
+	}
+
+	switch parsed.AddrMode {
+	case "static", "":
+		prov.AddrMode = "static"
+		if parsed.Addr == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'addr' field",
+				Detail:   "The 'addr' field is required with addr_mode 'static'",
+			})
+		}
+		if prov.Clone {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Static address with 'clone'",
+				Detail:   "Every clone gets the same 'addr', which only works if the template configures it. Consider addr_mode 'agent'",
+			})
+		}
+	case "agent":
+		prov.AddrMode = "agent"
+		if parsed.Addr != "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'addr' and 'addr_mode' fields",
+				Detail:   "The 'addr' field cannot be used with addr_mode 'agent'",
+			})
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid addr_mode",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for addr_mode. Must be one of: static, agent", parsed.AddrMode),
+		})
+	}
+
+	switch parsed.StopMode {
+	case "shutdown", "stop":
+		prov.StopMode = parsed.StopMode
+	case "":
+		prov.StopMode = "shutdown"
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid stop_mode",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for stop_mode. Must be one of: shutdown, stop", parsed.StopMode),
+		})
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+	prov.Check = check
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"guest_ip_timeout", parsed.GuestIpTimeout, &prov.GuestIpTimeout},
+		{"shutdown_timeout", parsed.ShutdownTimeout, &prov.ShutdownTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+		{"task_timeout", parsed.TaskTimeout, &prov.TaskTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	// Like 'virtualbox', a single VM is always shared, and clones are not
+	// shared by default.
+	if parsed.Shared == nil {
+		prov.Shared = !prov.Clone
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+	if !prov.Shared && !prov.Clone {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "A single VM serves all connections, so 'shared = false' requires 'clone = true'",
+		})
+	}
+	if parsed.AdoptRunning && prov.Clone {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'adopt_running' was ignored",
+			Detail:   "The 'adopt_running' field has no effect with 'clone = true', because clones are always created by LazySSH",
+		})
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'proxmox' targets with 'shared = false'"),
+		})
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := prov.start(mach)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+		if mach.State != nil {
+			prov.stop(mach)
+		}
+		return err
+	}
+
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		span = tracing.NewSpan(mach.Span, "connectivity_test")
+		err = prov.connectivityTest(mach)
+		span.SetError(err)
+		span.End()
+	}
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared VM left running by a previous process. Other
+// clones are deleted, because they were dedicated to an SSH connection that no
+// longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	vmid, err := strconv.Atoi(id)
+	if err != nil {
+		return fmt.Errorf("invalid Proxmox VM ID '%s'", id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	status, err := prov.PVE.vmStatus(ctx, prov.Node, vmid)
+	cancel()
+	if apiErr, ok := err.(*apiError); ok && apiErr.Status == 500 && strings.Contains(apiErr.Message, "does not exist") {
+		// Proxmox reports missing VMs as internal errors.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check Proxmox VM %d status: %w", vmid, err)
+	}
+
+	mach.State = &state{
+		id:      fmt.Sprintf("Proxmox VM %d", vmid),
+		vmid:    vmid,
+		created: prov.Clone,
+		started: true,
+	}
+	mach.SetInstanceID(id)
+	if status != "running" {
+		if prov.Clone {
+			prov.delete(mach)
+		}
+		return nil
+	}
+	if !prov.Shared {
+		log.Printf("Deleting orphaned Proxmox VM %d\n", vmid)
+		prov.stop(mach)
+		return nil
+	}
+
+	log.Printf("Adopted Proxmox VM %d\n", vmid)
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		err = prov.connectivityTest(mach)
+	}
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Clone the template if configured, then start the VM. An existing VM that is
+// already running is used as is.
+func (prov *Provider) start(mach *providers.Machine) error {
+	bgCtx := context.Background()
+	state := &state{
+		id:   fmt.Sprintf("Proxmox VM %d", prov.VMID),
+		vmid: prov.VMID,
+	}
+
+	if prov.Clone {
+		if err := prov.cloneTemplate(mach, state); err != nil {
+			return err
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		status, err := prov.PVE.vmStatus(ctx, prov.Node, state.vmid)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check %s status: %w", state.id, err)
+		}
+		mach.State = state
+		mach.SetInstanceID(strconv.Itoa(state.vmid))
+		if status == "running" {
+			log.Printf("%s is already running\n", state.id)
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(bgCtx, prov.TaskTimeout)
+	err := prov.PVE.vmAction(ctx, prov.Node, state.vmid, "start", nil)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("could not start %s: %w", state.id, err)
+	}
+	state.started = true
+	log.Printf("Started %s\n", state.id)
+	return nil
+}
+
+// Clone the template to a new VM with a free ID. Concurrent clones may pick
+// the same free ID, so this is retried a few times.
+func (prov *Provider) cloneTemplate(mach *providers.Machine, state *state) error {
+	name := cloneName(prov.Name)
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		state.vmid, err = prov.PVE.nextId(ctx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not get a free Proxmox VM ID: %w", err)
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), prov.TaskTimeout)
+		err = prov.PVE.cloneVm(ctx, prov.Node, prov.VMID, state.vmid, name, prov.FullClone)
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not clone Proxmox VM %d: %w", prov.VMID, err)
+	}
+
+	state.id = fmt.Sprintf("Proxmox VM %d", state.vmid)
+	state.created = true
+	mach.State = state
+	mach.SetInstanceID(strconv.Itoa(state.vmid))
+	mach.SetInfo("name", name)
+	mach.SetInfo("template", strconv.Itoa(prov.VMID))
+	log.Printf("Cloned Proxmox VM %d to %s '%s'\n", prov.VMID, state.id, name)
+	return nil
+}
+
+// Generate a clone name for a target, followed by a random string. VM names
+// must be valid DNS names.
+func cloneName(target string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(target, "-"), "-")
+	if len(name) > 50 {
+		name = strings.TrimRight(name[:50], "-")
+	}
+	if name == "" {
+		name = "lazyssh"
+	}
+	return name + "-" + randomString(5)
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// Set the VM address in state. With addr_mode 'agent', poll the QEMU guest
+// agent every 3 seconds for the first global IPv4 address.
+func (prov *Provider) resolveAddr(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	if prov.AddrMode == "static" {
+		state.addr = prov.Addr
+		return nil
+	}
+
+	deadline := time.Now().Add(prov.GuestIpTimeout)
+	for {
+		// The agent is not available until the guest has booted, so errors are
+		// expected for a while.
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		ifaces, err := prov.PVE.agentInterfaces(ctx, prov.Node, state.vmid)
+		cancel()
+		if err == nil {
+			if addr := prov.agentAddr(ifaces); addr != "" {
+				log.Printf("%s has address %s\n", state.id, addr)
+				state.addr = addr
+				mach.SetInfo("addr", addr)
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("could not find an IP for %s after %s: %w", state.id, prov.GuestIpTimeout, err)
+			}
+			return fmt.Errorf("could not find an IP for %s after %s", state.id, prov.GuestIpTimeout)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// Find the first IPv4 address that is not loopback or link-local, on the
+// configured interface, if any.
+func (prov *Provider) agentAddr(ifaces []agentInterface) string {
+	for _, iface := range ifaces {
+		if prov.Interface != "" && iface.Name != prov.Interface {
+			continue
+		}
+		for _, addr := range iface.IPAddresses {
+			ip := net.ParseIP(addr.Address)
+			if addr.Type == "ipv4" && ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+				return ip.String()
+			}
+		}
+	}
+	return ""
+}
+
+// Stop the VM if it was started by us, or adopt_running is set. Clones are
+// then deleted.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	if state.started || (prov.AdoptRunning && !state.created) {
+		if !prov.shutdown(mach) {
+			return
+		}
+	} else if !state.created {
+		log.Printf("Leaving %s running, because it was not started by LazySSH\n", state.id)
+		return
+	}
+	if state.created {
+		prov.delete(mach)
+	}
+}
+
+// Shut down the VM according to stop_mode. A shutdown that does not finish
+// within shutdown_timeout is followed by a forced stop. Returns whether the VM
+// stopped.
+func (prov *Provider) shutdown(mach *providers.Machine) bool {
+	state := mach.State.(*state)
+	bgCtx := context.Background()
+	var err error
+	if prov.StopMode == "shutdown" {
+		params := url.Values{}
+		params.Set("timeout", strconv.Itoa(int(prov.ShutdownTimeout/time.Second)))
+		ctx, cancel := context.WithTimeout(bgCtx, prov.ShutdownTimeout+prov.RequestTimeout)
+		err = prov.PVE.vmAction(ctx, prov.Node, state.vmid, "shutdown", params)
+		cancel()
+		if err == nil {
+			log.Printf("Shut down %s\n", state.id)
+			return true
+		}
+		log.Printf("%s did not shut down cleanly, forcing it to stop: %s\n", state.id, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(bgCtx, prov.TaskTimeout)
+	err = prov.PVE.vmAction(ctx, prov.Node, state.vmid, "stop", nil)
+	cancel()
+	if err != nil {
+		log.Printf("%s failed to stop: %s\n", state.id, err.Error())
+		mach.ReportStopError(fmt.Errorf("%s failed to stop: %w", state.id, err))
+		return false
+	}
+	log.Printf("Stopped %s\n", state.id)
+	return true
+}
+
+// Delete a stopped clone, including its disks.
+func (prov *Provider) delete(mach *providers.Machine) {
+	state := mach.State.(*state)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.TaskTimeout)
+	err := prov.PVE.deleteVm(ctx, prov.Node, state.vmid)
+	cancel()
+	if err != nil {
+		log.Printf("%s failed to be deleted: %s\n", state.id, err.Error())
+		mach.ReportStopError(fmt.Errorf("%s failed to be deleted: %w", state.id, err))
+		return
+	}
+	log.Printf("Deleted %s\n", state.id)
+}
+
+// Check port every 3 seconds for 2 minutes.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for i := 0; i < 40; i++ {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for %s\n", state.id)
+			return nil
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("%s port check on '%s' failed: %w", state.id, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
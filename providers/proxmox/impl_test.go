@@ -0,0 +1,188 @@
+package proxmox
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+// parseTarget creates a Provider from the body of a target block. The
+// Provider is nil if there are errors.
+func parseTarget(t *testing.T, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	if prov == nil {
+		return nil, diags
+	}
+	return prov.(*Provider), diags
+}
+
+// baseConfig has the required fields for a target that starts a single VM.
+const baseConfig = `
+api_url = "https://pve.internal:8006"
+token = "root@pam!lazyssh=secret"
+node = "pve"
+vmid = 100
+`
+
+// fakeApi creates a Provider that clones template 9000, with a client that
+// talks to a fake API server. Request bodies are returned by the bodies
+// function.
+func fakeApi(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{})
+	prov, diags := parseTarget(t, `
+api_url = "`+srv.URL+`"
+token = "root@pam!lazyssh=secret"
+node = "pve"
+vmid = 9000
+clone = true
+addr_mode = "agent"
+`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	prov.RequestTimeout = 5 * time.Second
+	prov.TaskTimeout = 5 * time.Second
+	prov.ShutdownTimeout = 5 * time.Second
+	return prov, srv.Bodies
+}
+
+// taskDone is the status of a task that finished successfully.
+const taskDone = `{"data": {"status": "stopped", "exitstatus": "OK"}}`
+
+func TestDefaults(t *testing.T) {
+	prov, diags := parseTarget(t, baseConfig+`addr = "192.0.2.10"`)
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if prov.AddrMode != "static" || prov.StopMode != "shutdown" || !prov.Shared || prov.CheckPort != 22 {
+		t.Fatalf("unexpected defaults: addr_mode '%s', stop_mode '%s', shared %v, check port %d", prov.AddrMode, prov.StopMode, prov.Shared, prov.CheckPort)
+	}
+	if prov.PVE.base != "https://pve.internal:8006/api2/json" {
+		t.Fatalf("unexpected API base URL: %s", prov.PVE.base)
+	}
+
+	prov, diags = parseTarget(t, baseConfig+"clone = true\naddr_mode = \"agent\"")
+	if diags.HasErrors() {
+		t.Fatalf("unexpected errors: %s", diags.Error())
+	}
+	if prov.Shared {
+		t.Fatalf("expected clones not to be shared by default")
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		summary string
+	}{
+		{`vmid = 99` + "\n" + `addr = "192.0.2.10"`, "Invalid value for 'vmid' field"},
+		{`vmid = 100`, "Missing 'addr' field"},
+		{`vmid = 100` + "\n" + `addr_mode = "agent"` + "\n" + `addr = "192.0.2.10"`, "Conflicting 'addr' and 'addr_mode' fields"},
+		{`vmid = 100` + "\n" + `addr = "192.0.2.10"` + "\n" + `stop_mode = "pause"`, "Invalid stop_mode"},
+		{`vmid = 100` + "\n" + `addr = "192.0.2.10"` + "\n" + `shared = false`, "Invalid value for 'shared' field"},
+	} {
+		body := "api_url = \"https://pve.internal:8006\"\ntoken = \"root@pam!lazyssh=secret\"\nnode = \"pve\"\n" + tc.body
+		prov, diags := parseTarget(t, body)
+		if prov != nil || !diags.HasErrors() {
+			t.Fatalf("expected an error for config:\n%s", body)
+		}
+		if diags[0].Summary != tc.summary {
+			t.Fatalf("expected error '%s', got: %s", tc.summary, diags.Error())
+		}
+	}
+}
+
+func TestInvalidToken(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		summary string
+	}{
+		{`token = "secret"`, "Invalid API token"},
+		{`token_env = "LAZYSSH_TEST_UNSET_TOKEN"`, "Missing API token"},
+		{`token = "root@pam!lazyssh=secret"` + "\n" + `token_env = "PROXMOX_API_TOKEN"`, "Conflicting 'token' and 'token_env' fields"},
+	} {
+		body := "api_url = \"https://pve.internal:8006\"\nnode = \"pve\"\nvmid = 100\naddr = \"192.0.2.10\"\n" + tc.body
+		prov, diags := parseTarget(t, body)
+		if prov != nil || !diags.HasErrors() {
+			t.Fatalf("expected an error for config:\n%s", body)
+		}
+		if diags[0].Summary != tc.summary {
+			t.Fatalf("expected error '%s', got: %s", tc.summary, diags.Error())
+		}
+	}
+}
+
+func TestStartStopClone(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /api2/json/cluster/nextid":                        `{"data": "101"}`,
+		"POST /api2/json/nodes/pve/qemu/9000/clone":            `{"data": "UPID:pve:clone"}`,
+		"GET /api2/json/nodes/pve/tasks/UPID:pve:clone/status": taskDone,
+		"POST /api2/json/nodes/pve/qemu/101/status/start":      `{"data": "UPID:pve:start"}`,
+		"GET /api2/json/nodes/pve/tasks/UPID:pve:start/status": taskDone,
+		"GET /api2/json/nodes/pve/qemu/101/agent/network-get-interfaces": `{"data": {"result": [
+			{"name": "lo", "ip-addresses": [{"ip-address-type": "ipv4", "ip-address": "127.0.0.1"}]},
+			{"name": "eth0", "ip-addresses": [{"ip-address-type": "ipv4", "ip-address": "192.0.2.10"}]}
+		]}}`,
+		"POST /api2/json/nodes/pve/qemu/101/status/shutdown":      `{"data": "UPID:pve:shutdown"}`,
+		"GET /api2/json/nodes/pve/tasks/UPID:pve:shutdown/status": taskDone,
+		"DELETE /api2/json/nodes/pve/qemu/101":                    `{"data": "UPID:pve:delete"}`,
+		"GET /api2/json/nodes/pve/tasks/UPID:pve:delete/status":   taskDone,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if state.vmid != 101 || !state.created || !state.started {
+		t.Fatalf("unexpected state: vmid %d, created %v, started %v", state.vmid, state.created, state.started)
+	}
+	if req := bodies()["POST /api2/json/nodes/pve/qemu/9000/clone"]; !strings.Contains(req, "newid=101") || !strings.Contains(req, "name=test-") {
+		t.Fatalf("unexpected clone request: %s", req)
+	}
+
+	if err := prov.resolveAddr(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if state.addr != "192.0.2.10" {
+		t.Fatalf("unexpected address: '%s'", state.addr)
+	}
+
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+	if _, ok := bodies()["GET /api2/json/nodes/pve/tasks/UPID:pve:delete/status"]; !ok {
+		t.Fatalf("expected the clone to be deleted")
+	}
+}
+
+func TestStartTaskFailed(t *testing.T) {
+	prov, _ := fakeApi(t, map[string]string{
+		"GET /api2/json/cluster/nextid":                        `{"data": "101"}`,
+		"POST /api2/json/nodes/pve/qemu/9000/clone":            `{"data": "UPID:pve:clone"}`,
+		"GET /api2/json/nodes/pve/tasks/UPID:pve:clone/status": `{"data": {"status": "stopped", "exitstatus": "storage 'local-lvm' is full"}}`,
+	})
+
+	mach := &providers.Machine{}
+	err := prov.start(mach)
+	expected := "could not clone Proxmox VM 9000: task failed: storage 'local-lvm' is full"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error '%s', got: %v", expected, err)
+	}
+	if mach.State != nil {
+		t.Fatalf("expected no state for a VM that was not cloned")
+	}
+}
@@ -0,0 +1,153 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer makes TCP connections to machines. A *net.Dialer is used for direct
+// connections, and a ProxyDialer for 'dial_proxy'.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// socksDialer is implemented by the Dialer returned from proxy.SOCKS5. Using
+// an existing connection means the result is a plain *net.TCPConn, which
+// supports half-close.
+type socksDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+}
+
+// ProxyDialer makes TCP connections through a SOCKS5 or HTTP CONNECT proxy.
+type ProxyDialer struct {
+	addr    string
+	forward *net.Dialer
+	socks   socksDialer
+	auth    string
+}
+
+// NewProxyDialer parses a 'dial_proxy' URL, which is one of
+// 'socks5://host:port' or 'http://host:port', optionally with credentials.
+// The forward Dialer is used to connect to the proxy itself.
+func NewProxyDialer(rawURL string, forward *net.Dialer) (*ProxyDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("the URL has no host")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, errors.New("the URL must not have a path")
+	}
+
+	d := &ProxyDialer{forward: forward}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d.addr = hostPortDefault(u, "1080")
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		// The network and address are not used with DialWithConn.
+		socks, err := proxy.SOCKS5("tcp", d.addr, auth, nil)
+		if err != nil {
+			return nil, err
+		}
+		d.socks = socks.(socksDialer)
+	case "http":
+		d.addr = hostPortDefault(u, "80")
+		if u.User != nil {
+			password, _ := u.User.Password()
+			d.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme '%s', must be one of 'socks5' or 'http'", u.Scheme)
+	}
+	return d, nil
+}
+
+func hostPortDefault(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// DialContext connects to the proxy, and asks it to connect to addr. The
+// context deadline, if any, also applies to the proxy handshake.
+func (d *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy '%s': %w", d.addr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if d.socks != nil {
+		_, err = d.socks.DialWithConn(ctx, conn, network, addr)
+	} else {
+		err = d.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy '%s' could not connect to '%s': %w", d.addr, addr, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Perform an HTTP CONNECT handshake.
+func (d *ProxyDialer) connect(conn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != "" {
+		req.Header.Set("Proxy-Authorization", d.auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Read the response headers one byte at a time, because the machine may
+	// send data right after, like an SSH server banner, which must not be
+	// consumed here.
+	var head []byte
+	buf := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= 64*1024 {
+			return errors.New("response headers too large")
+		}
+		if _, err := conn.Read(buf); err != nil {
+			return err
+		}
+		head = append(head, buf[0])
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package providers
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	// retryBaseDelay is the delay before the first retry of a failed start.
+	retryBaseDelay = 2 * time.Second
+	// retryMaxDelay caps the exponential backoff between start retries.
+	retryMaxDelay = 1 * time.Minute
+)
+
+// errStopped is returned by RetryStart when the Manager requested the Machine
+// stop while waiting to retry.
+var errStopped = errors.New("machine stop requested while retrying start")
+
+// StartError is returned from RunMachine when the Machine could not be
+// started at all, as opposed to failing after it was started. No external
+// resources remain when this error is returned, so another Provider may be
+// tried instead. See the 'fallback' type.
+type StartError struct {
+	Err error
+}
+
+func (err *StartError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *StartError) Unwrap() error {
+	return err.Err
+}
+
+// IsStartError returns whether the error is a StartError.
+func IsStartError(err error) bool {
+	var startErr *StartError
+	return errors.As(err, &startErr)
+}
+
+// RetryStart calls the start function, retrying up to the given number of
+// times with exponential backoff when it fails.
+//
+// The isRetryable function classifies errors returned from start. Errors for
+// which it returns false (e.g. capacity or quota errors) are returned
+// immediately without retrying.
+//
+// The start function is expected to clean up after itself on failure, so that
+// it can be called again. A Stop message received while waiting to retry
+// aborts the start. Errors from start are returned as a StartError.
+func RetryStart(mach *Machine, retries int, isRetryable func(error) bool, start func() error) error {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := start()
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries || !isRetryable(err) {
+			return &StartError{Err: err}
+		}
+
+		log.Printf("Machine start failed, retrying in %s (%d of %d): %s\n", delay, attempt+1, retries, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-mach.Stop:
+			return errStopped
+		}
+
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package scaleway
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	block "github.com/scaleway/scaleway-sdk-go/api/block/v1"
+	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
+	marketplace "github.com/scaleway/scaleway-sdk-go/api/marketplace/v2"
+	sdkerrors "github.com/scaleway/scaleway-sdk-go/errors"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"golang.org/x/net/context"
+)
+
+// client holds the Scaleway API clients used by the provider, for a single
+// zone.
+type client struct {
+	instance    *instance.API
+	block       *block.API
+	marketplace *marketplace.API
+	zone        scw.Zone
+}
+
+// Load a profile the same way the Scaleway CLI does: the named profile or the
+// active profile from the Scaleway config file, if it exists, with 'SCW_*'
+// environment variables taking precedence.
+func loadProfile(name string) (*scw.Profile, error) {
+	profile := &scw.Profile{}
+	cfg, err := scw.LoadConfig()
+	var notFound *scw.ConfigFileNotFoundError
+	switch {
+	case errors.As(err, &notFound):
+		if name != "" {
+			return nil, fmt.Errorf("%s, so profile '%s' does not exist", notFound.Error(), name)
+		}
+		err = nil
+	case err != nil:
+	case name != "":
+		profile, err = cfg.GetProfile(name)
+	default:
+		profile, err = cfg.GetActiveProfile()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scw.MergeProfiles(profile, scw.LoadEnvProfile()), nil
+}
+
+// Create clients for a profile. The profile must have a default zone.
+// Options are used by tests to point the clients at a local server.
+func newClient(profile *scw.Profile, opts ...scw.ClientOption) (*client, error) {
+	scwClient, err := scw.NewClient(append([]scw.ClientOption{scw.WithProfile(profile)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	zone, _ := scwClient.GetDefaultZone()
+	return &client{
+		instance:    instance.NewAPI(scwClient),
+		block:       block.NewAPI(scwClient),
+		marketplace: marketplace.NewAPI(scwClient),
+		zone:        zone,
+	}, nil
+}
+
+// Create a server. It is created stopped.
+func (c *client) createServer(ctx context.Context, req *instance.CreateServerRequest) (*instance.Server, error) {
+	req.Zone = c.zone
+	res, err := c.instance.CreateServer(req, scw.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return res.Server, nil
+}
+
+// Get a server by ID.
+func (c *client) getServer(ctx context.Context, id string) (*instance.Server, error) {
+	res, err := c.instance.GetServer(&instance.GetServerRequest{Zone: c.zone, ServerID: id}, scw.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return res.Server, nil
+}
+
+// List all servers that have every one of the given tags.
+func (c *client) listServers(ctx context.Context, tags []string) ([]*instance.Server, error) {
+	res, err := c.instance.ListServers(&instance.ListServersRequest{
+		Zone: c.zone,
+		Tags: tags,
+	}, scw.WithContext(ctx), scw.WithAllPages())
+	if err != nil {
+		return nil, err
+	}
+	return res.Servers, nil
+}
+
+// Set the cloud-init user data of a server.
+func (c *client) setCloudInit(ctx context.Context, id string, data string) error {
+	return c.instance.SetServerUserData(&instance.SetServerUserDataRequest{
+		Zone:     c.zone,
+		ServerID: id,
+		Key:      "cloud-init",
+		Content:  strings.NewReader(data),
+	}, scw.WithContext(ctx))
+}
+
+// Run a server action, like 'poweron' or 'poweroff'. Actions are
+// asynchronous, so the caller should wait for the server state to change.
+func (c *client) serverAction(ctx context.Context, id string, action instance.ServerAction) error {
+	_, err := c.instance.ServerAction(&instance.ServerActionRequest{
+		Zone:     c.zone,
+		ServerID: id,
+		Action:   action,
+	}, scw.WithContext(ctx))
+	return err
+}
+
+// Poll the server every 3 seconds until it is in the desired state, and
+// return it.
+func (c *client) waitServerState(ctx context.Context, id string, desired instance.ServerState) (*instance.Server, error) {
+	for {
+		srv, err := c.getServer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if srv.State == desired {
+			return srv, nil
+		}
+
+		select {
+		case <-time.After(3 * time.Second):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("server is in state '%s', waiting for '%s': %w", srv.State, desired, ctx.Err())
+		}
+	}
+}
+
+// Delete a stopped server. Its volumes are detached, but not deleted.
+func (c *client) deleteServer(ctx context.Context, id string) error {
+	return c.instance.DeleteServer(&instance.DeleteServerRequest{Zone: c.zone, ServerID: id}, scw.WithContext(ctx))
+}
+
+// Delete a detached volume, using the Block API for SBS volumes.
+func (c *client) deleteVolume(ctx context.Context, vol *instance.VolumeServer) error {
+	if vol.VolumeType == instance.VolumeServerVolumeTypeSbsVolume {
+		return c.block.DeleteVolume(&block.DeleteVolumeRequest{Zone: c.zone, VolumeID: vol.ID}, scw.WithContext(ctx))
+	}
+	return c.instance.DeleteVolume(&instance.DeleteVolumeRequest{Zone: c.zone, VolumeID: vol.ID}, scw.WithContext(ctx))
+}
+
+// Delete a flexible IP.
+func (c *client) deleteIp(ctx context.Context, id string) error {
+	return c.instance.DeleteIP(&instance.DeleteIPRequest{Zone: c.zone, IP: id}, scw.WithContext(ctx))
+}
+
+// List the Marketplace images for a label, like 'ubuntu_jammy', in the zone.
+func (c *client) listLocalImages(ctx context.Context, label string) ([]*marketplace.LocalImage, error) {
+	res, err := c.marketplace.ListLocalImages(&marketplace.ListLocalImagesRequest{
+		ImageLabel: scw.StringPtr(label),
+		Zone:       &c.zone,
+	}, scw.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return res.LocalImages, nil
+}
+
+// isApiError checks whether an error is an error response from the API. The
+// SDK turns some error responses into specific types, like
+// scw.QuotasExceededError, and the rest into scw.ResponseError. Other errors
+// from the SDK, like network errors, are wrapped in an sdkerrors.Error.
+func isApiError(err error) bool {
+	var sdkErr scw.SdkError
+	var wrapped *sdkerrors.Error
+	return errors.As(err, &sdkErr) && !errors.As(err, &wrapped)
+}
+
+// isNotFound checks whether an error indicates a resource does not exist.
+func isNotFound(err error) bool {
+	var notFound *scw.ResourceNotFoundError
+	var respErr *scw.ResponseError
+	return errors.As(err, &notFound) || (errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound)
+}
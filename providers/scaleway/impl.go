@@ -0,0 +1,803 @@
+// Implements the 'scaleway' target type, which uses the Scaleway Instance API
+// to create and delete servers.
+package scaleway
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
+	marketplace "github.com/scaleway/scaleway-sdk-go/api/marketplace/v2"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("scaleway", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target string
+	// Server is the template for new servers. The name and image are set per
+	// machine.
+	Server *instance.CreateServerRequest
+	// ImageLabel is set if 'image' is a Marketplace label, instead of an ID.
+	ImageLabel     string
+	RootVolumeType string
+	UserData       *string
+	// FlexibleIp is the ID of an existing flexible IP to attach to servers.
+	FlexibleIp     string
+	UsePrivateIp   bool
+	KeepVolume     bool
+	CheckAddr      *string
+	CheckPort      uint16
+	Check          *providers.ConnectivityCheck
+	StartRetries   int
+	Shared         bool
+	Linger         time.Duration
+	MinUptime      time.Duration
+	StartTimeout   time.Duration
+	RequestTimeout time.Duration
+	GcOnStart      bool
+	GcMinAge       time.Duration
+	Scw            *client
+}
+
+type state struct {
+	id   string
+	name string
+	addr string
+	// volumes are the volumes of the server, which are deleted along with it,
+	// unless 'keep_volume' is set.
+	volumes []*instance.VolumeServer
+	// ipId is set if the server got a public IP address of its own, which is
+	// deleted along with it.
+	ipId string
+	// deadline is when the server must be ready, according to
+	// 'start_timeout'.
+	deadline time.Time
+}
+
+type hclTarget struct {
+	AccessKey           string   `hcl:"access_key,optional"`
+	SecretKey           *string  `hcl:"secret_key,optional"`
+	SecretKeyFile       *string  `hcl:"secret_key_file,optional"`
+	Profile             string   `hcl:"profile,optional"`
+	ProjectId           string   `hcl:"project_id,optional"`
+	OrganizationId      string   `hcl:"organization_id,optional"`
+	Zone                string   `hcl:"zone,optional"`
+	CommercialType      string   `hcl:"commercial_type,attr"`
+	Image               string   `hcl:"image,attr"`
+	RootVolumeSizeGb    int64    `hcl:"root_volume_size_gb,optional"`
+	RootVolumeType      string   `hcl:"root_volume_type,optional"`
+	EnableIpv6          bool     `hcl:"enable_ipv6,optional"`
+	Tags                []string `hcl:"tags,optional"`
+	UserData            *string  `hcl:"user_data,optional"`
+	FlexibleIp          string   `hcl:"flexible_ip,optional"`
+	UsePrivateIp        bool     `hcl:"use_private_ip,optional"`
+	KeepVolume          bool     `hcl:"keep_volume,optional"`
+	CheckAddr           *string  `hcl:"check_addr,optional"`
+	CheckPort           uint16   `hcl:"check_port,optional"`
+	CheckType           string   `hcl:"check_type,optional"`
+	CheckServerName     string   `hcl:"check_servername,optional"`
+	CheckInsecure       bool     `hcl:"check_insecure,optional"`
+	CheckCommand        string   `hcl:"check_command,optional"`
+	CheckCommandTimeout string   `hcl:"check_command_timeout,optional"`
+	StartRetries        int      `hcl:"start_retries,optional"`
+	Shared              *bool    `hcl:"shared,optional"`
+	Linger              string   `hcl:"linger,optional"`
+	MinUptime           string   `hcl:"min_uptime,optional"`
+	StartTimeout        string   `hcl:"start_timeout,optional"`
+	RequestTimeout      string   `hcl:"request_timeout,optional"`
+	GcOnStart           bool     `hcl:"gc_on_start,optional"`
+	GcMinAge            string   `hcl:"gc_min_age,optional"`
+}
+
+// managedTag is added to every server LazySSH creates, so orphaned servers
+// can be found.
+const managedTag = "ManagedBy=lazyssh"
+
+// targetTagPrefix is followed by the target address in a tag added to every
+// server LazySSH creates, so servers can be matched to targets.
+const targetTagPrefix = "lazyssh-target="
+
+var (
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]`)
+	uuidRegexp       = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+var (
+	errNoAddress = errors.New("does not have an IP address to connect to")
+	errNoQuota   = errors.New("Scaleway quota exceeded or out of stock")
+	errNoImage   = errors.New("no compatible Scaleway image")
+)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	// In check mode, the environment may lack credentials entirely.
+	envSeverity := hcl.DiagError
+	if cfgCtx.CheckOnly {
+		envSeverity = hcl.DiagWarning
+	}
+	incomplete := false
+
+	profile, err := loadProfile(parsed.Profile)
+	if err != nil {
+		incomplete = true
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: envSeverity,
+			Summary:  "Error loading Scaleway config",
+			Detail:   err.Error(),
+		})
+		profile = &scw.Profile{}
+	}
+
+	if parsed.AccessKey != "" {
+		profile.AccessKey = &parsed.AccessKey
+	}
+	if parsed.SecretKey != nil || parsed.SecretKeyFile != nil {
+		secretKey, secretDiags := providers.ResolveSecret("secret_key", parsed.SecretKey, parsed.SecretKeyFile)
+		diags = append(diags, secretDiags...)
+		if secretKey == "" && !secretDiags.HasErrors() {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing secret key",
+				Detail:   "The 'secret_key' or 'secret_key_file' value is empty",
+			})
+		}
+		profile.SecretKey = &secretKey
+	}
+	if profile.AccessKey == nil || *profile.AccessKey == "" || profile.SecretKey == nil || *profile.SecretKey == "" {
+		incomplete = true
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: envSeverity,
+			Summary:  "Missing API key",
+			Detail:   "Set 'access_key' and one of 'secret_key' or 'secret_key_file', set the 'SCW_ACCESS_KEY' and 'SCW_SECRET_KEY' environment variables, or configure them in the Scaleway config file for 'scaleway' targets",
+		})
+	}
+
+	if parsed.Zone != "" {
+		profile.DefaultZone = &parsed.Zone
+	}
+	if profile.DefaultZone == nil || *profile.DefaultZone == "" {
+		incomplete = true
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: envSeverity,
+			Summary:  "Missing 'zone' field",
+			Detail:   "Set the 'zone' field, the 'SCW_DEFAULT_ZONE' environment variable, or 'default_zone' in the Scaleway config file for 'scaleway' targets",
+		})
+	}
+
+	// Servers are created in the default project, or the default project of
+	// the organization, if there is no default project.
+	if parsed.ProjectId != "" {
+		profile.DefaultProjectID = &parsed.ProjectId
+	} else if parsed.OrganizationId != "" {
+		profile.DefaultProjectID = nil
+	}
+	if parsed.OrganizationId != "" {
+		profile.DefaultOrganizationID = &parsed.OrganizationId
+	}
+	if (profile.DefaultProjectID == nil || *profile.DefaultProjectID == "") &&
+		(profile.DefaultOrganizationID == nil || *profile.DefaultOrganizationID == "") {
+		incomplete = true
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: envSeverity,
+			Summary:  "Missing 'project_id' field",
+			Detail:   "Set the 'project_id' or 'organization_id' field, the 'SCW_DEFAULT_PROJECT_ID' or 'SCW_DEFAULT_ORGANIZATION_ID' environment variable, or 'default_project_id' in the Scaleway config file for 'scaleway' targets",
+		})
+	}
+
+	srv := &instance.CreateServerRequest{
+		CommercialType: parsed.CommercialType,
+		Tags:           []string{managedTag, targetTagPrefix + target},
+		EnableIPv6:     scw.BoolPtr(parsed.EnableIpv6),
+	}
+	for _, tag := range parsed.Tags {
+		if tag != managedTag && !strings.HasPrefix(tag, targetTagPrefix) {
+			srv.Tags = append(srv.Tags, tag)
+		}
+	}
+
+	prov := &Provider{
+		Target:         target,
+		Server:         srv,
+		RootVolumeType: parsed.RootVolumeType,
+		UserData:       parsed.UserData,
+		FlexibleIp:     parsed.FlexibleIp,
+		UsePrivateIp:   parsed.UsePrivateIp,
+		KeepVolume:     parsed.KeepVolume,
+		CheckAddr:      parsed.CheckAddr,
+		StartRetries:   parsed.StartRetries,
+		StartTimeout:   5 * time.Minute,
+		RequestTimeout: 30 * time.Second,
+		GcOnStart:      parsed.GcOnStart,
+		GcMinAge:       time.Hour,
+	}
+
+	if parsed.CommercialType == "" || parsed.Image == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required field",
+			Detail:   "The 'commercial_type' and 'image' fields must not be empty",
+		})
+	}
+	if uuidRegexp.MatchString(parsed.Image) {
+		srv.Image = &parsed.Image
+	} else {
+		prov.ImageLabel = parsed.Image
+	}
+
+	if parsed.RootVolumeSizeGb < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'root_volume_size_gb' field",
+			Detail:   fmt.Sprintf("The 'root_volume_size_gb' value must not be negative, but got %d", parsed.RootVolumeSizeGb),
+		})
+	}
+	switch parsed.RootVolumeType {
+	case "", "l_ssd", "b_ssd", "sbs_volume":
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'root_volume_type' field",
+			Detail:   "The 'root_volume_type' field must be one of \"l_ssd\", \"b_ssd\" or \"sbs_volume\"",
+		})
+	}
+	if parsed.RootVolumeSizeGb > 0 || parsed.RootVolumeType != "" {
+		root := &instance.VolumeServerTemplate{VolumeType: instance.VolumeVolumeType(parsed.RootVolumeType)}
+		if parsed.RootVolumeSizeGb > 0 {
+			root.Size = scw.SizePtr(scw.Size(parsed.RootVolumeSizeGb) * scw.GB)
+		}
+		srv.Volumes = map[string]*instance.VolumeServerTemplate{"0": root}
+	}
+
+	// Servers get a dynamic public IP address, unless they get the flexible
+	// IP, or only need a private address.
+	if parsed.FlexibleIp != "" {
+		srv.PublicIPs = &[]string{parsed.FlexibleIp}
+	} else {
+		srv.DynamicIPRequired = scw.BoolPtr(!parsed.UsePrivateIp)
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
+	if parsed.Shared == nil {
+		prov.Shared = true
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+
+	if !prov.Shared && parsed.FlexibleIp != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'shared' field",
+			Detail:   "The 'flexible_ip' field requires 'shared = true', because the flexible IP can only be attached to one server at a time",
+		})
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'scaleway' targets with 'shared = false'"),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"start_timeout", parsed.StartTimeout, &prov.StartTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	// In check mode, don't create a client without the full config.
+	if incomplete {
+		return prov, diags
+	}
+	prov.Scw, err = newClient(profile)
+	if err != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid Scaleway config",
+			Detail:   err.Error(),
+		})
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially created server before a retry.
+			prov.stop(mach)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("Scaleway server failed to start: %s\n", err.Error())
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared Scaleway server left running by a previous
+// process. Other servers are deleted, because they were dedicated to an SSH
+// connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	srv, err := prov.Scw.getServer(ctx, id)
+	cancel()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check Scaleway server '%s' state: %w", id, err)
+	}
+
+	state := prov.newState(srv)
+	state.deadline = time.Now().Add(prov.StartTimeout)
+	mach.State = state
+	mach.SetInstanceID(id)
+
+	if srv.State == instance.ServerStateRunning {
+		state.addr = prov.serverAddr(srv)
+	}
+	if !prov.Shared || state.addr == "" {
+		log.Printf("Deleting orphaned Scaleway server '%s'\n", state.name)
+		prov.stop(mach)
+		return nil
+	}
+
+	log.Printf("Adopted Scaleway server '%s'\n", state.name)
+	err = prov.connectivityTest(mach)
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Sweep deletes servers created for this target that are older than
+// 'gc_min_age', if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	servers, err := prov.Scw.listServers(ctx, []string{managedTag, targetTagPrefix + prov.Target})
+	cancel()
+	if err != nil {
+		log.Printf("Could not list Scaleway servers for target '%s': %s\n", prov.Target, err.Error())
+		return
+	}
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	for _, srv := range servers {
+		if skip[srv.ID] || srv.CreationDate == nil || time.Since(*srv.CreationDate) < prov.GcMinAge {
+			continue
+		}
+		log.Printf("Deleting orphaned Scaleway server '%s' for target '%s', created at %s\n", srv.Name, prov.Target, srv.CreationDate.Format(time.RFC3339))
+		prov.stop(&providers.Machine{State: prov.newState(srv)})
+	}
+}
+
+// Build the state for a server, recording the resources to delete with it.
+func (prov *Provider) newState(srv *instance.Server) *state {
+	state := &state{id: srv.ID, name: srv.Name}
+	for _, vol := range srv.Volumes {
+		state.volumes = append(state.volumes, vol)
+	}
+	for _, ip := range serverIps(srv) {
+		if ip.ID != "" && ip.ID != prov.FlexibleIp {
+			state.ipId = ip.ID
+		}
+	}
+	return state
+}
+
+// Create a server, set its user data, power it on, and wait for it to be
+// running. The API creates servers stopped, so these are separate steps.
+func (prov *Provider) start(mach *providers.Machine) error {
+	deadline := time.Now().Add(prov.StartTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	req := *prov.Server
+	req.Name = serverName(prov.Target)
+	if prov.ImageLabel != "" {
+		image, err := prov.resolveImage(ctx)
+		if err != nil {
+			return err
+		}
+		req.Image = &image
+	}
+
+	log.Printf("Creating Scaleway server '%s'\n", req.Name)
+	srv, err := prov.Scw.createServer(ctx, &req)
+	if err != nil {
+		return describeError(fmt.Sprintf("could not create Scaleway server '%s'", req.Name), err)
+	}
+
+	state := prov.newState(srv)
+	state.deadline = deadline
+	mach.State = state
+	mach.SetInstanceID(srv.ID)
+	mach.SetInfo("commercial_type", req.CommercialType)
+	mach.SetInfo("zone", prov.Scw.zone.String())
+
+	if prov.UserData != nil {
+		if err := prov.Scw.setCloudInit(ctx, state.id, *prov.UserData); err != nil {
+			return fmt.Errorf("could not set Scaleway server '%s' user data: %w", state.name, err)
+		}
+	}
+
+	if err := prov.Scw.serverAction(ctx, state.id, instance.ServerActionPoweron); err != nil {
+		return describeError(fmt.Sprintf("could not power on Scaleway server '%s'", state.name), err)
+	}
+	srv, err = prov.Scw.waitServerState(ctx, state.id, instance.ServerStateRunning)
+	if err != nil {
+		return fmt.Errorf("Scaleway server '%s' failed to start: %w", state.name, err)
+	}
+
+	state.addr = prov.serverAddr(srv)
+	if state.addr == "" {
+		return fmt.Errorf("Scaleway server '%s' %w", state.name, errNoAddress)
+	}
+	log.Printf("Scaleway server '%s' is running with address %s\n", state.name, state.addr)
+	mach.SetInfo("addr", state.addr)
+	return nil
+}
+
+// Find the Marketplace image for 'image' in the zone that is compatible with
+// the commercial type. If 'root_volume_type' is set, images for the matching
+// kind of volume are preferred.
+func (prov *Provider) resolveImage(ctx context.Context) (string, error) {
+	images, err := prov.Scw.listLocalImages(ctx, prov.ImageLabel)
+	if err != nil {
+		return "", fmt.Errorf("could not find Scaleway image '%s': %w", prov.ImageLabel, err)
+	}
+
+	var preferredType marketplace.LocalImageType
+	switch prov.RootVolumeType {
+	case "l_ssd":
+		preferredType = marketplace.LocalImageTypeInstanceLocal
+	case "b_ssd", "sbs_volume":
+		preferredType = marketplace.LocalImageTypeInstanceSbs
+	}
+
+	found := ""
+	for _, image := range images {
+		if !image.IsCompatible(strings.ToUpper(prov.Server.CommercialType)) {
+			continue
+		}
+		if preferredType == "" || image.Type == preferredType {
+			return image.ID, nil
+		}
+		if found == "" {
+			found = image.ID
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("%w '%s' for commercial type '%s' in zone '%s'", errNoImage, prov.ImageLabel, prov.Server.CommercialType, prov.Scw.zone)
+	}
+	return found, nil
+}
+
+// Generate a server name for a target, followed by a random string. Server
+// names double as the hostname.
+func serverName(target string) string {
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(target), "-"), ".-")
+	if len(name) > 50 {
+		name = strings.TrimRight(name[:50], ".-")
+	}
+	if name == "" {
+		name = "lazyssh"
+	}
+	return name + "-" + randomString(8)
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// The public IPs of a server. Older servers only have the single 'public_ip'
+// field.
+func serverIps(srv *instance.Server) []*instance.ServerIP {
+	if len(srv.PublicIPs) != 0 {
+		return srv.PublicIPs
+	}
+	if srv.PublicIP != nil {
+		return []*instance.ServerIP{srv.PublicIP}
+	}
+	return nil
+}
+
+// Select the address LazySSH connects to for a server: the public IPv4
+// address, or the private IP address with 'use_private_ip'. Returns an empty
+// string if the server has no suitable address.
+func (prov *Provider) serverAddr(srv *instance.Server) string {
+	if prov.UsePrivateIp {
+		if srv.PrivateIP != nil {
+			return *srv.PrivateIP
+		}
+		return ""
+	}
+	for _, ip := range serverIps(srv) {
+		if ip.Family != instance.ServerIPIPFamilyInet6 && ip.Address != nil {
+			return ip.Address.String()
+		}
+	}
+	return ""
+}
+
+// describeError wraps an API error. Quota and stock errors are marked, so they
+// are not retried, and reported to SSH clients as such.
+func describeError(msg string, err error) error {
+	var quotaErr *scw.QuotasExceededError
+	var stockErr *scw.OutOfStockError
+	if errors.As(err, &quotaErr) || errors.As(err, &stockErr) {
+		return fmt.Errorf("%s: %w: %s", msg, errNoQuota, err.Error())
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// isRetryable classifies errors from start. Rate limiting and server-side
+// errors are retried, while quota, stock and validation errors are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, errNoQuota) || errors.Is(err, errNoAddress) || errors.Is(err, errNoImage) {
+		return false
+	}
+	if !isApiError(err) {
+		// Network errors and the like.
+		return true
+	}
+	var respErr *scw.ResponseError
+	return errors.As(err, &respErr) && (respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= 500)
+}
+
+// Power off and delete the server, then delete its volumes, unless
+// 'keep_volume' is set, and its own public IP address. The flexible IP set
+// with 'flexible_ip' is only detached.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.StartTimeout)
+	defer cancel()
+
+	err := prov.powerOff(ctx, state)
+	if err == nil {
+		err = prov.Scw.deleteServer(ctx, state.id)
+	}
+	if err != nil && !isNotFound(err) {
+		log.Printf("Scaleway server '%s' failed to delete: %s\n", state.name, err.Error())
+		mach.ReportStopError(fmt.Errorf("Scaleway server '%s' failed to delete: %w", state.name, err))
+		return
+	}
+
+	if !prov.KeepVolume {
+		for _, vol := range state.volumes {
+			err := prov.Scw.deleteVolume(ctx, vol)
+			if err != nil && !isNotFound(err) {
+				log.Printf("Scaleway server '%s' volume '%s' failed to delete: %s\n", state.name, vol.ID, err.Error())
+				mach.ReportStopError(fmt.Errorf("Scaleway server '%s' volume '%s' failed to delete: %w", state.name, vol.ID, err))
+			}
+		}
+	}
+	if state.ipId != "" {
+		err := prov.Scw.deleteIp(ctx, state.ipId)
+		if err != nil && !isNotFound(err) {
+			log.Printf("Scaleway server '%s' IP address failed to delete: %s\n", state.name, err.Error())
+			mach.ReportStopError(fmt.Errorf("Scaleway server '%s' IP address failed to delete: %w", state.name, err))
+		}
+	}
+	log.Printf("Deleted Scaleway server '%s'\n", state.name)
+}
+
+// Power off the server, unless it is already stopped, because only stopped
+// servers can be deleted.
+func (prov *Provider) powerOff(ctx context.Context, state *state) error {
+	srv, err := prov.Scw.getServer(ctx, state.id)
+	if err != nil {
+		return err
+	}
+	if srv.State == instance.ServerStateStopped {
+		return nil
+	}
+	if srv.State != instance.ServerStateStopping {
+		if err := prov.Scw.serverAction(ctx, state.id, instance.ServerActionPoweroff); err != nil {
+			return err
+		}
+	}
+	_, err = prov.Scw.waitServerState(ctx, state.id, instance.ServerStateStopped)
+	return err
+}
+
+// Check port every 3 seconds until the 'start_timeout' deadline.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for Scaleway server '%s'\n", state.name)
+			return nil
+		}
+		if checkStart.Add(checkTimeout).After(state.deadline) {
+			break
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("Scaleway server '%s' port check on '%s' timed out: %w", state.name, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package scaleway
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
+	"github.com/scaleway/scaleway-sdk-go/scw"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+const zonePath = "/instance/v1/zones/fr-par-1"
+
+// fakeApi creates a Provider with a client that talks to a fake API server,
+// with responses keyed by method and path relative to the zone. Request bodies
+// are returned by the bodies function.
+func fakeApi(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{
+		Key: func(r *http.Request) string {
+			return r.Method + " " + strings.TrimPrefix(r.URL.Path, zonePath)
+		},
+	})
+	scwClient, err := newClient(&scw.Profile{
+		AccessKey:        scw.StringPtr("SCWXXXXXXXXXXXXXXXXX"),
+		SecretKey:        scw.StringPtr("11111111-1111-1111-1111-111111111111"),
+		DefaultProjectID: scw.StringPtr("22222222-2222-2222-2222-222222222222"),
+		DefaultZone:      scw.StringPtr("fr-par-1"),
+	}, scw.WithAPIURL(srv.URL))
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	prov = &Provider{
+		Target: "test",
+		Server: &instance.CreateServerRequest{
+			CommercialType:    "DEV1-S",
+			Image:             scw.StringPtr("33333333-3333-3333-3333-333333333333"),
+			Tags:              []string{managedTag, targetTagPrefix + "test"},
+			DynamicIPRequired: scw.BoolPtr(true),
+		},
+		StartTimeout:   time.Minute,
+		RequestTimeout: 5 * time.Second,
+		Scw:            scwClient,
+	}
+	return prov, srv.Bodies
+}
+
+const runningServer = `{"server": {
+	"id": "44444444-4444-4444-4444-444444444444",
+	"name": "test-abcd1234",
+	"state": "running",
+	"private_ip": "10.1.2.3",
+	"public_ips": [
+		{"id": "55555555-5555-5555-5555-555555555555", "address": "2001:db8::1", "family": "inet6", "dynamic": true},
+		{"id": "66666666-6666-6666-6666-666666666666", "address": "192.0.2.10", "family": "inet", "dynamic": true}
+	],
+	"volumes": {"0": {"id": "77777777-7777-7777-7777-777777777777", "volume_type": "sbs_volume"}}
+}}`
+
+func TestStart(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"POST /servers": `201 {"server": {
+			"id": "44444444-4444-4444-4444-444444444444",
+			"name": "test-abcd1234",
+			"state": "stopped",
+			"volumes": {"0": {"id": "77777777-7777-7777-7777-777777777777", "volume_type": "sbs_volume"}}
+		}}`,
+		"POST /servers/44444444-4444-4444-4444-444444444444/action": `202 {"task": {"id": "88888888-8888-8888-8888-888888888888"}}`,
+		"GET /servers/44444444-4444-4444-4444-444444444444":         runningServer,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if state.addr != "192.0.2.10" || len(state.volumes) != 1 {
+		t.Fatalf("unexpected state: addr '%s', %d volumes", state.addr, len(state.volumes))
+	}
+
+	req := bodies()["POST /servers"]
+	if !strings.Contains(req, `"project":"22222222-2222-2222-2222-222222222222"`) ||
+		!strings.Contains(req, `"tags":["ManagedBy=lazyssh","lazyssh-target=test"]`) {
+		t.Fatalf("unexpected create request: %s", req)
+	}
+}
+
+func TestStartRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		response  string
+		err       error
+		retryable bool
+	}{
+		{
+			name: "quota exceeded",
+			response: `403 {"type": "quotas_exceeded", "message": "quota(s) exceeded for this resource",
+				"details": [{"resource": "instances_dev1_s_servers_count", "quota": 1, "current": 1}]}`,
+			err: errNoQuota,
+		},
+		{
+			name:     "out of stock",
+			response: `412 {"type": "out_of_stock", "message": "out of stock", "resource": "DEV1-S"}`,
+			err:      errNoQuota,
+		},
+		{
+			name:     "invalid arguments",
+			response: `400 {"type": "invalid_arguments", "message": "invalid argument(s)", "details": [{"argument_name": "commercial_type", "reason": "constraint"}]}`,
+		},
+		{
+			name:      "rate limited",
+			response:  `429 {"message": "Too many requests"}`,
+			retryable: true,
+		},
+		{
+			name:      "server error",
+			response:  `500 {"message": "Internal server error"}`,
+			retryable: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, _ := fakeApi(t, map[string]string{
+				"POST /servers": tc.response,
+			})
+
+			mach := &providers.Machine{}
+			err := prov.start(mach)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%s', got: %s", tc.err, err)
+			}
+			if isRetryable(err) != tc.retryable {
+				t.Fatalf("expected retryable to be %v for: %s", tc.retryable, err)
+			}
+		})
+	}
+}
+
+func TestStopDeletesResources(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /servers/44444444-4444-4444-4444-444444444444":    strings.Replace(runningServer, "running", "stopped", 1),
+		"DELETE /servers/44444444-4444-4444-4444-444444444444": "204 ",
+		"DELETE /ips/66666666-6666-6666-6666-666666666666":     `404 {"type": "not_found", "message": "resource is not found"}`,
+	})
+	mach := &providers.Machine{State: &state{
+		id:   "44444444-4444-4444-4444-444444444444",
+		name: "test-abcd1234",
+		ipId: "66666666-6666-6666-6666-666666666666",
+	}}
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+	received := bodies()
+	for _, key := range []string{
+		"DELETE /servers/44444444-4444-4444-4444-444444444444",
+		"DELETE /ips/66666666-6666-6666-6666-666666666666",
+	} {
+		if _, ok := received[key]; !ok {
+			t.Fatalf("expected request %s", key)
+		}
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lazyssh-scaleway-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+access_key: SCWXXXXXXXXXXXXXXXXX
+secret_key: 11111111-1111-1111-1111-111111111111
+default_zone: fr-par-1
+profiles:
+  lazyssh:
+    default_zone: nl-ams-1
+    default_project_id: 22222222-2222-2222-2222-222222222222
+`), 0600)
+	if err != nil {
+		t.Fatalf("could not write config file: %s", err)
+	}
+	setenv(t, "SCW_CONFIG_PATH", path)
+	setenv(t, "SCW_PROFILE", "")
+	setenv(t, "SCW_ACCESS_KEY", "")
+	setenv(t, "SCW_DEFAULT_PROJECT_ID", "")
+	setenv(t, "SCW_DEFAULT_ZONE", "pl-waw-1")
+
+	profile, err := loadProfile("lazyssh")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *profile.AccessKey != "SCWXXXXXXXXXXXXXXXXX" || *profile.DefaultProjectID != "22222222-2222-2222-2222-222222222222" {
+		t.Fatalf("expected the profile to be merged with the default profile")
+	}
+	if *profile.DefaultZone != "pl-waw-1" {
+		t.Fatalf("expected the environment to take precedence, got zone '%s'", *profile.DefaultZone)
+	}
+
+	if _, err := loadProfile("missing"); err == nil {
+		t.Fatalf("expected an error for a missing profile")
+	}
+}
+
+// setenv sets an environment variable for the duration of a test. An empty
+// value unsets the variable.
+func setenv(t *testing.T, key string, value string) {
+	old, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestSweep(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /servers": `{"servers": [
+			{"id": "tracked", "name": "test-tracked1", "state": "running", "creation_date": "` + old + `"},
+			{"id": "orphaned", "name": "test-orphaned", "state": "running", "creation_date": "` + old + `"},
+			{"id": "starting", "name": "test-starting", "state": "running", "creation_date": "` + recent + `"}
+		], "total_count": 3}`,
+		"GET /servers/orphaned":    `{"server": {"id": "orphaned", "name": "test-orphaned", "state": "stopped"}}`,
+		"DELETE /servers/orphaned": "204 ",
+	})
+	prov.GcOnStart = true
+	prov.GcMinAge = time.Hour
+
+	prov.Sweep([]string{"tracked"})
+	received := bodies()
+	if _, ok := received["DELETE /servers/orphaned"]; !ok || len(received) != 3 {
+		t.Fatalf("expected only the orphaned server to be deleted, got requests: %v", received)
+	}
+}
@@ -0,0 +1,58 @@
+package providers
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// ResolveSecret returns the value of a sensitive field, which may either be
+// set inline, or read from a file using a '_file' variant of the field.
+//
+// The name is the name of the inline field, used in diagnostics. File
+// contents are trimmed of surrounding whitespace. If neither is set, an empty
+// string is returned. Diagnostics never include the secret value.
+func ResolveSecret(name string, inline *string, file *string) (string, hcl.Diagnostics) {
+	if inline != nil && file != nil {
+		return "", hcl.Diagnostics{
+			&hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Conflicting '%s' and '%s_file' fields", name, name),
+				Detail:   fmt.Sprintf("Only one of '%s' and '%s_file' may be set", name, name),
+			},
+		}
+	}
+
+	if file != nil {
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return "", hcl.Diagnostics{
+				&hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  fmt.Sprintf("Could not read '%s_file'", name),
+					Detail:   err.Error(),
+				},
+			}
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if inline != nil {
+		return *inline, nil
+	}
+
+	return "", nil
+}
+
+// ResolvePath resolves a path from configuration relative to the directory of
+// the file that defines the given block. Absolute paths are returned as is.
+func ResolvePath(hclBlock hcl.Body, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	filename := hclBlock.MissingItemRange().Filename
+	return filepath.Join(filepath.Dir(filename), path)
+}
@@ -1,19 +1,23 @@
 // Implements the 'virtualbox' target type, which uses the VirtualBox CLI to
-// start/stop existing virtual machines.
+// start/stop existing virtual machines, or linked clones of a base machine.
 package virtualbox
 
 import (
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 
 	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
 )
 
 func init() {
@@ -23,33 +27,245 @@ func init() {
 type Factory struct{}
 
 type Provider struct {
+	Target    string
 	Name      string
 	Addr      string
+	CheckAddr string
 	CheckPort uint16
+	Check     *providers.ConnectivityCheck
 	StartMode string
 	StopMode  string
+	// Shared means connections share a machine. Only clones can be unshared.
+	Shared    bool
 	Linger    time.Duration
+	MinUptime time.Duration
+	// AdoptRunning means machines that were already running are stopped like
+	// machines we started ourselves. Otherwise, they are left running.
+	AdoptRunning bool
+	// AddrMode is 'static' to use Addr, or 'guestproperty' to read the address
+	// reported by Guest Additions for network adapter GuestNic.
+	AddrMode       string
+	GuestNic       int
+	GuestIpTimeout time.Duration
+	// Clone is set to create a linked clone for every machine, instead of
+	// starting the Name machine.
+	Clone *clone
+	// RestoreSnapshot is restored before starting the Name machine, so it
+	// starts from a clean state every time.
+	RestoreSnapshot string
+	// VBoxManage is the path to the VBoxManage binary, and CommandTimeout the
+	// time after which a VBoxManage command is killed.
+	VBoxManage     string
+	CommandTimeout time.Duration
+	// Remote is set to run VBoxManage on another host over SSH.
+	Remote *remote
+}
+
+type clone struct {
+	Base       string
+	Snapshot   string
+	NamePrefix string
+}
+
+type state struct {
+	// name is the name of the virtual machine, which is either Name or the
+	// name of the linked clone.
+	name string
+	// addr is the address of the machine, either Addr or the address reported
+	// by Guest Additions.
+	addr string
+}
+
+type hclClone struct {
+	Base       string `hcl:"base,attr"`
+	Snapshot   string `hcl:"snapshot,attr"`
+	NamePrefix string `hcl:"name_prefix,optional"`
 }
 
 type hclTarget struct {
-	Name      string `hcl:"name,attr"`
-	Addr      string `hcl:"addr,attr"`
-	CheckPort uint16 `hcl:"check_port,optional"`
-	StartMode string `hcl:"start_mode,optional"`
-	StopMode  string `hcl:"stop_mode,optional"`
-	Linger    string `hcl:"linger,optional"`
+	Name                string    `hcl:"name,optional"`
+	Clone               *hclClone `hcl:"clone,block"`
+	Addr                string    `hcl:"addr,optional"`
+	AddrMode            string    `hcl:"addr_mode,optional"`
+	GuestNic            int       `hcl:"guest_nic,optional"`
+	GuestIpTimeout      string    `hcl:"guest_ip_timeout,optional"`
+	CheckAddr           string    `hcl:"check_addr,optional"`
+	CheckPort           uint16    `hcl:"check_port,optional"`
+	CheckType           string    `hcl:"check_type,optional"`
+	CheckServerName     string    `hcl:"check_servername,optional"`
+	CheckInsecure       bool      `hcl:"check_insecure,optional"`
+	CheckCommand        string    `hcl:"check_command,optional"`
+	CheckCommandTimeout string    `hcl:"check_command_timeout,optional"`
+	StartMode           string    `hcl:"start_mode,optional"`
+	StopMode            string    `hcl:"stop_mode,optional"`
+	Shared              *bool     `hcl:"shared,optional"`
+	RestoreSnapshot     string    `hcl:"restore_snapshot,optional"`
+	Linger              string    `hcl:"linger,optional"`
+	MinUptime           string    `hcl:"min_uptime,optional"`
+	AdoptRunning        bool      `hcl:"adopt_running,optional"`
+	VBoxManagePath      string    `hcl:"vboxmanage_path,optional"`
+	CommandTimeout      string    `hcl:"command_timeout,optional"`
+	SSHHost             string    `hcl:"ssh_host,optional"`
+	SSHKeyFile          string    `hcl:"ssh_key_file,optional"`
+	SSHKnownHosts       string    `hcl:"ssh_known_hosts,optional"`
 }
 
-func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers.Provider, error) {
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
 	parsed := &hclTarget{}
-	diags := gohcl.DecodeBody(hclBlock, nil, parsed)
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
 	if diags.HasErrors() {
 		return nil, diags
 	}
 
 	prov := &Provider{
-		Name: parsed.Name,
-		Addr: parsed.Addr,
+		Target:          target,
+		Name:            parsed.Name,
+		Addr:            parsed.Addr,
+		CheckAddr:       parsed.CheckAddr,
+		AdoptRunning:    parsed.AdoptRunning,
+		RestoreSnapshot: parsed.RestoreSnapshot,
+		GuestNic:        parsed.GuestNic,
+		GuestIpTimeout:  5 * time.Minute,
+		VBoxManage:      parsed.VBoxManagePath,
+		CommandTimeout:  2 * time.Minute,
+	}
+
+	if parsed.SSHHost != "" {
+		knownHosts := parsed.SSHKnownHosts
+		if knownHosts == "" {
+			home, _ := os.UserHomeDir()
+			knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		if parsed.SSHKeyFile == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'ssh_key_file' field",
+				Detail:   "The 'ssh_key_file' field is required with 'ssh_host'",
+			})
+		} else if remote, err := newRemote(parsed.SSHHost, parsed.SSHKeyFile, knownHosts); err == nil {
+			prov.Remote = remote
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid SSH configuration",
+				Detail:   fmt.Sprintf("Could not configure remote execution on '%s': %s", parsed.SSHHost, err.Error()),
+			})
+		}
+	}
+
+	if prov.VBoxManage == "" && parsed.SSHHost != "" {
+		// Rely on PATH of the remote host.
+		prov.VBoxManage = "VBoxManage"
+	} else if prov.VBoxManage == "" {
+		prov.VBoxManage = findVBoxManage()
+		if prov.VBoxManage == "" {
+			// Depends on the environment, so only warn, and try PATH at runtime.
+			prov.VBoxManage = "VBoxManage"
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "VBoxManage not found",
+				Detail:   "Could not find VBoxManage in PATH or the default install location. Set 'vboxmanage_path' if it is installed elsewhere.",
+			})
+		}
+	}
+
+	if parsed.CommandTimeout != "" {
+		commandTimeout, err := time.ParseDuration(parsed.CommandTimeout)
+		if err == nil && commandTimeout > 0 {
+			prov.CommandTimeout = commandTimeout
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'command_timeout' field",
+				Detail:   fmt.Sprintf("The 'command_timeout' value '%s' is not a valid positive duration", parsed.CommandTimeout),
+			})
+		}
+	}
+
+	switch parsed.AddrMode {
+	case "static", "":
+		prov.AddrMode = "static"
+		if parsed.Addr == "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Missing 'addr' field",
+				Detail:   "The 'addr' field is required with addr_mode 'static'",
+			})
+		}
+	case "guestproperty":
+		prov.AddrMode = parsed.AddrMode
+		if parsed.Addr != "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'addr' and 'addr_mode' fields",
+				Detail:   "The 'addr' field cannot be used with addr_mode 'guestproperty'",
+			})
+		}
+	default:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid addr_mode",
+			Detail:   fmt.Sprintf("Value '%s' is invalid for addr_mode. Must be one of: static, guestproperty", parsed.AddrMode),
+		})
+	}
+
+	switch {
+	case parsed.Name != "" && parsed.Clone != nil:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'name' and 'clone' fields",
+			Detail:   "Only one of 'name' and 'clone' may be set",
+		})
+	case parsed.Name == "" && parsed.Clone == nil:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'name' field",
+			Detail:   "One of 'name' and 'clone' must be set for 'virtualbox' targets",
+		})
+	case parsed.Clone != nil:
+		prov.Clone = &clone{
+			Base:       parsed.Clone.Base,
+			Snapshot:   parsed.Clone.Snapshot,
+			NamePrefix: parsed.Clone.NamePrefix,
+		}
+		if prov.Clone.NamePrefix == "" {
+			prov.Clone.NamePrefix = prov.Clone.Base + "-lazyssh"
+		}
+		if parsed.AdoptRunning {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagWarning,
+				Summary:  "Field 'adopt_running' was ignored",
+				Detail:   "The 'adopt_running' field has no effect with 'clone', because clones are always started by LazySSH",
+			})
+		}
+		if parsed.RestoreSnapshot != "" {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Conflicting 'restore_snapshot' and 'clone' fields",
+				Detail:   "The 'restore_snapshot' field cannot be used with 'clone'. Clones always start from the 'snapshot' set in the 'clone' block",
+			})
+		}
+	}
+
+	if parsed.GuestNic < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'guest_nic' field",
+			Detail:   fmt.Sprintf("The 'guest_nic' value must not be negative, but got %d", parsed.GuestNic),
+		})
+	}
+
+	if parsed.GuestIpTimeout != "" {
+		guestIpTimeout, err := time.ParseDuration(parsed.GuestIpTimeout)
+		if err == nil && guestIpTimeout > 0 {
+			prov.GuestIpTimeout = guestIpTimeout
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'guest_ip_timeout' field",
+				Detail:   fmt.Sprintf("The 'guest_ip_timeout' value '%s' is not a valid positive duration", parsed.GuestIpTimeout),
+			})
+		}
 	}
 
 	if parsed.CheckPort == 0 {
@@ -58,6 +274,11 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		prov.CheckPort = parsed.CheckPort
 	}
 
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
 	switch parsed.StartMode {
 	case "gui", "headless", "separate":
 		prov.StartMode = parsed.StartMode
@@ -84,98 +305,369 @@ func (factory *Factory) NewProvider(target string, hclBlock hcl.Body) (providers
 		})
 	}
 
-	linger, err := time.ParseDuration(parsed.Linger)
-	if err == nil {
-		prov.Linger = linger
+	// A single virtual machine is always shared. Clones are per connection,
+	// unless shared is set.
+	if parsed.Shared == nil {
+		prov.Shared = prov.Clone == nil
 	} else {
+		prov.Shared = *parsed.Shared
+		if !prov.Shared && parsed.Clone == nil {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid value for 'shared' field",
+				Detail:   "The 'shared = false' setting requires 'clone', because a single virtual machine cannot be started for every connection",
+			})
+		}
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
 		diags = append(diags, &hcl.Diagnostic{
-			Severity: hcl.DiagError,
-			Summary:  "Invalid duration for 'linger' field",
-			Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration: %s", parsed.Linger, err.Error()),
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   "The 'linger' field has no effect for 'virtualbox' targets with 'shared = false'",
 		})
 	}
 
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
 	return prov, diags
 }
 
 func (prov *Provider) IsShared() bool {
-	// Shared, because we launch existing virtual machines by name.
-	return true
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	var started bool
+	var err error
+	if prov.Clone == nil {
+		mach.State = &state{name: prov.Name}
+		started, err = prov.start(mach)
+	} else {
+		started, err = true, prov.startClone(mach)
+	}
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("%s\n", err.Error())
+		return &providers.StartError{Err: err}
+	}
+	state := mach.State.(*state)
+	mach.SetInstanceID(state.name)
+	if prov.Clone != nil {
+		mach.SetInfo("base", prov.Clone.Base)
+	}
+
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		span = tracing.NewSpan(mach.Span, "connectivity_test")
+		err = prov.connectivityTest(mach)
+		span.SetError(err)
+		span.End()
+	}
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	if started || prov.AdoptRunning {
+		prov.stop(mach)
+	} else {
+		log.Printf("Leaving VirtualBox machine '%s' running, because it was not started by LazySSH\n", state.name)
+	}
+	return err
+}
+
+// RecoverMachine adopts the virtual machine if it was left running by a
+// previous process. Linked clones are deleted instead, and created afresh
+// when needed.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	if prov.Clone != nil {
+		mach.State = &state{name: id}
+		mach.SetInstanceID(id)
+		log.Printf("Deleting orphaned VirtualBox clone '%s'\n", id)
+		prov.stop(mach)
+		return nil
+	}
+
+	mach.State = &state{name: prov.Name}
+	current, err := prov.vmState(prov.Name)
+	if err != nil {
+		return err
+	}
+	if current != "running" {
+		return nil
+	}
+
+	mach.SetInstanceID(prov.Name)
+	log.Printf("Adopted VirtualBox machine '%s'\n", prov.Name)
+	err = prov.resolveAddr(mach)
+	if err == nil {
+		err = prov.connectivityTest(mach)
+	}
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// transitionalStates are VirtualBox machine states that settle by
+// themselves, and are waited on before starting the machine.
+var transitionalStates = map[string]bool{
+	"starting":           true,
+	"stopping":           true,
+	"saving":             true,
+	"restoring":          true,
+	"settingup":          true,
+	"snapshotting":       true,
+	"livesnapshotting":   true,
+	"onlinesnapshotting": true,
+	"restoringsnapshot":  true,
+	"deletingsnapshot":   true,
 }
 
-func (prov *Provider) RunMachine(mach *providers.Machine) {
-	if prov.start() {
-		if prov.connectivityTest() {
-			prov.msgLoop(mach)
+// Start the machine, unless it is already running. Returns whether the
+// machine was started by us.
+func (prov *Provider) start(mach *providers.Machine) (bool, error) {
+	name := mach.State.(*state).name
+
+	// Wait for transitional states every 3 seconds for 2 minutes.
+	current, err := prov.vmState(name)
+	for i := 0; i < 40 && err == nil && transitionalStates[current]; i++ {
+		time.Sleep(3 * time.Second)
+		current, err = prov.vmState(name)
+	}
+	switch {
+	case err != nil:
+		return false, err
+	case current == "running" && prov.RestoreSnapshot != "":
+		log.Printf("VirtualBox machine '%s' is already running, not restoring snapshot '%s', because a running machine cannot be restored\n", name, prov.RestoreSnapshot)
+		return false, nil
+	case current == "running":
+		log.Printf("VirtualBox machine '%s' is already running\n", name)
+		return false, nil
+	case transitionalStates[current]:
+		return false, fmt.Errorf("VirtualBox machine '%s' is stuck in state '%s'", name, current)
+	}
+
+	if prov.RestoreSnapshot != "" {
+		if err := prov.vboxmanageLogged("snapshot", name, "restore", prov.RestoreSnapshot); err != nil {
+			return false, fmt.Errorf("VirtualBox machine '%s' snapshot '%s' could not be restored: %w", name, prov.RestoreSnapshot, err)
 		}
-		prov.stop()
+		log.Printf("Restored VirtualBox machine '%s' to snapshot '%s'\n", name, prov.RestoreSnapshot)
+	}
+
+	if err := prov.startVm(name); err != nil {
+		return false, err
 	}
+	return true, nil
 }
 
-func (prov *Provider) start() bool {
-	// TODO: What to do when the machine is already running?
-	cmd := exec.Command("VBoxManage", "startvm", prov.Name, fmt.Sprintf("--type=%s", prov.StartMode))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Printf("VirtualBox machine '%s' failed to start: %s\n", prov.Name, err.Error())
-		return false
+// Create a linked clone of the base machine, and start it. The clone is
+// deleted again if anything fails.
+func (prov *Provider) startClone(mach *providers.Machine) error {
+	name := fmt.Sprintf("%s-%s", prov.Clone.NamePrefix, randomString(5))
+	err := prov.vboxmanageLogged("clonevm", prov.Clone.Base,
+		"--snapshot", prov.Clone.Snapshot, "--options", "link", "--name", name, "--register")
+	if err == nil {
+		log.Printf("Created VirtualBox clone '%s' of '%s'\n", name, prov.Clone.Base)
+		err = prov.startVm(name)
+	} else {
+		err = fmt.Errorf("VirtualBox clone '%s' of '%s' could not be created: %w", name, prov.Clone.Base, err)
+	}
+	if err != nil {
+		// Clean up a partially created clone. This fails harmlessly if the clone
+		// was never registered.
+		if delErr := prov.deleteVm(name); delErr != nil {
+			log.Printf("Could not clean up VirtualBox clone '%s': %s\n", name, delErr.Error())
+		}
+		return err
 	}
-	log.Printf("Started VirtualBox machine '%s'\n", prov.Name)
-	return true
+
+	mach.State = &state{name: name}
+	return nil
 }
 
-func (prov *Provider) stop() {
-	cmd := exec.Command("VBoxManage", "controlvm", prov.Name, prov.StopMode)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		log.Printf("VirtualBox machine '%s' failed to stop: %s\n", prov.Name, err.Error())
+// Start a virtual machine by name.
+func (prov *Provider) startVm(name string) error {
+	if err := prov.vboxmanageLogged("startvm", name, fmt.Sprintf("--type=%s", prov.StartMode)); err != nil {
+		return fmt.Errorf("VirtualBox machine '%s' failed to start: %w", name, err)
+	}
+	log.Printf("Started VirtualBox machine '%s'\n", name)
+	return nil
+}
+
+// Unregister a virtual machine, and delete its files.
+func (prov *Provider) deleteVm(name string) error {
+	return prov.vboxmanageLogged("unregistervm", name, "--delete")
+}
+
+// Query the machine state, like 'running' or 'poweroff'.
+func (prov *Provider) vmState(name string) (string, error) {
+	out, err := prov.vboxmanage("showvminfo", name, "--machinereadable")
+	if err != nil {
+		return "", fmt.Errorf("could not check VirtualBox machine '%s' state: %w", name, err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "VMState=") {
+			return strings.Trim(strings.TrimSpace(line[len("VMState="):]), "\""), nil
+		}
+	}
+	return "", fmt.Errorf("could not check VirtualBox machine '%s' state: VMState missing from output", name)
+}
+
+// Stop the machine. Linked clones are powered off and deleted.
+func (prov *Provider) stop(mach *providers.Machine) {
+	name := mach.State.(*state).name
+	if prov.Clone == nil {
+		if err := prov.vboxmanageLogged("controlvm", name, prov.StopMode); err != nil {
+			log.Printf("VirtualBox machine '%s' failed to stop: %s\n", name, err.Error())
+			mach.ReportStopError(fmt.Errorf("VirtualBox machine '%s' failed to stop: %w", name, err))
+			return
+		}
+		log.Printf("Stopped VirtualBox machine '%s'\n", name)
+		return
+	}
+
+	// The clone may already be powered off, so ignore errors, and only check
+	// that deleting it succeeds. The machine lock is released shortly after
+	// power off, so retry deleting a few times.
+	prov.vboxmanageLogged("controlvm", name, "poweroff")
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = prov.deleteVm(name); err == nil {
+			log.Printf("Deleted VirtualBox clone '%s'\n", name)
+			return
+		}
+		time.Sleep(2 * time.Second)
+	}
+	log.Printf("VirtualBox clone '%s' could not be deleted: %s\n", name, err.Error())
+	mach.ReportStopError(fmt.Errorf("VirtualBox clone '%s' could not be deleted: %w", name, err))
+}
+
+// Set the machine address in state, by polling Guest Additions every 3
+// seconds with addr_mode 'guestproperty'.
+func (prov *Provider) resolveAddr(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	if prov.AddrMode == "static" {
+		state.addr = prov.Addr
+		return nil
+	}
+
+	property := fmt.Sprintf("/VirtualBox/GuestInfo/Net/%d/V4/IP", prov.GuestNic)
+	deadline := time.Now().Add(prov.GuestIpTimeout)
+	for {
+		out, err := prov.vboxmanage("guestproperty", "get", state.name, property)
+		if err != nil {
+			return fmt.Errorf("could not read VirtualBox machine '%s' guest property: %w", state.name, err)
+		}
+		// Output is either 'Value: <ip>' or 'No value set!'
+		if value := strings.TrimSpace(out); strings.HasPrefix(value, "Value: ") {
+			addr := strings.TrimPrefix(value, "Value: ")
+			log.Printf("VirtualBox machine '%s' has address %s\n", state.name, addr)
+			state.addr = addr
+			mach.SetInfo("addr", addr)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Guest Additions not reporting an IP for VirtualBox machine '%s' network adapter %d after %s", state.name, prov.GuestNic, prov.GuestIpTimeout)
+		}
+		time.Sleep(3 * time.Second)
 	}
-	log.Printf("Stopped VirtualBox machine '%s'\n", prov.Name)
 }
 
 // Check port every 3 seconds for 2 minutes.
-func (prov *Provider) connectivityTest() bool {
-	checkAddr := fmt.Sprintf("%s:%d", prov.Addr, prov.CheckPort)
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := prov.CheckAddr
+	if checkHost == "" {
+		checkHost = state.addr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
 	checkTimeout := 3 * time.Second
 	var err error
-	var conn net.Conn
 	for i := 0; i < 40; i++ {
 		checkStart := time.Now()
-		conn, err = net.DialTimeout("tcp", checkAddr, checkTimeout)
+		err = prov.Check.Dial(checkAddr, checkTimeout)
 		if err == nil {
-			conn.Close()
-			log.Printf("Connectivity test succeeded for VirtualBox machine '%s'\n", prov.Name)
-			return true
+			log.Printf("Connectivity test succeeded for VirtualBox machine '%s'\n", state.name)
+			return nil
 		}
 		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
 	}
-	log.Printf("VirtualBox machine '%s' connectivity test failed: %s\n", prov.Name, err.Error())
-	return false
+	return fmt.Errorf("VirtualBox machine '%s' connectivity test failed: %w", state.name, err)
 }
 
-func (prov *Provider) msgLoop(mach *providers.Machine) {
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
 	// TODO: Monitor machine status
-	active := <-mach.ModActive
-	for active > 0 {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
 		for active > 0 {
 			select {
 			case mod := <-mach.ModActive:
 				active += mod
 			case msg := <-mach.Translate:
-				msg.Reply <- fmt.Sprintf("%s:%d", prov.Addr, msg.Port)
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
 			case <-mach.Stop:
 				return
 			}
 		}
 
-		// Linger
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
 		select {
 		case mod := <-mach.ModActive:
 			active += mod
-		case <-time.After(time.Duration(prov.Linger) * time.Second):
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
 			return
 		}
 	}
 }
+
+// Generate a random string of lowercase letters and digits, used to make
+// clone names unique.
+func randomString(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
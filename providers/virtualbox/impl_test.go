@@ -0,0 +1,97 @@
+package virtualbox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/stephank/lazyssh/providers"
+)
+
+// parseTarget creates a Provider from the body of a target block. The
+// Provider is nil if there are errors.
+func parseTarget(t *testing.T, body string) (*Provider, hcl.Diagnostics) {
+	t.Helper()
+	file, diags := hclparse.NewParser().ParseHCL([]byte(body), "test.hcl")
+	if diags.HasErrors() {
+		t.Fatalf("could not parse config: %s", diags.Error())
+	}
+	prov, err := (&Factory{}).NewProvider("test", file.Body, &providers.ConfigContext{CheckOnly: true})
+	diags, _ = err.(hcl.Diagnostics)
+	if prov == nil {
+		return nil, diags
+	}
+	return prov.(*Provider), diags
+}
+
+func TestLinger(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		body    string
+		linger  time.Duration
+		err     bool
+		warning bool
+	}{
+		{
+			name: "empty",
+			body: `name = "vm"`,
+		},
+		{
+			name:   "valid",
+			body:   `name = "vm"` + "\n" + `linger = "10m"`,
+			linger: 10 * time.Minute,
+		},
+		{
+			name:   "zero",
+			body:   `name = "vm"` + "\n" + `linger = "0s"`,
+			linger: 0,
+		},
+		{
+			name: "invalid",
+			body: `name = "vm"` + "\n" + `linger = "ten minutes"`,
+			err:  true,
+		},
+		{
+			name: "unitless",
+			body: `name = "vm"` + "\n" + `linger = "600"`,
+			err:  true,
+		},
+		{
+			name: "negative",
+			body: `name = "vm"` + "\n" + `linger = "-5s"`,
+			err:  true,
+		},
+		{
+			name: "unshared clone",
+			body: `
+clone {
+  base = "base"
+  snapshot = "clean"
+}
+shared = false
+linger = "10m"
+`,
+			warning: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, diags := parseTarget(t, tc.body+"\naddr = \"10.0.0.2\"\nvboxmanage_path = \"/bin/false\"\n")
+			if tc.err {
+				if !diags.HasErrors() {
+					t.Fatalf("expected an error, got linger %s", prov.Linger)
+				}
+				return
+			}
+			if diags.HasErrors() {
+				t.Fatalf("unexpected error: %s", diags.Error())
+			}
+			if prov.Linger != tc.linger {
+				t.Fatalf("expected linger %s, got %s", tc.linger, prov.Linger)
+			}
+			if hasWarning := len(diags) != 0; hasWarning != tc.warning {
+				t.Fatalf("expected warning %t, got diagnostics: %v", tc.warning, diags)
+			}
+		})
+	}
+}
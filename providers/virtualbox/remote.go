@@ -0,0 +1,129 @@
+package virtualbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// remote runs commands on another host over SSH. The SSH connection is
+// opened on first use, and reopened if it breaks.
+type remote struct {
+	addr   string
+	config *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// Create a remote from the 'ssh_host' value, in the format user@host:port,
+// where the port is optional. The host key is verified using the known hosts
+// file.
+func newRemote(host string, keyFile string, knownHostsFile string) (*remote, error) {
+	idx := strings.LastIndexByte(host, '@')
+	if idx < 1 {
+		return nil, fmt.Errorf("the 'ssh_host' value '%s' must be in the format user@host", host)
+	}
+	user := host[:idx]
+	addr := host[idx+1:]
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+
+	keyPem, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read 'ssh_key_file': %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse 'ssh_key_file': %w", err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known hosts file: %w", err)
+	}
+
+	return &remote{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         30 * time.Second,
+		},
+	}, nil
+}
+
+// Open a session, connecting first if necessary. A broken connection is
+// reopened once.
+func (r *remote) newSession() (*ssh.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if r.client == nil {
+			client, err := ssh.Dial("tcp", r.addr, r.config)
+			if err != nil {
+				return nil, fmt.Errorf("could not connect to '%s': %w", r.addr, err)
+			}
+			r.client = client
+		}
+		session, err := r.client.NewSession()
+		if err == nil {
+			return session, nil
+		}
+		r.client.Close()
+		r.client = nil
+		if attempt > 0 {
+			return nil, fmt.Errorf("could not open session on '%s': %w", r.addr, err)
+		}
+	}
+}
+
+// Run a command on the remote host, and wait for it to finish. The session is
+// closed early if the context ends, which makes the remote sshd terminate the
+// command.
+func (r *remote) run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) error {
+	session, err := r.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	if err := session.Start(strings.Join(quoted, " ")); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		// Wait for output copying to stop before returning.
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Quote an argument for a POSIX shell.
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
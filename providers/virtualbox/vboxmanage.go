@@ -0,0 +1,97 @@
+package virtualbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Find VBoxManage in PATH, or in the default install location for the OS.
+// Returns an empty string if not found.
+func findVBoxManage() string {
+	if path, err := exec.LookPath("VBoxManage"); err == nil {
+		return path
+	}
+
+	var candidates []string
+	switch runtime.GOOS {
+	case "windows":
+		// Set by the VirtualBox installer.
+		for _, env := range []string{"VBOX_MSI_INSTALL_PATH", "VBOX_INSTALL_PATH"} {
+			if dir := os.Getenv(env); dir != "" {
+				candidates = append(candidates, filepath.Join(dir, "VBoxManage.exe"))
+			}
+		}
+		candidates = append(candidates, `C:\Program Files\Oracle\VirtualBox\VBoxManage.exe`)
+	case "darwin":
+		candidates = []string{
+			"/Applications/VirtualBox.app/Contents/MacOS/VBoxManage",
+			"/usr/local/bin/VBoxManage",
+		}
+	default:
+		candidates = []string{
+			"/usr/bin/VBoxManage",
+			"/usr/local/bin/VBoxManage",
+		}
+	}
+	for _, path := range candidates {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// Run VBoxManage with a timeout, and return its stdout. Anything written to
+// stderr is logged, and included in the error if the command fails. With
+// Remote, the command runs on the remote host.
+func (prov *Provider) vboxmanage(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.CommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	var err error
+	if prov.Remote != nil {
+		err = prov.Remote.run(ctx, append([]string{prov.VBoxManage}, args...), &stdout, &stderr)
+	} else {
+		cmd := exec.CommandContext(ctx, prov.VBoxManage, args...)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+	}
+	prov.logOutput(stderr.String())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("VBoxManage %s timed out after %s", args[0], prov.CommandTimeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("VBoxManage %s failed: %w: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("VBoxManage %s failed: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// Like vboxmanage, but also log stdout. Used for commands that only report
+// progress on stdout.
+func (prov *Provider) vboxmanageLogged(args ...string) error {
+	out, err := prov.vboxmanage(args...)
+	prov.logOutput(out)
+	return err
+}
+
+// Log VBoxManage output line by line, prefixed with the target name.
+func (prov *Provider) logOutput(out string) {
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			log.Printf("%s: VBoxManage: %s\n", prov.Target, line)
+		}
+	}
+}
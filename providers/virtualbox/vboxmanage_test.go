@@ -0,0 +1,174 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package virtualbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stephank/lazyssh/providers"
+)
+
+// fakeVBoxManage creates a Provider that runs a shell script in place of
+// VBoxManage. Every invocation appends its arguments to a log file, which is
+// returned by the calls function.
+func fakeVBoxManage(t *testing.T, script string) (prov *Provider, calls func() []string) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "lazyssh-vboxmanage-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "VBoxManage")
+	callsFile := filepath.Join(dir, "calls")
+	script = "#!/bin/sh\necho \"$*\" >> '" + callsFile + "'\n" + script
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("could not write script: %s", err)
+	}
+
+	prov = &Provider{
+		Target:         "test",
+		Name:           "vm",
+		StartMode:      "headless",
+		StopMode:       "acpipowerbutton",
+		VBoxManage:     path,
+		CommandTimeout: 5 * time.Second,
+	}
+	calls = func() []string {
+		data, _ := ioutil.ReadFile(callsFile)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	return prov, calls
+}
+
+func TestVBoxManageOutput(t *testing.T) {
+	prov, calls := fakeVBoxManage(t, `
+echo "VMState=\"poweroff\""
+echo "progress on stderr" >&2
+`)
+	out, err := prov.vboxmanage("showvminfo", "vm", "--machinereadable")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out != "VMState=\"poweroff\"\n" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if c := calls(); len(c) != 1 || c[0] != "showvminfo vm --machinereadable" {
+		t.Fatalf("unexpected calls: %q", c)
+	}
+}
+
+func TestVBoxManageFailure(t *testing.T) {
+	prov, _ := fakeVBoxManage(t, `
+echo "VBoxManage: error: Could not find a registered machine named 'vm'" >&2
+exit 1
+`)
+	_, err := prov.vboxmanage("showvminfo", "vm", "--machinereadable")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	expected := "VBoxManage showvminfo failed: exit status 1: VBoxManage: error: Could not find a registered machine named 'vm'"
+	if err.Error() != expected {
+		t.Fatalf("expected error '%s', got: %s", expected, err)
+	}
+}
+
+func TestVBoxManageFailureWithoutStderr(t *testing.T) {
+	prov, _ := fakeVBoxManage(t, "exit 2\n")
+	_, err := prov.vboxmanage("startvm", "vm")
+	if err == nil || err.Error() != "VBoxManage startvm failed: exit status 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestVBoxManageTimeout(t *testing.T) {
+	// Exec, so the kill on timeout reaches sleep, and doesn't leave it holding
+	// the output pipes open.
+	prov, _ := fakeVBoxManage(t, "exec sleep 30\n")
+	prov.CommandTimeout = 100 * time.Millisecond
+
+	begin := time.Now()
+	_, err := prov.vboxmanage("startvm", "vm")
+	if err == nil || err.Error() != "VBoxManage startvm timed out after 100ms" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("command was not killed, took %s", elapsed)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	prov, calls := fakeVBoxManage(t, `
+case "$1" in
+  showvminfo) echo 'VMState="poweroff"' ;;
+  startvm) echo "VBoxManage: error: The virtual machine 'vm' has terminated unexpectedly" >&2; exit 1 ;;
+esac
+`)
+	mach := &providers.Machine{State: &state{name: "vm"}}
+	started, err := prov.start(mach)
+	if started {
+		t.Fatalf("expected machine not to be started")
+	}
+	expected := "VirtualBox machine 'vm' failed to start: VBoxManage startvm failed: exit status 1: VBoxManage: error: The virtual machine 'vm' has terminated unexpectedly"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error '%s', got: %v", expected, err)
+	}
+	if c := calls(); strings.Join(c, "|") != "showvminfo vm --machinereadable|startvm vm --type=headless" {
+		t.Fatalf("unexpected calls: %q", c)
+	}
+}
+
+func TestStartStateTimeout(t *testing.T) {
+	prov, _ := fakeVBoxManage(t, "exec sleep 30\n")
+	prov.CommandTimeout = 100 * time.Millisecond
+
+	mach := &providers.Machine{State: &state{name: "vm"}}
+	_, err := prov.start(mach)
+	expected := "could not check VirtualBox machine 'vm' state: VBoxManage showvminfo timed out after 100ms"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error '%s', got: %v", expected, err)
+	}
+}
+
+func TestStartAlreadyRunning(t *testing.T) {
+	prov, calls := fakeVBoxManage(t, `echo 'VMState="running"'`+"\n")
+	mach := &providers.Machine{State: &state{name: "vm"}}
+	started, err := prov.start(mach)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if started {
+		t.Fatalf("expected running machine not to be reported as started")
+	}
+	if c := calls(); len(c) != 1 {
+		t.Fatalf("expected only a state check, got: %q", c)
+	}
+}
+
+func TestCloneFailureCleansUp(t *testing.T) {
+	prov, calls := fakeVBoxManage(t, `
+case "$1" in
+  clonevm) echo "VBoxManage: error: Could not find a snapshot named 'clean'" >&2; exit 1 ;;
+esac
+`)
+	prov.Clone = &clone{Base: "base", Snapshot: "clean", NamePrefix: "lazyssh"}
+
+	mach := &providers.Machine{}
+	err := prov.startClone(mach)
+	if err == nil || !strings.Contains(err.Error(), "could not be created: VBoxManage clonevm failed: exit status 1") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := calls()
+	if len(c) != 2 || !strings.HasPrefix(c[0], "clonevm base --snapshot clean") || !strings.HasPrefix(c[1], "unregistervm lazyssh-") {
+		t.Fatalf("expected clone followed by cleanup, got: %q", c)
+	}
+	if mach.State != nil {
+		t.Fatalf("expected no state for a failed clone")
+	}
+}
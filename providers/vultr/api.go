@@ -0,0 +1,53 @@
+package vultr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/vultr/govultr/v3"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+// client wraps the govultr client with the helpers the provider needs on top.
+type client struct {
+	*govultr.Client
+}
+
+// Create a client for an API key. The client retries rate limited and failed
+// requests a few times by itself.
+func newClient(apiKey string) *client {
+	httpClient := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: apiKey}))
+	return &client{govultr.NewClient(httpClient)}
+}
+
+// List instances with a tag. Only the first page of 500 instances is fetched,
+// which is plenty for the instances of a target.
+func (c *client) listInstances(ctx context.Context, tag string) ([]govultr.Instance, error) {
+	instances, _, _, err := c.Instance.List(ctx, &govultr.ListOptions{Tag: tag, PerPage: 500})
+	return instances, err
+}
+
+// apiError extracts the HTTP status code and message from an error response.
+// The client returns the JSON response body as the error, which holds both.
+// Requests that are still rate limited or failing after the retries of the
+// client result in a different error, which is not an API error.
+func apiError(err error) (status int, message string, ok bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		var body struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}
+		if json.Unmarshal([]byte(err.Error()), &body) == nil && body.Status != 0 {
+			return body.Status, body.Error, true
+		}
+	}
+	return 0, "", false
+}
+
+// isNotFound checks whether an error indicates a resource does not exist.
+func isNotFound(err error) bool {
+	status, _, ok := apiError(err)
+	return ok && status == http.StatusNotFound
+}
@@ -0,0 +1,661 @@
+// Implements the 'vultr' target type, which uses the Vultr API to create and
+// delete instances.
+package vultr
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/vultr/govultr/v3"
+	"golang.org/x/net/context"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/tracing"
+)
+
+func init() {
+	providers.Register("vultr", &Factory{})
+}
+
+type Factory struct{}
+
+type Provider struct {
+	Target string
+	// Instance is the template for new instances. The label and hostname are
+	// set per machine.
+	Instance       *govultr.InstanceCreateReq
+	LabelPrefix    string
+	UsePrivateIp   bool
+	CheckAddr      *string
+	CheckPort      uint16
+	Check          *providers.ConnectivityCheck
+	StartRetries   int
+	Shared         bool
+	Linger         time.Duration
+	MinUptime      time.Duration
+	StartTimeout   time.Duration
+	RequestTimeout time.Duration
+	GcOnStart      bool
+	GcMinAge       time.Duration
+	Vultr          *client
+}
+
+type state struct {
+	id    string
+	label string
+	addr  string
+	// deadline is when the instance must be ready, according to
+	// 'start_timeout'.
+	deadline time.Time
+}
+
+type hclTarget struct {
+	ApiKey              *string  `hcl:"api_key,optional"`
+	ApiKeyFile          *string  `hcl:"api_key_file,optional"`
+	ApiKeyEnv           *string  `hcl:"api_key_env,optional"`
+	Region              string   `hcl:"region,attr"`
+	Plan                string   `hcl:"plan,attr"`
+	OsId                int      `hcl:"os_id,optional"`
+	SnapshotId          string   `hcl:"snapshot_id,optional"`
+	IsoId               string   `hcl:"iso_id,optional"`
+	SshKeyIds           []string `hcl:"ssh_key_ids,optional"`
+	UserData            *string  `hcl:"user_data,optional"`
+	Label               string   `hcl:"label,optional"`
+	Tags                []string `hcl:"tags,optional"`
+	EnableIpv6          bool     `hcl:"enable_ipv6,optional"`
+	VpcId               string   `hcl:"vpc_id,optional"`
+	UsePrivateIp        bool     `hcl:"use_private_ip,optional"`
+	CheckAddr           *string  `hcl:"check_addr,optional"`
+	CheckPort           uint16   `hcl:"check_port,optional"`
+	CheckType           string   `hcl:"check_type,optional"`
+	CheckServerName     string   `hcl:"check_servername,optional"`
+	CheckInsecure       bool     `hcl:"check_insecure,optional"`
+	CheckCommand        string   `hcl:"check_command,optional"`
+	CheckCommandTimeout string   `hcl:"check_command_timeout,optional"`
+	StartRetries        int      `hcl:"start_retries,optional"`
+	Shared              *bool    `hcl:"shared,optional"`
+	Linger              string   `hcl:"linger,optional"`
+	MinUptime           string   `hcl:"min_uptime,optional"`
+	StartTimeout        string   `hcl:"start_timeout,optional"`
+	RequestTimeout      string   `hcl:"request_timeout,optional"`
+	GcOnStart           bool     `hcl:"gc_on_start,optional"`
+	GcMinAge            string   `hcl:"gc_min_age,optional"`
+}
+
+// managedTag is added to every instance LazySSH creates, so orphaned
+// instances can be found.
+const managedTag = "ManagedBy=lazyssh"
+
+// targetTagPrefix is followed by the target address in a tag added to every
+// instance LazySSH creates, so instances can be matched to targets.
+const targetTagPrefix = "lazyssh-target:"
+
+var invalidHostnameChars = regexp.MustCompile(`[^a-z0-9-]`)
+
+var (
+	errNoAddress = errors.New("does not have an IP address to connect to")
+	errNoQuota   = errors.New("Vultr instance limit or capacity exceeded")
+)
+
+func (factory *Factory) NewProvider(target string, hclBlock hcl.Body, cfgCtx *providers.ConfigContext) (providers.Provider, error) {
+	parsed := &hclTarget{}
+	diags := gohcl.DecodeBody(hclBlock, cfgCtx.EvalContext, parsed)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	apiKey, apiKeyDiags := providers.ResolveSecret("api_key", parsed.ApiKey, parsed.ApiKeyFile)
+	diags = append(diags, apiKeyDiags...)
+	if (parsed.ApiKey != nil || parsed.ApiKeyFile != nil) && parsed.ApiKeyEnv != nil {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting 'api_key' and 'api_key_env' fields",
+			Detail:   "Only one of 'api_key', 'api_key_file' and 'api_key_env' may be set",
+		})
+	}
+	if parsed.ApiKey == nil && parsed.ApiKeyFile == nil {
+		// Fall back to the environment.
+		apiKeyEnv := "VULTR_API_KEY"
+		if parsed.ApiKeyEnv != nil {
+			apiKeyEnv = *parsed.ApiKeyEnv
+		}
+		apiKey = strings.TrimSpace(os.Getenv(apiKeyEnv))
+		if apiKey == "" {
+			// In check mode, the environment may lack credentials entirely.
+			severity := hcl.DiagError
+			if cfgCtx.CheckOnly {
+				severity = hcl.DiagWarning
+			}
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: severity,
+				Summary:  "Missing API key",
+				Detail:   fmt.Sprintf("Set one of 'api_key' or 'api_key_file', or set the '%s' environment variable for 'vultr' targets", apiKeyEnv),
+			})
+		}
+	} else if apiKey == "" && !apiKeyDiags.HasErrors() {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing API key",
+			Detail:   "The 'api_key' or 'api_key_file' value is empty",
+		})
+	}
+
+	inst := &govultr.InstanceCreateReq{
+		Region:     parsed.Region,
+		Plan:       parsed.Plan,
+		OsID:       parsed.OsId,
+		SnapshotID: parsed.SnapshotId,
+		ISOID:      parsed.IsoId,
+		SSHKeys:    parsed.SshKeyIds,
+		Tags:       []string{managedTag, targetTagPrefix + target},
+		EnableIPv6: govultr.BoolToBoolPtr(parsed.EnableIpv6),
+	}
+	prov := &Provider{
+		Vultr:          newClient(apiKey),
+		Target:         target,
+		Instance:       inst,
+		LabelPrefix:    parsed.Label,
+		UsePrivateIp:   parsed.UsePrivateIp,
+		CheckAddr:      parsed.CheckAddr,
+		StartRetries:   parsed.StartRetries,
+		StartTimeout:   10 * time.Minute,
+		RequestTimeout: 30 * time.Second,
+		GcOnStart:      parsed.GcOnStart,
+		GcMinAge:       time.Hour,
+	}
+	if prov.LabelPrefix == "" {
+		prov.LabelPrefix = target
+	}
+
+	if parsed.Region == "" || parsed.Plan == "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing required field",
+			Detail:   "The 'region' and 'plan' fields must not be empty",
+		})
+	}
+
+	sources := 0
+	for _, set := range []bool{parsed.OsId != 0, parsed.SnapshotId != "", parsed.IsoId != ""} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case sources == 0:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'os_id', 'snapshot_id' or 'iso_id' field",
+			Detail:   "One of 'os_id', 'snapshot_id' or 'iso_id' must be set for 'vultr' targets",
+		})
+	case sources > 1:
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Conflicting image fields",
+			Detail:   "Only one of 'os_id', 'snapshot_id' and 'iso_id' may be set",
+		})
+	}
+
+	if parsed.UserData != nil {
+		inst.UserData = base64.StdEncoding.EncodeToString([]byte(*parsed.UserData))
+	}
+
+	for _, tag := range parsed.Tags {
+		if tag != managedTag && !strings.HasPrefix(tag, targetTagPrefix) {
+			inst.Tags = append(inst.Tags, tag)
+		}
+	}
+
+	if parsed.VpcId != "" {
+		inst.AttachVPC = []string{parsed.VpcId}
+	} else if parsed.UsePrivateIp {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Missing 'vpc_id' field",
+			Detail:   "The 'use_private_ip' field requires 'vpc_id' to be set",
+		})
+	}
+
+	if parsed.GcMinAge != "" {
+		gcMinAge, err := time.ParseDuration(parsed.GcMinAge)
+		if err == nil && gcMinAge >= 0 {
+			prov.GcMinAge = gcMinAge
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'gc_min_age' field",
+				Detail:   fmt.Sprintf("The 'gc_min_age' value '%s' is not a valid duration", parsed.GcMinAge),
+			})
+		}
+	}
+
+	if parsed.CheckPort == 0 {
+		prov.CheckPort = 22
+	} else {
+		prov.CheckPort = parsed.CheckPort
+	}
+
+	check, checkDiags := providers.NewConnectivityCheck(parsed.CheckType, parsed.CheckServerName, parsed.CheckInsecure, cfgCtx.Dialer)
+	diags = append(diags, checkDiags...)
+	prov.Check = check
+	diags = append(diags, check.SetCommand(parsed.CheckCommand, parsed.CheckCommandTimeout)...)
+
+	if parsed.StartRetries < 0 {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagError,
+			Summary:  "Invalid value for 'start_retries' field",
+			Detail:   fmt.Sprintf("The 'start_retries' value must not be negative, but got %d", parsed.StartRetries),
+		})
+	}
+
+	if parsed.Shared == nil {
+		prov.Shared = true
+	} else {
+		prov.Shared = *parsed.Shared
+	}
+
+	if prov.Shared {
+		if parsed.Linger != "" {
+			linger, err := time.ParseDuration(parsed.Linger)
+			if err == nil && linger >= 0 {
+				prov.Linger = linger
+			} else {
+				diags = append(diags, &hcl.Diagnostic{
+					Severity: hcl.DiagError,
+					Summary:  "Invalid duration for 'linger' field",
+					Detail:   fmt.Sprintf("The 'linger' value '%s' is not a valid duration", parsed.Linger),
+				})
+			}
+		}
+	} else if parsed.Linger != "" {
+		diags = append(diags, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "Field 'linger' was ignored",
+			Detail:   fmt.Sprintf("The 'linger' field has no effect for 'vultr' targets with 'shared = false'"),
+		})
+	}
+
+	for _, field := range []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"start_timeout", parsed.StartTimeout, &prov.StartTimeout},
+		{"request_timeout", parsed.RequestTimeout, &prov.RequestTimeout},
+	} {
+		if field.value == "" {
+			continue
+		}
+		value, err := time.ParseDuration(field.value)
+		if err == nil && value > 0 {
+			*field.dest = value
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  fmt.Sprintf("Invalid duration for '%s' field", field.name),
+				Detail:   fmt.Sprintf("The '%s' value '%s' is not a valid positive duration", field.name, field.value),
+			})
+		}
+	}
+
+	if parsed.MinUptime != "" {
+		minUptime, err := time.ParseDuration(parsed.MinUptime)
+		if err == nil && minUptime >= 0 {
+			prov.MinUptime = minUptime
+		} else {
+			diags = append(diags, &hcl.Diagnostic{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid duration for 'min_uptime' field",
+				Detail:   fmt.Sprintf("The 'min_uptime' value '%s' is not a valid duration", parsed.MinUptime),
+			})
+		}
+	}
+
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	return prov, diags
+}
+
+func (prov *Provider) IsShared() bool {
+	return prov.Shared
+}
+
+func (prov *Provider) RunMachine(mach *providers.Machine) error {
+	span := tracing.NewSpan(mach.Span, "start")
+	err := providers.RetryStart(mach, prov.StartRetries, isRetryable, func() error {
+		err := prov.start(mach)
+		if err != nil && mach.State != nil {
+			// Clean up the partially created instance before a retry.
+			prov.stop(mach)
+			mach.State = nil
+		}
+		return err
+	})
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		log.Printf("Vultr instance failed to start: %s\n", err.Error())
+		return err
+	}
+
+	span = tracing.NewSpan(mach.Span, "connectivity_test")
+	err = prov.connectivityTest(mach)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		prov.msgLoop(mach, <-mach.ModActive)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// RecoverMachine adopts a shared Vultr instance left running by a previous
+// process. Other instances are deleted, because they were dedicated to an SSH
+// connection that no longer exists.
+func (prov *Provider) RecoverMachine(mach *providers.Machine, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	inst, _, err := prov.Vultr.Instance.Get(ctx, id)
+	cancel()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not check Vultr instance '%s' state: %w", id, err)
+	}
+
+	state := &state{
+		id:       id,
+		label:    inst.Label,
+		deadline: time.Now().Add(prov.StartTimeout),
+	}
+	mach.State = state
+	mach.SetInstanceID(id)
+
+	if inst.Status == "active" && inst.PowerStatus == "running" {
+		state.addr = prov.instanceAddr(inst)
+	}
+	if !prov.Shared || state.addr == "" {
+		log.Printf("Deleting orphaned Vultr instance '%s'\n", state.label)
+		prov.stop(mach)
+		return nil
+	}
+
+	log.Printf("Adopted Vultr instance '%s'\n", state.label)
+	err = prov.connectivityTest(mach)
+	if err == nil {
+		prov.msgLoop(mach, 0)
+	} else {
+		log.Printf("%s\n", err.Error())
+	}
+	prov.stop(mach)
+	return err
+}
+
+// Sweep deletes instances created for this target that are older than
+// 'gc_min_age', if 'gc_on_start' is set.
+func (prov *Provider) Sweep(tracked []string) {
+	if !prov.GcOnStart {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	instances, err := prov.Vultr.listInstances(ctx, managedTag)
+	cancel()
+	if err != nil {
+		log.Printf("Could not list Vultr instances for target '%s': %s\n", prov.Target, err.Error())
+		return
+	}
+
+	skip := make(map[string]bool)
+	for _, id := range tracked {
+		skip[id] = true
+	}
+
+	for _, inst := range instances {
+		dateCreated, err := time.Parse(time.RFC3339, inst.DateCreated)
+		if skip[inst.ID] || !hasTag(inst.Tags, targetTagPrefix+prov.Target) || err != nil || time.Since(dateCreated) < prov.GcMinAge {
+			continue
+		}
+		log.Printf("Deleting orphaned Vultr instance '%s' for target '%s', created at %s\n", inst.Label, prov.Target, inst.DateCreated)
+		ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+		err = prov.Vultr.Instance.Delete(ctx, inst.ID)
+		cancel()
+		if err != nil {
+			log.Printf("Could not delete orphaned Vultr instance '%s': %s\n", inst.Label, err.Error())
+		}
+	}
+}
+
+// Check whether a list of tags contains a tag.
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Create an instance, and wait for it to be running with an address.
+func (prov *Provider) start(mach *providers.Machine) error {
+	req := *prov.Instance
+	req.Label = instanceLabel(prov.LabelPrefix)
+	req.Hostname = hostname(req.Label)
+
+	deadline := time.Now().Add(prov.StartTimeout)
+	log.Printf("Creating Vultr instance '%s'\n", req.Label)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	inst, _, err := prov.Vultr.Instance.Create(ctx, &req)
+	cancel()
+	if err != nil {
+		return describeError(fmt.Sprintf("could not create Vultr instance '%s'", req.Label), err)
+	}
+
+	state := &state{
+		id:       inst.ID,
+		label:    req.Label,
+		deadline: deadline,
+	}
+	mach.State = state
+	mach.SetInstanceID(inst.ID)
+	mach.SetInfo("plan", req.Plan)
+	mach.SetInfo("region", req.Region)
+
+	return prov.waitRunning(mach)
+}
+
+// Generate an instance label from the prefix, followed by a random string.
+func instanceLabel(prefix string) string {
+	return prefix + "-" + randomString(8)
+}
+
+// Derive a hostname from an instance label. Hostnames may only contain
+// lowercase letters, digits and dashes.
+func hostname(label string) string {
+	name := strings.Trim(invalidHostnameChars.ReplaceAllString(strings.ToLower(label), "-"), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[len(name)-63:], "-")
+	}
+	if name == "" {
+		name = "lazyssh"
+	}
+	return name
+}
+
+func randomString(n int) string {
+	var letters = []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+
+	s := make([]rune, n)
+	for i := range s {
+		s[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(s)
+}
+
+// Wait for the instance to be active and running, and to have an address,
+// then set the address in state. The address is often missing for a while
+// after the instance is active, so polling continues until it shows up.
+func (prov *Provider) waitRunning(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	bgCtx := context.Background()
+	for {
+		ctx, cancel := context.WithTimeout(bgCtx, prov.RequestTimeout)
+		inst, _, err := prov.Vultr.Instance.Get(ctx, state.id)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("could not check Vultr instance '%s' state: %w", state.label, err)
+		}
+
+		switch inst.Status {
+		case "active":
+			if inst.PowerStatus == "running" {
+				state.addr = prov.instanceAddr(inst)
+				if state.addr != "" {
+					log.Printf("Vultr instance '%s' is running with address %s\n", state.label, state.addr)
+					mach.SetInfo("addr", state.addr)
+					return nil
+				}
+			}
+		case "pending":
+		default:
+			return fmt.Errorf("Vultr instance '%s' in unexpected state '%s'", state.label, inst.Status)
+		}
+
+		if time.Now().Add(3 * time.Second).After(state.deadline) {
+			if inst.Status == "active" && inst.PowerStatus == "running" {
+				return fmt.Errorf("Vultr instance '%s' %w", state.label, errNoAddress)
+			}
+			return fmt.Errorf("timed out waiting for Vultr instance '%s' to be running", state.label)
+		}
+		<-time.After(3 * time.Second)
+	}
+}
+
+// Select the address LazySSH connects to for an instance: the main IP
+// address, or the VPC address with 'use_private_ip'. Returns an empty string
+// if the instance has no address yet.
+func (prov *Provider) instanceAddr(inst *govultr.Instance) string {
+	addr := inst.MainIP
+	if prov.UsePrivateIp {
+		addr = inst.InternalIP
+	}
+	if addr == "0.0.0.0" {
+		return ""
+	}
+	return addr
+}
+
+// describeError wraps an API error. Errors about limits and unavailable plans
+// are marked, so they are not retried, and reported to SSH clients as such.
+func describeError(msg string, err error) error {
+	if status, message, ok := apiError(err); ok && status == http.StatusBadRequest {
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "limit") || strings.Contains(lower, "not available") || strings.Contains(lower, "unavailable") {
+			return fmt.Errorf("%s: %w: %s", msg, errNoQuota, message)
+		}
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// isRetryable classifies errors from start. Rate limiting and server-side
+// errors are retried, while limit, capacity and validation errors are not.
+func isRetryable(err error) bool {
+	if errors.Is(err, errNoQuota) || errors.Is(err, errNoAddress) {
+		return false
+	}
+	status, _, ok := apiError(err)
+	if !ok {
+		// Network errors, and requests the client gave up retrying.
+		return true
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// Delete the instance.
+func (prov *Provider) stop(mach *providers.Machine) {
+	state := mach.State.(*state)
+	ctx, cancel := context.WithTimeout(context.Background(), prov.RequestTimeout)
+	err := prov.Vultr.Instance.Delete(ctx, state.id)
+	cancel()
+	if err != nil && !isNotFound(err) {
+		log.Printf("Vultr instance '%s' failed to delete: %s\n", state.label, err.Error())
+		mach.ReportStopError(fmt.Errorf("Vultr instance '%s' failed to delete: %w", state.label, err))
+		return
+	}
+	log.Printf("Deleted Vultr instance '%s'\n", state.label)
+}
+
+// Check port every 3 seconds until the 'start_timeout' deadline.
+func (prov *Provider) connectivityTest(mach *providers.Machine) error {
+	state := mach.State.(*state)
+	checkHost := state.addr
+	if prov.CheckAddr != nil {
+		checkHost = *prov.CheckAddr
+	}
+	checkAddr := net.JoinHostPort(checkHost, strconv.Itoa(int(prov.CheckPort)))
+	checkTimeout := 3 * time.Second
+	var err error
+	for {
+		checkStart := time.Now()
+		err = prov.Check.Dial(checkAddr, checkTimeout)
+		if err == nil {
+			log.Printf("Connectivity test succeeded for Vultr instance '%s'\n", state.label)
+			return nil
+		}
+		if checkStart.Add(checkTimeout).After(state.deadline) {
+			break
+		}
+		time.Sleep(time.Until(checkStart.Add(checkTimeout)))
+	}
+	return fmt.Errorf("Vultr instance '%s' port check on '%s' timed out: %w", state.label, checkAddr, err)
+}
+
+// Process messages until there are no more active connections, and the
+// linger time has passed. The active count is the initial number of active
+// connections.
+func (prov *Provider) msgLoop(mach *providers.Machine, active int8) {
+	state := mach.State.(*state)
+	ready := time.Now()
+	for {
+		for active > 0 {
+			select {
+			case mod := <-mach.ModActive:
+				active += mod
+			case msg := <-mach.Translate:
+				msg.Reply <- providers.TranslateReply{Addr: net.JoinHostPort(state.addr, strconv.Itoa(int(msg.Port)))}
+			case <-mach.Stop:
+				return
+			}
+		}
+
+		// Linger, but keep the machine up for at least the minimum uptime.
+		linger := prov.Linger
+		if remaining := prov.MinUptime - time.Since(ready); remaining > linger {
+			linger = remaining
+		}
+		select {
+		case mod := <-mach.ModActive:
+			active += mod
+		case <-time.After(linger):
+			return
+		case <-mach.Stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package vultr
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vultr/govultr/v3"
+
+	"github.com/stephank/lazyssh/providers"
+	"github.com/stephank/lazyssh/providers/internal/apitest"
+)
+
+// fakeApi creates a Provider with a client that talks to a fake API server.
+// Request bodies are returned by the bodies function.
+func fakeApi(t *testing.T, responses map[string]string) (prov *Provider, bodies func() map[string]string) {
+	t.Helper()
+	srv := apitest.NewServer(t, responses, apitest.Options{})
+	vultr := newClient("key")
+	if err := vultr.SetBaseURL(srv.URL); err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	vultr.SetRetryLimit(0)
+	prov = &Provider{
+		Target: "test",
+		Instance: &govultr.InstanceCreateReq{
+			Region: "ams",
+			Plan:   "vc2-1c-1gb",
+			OsID:   2136,
+			Tags:   []string{managedTag, targetTagPrefix + "test"},
+		},
+		LabelPrefix:    "test",
+		StartTimeout:   time.Minute,
+		RequestTimeout: 5 * time.Second,
+		Vultr:          vultr,
+	}
+	return prov, srv.Bodies
+}
+
+func TestStart(t *testing.T) {
+	prov, bodies := fakeApi(t, map[string]string{
+		"POST /v2/instances": `202 {"instance": {"id": "abcd", "status": "pending", "power_status": "stopped", "main_ip": "0.0.0.0"}}`,
+		"GET /v2/instances/abcd": `{"instance": {"id": "abcd", "status": "active", "power_status": "running",
+			"main_ip": "192.0.2.10", "internal_ip": "10.1.96.3"}}`,
+	})
+
+	mach := &providers.Machine{}
+	if err := prov.start(mach); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	state := mach.State.(*state)
+	if state.id != "abcd" || state.addr != "192.0.2.10" {
+		t.Fatalf("unexpected state: id '%s', addr '%s'", state.id, state.addr)
+	}
+
+	req := bodies()["POST /v2/instances"]
+	if !strings.Contains(req, `"label":"test-`) || !strings.Contains(req, `"tags":["ManagedBy=lazyssh","lazyssh-target:test"]`) {
+		t.Fatalf("unexpected create request: %s", req)
+	}
+}
+
+func TestStartRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		response  string
+		err       error
+		retryable bool
+	}{
+		{
+			name:     "instance limit",
+			response: `400 {"error": "Server add failed: You have reached the maximum monthly fee limit for this account.", "status": 400}`,
+			err:      errNoQuota,
+		},
+		{
+			name:     "invalid plan",
+			response: `400 {"error": "Invalid plan chosen.", "status": 400}`,
+		},
+		{
+			name:      "rate limited",
+			response:  `429 {"error": "Rate limit exceeded.", "status": 429}`,
+			retryable: true,
+		},
+		{
+			name:      "server error",
+			response:  `500 {"error": "Internal server error.", "status": 500}`,
+			retryable: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prov, _ := fakeApi(t, map[string]string{
+				"POST /v2/instances": tc.response,
+			})
+
+			mach := &providers.Machine{}
+			err := prov.start(mach)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if tc.err != nil && !errors.Is(err, tc.err) {
+				t.Fatalf("expected error '%s', got: %s", tc.err, err)
+			}
+			if isRetryable(err) != tc.retryable {
+				t.Fatalf("expected retryable to be %v for: %s", tc.retryable, err)
+			}
+			if mach.State != nil {
+				t.Fatalf("expected no state for an instance that was not created")
+			}
+		})
+	}
+}
+
+func TestStopNotFound(t *testing.T) {
+	prov, _ := fakeApi(t, map[string]string{
+		"DELETE /v2/instances/abcd": `404 {"error": "Invalid instance-id.", "status": 404}`,
+	})
+
+	mach := &providers.Machine{State: &state{id: "abcd", label: "test-abcd1234"}}
+	prov.stop(mach)
+	if errs := mach.StopErrors(); len(errs) != 0 {
+		t.Fatalf("unexpected stop errors: %v", errs)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	recent := time.Now().UTC().Format(time.RFC3339)
+	prov, bodies := fakeApi(t, map[string]string{
+		"GET /v2/instances": `{"instances": [
+			{"id": "tracked", "label": "test-tracked1", "date_created": "` + old + `", "tags": ["ManagedBy=lazyssh", "lazyssh-target:test"]},
+			{"id": "orphaned", "label": "test-orphaned", "date_created": "` + old + `", "tags": ["ManagedBy=lazyssh", "lazyssh-target:test"]},
+			{"id": "starting", "label": "test-starting", "date_created": "` + recent + `", "tags": ["ManagedBy=lazyssh", "lazyssh-target:test"]},
+			{"id": "other", "label": "other-orphaned", "date_created": "` + old + `", "tags": ["ManagedBy=lazyssh", "lazyssh-target:other"]}
+		], "meta": {"total": 4}}`,
+		"DELETE /v2/instances/orphaned": "204 ",
+	})
+	prov.GcOnStart = true
+	prov.GcMinAge = time.Hour
+
+	prov.Sweep([]string{"tracked"})
+	received := bodies()
+	if _, ok := received["DELETE /v2/instances/orphaned"]; !ok || len(received) != 2 {
+		t.Fatalf("expected only the orphaned instance to be deleted, got requests: %v", received)
+	}
+}
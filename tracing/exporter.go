@@ -0,0 +1,258 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// queueSize is the number of finished spans buffered for export. Spans
+	// are dropped when the queue is full.
+	queueSize = 2048
+	// batchSize is the maximum number of spans sent in a single request.
+	batchSize = 512
+	// flushInterval is the maximum time a finished span waits for export.
+	flushInterval = 5 * time.Second
+)
+
+// Options holds the tracing configuration.
+type Options struct {
+	// Endpoint is the base URL of the OTLP/HTTP collector, for example
+	// 'http://localhost:4318'. Spans are sent to the '/v1/traces' path.
+	Endpoint string
+	// Headers are additional HTTP headers sent with every export request,
+	// typically used for authentication.
+	Headers map[string]string
+	// ServiceName is reported as the 'service.name' resource attribute.
+	ServiceName string
+}
+
+// otlpExporter batches finished spans and sends them to an OTLP/HTTP
+// collector using the JSON encoding.
+type otlpExporter struct {
+	url         string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	queue       chan *Span
+	done        chan struct{}
+
+	// stopped is set by Shutdown, after which spans are dropped. The queue is
+	// only closed while holding the write lock, so enqueue never sends on a
+	// closed channel.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// Start enables tracing, and starts a goroutine that exports spans.
+//
+// Must be called at most once, before any spans are created.
+func Start(opts Options) {
+	serviceName := opts.ServiceName
+	if serviceName == "" {
+		serviceName = "lazyssh"
+	}
+
+	exporter = &otlpExporter{
+		url:         strings.TrimRight(opts.Endpoint, "/") + "/v1/traces",
+		headers:     opts.Headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, queueSize),
+		done:        make(chan struct{}),
+	}
+	go exporter.run()
+}
+
+// Shutdown exports any remaining spans and disables tracing. Spans that end
+// afterwards are dropped.
+//
+// Does nothing if tracing is not enabled.
+func Shutdown() {
+	if exporter == nil {
+		return
+	}
+	exporter.mu.Lock()
+	if !exporter.stopped {
+		exporter.stopped = true
+		close(exporter.queue)
+	}
+	exporter.mu.Unlock()
+	<-exporter.done
+}
+
+// enqueue adds a finished span to the export queue, dropping it if full, or
+// if the exporter was shut down.
+func (exp *otlpExporter) enqueue(span *Span) {
+	exp.mu.RLock()
+	defer exp.mu.RUnlock()
+	if exp.stopped {
+		return
+	}
+	select {
+	case exp.queue <- span:
+	default:
+	}
+}
+
+// run is the exporter goroutine, which collects spans into batches.
+func (exp *otlpExporter) run() {
+	defer close(exp.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span, ok := <-exp.queue:
+			if !ok {
+				exp.export(batch)
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				exp.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			exp.export(batch)
+			batch = nil
+		}
+	}
+}
+
+// export sends a batch of spans to the collector.
+func (exp *otlpExporter) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(exp.encode(batch))
+	if err != nil {
+		log.Printf("Could not encode trace spans: %s\n", err.Error())
+		return
+	}
+
+	req, err := http.NewRequest("POST", exp.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Could not export trace spans: %s\n", err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range exp.headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := exp.client.Do(req)
+	if err != nil {
+		log.Printf("Could not export trace spans: %s\n", err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		log.Printf("Could not export trace spans: collector responded with %s\n", res.Status)
+	}
+}
+
+// The following types mirror the OTLP JSON encoding of trace data.
+//
+// See: https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// encode converts a batch of spans to an OTLP export request.
+func (exp *otlpExporter) encode(batch []*Span) *otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		span.mu.Lock()
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(span.traceID[:]),
+			SpanID:            hex.EncodeToString(span.spanID[:]),
+			Name:              span.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		for key, value := range span.attrs {
+			out.Attributes = append(out.Attributes, stringAttribute(key, value))
+		}
+		if span.hasErr {
+			out.Status = &otlpStatus{Code: 2, Message: span.errMsg} // STATUS_CODE_ERROR
+		}
+		span.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	return &otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{stringAttribute("service.name", exp.serviceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/stephank/lazyssh"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
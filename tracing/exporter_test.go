@@ -0,0 +1,36 @@
+package tracing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestShutdownDropsLateSpans(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests++
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+
+	Start(Options{Endpoint: srv.URL})
+	t.Cleanup(func() { exporter = nil })
+
+	NewSpan(nil, "before").End()
+	Shutdown()
+	mu.Lock()
+	if requests != 1 {
+		t.Fatalf("expected the remaining span to be exported on shutdown, got %d requests", requests)
+	}
+	mu.Unlock()
+
+	// Ending a span after shutdown used to send on the closed queue.
+	NewSpan(nil, "after").End()
+	Shutdown()
+}
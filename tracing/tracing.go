@@ -0,0 +1,100 @@
+/*
+Package tracing implements lightweight tracing of LazySSH operations, exported
+to an OpenTelemetry collector using OTLP over HTTP.
+
+Tracing is disabled until Start is called. While disabled, NewSpan returns a
+nil Span, and all Span methods are no-ops on a nil Span, so instrumented code
+does not need to check whether tracing is enabled.
+*/
+package tracing
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// exporter is the active exporter, or nil if tracing is disabled. It is set
+// once by Start, before any spans are created.
+var exporter *otlpExporter
+
+// Span represents a single timed operation.
+//
+// A nil Span is valid, and all methods on it do nothing.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+
+	mu      sync.Mutex
+	attrs   map[string]string
+	errMsg  string
+	hasErr  bool
+	isEnded bool
+}
+
+// NewSpan starts a new span with the given name. If parent is not nil, the
+// new span is a child of parent, otherwise it starts a new trace.
+//
+// Returns nil if tracing is disabled.
+func NewSpan(parent *Span, name string) *Span {
+	if exporter == nil {
+		return nil
+	}
+
+	span := &Span{
+		name:  name,
+		start: time.Now(),
+		attrs: make(map[string]string),
+	}
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// SetAttribute sets a string attribute on the span.
+func (span *Span) SetAttribute(key string, value string) {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	span.attrs[key] = value
+	span.mu.Unlock()
+}
+
+// SetError marks the span as failed with the given error. Does nothing if err
+// is nil.
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mu.Lock()
+	span.hasErr = true
+	span.errMsg = err.Error()
+	span.mu.Unlock()
+}
+
+// End finishes the span and queues it for export. Calling End more than once
+// has no effect.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.mu.Lock()
+	if span.isEnded {
+		span.mu.Unlock()
+		return
+	}
+	span.isEnded = true
+	span.end = time.Now()
+	span.mu.Unlock()
+	exporter.enqueue(span)
+}